@@ -0,0 +1,99 @@
+/*
+Package checks provides ready made hooks for the usual things one
+wants to monitor.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package checks
+
+import (
+	"context"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// DefaultTimeout is used by checks that talk to the network, when no
+// timeout is given.
+const DefaultTimeout = 10 * time.Second
+
+// Result is what every check reports, both as the alert response and
+// in the status cache.
+type Result struct {
+	OK        bool   `json:"ok"`
+	Message   string `json:"message"`
+	CheckedAt string `json:"checked_at"`
+
+	// LatencyMS is how long the probe took, for the checks that talk
+	// to the network.
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+
+	// Details are extra, check specific, values: the status code of an
+	// http check, the free bytes of a disk check, and so on.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func resultNew(ok bool, message string) Result {
+	return Result{
+		OK:        ok,
+		Message:   message,
+		CheckedAt: time.Now().Format(time.RFC3339),
+	}
+}
+
+func (s Result) withLatency(latency time.Duration) Result {
+	s.LatencyMS = float64(latency) / float64(time.Millisecond)
+	return s
+}
+
+func (s Result) with(key string, value interface{}) Result {
+	details := make(map[string]interface{}, len(s.Details)+1)
+	for k, v := range s.Details {
+		details[k] = v
+	}
+	details[key] = value
+
+	s.Details = details
+	return s
+}
+
+// report stores the result in the status cache, under the unique
+// name of the event, and returns what the hook should return. The
+// entry goes stale if the check stops running.
+func report(params *cynic.HookParameters, result Result) (bool, interface{}) {
+	if params != nil && params.Status != nil && params.Event != nil {
+		severity := cynic.SeverityInfo
+		if !result.OK {
+			severity = cynic.SeverityCritical
+		}
+		params.Status.UpdateEntry(params.Event.UniqStr(), params.Event.StatusEntry(result, severity))
+	}
+
+	return !result.OK, result
+}
+
+func hookContext(params *cynic.HookParameters) context.Context {
+	if params == nil || params.Context == nil {
+		return context.Background()
+	}
+	return params.Context
+}
+
+func orDefault(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,27 @@
+//go:build !(linux || darwin || freebsd)
+
+/*
+Package checks provides ready made hooks for the usual things one
+wants to monitor.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package checks
+
+import "errors"
+
+func diskSpace(path string) (total, free uint64, err error) {
+	return 0, 0, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,106 @@
+/*
+Package checks provides ready made hooks for the usual things one
+wants to monitor.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package checks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// JSONOptions configures a json assertion.
+type JSONOptions struct {
+	URL string
+
+	// Path is where to look in the response, eg: $.data.status. See
+	// cynic.JSONPath for what is supported.
+	Path string
+
+	// Expect is what the value at Path should print as: "ok", "200",
+	// "true", "null". If empty, the path only needs to exist.
+	Expect string
+
+	Timeout time.Duration
+
+	// Client is used for the requests, if given. Otherwise a client
+	// with Timeout is made.
+	Client *http.Client
+}
+
+// JSON checks that an http endpoint answers with a json document, and
+// that the value at a path of that document is what is expected.
+func JSON(opts JSONOptions) cynic.HookSignature {
+	httpOpts := HTTPOptions{Timeout: opts.Timeout, Client: opts.Client}
+	client := httpOpts.client()
+
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		resp, body, latency, err := get(hookContext(params), client, opts.URL)
+		if err != nil {
+			return report(params, resultNew(false, err.Error()))
+		}
+
+		if !statusMatches(0, resp.StatusCode) {
+			return report(params, resultNew(false, "unexpected status: "+resp.Status).withLatency(latency))
+		}
+
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return report(params, resultNew(false, "bad json: "+err.Error()).withLatency(latency))
+		}
+
+		value, err := cynic.JSONPath(doc, opts.Path)
+		if err != nil {
+			return report(params, resultNew(false, err.Error()).withLatency(latency))
+		}
+
+		actual := jsonString(value)
+		result := resultNew(true, fmt.Sprintf("%s is %s", opts.Path, actual)).
+			withLatency(latency).
+			with("value", value)
+
+		if opts.Expect != "" && actual != opts.Expect {
+			result.OK = false
+			result.Message = fmt.Sprintf("%s is %s, expected %s", opts.Path, actual, opts.Expect)
+		}
+
+		return report(params, result)
+	}
+}
+
+// jsonString prints scalars the way they would be written by hand, and
+// anything else as json.
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
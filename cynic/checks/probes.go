@@ -0,0 +1,276 @@
+/*
+Package checks provides ready made hooks for the usual things one
+wants to monitor.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package checks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// maxBodySize is how much of a response body is looked at when
+// matching against a regex.
+const maxBodySize = 1 << 20
+
+// HTTPOptions configures an http check.
+type HTTPOptions struct {
+	URL string
+
+	// ExpectStatus is the status code the endpoint should respond
+	// with. Zero means any 2xx.
+	ExpectStatus int
+
+	// BodyRegex, if not empty, must match the response body.
+	BodyRegex string
+
+	// MaxLatency, if not zero, is the longest the endpoint may take to
+	// respond before the check fails.
+	MaxLatency time.Duration
+
+	// MinCertValidity, if not zero, fails the check when the tls
+	// certificate of the endpoint expires sooner than that.
+	MinCertValidity time.Duration
+
+	Timeout time.Duration
+
+	// Client is used for the requests, if given. Otherwise a client
+	// with Timeout is made.
+	Client *http.Client
+}
+
+func (s *HTTPOptions) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return &http.Client{Timeout: orDefault(s.Timeout)}
+}
+
+// HTTP checks that an http endpoint answers a GET with the expected
+// status, and optionally a body matching a regex, quickly enough, and
+// with a certificate that is not about to expire.
+func HTTP(opts HTTPOptions) (cynic.HookSignature, error) {
+	var bodyRegex *regexp.Regexp
+	if opts.BodyRegex != "" {
+		var err error
+		bodyRegex, err = regexp.Compile(opts.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("bad body regex: %w", err)
+		}
+	}
+
+	client := opts.client()
+
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		resp, body, latency, err := get(hookContext(params), client, opts.URL)
+		if err != nil {
+			return report(params, resultNew(false, err.Error()))
+		}
+
+		result := resultNew(true, resp.Status).
+			withLatency(latency).
+			with("status_code", resp.StatusCode)
+
+		var expiresIn time.Duration
+		if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+			notAfter := resp.TLS.PeerCertificates[0].NotAfter
+			expiresIn = time.Until(notAfter)
+
+			result = result.
+				with("cert_expires_at", notAfter.Format(time.RFC3339)).
+				with("cert_expires_in_days", int(expiresIn.Hours()/24))
+		}
+
+		switch {
+		case !statusMatches(opts.ExpectStatus, resp.StatusCode):
+			result.OK = false
+			result.Message = "unexpected status: " + resp.Status
+
+		case bodyRegex != nil && !bodyRegex.Match(body):
+			result.OK = false
+			result.Message = "body does not match " + opts.BodyRegex
+
+		case opts.MaxLatency > 0 && latency > opts.MaxLatency:
+			result.OK = false
+			result.Message = fmt.Sprintf("took %v, more than %v", latency.Round(time.Millisecond), opts.MaxLatency)
+
+		case opts.MinCertValidity > 0 && resp.TLS == nil:
+			result.OK = false
+			result.Message = "no tls certificate to check"
+
+		case opts.MinCertValidity > 0 && expiresIn < opts.MinCertValidity:
+			result.OK = false
+			result.Message = fmt.Sprintf("certificate expires in %v", expiresIn.Round(time.Hour))
+		}
+
+		return report(params, result)
+	}, nil
+}
+
+// get does a GET, and returns the response along with its (limited)
+// body, and how long it took for the response to arrive.
+func get(ctx context.Context, client *http.Client, url string) (*http.Response, []byte, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	start := time.Now()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	latency := time.Since(start)
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return resp, body, latency, nil
+}
+
+func statusMatches(expected, actual int) bool {
+	if expected == 0 {
+		return actual >= 200 && actual <= 299
+	}
+	return expected == actual
+}
+
+// TCP checks that a tcp connection can be made to the address
+// (host:port).
+func TCP(address string, timeout time.Duration) cynic.HookSignature {
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		dialer := net.Dialer{Timeout: orDefault(timeout)}
+
+		start := time.Now()
+		conn, err := dialer.DialContext(hookContext(params), "tcp", address)
+		if err != nil {
+			return report(params, resultNew(false, err.Error()))
+		}
+		defer conn.Close()
+
+		result := resultNew(true, "connected to "+address).withLatency(time.Since(start))
+		return report(params, result)
+	}
+}
+
+// DefaultPingPort is the port Ping knocks on when none is given.
+const DefaultPingPort = 80
+
+// Ping checks that a host is up, without needing the privileges icmp
+// would. It tries to open a tcp connection to the port: either being
+// accepted or refused means the host is there. Only timeouts and
+// unreachable networks fail the check.
+func Ping(host string, port int, timeout time.Duration) cynic.HookSignature {
+	if port == 0 {
+		port = DefaultPingPort
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		dialer := net.Dialer{Timeout: orDefault(timeout)}
+
+		start := time.Now()
+		conn, err := dialer.DialContext(hookContext(params), "tcp", address)
+		latency := time.Since(start)
+
+		switch {
+		case err == nil:
+			conn.Close()
+		case errors.Is(err, syscall.ECONNREFUSED):
+		default:
+			return report(params, resultNew(false, err.Error()))
+		}
+
+		return report(params, resultNew(true, host+" is up").withLatency(latency))
+	}
+}
+
+// DNS checks that the host name resolves to at least one address.
+func DNS(host string, timeout time.Duration) cynic.HookSignature {
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		ctx, cancel := context.WithTimeout(hookContext(params), orDefault(timeout))
+		defer cancel()
+
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return report(params, resultNew(false, err.Error()))
+		}
+
+		if len(addrs) == 0 {
+			return report(params, resultNew(false, "no addresses for "+host))
+		}
+
+		return report(params, resultNew(true, strings.Join(addrs, ",")))
+	}
+}
+
+// Command checks that running a command exits with the expected exit
+// code.
+func Command(name string, args []string, expectExit int) cynic.HookSignature {
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		//nolint:gosec // running the configured command is the point
+		cmd := exec.CommandContext(hookContext(params), name, args...)
+		out, err := cmd.CombinedOutput()
+
+		exitCode := 0
+		if err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				return report(params, resultNew(false, err.Error()))
+			}
+			exitCode = exitErr.ExitCode()
+		}
+
+		message := fmt.Sprintf("exit %d: %s", exitCode, strings.TrimSpace(string(out)))
+
+		return report(params, resultNew(exitCode == expectExit, message))
+	}
+}
+
+// FileAge checks that a file exists, and was modified within maxAge.
+// Useful to see if backups and the like are still happening.
+func FileAge(path string, maxAge time.Duration) cynic.HookSignature {
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return report(params, resultNew(false, err.Error()))
+		}
+
+		age := time.Since(info.ModTime()).Truncate(time.Second)
+		message := fmt.Sprintf("%s is %v old", path, age)
+
+		return report(params, resultNew(age <= maxAge, message))
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Package checks provides ready made hooks for the usual things one
+wants to monitor.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package checks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// DiskUsage checks that the filesystem holding path is no more than
+// maxPercent full.
+func DiskUsage(path string, maxPercent float64) cynic.HookSignature {
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		total, free, err := diskSpace(path)
+		if err != nil {
+			return report(params, resultNew(false, err.Error()))
+		}
+
+		used := 0.0
+		if total > 0 {
+			used = float64(total-free) / float64(total) * 100
+		}
+
+		message := fmt.Sprintf("%s is %.1f%% full", path, used)
+		result := resultNew(used <= maxPercent, message).
+			with("total_bytes", total).
+			with("free_bytes", free).
+			with("used_percent", used)
+
+		return report(params, result)
+	}
+}
+
+// Process checks that at least one process with the given name is
+// running. The name is matched against the executable name, the way
+// pgrep -x would.
+func Process(name string) cynic.HookSignature {
+	return func(params *cynic.HookParameters) (bool, interface{}) {
+		pids, err := findProcess(name)
+		if err != nil {
+			return report(params, resultNew(false, err.Error()))
+		}
+
+		if len(pids) == 0 {
+			return report(params, resultNew(false, name+" is not running"))
+		}
+
+		message := fmt.Sprintf("%s is running (%d)", name, len(pids))
+		return report(params, resultNew(true, message).with("pids", pids))
+	}
+}
+
+// findProcess looks through /proc where there is one, and asks pgrep
+// otherwise.
+func findProcess(name string) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return pgrep(name)
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if processName(entry.Name()) == name || processArg0(entry.Name()) == name {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
+
+func processName(pid string) string {
+	comm, err := os.ReadFile(filepath.Join("/proc", pid, "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// processArg0 is needed because comm is cut at 15 characters.
+func processArg0(pid string) string {
+	cmdline, err := os.ReadFile(filepath.Join("/proc", pid, "cmdline"))
+	if err != nil || len(cmdline) == 0 {
+		return ""
+	}
+
+	arg0, _, _ := bytes.Cut(cmdline, []byte{0})
+	return filepath.Base(string(arg0))
+}
+
+func pgrep(name string) ([]int, error) {
+	out, err := exec.Command("pgrep", "-x", name).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var pids []int
+	for _, field := range strings.Fields(string(out)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
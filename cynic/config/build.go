@@ -0,0 +1,446 @@
+/*
+Package config builds cynic sessions out of configuration files, so
+that checks can be added without writing any go.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"net"
+	"net/smtp"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/checks"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+	"git.sr.ht/~psyomn/ecophagy/cynic/script"
+)
+
+// defaultAlertWait is how often alerts are sent when not configured.
+const defaultAlertWait = 20 * time.Second
+
+// Session builds everything the config describes, ready to be given
+// to cynic.Start. The status server listens from the moment it is
+// built; it is closed again if anything after it fails.
+func (s *Config) Session() (_ cynic.Session, err error) {
+	session := cynic.Session{
+		Workers:   s.Workers,
+		StatePath: s.StatePath,
+	}
+
+	defer func() {
+		if err != nil && session.StatusCache != nil {
+			_ = session.StatusCache.Stop()
+		}
+	}()
+
+	if s.Status != nil {
+		port := s.Status.Port
+		if port == "" {
+			port = cynic.StatusPort
+		}
+
+		root := s.Status.Root
+		if root == "" {
+			root = cynic.DefaultStatusEndpoint
+		}
+
+		statusConfig := cynic.StatusCacheConfig{
+			Host: s.Status.Host,
+			Port: port,
+			Root: root,
+
+			DefaultTTL: s.Status.DefaultTTL,
+		}
+
+		if auth := s.Status.Auth; auth != nil {
+			statusConfig.Token = auth.Token
+			statusConfig.Username = auth.Username
+			statusConfig.Password = auth.Password
+		}
+
+		if tls := s.Status.TLS; tls != nil {
+			statusConfig.TLS = &cynic.StatusTLSConfig{
+				CertFile:     tls.CertFile,
+				KeyFile:      tls.KeyFile,
+				ClientCAFile: tls.ClientCAFile,
+			}
+		}
+
+		statusCache, err := cynic.StatusCacheNew(statusConfig)
+		if err != nil {
+			return cynic.Session{}, err
+		}
+		session.StatusCache = statusCache
+
+		if s.Status.History != nil {
+			statusCache.WithHistory(cynic.HistoryConfig{
+				Capacity: s.Status.History.Capacity,
+				MaxAge:   s.Status.History.MaxAge,
+			})
+		}
+
+		if s.Status.APIToken != "" {
+			session.APIToken = s.Status.APIToken
+			session.EventFactory = EventFactory(session.StatusCache)
+		}
+	}
+
+	if s.Snapshots != nil {
+		session.SnapshotConfig = &cynic.SnapshotConfig{
+			Interval:  s.Snapshots.Interval,
+			DumpEvery: s.Snapshots.DumpEvery,
+			Path:      s.Snapshots.Path,
+		}
+
+		switch s.Snapshots.Compression {
+		case "gzip":
+			session.SnapshotConfig.Compression = cynic.SnapshotGzip
+		case "zstd":
+			session.SnapshotConfig.Compression = cynic.SnapshotZstd
+		}
+
+		if retention := s.Snapshots.Retention; retention != nil {
+			policy := &cynic.RetentionPolicy{
+				MaxAge:       retention.MaxAge,
+				MaxFiles:     retention.MaxFiles,
+				MaxBytes:     retention.MaxBytes,
+				CompactAfter: retention.CompactAfter,
+			}
+			for _, rule := range retention.Downsample {
+				policy.Downsample = append(policy.Downsample, cynic.DownsampleRule{
+					After: rule.After,
+					Every: rule.Every,
+				})
+			}
+			session.SnapshotConfig.Retention = policy
+		}
+	}
+
+	if s.Cluster != nil {
+		cluster, err := cynic.ClusterNew(cynic.ClusterConfig{
+			Node:      s.Cluster.Node,
+			Peers:     append([]string(nil), s.Cluster.Peers...),
+			Token:     s.Cluster.Token,
+			Interval:  s.Cluster.Interval,
+			LeaseTTL:  s.Cluster.LeaseTTL,
+			LeaseFile: s.Cluster.LeaseFile,
+			Quorum:    s.Cluster.Quorum,
+		})
+		if err != nil {
+			return cynic.Session{}, err
+		}
+		session.Cluster = cluster
+	}
+
+	for _, maintenance := range s.Maintenance {
+		window, err := maintenance.build()
+		if err != nil {
+			return cynic.Session{}, err
+		}
+		session.Maintenance = append(session.Maintenance, window)
+	}
+
+	if s.Alerts != nil {
+		alerter, err := s.Alerts.build()
+		if err != nil {
+			return cynic.Session{}, err
+		}
+		session.Alerter = alerter
+	}
+
+	for _, check := range s.Checks {
+		var (
+			event cynic.Event
+			err   error
+		)
+
+		if check.Type == CheckHeartbeat {
+			if session.Heartbeats == nil {
+				session.Heartbeats = cynic.HeartbeatsNew(s.Status.HeartbeatToken)
+			}
+			event, err = BuildHeartbeatEvent(check, session.Heartbeats)
+		} else {
+			event, err = BuildEvent(check)
+		}
+		if err != nil {
+			return cynic.Session{}, err
+		}
+
+		if session.StatusCache != nil {
+			event.SetDataRepo(session.StatusCache)
+		}
+
+		session.Events = append(session.Events, event)
+	}
+
+	return session, nil
+}
+
+// EventFactory creates events out of check definitions (yaml or json)
+// sent to the event api. The checks report to the status cache, if
+// one is given.
+func EventFactory(status *cynic.StatusCache) cynic.EventFactory {
+	return func(data []byte) (*cynic.Event, error) {
+		check, err := ParseCheck(data)
+		if err != nil {
+			return nil, err
+		}
+
+		event, err := BuildEvent(*check)
+		if err != nil {
+			return nil, err
+		}
+
+		if status != nil {
+			event.SetDataRepo(status)
+		}
+
+		return &event, nil
+	}
+}
+
+func (s *MaintenanceConfig) build() (cynic.MaintenanceWindow, error) {
+	window := cynic.MaintenanceWindow{
+		Start:  s.Start,
+		End:    s.End,
+		Labels: s.Checks,
+		Tags:   s.Tags,
+		Reason: s.Reason,
+	}
+
+	if s.Cron != "" {
+		loc, err := loadLocation(s.Timezone)
+		if err != nil {
+			return window, invalid("maintenance %q: %v", s.Reason, err)
+		}
+
+		window.Schedule, err = cynic.CronParse(s.Cron, loc)
+		if err != nil {
+			return window, invalid("maintenance %q: %v", s.Reason, err)
+		}
+		window.Duration = s.Duration
+	}
+
+	return window, nil
+}
+
+func loadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(timezone)
+}
+
+func (s *AlertsConfig) build() (*cynic.Alerter, error) {
+	wait := s.Wait
+	if wait <= 0 {
+		wait = defaultAlertWait
+	}
+
+	secs := int(wait / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	alerter := cynic.AlerterNew(secs, nil)
+
+	for _, sinkConf := range s.Sinks {
+		sink, err := BuildSink(sinkConf)
+		if err != nil {
+			return nil, err
+		}
+		alerter.AddSink(sink)
+	}
+
+	return &alerter, nil
+}
+
+// BuildSink creates the sink that the config describes.
+func BuildSink(conf SinkConfig) (cynic.Sink, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	var sink cynic.Sink
+
+	switch conf.Type {
+	case SinkWebhook:
+		format := cynic.WebhookJSON
+		switch conf.Format {
+		case "slack":
+			format = cynic.WebhookSlack
+		case "matrix":
+			format = cynic.WebhookMatrix
+		}
+		sink = cynic.WebhookSinkNew(conf.URL, format)
+
+	case SinkSMTP:
+		var auth smtp.Auth
+		if conf.Username != "" {
+			host, _, err := net.SplitHostPort(conf.Addr)
+			if err != nil {
+				return nil, invalid("smtp sink: bad addr %q", conf.Addr)
+			}
+			auth = smtp.PlainAuth("", conf.Username, conf.Password, host)
+		}
+		sink = cynic.SMTPSinkNew(conf.Addr, conf.From, conf.To, auth)
+
+	case SinkExec:
+		sink = cynic.ExecSinkNew(conf.Command, conf.Args...)
+	}
+
+	if conf.RateLimit != nil {
+		sink = cynic.RateLimit(sink, conf.RateLimit.Burst, conf.RateLimit.Per)
+	}
+
+	return sink, nil
+}
+
+// BuildHook creates the hook that performs the check.
+func BuildHook(check CheckConfig) (cynic.HookSignature, error) {
+	switch check.Type {
+	case CheckHTTP:
+		return checks.HTTP(checks.HTTPOptions{
+			URL:             check.URL,
+			ExpectStatus:    check.ExpectStatus,
+			BodyRegex:       check.BodyRegex,
+			MaxLatency:      check.MaxLatency,
+			MinCertValidity: check.MinCertValidity,
+			Timeout:         check.Timeout,
+		})
+	case CheckTCP:
+		return checks.TCP(check.Address, check.Timeout), nil
+	case CheckDNS:
+		return checks.DNS(check.Host, check.Timeout), nil
+	case CheckCommand:
+		return checks.Command(check.Command, check.Args, check.ExpectExit), nil
+	case CheckFileAge:
+		return checks.FileAge(check.Path, check.MaxAge), nil
+	case CheckPing:
+		return checks.Ping(check.Host, check.Port, check.Timeout), nil
+	case CheckDisk:
+		return checks.DiskUsage(check.Path, check.MaxPercent), nil
+	case CheckProcess:
+		return checks.Process(check.Process), nil
+	case CheckJSON:
+		return checks.JSON(checks.JSONOptions{
+			URL:     check.URL,
+			Path:    check.JSONPath,
+			Expect:  check.Expect,
+			Timeout: check.Timeout,
+		}), nil
+	case CheckScript:
+		return script.Hook(script.Options{
+			Path:    check.Path,
+			Timeout: check.Timeout,
+		})
+	}
+
+	return nil, invalid("check %q: unknown type %q", check.Name, check.Type)
+}
+
+// BuildEvent creates a repeating event, labeled with the name of the
+// check, that runs the check on its interval or cron schedule.
+func BuildEvent(check CheckConfig) (cynic.Event, error) {
+	if err := check.Validate(); err != nil {
+		return cynic.Event{}, err
+	}
+
+	if check.Type == CheckHeartbeat {
+		return cynic.Event{}, invalid("check %q: heartbeats can only be set up in the config file", check.Name)
+	}
+
+	hook, err := BuildHook(check)
+	if err != nil {
+		return cynic.Event{}, err
+	}
+
+	var event cynic.Event
+
+	if check.Cron != "" {
+		loc, err := loadLocation(check.Timezone)
+		if err != nil {
+			return cynic.Event{}, invalid("check %q: %v", check.Name, err)
+		}
+
+		event, err = cynic.EventCronNew(check.Cron, loc)
+		if err != nil {
+			return cynic.Event{}, invalid("check %q: %v", check.Name, err)
+		}
+	} else {
+		event = cynic.EventNew(int(check.Interval / time.Second))
+		event.Repeat(true)
+	}
+
+	event.Label = check.Name
+	event.Immediate(check.Immediate)
+	applyCheck(&event, check)
+	event.AddHook(hook)
+
+	return event, nil
+}
+
+// BuildHeartbeatEvent creates the event of a heartbeat check, which
+// waits for heartbeats on the given registry.
+func BuildHeartbeatEvent(check CheckConfig, heartbeats *cynic.Heartbeats) (cynic.Event, error) {
+	if err := check.Validate(); err != nil {
+		return cynic.Event{}, err
+	}
+
+	var (
+		event cynic.Event
+		err   error
+	)
+
+	if check.Cron != "" {
+		loc, locErr := loadLocation(check.Timezone)
+		if locErr != nil {
+			return cynic.Event{}, invalid("check %q: %v", check.Name, locErr)
+		}
+
+		schedule, cronErr := cynic.CronParse(check.Cron, loc)
+		if cronErr != nil {
+			return cynic.Event{}, invalid("check %q: %v", check.Name, cronErr)
+		}
+
+		event, err = cynic.HeartbeatCronEventNew(heartbeats, check.Name, schedule, check.Grace)
+	} else {
+		event, err = cynic.HeartbeatEventNew(heartbeats, check.Name, check.Interval, check.Grace)
+	}
+	if err != nil {
+		return cynic.Event{}, invalid("check %q: %v", check.Name, err)
+	}
+
+	applyCheck(&event, check)
+
+	return event, nil
+}
+
+// applyCheck sets what every kind of check has in common.
+func applyCheck(event *cynic.Event, check CheckConfig) {
+	event.SetTimeout(check.Timeout)
+	event.SetTags(check.Tags...)
+	event.DependsOn(check.DependsOn...)
+
+	if check.Retry != nil {
+		event.SetRetryPolicy(cynic.RetryPolicy{
+			MaxAttempts: check.Retry.Attempts,
+			Base:        check.Retry.Base,
+			Cap:         check.Retry.Cap,
+			Jitter:      check.Retry.Jitter,
+		})
+	}
+}
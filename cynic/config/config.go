@@ -0,0 +1,573 @@
+/*
+Package config builds cynic sessions out of configuration files, so
+that checks can be added without writing any go.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidConfig is wrapped by every validation error.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Check types that can be described in a config file.
+const (
+	CheckHTTP    = "http"
+	CheckTCP     = "tcp"
+	CheckDNS     = "dns"
+	CheckCommand = "command"
+	CheckFileAge = "file_age"
+	CheckPing    = "ping"
+	CheckDisk    = "disk"
+	CheckProcess = "process"
+	CheckJSON    = "json"
+
+	// CheckHeartbeat is passive: the job POSTs to
+	// /heartbeat/<name> when it runs, every interval or on the cron
+	// schedule, and the check fails when it does not (see
+	// cynic.Heartbeats).
+	CheckHeartbeat = "heartbeat"
+
+	// CheckScript runs a check written in the cynic scripting
+	// language, from the file at path (see script.Script).
+	CheckScript = "script"
+)
+
+// Sink types that can be described in a config file.
+const (
+	SinkWebhook = "webhook"
+	SinkSMTP    = "smtp"
+	SinkExec    = "exec"
+)
+
+// Config describes a whole cynic deployment: where the status server
+// listens, where alerts go, and what to check.
+type Config struct {
+	Status    *StatusConfig    `yaml:"status"`
+	Alerts    *AlertsConfig    `yaml:"alerts"`
+	Snapshots *SnapshotsConfig `yaml:"snapshots"`
+	Workers   int              `yaml:"workers"`
+	StatePath string           `yaml:"state_path"`
+	Checks    []CheckConfig    `yaml:"checks"`
+
+	Maintenance []MaintenanceConfig `yaml:"maintenance"`
+	Cluster     *ClusterConfig      `yaml:"cluster"`
+}
+
+// ClusterConfig maps to cynic.ClusterConfig. Every node of a cluster
+// should run the same checks.
+type ClusterConfig struct {
+	Node      string        `yaml:"node"`
+	Peers     []string      `yaml:"peers"`
+	Token     string        `yaml:"token"`
+	Interval  time.Duration `yaml:"interval"`
+	LeaseTTL  time.Duration `yaml:"lease_ttl"`
+	LeaseFile string        `yaml:"lease_file"`
+	Quorum    int           `yaml:"quorum"`
+}
+
+// MaintenanceConfig maps to cynic.MaintenanceWindow: either a start
+// and end, or a cron schedule and a duration.
+type MaintenanceConfig struct {
+	Start time.Time `yaml:"start"`
+	End   time.Time `yaml:"end"`
+
+	Cron     string        `yaml:"cron"`
+	Timezone string        `yaml:"timezone"`
+	Duration time.Duration `yaml:"duration"`
+
+	Checks []string `yaml:"checks"`
+	Tags   []string `yaml:"tags"`
+	Reason string   `yaml:"reason"`
+}
+
+// StatusConfig is the status http server.
+type StatusConfig struct {
+	Host string `yaml:"host"`
+	Port string `yaml:"port"`
+	Root string `yaml:"root"`
+
+	// APIToken enables the event api, for requests that carry it
+	// as a bearer token.
+	APIToken string `yaml:"api_token"`
+
+	// HeartbeatToken, if set, must be carried by heartbeats as a
+	// bearer token.
+	HeartbeatToken string `yaml:"heartbeat_token"`
+
+	History *HistoryConfig `yaml:"history"`
+
+	// DefaultTTL marks entries stale once they are that old, unless
+	// they come from checks, which go stale after three of their
+	// periods without a result.
+	DefaultTTL time.Duration `yaml:"default_ttl"`
+
+	TLS  *TLSConfig  `yaml:"tls"`
+	Auth *AuthConfig `yaml:"auth"`
+}
+
+// TLSConfig serves the status over https. With a client_ca_file,
+// clients must present a certificate it signed.
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// AuthConfig protects the status server: requests need the token as a
+// bearer token, or the username and password as basic auth.
+type AuthConfig struct {
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// HistoryConfig keeps past values of the status cache, queryable on
+// /status/history/<key>.
+type HistoryConfig struct {
+	Capacity int           `yaml:"capacity"`
+	MaxAge   time.Duration `yaml:"max_age"`
+}
+
+// AlertsConfig is how often alerts are sent, and to where.
+type AlertsConfig struct {
+	Wait  time.Duration `yaml:"wait"`
+	Sinks []SinkConfig  `yaml:"sinks"`
+}
+
+// RateLimitConfig limits a sink to Burst deliveries every Per.
+type RateLimitConfig struct {
+	Burst int           `yaml:"burst"`
+	Per   time.Duration `yaml:"per"`
+}
+
+// SinkConfig describes one alert sink. Which fields matter depends on
+// the type.
+type SinkConfig struct {
+	Type      string           `yaml:"type"`
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+
+	// webhook
+	URL    string `yaml:"url"`
+	Format string `yaml:"format"`
+
+	// smtp
+	Addr     string   `yaml:"addr"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+
+	// exec
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+}
+
+// SnapshotsConfig enables snapshots of the status cache.
+type SnapshotsConfig struct {
+	Interval  time.Duration `yaml:"interval"`
+	DumpEvery time.Duration `yaml:"dump_every"`
+	Path      string        `yaml:"path"`
+
+	// Compression is "none" (the default), "gzip" or "zstd".
+	Compression string `yaml:"compression"`
+
+	Retention *RetentionConfig `yaml:"retention"`
+}
+
+// RetentionConfig maps to cynic.RetentionPolicy.
+type RetentionConfig struct {
+	MaxAge       time.Duration      `yaml:"max_age"`
+	MaxFiles     int                `yaml:"max_files"`
+	MaxBytes     int64              `yaml:"max_bytes"`
+	CompactAfter time.Duration      `yaml:"compact_after"`
+	Downsample   []DownsampleConfig `yaml:"downsample"`
+}
+
+// DownsampleConfig maps to cynic.DownsampleRule.
+type DownsampleConfig struct {
+	After time.Duration `yaml:"after"`
+	Every time.Duration `yaml:"every"`
+}
+
+// RetryConfig maps to cynic.RetryPolicy.
+type RetryConfig struct {
+	Attempts int           `yaml:"attempts"`
+	Base     time.Duration `yaml:"base"`
+	Cap      time.Duration `yaml:"cap"`
+	Jitter   float64       `yaml:"jitter"`
+}
+
+// CheckConfig describes one check. Either Interval or Cron must be
+// set. Which of the probe fields matter depends on the type.
+type CheckConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	Interval  time.Duration `yaml:"interval"`
+	Cron      string        `yaml:"cron"`
+	Timezone  string        `yaml:"timezone"`
+	Immediate bool          `yaml:"immediate"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Retry     *RetryConfig  `yaml:"retry"`
+
+	// Tags group checks, for maintenance windows. The alerts of a
+	// check are muted while any check it depends on is failing.
+	Tags      []string `yaml:"tags"`
+	DependsOn []string `yaml:"depends_on"`
+
+	// http, json
+	URL             string        `yaml:"url"`
+	ExpectStatus    int           `yaml:"expect_status"`
+	BodyRegex       string        `yaml:"body_regex"`
+	MaxLatency      time.Duration `yaml:"max_latency"`
+	MinCertValidity time.Duration `yaml:"min_cert_validity"`
+	JSONPath        string        `yaml:"json_path"`
+	Expect          string        `yaml:"expect"`
+
+	// tcp
+	Address string `yaml:"address"`
+
+	// dns, ping
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+
+	// command
+	Command    string   `yaml:"command"`
+	Args       []string `yaml:"args"`
+	ExpectExit int      `yaml:"expect_exit"`
+
+	// file_age, disk, script
+	Path       string        `yaml:"path"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxPercent float64       `yaml:"max_percent"`
+
+	// process
+	Process string `yaml:"process"`
+
+	// heartbeat
+	Grace time.Duration `yaml:"grace"`
+}
+
+// Load reads and validates a config file. Both yaml and json files
+// are accepted, since json is valid yaml. Durations are written the go
+// way: "30s", "1h30m".
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Parse parses and validates a config.
+func Parse(data []byte) (*Config, error) {
+	var conf Config
+
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &conf, nil
+}
+
+// ParseCheck parses and validates a single check.
+func ParseCheck(data []byte) (*CheckConfig, error) {
+	var check CheckConfig
+
+	if err := yaml.Unmarshal(data, &check); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	if err := check.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &check, nil
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, args...))
+}
+
+// Validate reports everything wrong with the config at once.
+func (s *Config) Validate() error {
+	var errs []error
+
+	if len(s.Checks) == 0 {
+		errs = append(errs, invalid("no checks"))
+	}
+
+	names := make(map[string]bool)
+	for i := range s.Checks {
+		check := &s.Checks[i]
+		if names[check.Name] {
+			errs = append(errs, invalid("duplicate check name %q", check.Name))
+		}
+		names[check.Name] = true
+
+		errs = append(errs, check.Validate())
+	}
+
+	errs = append(errs, s.validateDependencies(names))
+
+	for _, check := range s.Checks {
+		if check.Type == CheckHeartbeat && s.Status == nil {
+			errs = append(errs, invalid("check %q: heartbeats need a status server", check.Name))
+		}
+	}
+
+	for i := range s.Maintenance {
+		errs = append(errs, s.Maintenance[i].Validate())
+	}
+
+	if s.Alerts != nil {
+		for _, sink := range s.Alerts.Sinks {
+			errs = append(errs, sink.Validate())
+		}
+	}
+
+	if s.Snapshots != nil {
+		if s.Status == nil {
+			errs = append(errs, invalid("snapshots need a status server"))
+		}
+
+		if s.Snapshots.Interval <= 0 || s.Snapshots.DumpEvery <= 0 {
+			errs = append(errs, invalid("snapshots need an interval and dump_every"))
+		}
+
+		switch s.Snapshots.Compression {
+		case "", "none", "gzip", "zstd":
+		default:
+			errs = append(errs, invalid("unknown snapshot compression %q", s.Snapshots.Compression))
+		}
+
+		if retention := s.Snapshots.Retention; retention != nil {
+			if retention.MaxAge < 0 || retention.MaxFiles < 0 || retention.MaxBytes < 0 || retention.CompactAfter < 0 {
+				errs = append(errs, invalid("snapshot retention limits can not be negative"))
+			}
+
+			for _, rule := range retention.Downsample {
+				if rule.Every < time.Second || rule.After <= 0 {
+					errs = append(errs, invalid("downsample rules need an after, and every of at least 1s"))
+				}
+			}
+
+			if len(retention.Downsample) > 0 && retention.CompactAfter == 0 {
+				errs = append(errs, invalid("downsampling needs compact_after"))
+			}
+		}
+	}
+
+	if s.Status != nil {
+		if s.Status.DefaultTTL < 0 {
+			errs = append(errs, invalid("default_ttl can not be negative"))
+		}
+
+		if tls := s.Status.TLS; tls != nil && (tls.CertFile == "" || tls.KeyFile == "") {
+			errs = append(errs, invalid("tls needs a cert_file and a key_file"))
+		}
+
+		if auth := s.Status.Auth; auth != nil {
+			if (auth.Username == "") != (auth.Password == "") {
+				errs = append(errs, invalid("basic auth needs a username and a password"))
+			}
+			if auth.Token == "" && auth.Username == "" {
+				errs = append(errs, invalid("auth needs a token, or a username and a password"))
+			}
+		}
+	}
+
+	if s.Cluster != nil {
+		if s.Status == nil {
+			errs = append(errs, invalid("a cluster needs a status server"))
+		}
+
+		if s.Cluster.Token == "" {
+			errs = append(errs, invalid("a cluster needs a token"))
+		}
+
+		if s.Cluster.Quorum < 0 || s.Cluster.Quorum > len(s.Cluster.Peers)+1 {
+			errs = append(errs, invalid("cluster quorum must be between 0 and the number of nodes"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateDependencies checks that checks depend on checks that exist,
+// and not on themselves, even indirectly: checks that depend on each
+// other would mute each other for good.
+func (s *Config) validateDependencies(names map[string]bool) error {
+	dependsOn := make(map[string][]string)
+
+	for _, check := range s.Checks {
+		for _, parent := range check.DependsOn {
+			if !names[parent] {
+				return invalid("check %q: depends on unknown check %q", check.Name, parent)
+			}
+		}
+		dependsOn[check.Name] = check.DependsOn
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return invalid("check %q: circular dependency", name)
+		case done:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, parent := range dependsOn[name] {
+			if err := visit(parent); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+
+	for _, check := range s.Checks {
+		if err := visit(check.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks a maintenance window.
+func (s *MaintenanceConfig) Validate() error {
+	switch {
+	case s.Cron != "" && s.Duration <= 0:
+		return invalid("maintenance %q: a cron window needs a duration", s.Reason)
+	case s.Cron == "" && !s.End.After(s.Start):
+		return invalid("maintenance %q: needs a start and an end after it, or a cron", s.Reason)
+	}
+	return nil
+}
+
+// Validate checks a single check.
+func (s *CheckConfig) Validate() error {
+	if s.Name == "" {
+		return invalid("check without a name")
+	}
+
+	switch {
+	case s.Interval > 0 && s.Cron != "":
+		return invalid("check %q: interval and cron are exclusive", s.Name)
+	case s.Cron == "" && s.Interval < time.Second:
+		return invalid("check %q: needs an interval of at least 1s, or a cron", s.Name)
+	}
+
+	require := func(field, value string) error {
+		if value == "" {
+			return invalid("check %q: %s check needs %s", s.Name, s.Type, field)
+		}
+		return nil
+	}
+
+	switch s.Type {
+	case CheckHTTP:
+		return require("url", s.URL)
+	case CheckTCP:
+		return require("address", s.Address)
+	case CheckDNS:
+		return require("host", s.Host)
+	case CheckCommand:
+		return require("command", s.Command)
+	case CheckFileAge:
+		if s.MaxAge <= 0 {
+			return invalid("check %q: file_age check needs max_age", s.Name)
+		}
+		return require("path", s.Path)
+	case CheckPing:
+		return require("host", s.Host)
+	case CheckDisk:
+		if s.MaxPercent <= 0 || s.MaxPercent > 100 {
+			return invalid("check %q: disk check needs max_percent between 0 and 100", s.Name)
+		}
+		return require("path", s.Path)
+	case CheckProcess:
+		return require("process", s.Process)
+	case CheckJSON:
+		if err := require("url", s.URL); err != nil {
+			return err
+		}
+		return require("json_path", s.JSONPath)
+	case CheckHeartbeat:
+		if s.Grace < 0 {
+			return invalid("check %q: grace can not be negative", s.Name)
+		}
+		return nil
+	case CheckScript:
+		return require("path", s.Path)
+	}
+
+	return invalid("check %q: unknown type %q", s.Name, s.Type)
+}
+
+// Validate checks a single sink.
+func (s *SinkConfig) Validate() error {
+	switch s.Type {
+	case SinkWebhook:
+		if s.URL == "" {
+			return invalid("webhook sink needs url")
+		}
+		switch s.Format {
+		case "", "json", "slack", "matrix":
+		default:
+			return invalid("unknown webhook format %q", s.Format)
+		}
+	case SinkSMTP:
+		if s.Addr == "" || s.From == "" || len(s.To) == 0 {
+			return invalid("smtp sink needs addr, from and to")
+		}
+	case SinkExec:
+		if s.Command == "" {
+			return invalid("exec sink needs command")
+		}
+	default:
+		return invalid("unknown sink type %q", s.Type)
+	}
+
+	if s.RateLimit != nil && (s.RateLimit.Burst <= 0 || s.RateLimit.Per <= 0) {
+		return invalid("%s sink: rate_limit needs burst and per", s.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+Package config builds cynic sessions out of configuration files, so
+that checks can be added without writing any go.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+// Sample is a config that shows off most of what can be configured
+// (cynic -generate writes it out). It builds a session as it is.
+const Sample = `# cynic sample configuration
+status:
+  host: 0.0.0.0
+  port: "9999"
+  root: /status/
+  # values that are not updated for this long are marked stale; the
+  # results of checks go stale after three of their periods anyway
+  default_ttl: 1h
+  # keep past values, eg: /status/history/homepage-1?from=-1h&step=1m&path=$.latency_ms
+  history:
+    capacity: 2880
+    max_age: 24h
+  # uncomment to enable the event api on /events/, and writes to the
+  # status cache (eg: cynic-store replay); requests need
+  # the header "Authorization: Bearer <api_token>"
+  # api_token: a-long-random-secret
+  # heartbeats (see the backup check) must carry this bearer token
+  heartbeat_token: a-secret-for-cron-jobs
+  # uncomment to serve https; with client_ca_file, clients need a
+  # certificate it signed
+  # tls:
+  #   cert_file: /etc/cynic/cert.pem
+  #   key_file: /etc/cynic/key.pem
+  #   client_ca_file: /etc/cynic/clients.pem
+  # uncomment to require a bearer token, or basic auth, to read the
+  # status (the event api keeps using api_token)
+  # auth:
+  #   token: a-read-only-secret
+  #   username: admin
+  #   password: change-me
+
+alerts:
+  wait: 20s
+  sinks:
+    - type: webhook
+      format: slack
+      url: https://hooks.slack.com/services/CHANGE/ME
+      rate_limit:
+        burst: 10
+        per: 1m
+
+workers: 10
+
+# remember when each check is due, so restarts do not skew schedules
+state_path: /var/lib/cynic/state.json
+
+# snapshot the status every minute, and write the snapshots to disk
+# every hour. Dumps older than two days are merged into daily files,
+# which are thinned out as they age, and nothing is kept past 90 days.
+snapshots:
+  interval: 1m
+  dump_every: 1h
+  path: /var/lib/cynic/snapshots
+  compression: gzip
+  retention:
+    max_age: 2160h
+    max_bytes: 1073741824
+    compact_after: 48h
+    downsample:
+      - after: 168h
+        every: 5m
+      - after: 720h
+        every: 1h
+
+# alerts of matching checks are muted during maintenance; the checks
+# still run. More windows can be added with the event api.
+maintenance:
+  - cron: "0 3 * * sun"
+    timezone: America/Montreal
+    duration: 1h
+    tags: [storage]
+    reason: weekly database backup
+
+# uncomment to run several cynics that share the alerting: they
+# gossip their results, and the leader alerts once a quorum of them
+# sees a check failing ("failing from 2 of 3 locations")
+# cluster:
+#   node: montreal
+#   peers: [http://10.0.0.2:9999, http://10.0.0.3:9999]
+#   token: another-long-random-secret
+#   interval: 5s
+#   quorum: 2
+#   # lease_file: /shared/cynic/leader.json
+
+checks:
+  - name: homepage
+    type: http
+    interval: 30s
+    timeout: 5s
+    url: https://example.com/
+    expect_status: 200
+    body_regex: "Example Domain"
+    max_latency: 2s
+    min_cert_validity: 336h
+    # no alerts for the homepage while the gateway is down
+    depends_on: [gateway]
+    retry:
+      attempts: 3
+      base: 1s
+      cap: 10s
+
+  - name: database
+    type: tcp
+    interval: 10s
+    address: localhost:5432
+    tags: [storage]
+
+  - name: api-health
+    type: json
+    interval: 1m
+    url: https://api.example.com/health
+    json_path: $.status
+    expect: ok
+
+  - name: gateway
+    type: ping
+    interval: 30s
+    host: 192.168.1.1
+    port: 22
+
+  - name: root-disk
+    type: disk
+    interval: 5m
+    path: /
+    max_percent: 90
+
+  - name: sshd
+    type: process
+    interval: 1m
+    process: sshd
+
+  - name: resolver
+    type: dns
+    interval: 1m
+    host: example.com
+
+  # a dead man's switch: the nightly backup ends with
+  #   curl -X POST -H "Authorization: Bearer $TOKEN" http://cynic:9999/heartbeat/backup
+  # (or .../heartbeat/backup/fail), and this alerts if it has not by 4am
+  - name: backup
+    type: heartbeat
+    cron: "0 3 * * *"
+    timezone: America/Montreal
+    grace: 1h
+    tags: [storage]
+
+  # uncomment for a check written in the cynic scripting language (see
+  # the script package); the file is read again whenever it changes
+  # - name: queue
+  #   type: script
+  #   interval: 1m
+  #   path: /etc/cynic/queue.cynic
+  #   timeout: 10s
+
+  - name: backups
+    type: file_age
+    cron: "30 2 * * mon-fri"
+    timezone: America/Montreal
+    path: /var/backups/latest.tar.gz
+    max_age: 26h
+
+  - name: disk-script
+    type: command
+    interval: 5m
+    command: /usr/local/bin/check-disk
+    args: ["/"]
+    expect_exit: 0
+`
@@ -0,0 +1,538 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func runDump(args []string, out io.Writer) error {
+	flags := newFlagSet("dump")
+	input := flags.String("input", "", "the cynic db store to dump")
+	_ = flags.Parse(args)
+
+	paths := flags.Args()
+	if *input != "" {
+		paths = append([]string{*input}, paths...)
+	}
+
+	files, err := snapshotFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	buffered := bufio.NewWriter(out)
+	defer buffered.Flush()
+
+	for _, file := range files {
+		if err := dumpFile(buffered, file); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+func dumpFile(out io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := cynic.SnapshotReaderNew(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	fmt.Fprintf(out, "version: %d\n", reader.Version())
+
+	for {
+		snap, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "%d:%s\n", snap.Timestamp, snap.Data)
+	}
+}
+
+func runQuery(args []string, out io.Writer) error {
+	var sel selection
+
+	flags := newFlagSet("query")
+	sel.timeFlags(flags)
+	sel.valueFlags(flags)
+	_ = flags.Parse(args)
+
+	if err := sel.parse(time.Now()); err != nil {
+		return err
+	}
+
+	buffered := bufio.NewWriter(out)
+	defer buffered.Flush()
+
+	return eachSnapshot(flags.Args(), &sel, func(snap *cynic.Snapshot) error {
+		value, ok, err := sel.value(snap)
+		if err != nil || !ok {
+			return err
+		}
+
+		fmt.Fprintf(buffered, "%s\t%s\n", formatTimestamp(snap.Timestamp), formatValue(value))
+		return nil
+	})
+}
+
+func runDiff(args []string, out io.Writer) error {
+	var sel selection
+	var a, b string
+
+	flags := newFlagSet("diff")
+	flags.StringVar(&a, "a", "", "compare the last snapshot taken at or before this time (default: the first one)")
+	flags.StringVar(&b, "b", "", "to the last snapshot taken at or before this time (default: the last one)")
+	sel.valueFlags(flags)
+	_ = flags.Parse(args)
+
+	now := time.Now()
+
+	aTime, err := parseTime(a, now)
+	if err != nil {
+		return err
+	}
+
+	bTime, err := parseTime(b, now)
+	if err != nil {
+		return err
+	}
+
+	var snapA, snapB *cynic.Snapshot
+
+	err = eachSnapshot(flags.Args(), &sel, func(snap *cynic.Snapshot) error {
+		at := time.Unix(snap.Timestamp, 0)
+
+		if (aTime.IsZero() && snapA == nil) || (!aTime.IsZero() && !at.After(aTime)) {
+			snapA = snap
+		}
+		if bTime.IsZero() || !at.After(bTime) {
+			snapB = snap
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if snapA == nil || snapB == nil {
+		return errors.New("no snapshots to compare at those times")
+	}
+
+	before, err := flatSnapshot(&sel, snapA)
+	if err != nil {
+		return err
+	}
+
+	after, err := flatSnapshot(&sel, snapB)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", formatTimestamp(snapA.Timestamp), formatTimestamp(snapB.Timestamp))
+
+	for _, line := range diffLines(before, after) {
+		fmt.Fprintln(out, line)
+	}
+
+	return nil
+}
+
+func flatSnapshot(sel *selection, snap *cynic.Snapshot) (map[string]string, error) {
+	flat := make(map[string]string)
+
+	value, ok, err := sel.value(snap)
+	if err != nil || !ok {
+		return flat, err
+	}
+
+	flatten("$", value, flat)
+	return flat, nil
+}
+
+// diffLines lists what was added (+), removed (-) and changed (~)
+// between two flattened values.
+func diffLines(before, after map[string]string) []string {
+	paths := make(map[string]bool)
+	for p := range before {
+		paths[p] = true
+	}
+	for p := range after {
+		paths[p] = true
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+
+	for _, p := range sorted {
+		old, inBefore := before[p]
+		now, inAfter := after[p]
+
+		switch {
+		case !inBefore:
+			lines = append(lines, fmt.Sprintf("+ %s %s", p, now))
+		case !inAfter:
+			lines = append(lines, fmt.Sprintf("- %s %s", p, old))
+		case old != now:
+			lines = append(lines, fmt.Sprintf("~ %s %s -> %s", p, old, now))
+		}
+	}
+
+	return lines
+}
+
+// flatten turns a decoded json value into json path -> json scalar, so
+// that two values can be compared leaf by leaf.
+func flatten(prefix string, value interface{}, out map[string]string) {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		if len(node) == 0 {
+			out[prefix] = "{}"
+		}
+		for key, child := range node {
+			flatten(prefix+pathSegment(key), child, out)
+		}
+
+	case []interface{}:
+		if len(node) == 0 {
+			out[prefix] = "[]"
+		}
+		for i, child := range node {
+			flatten(prefix+"["+strconv.Itoa(i)+"]", child, out)
+		}
+
+	default:
+		data, _ := json.Marshal(node)
+		out[prefix] = string(data)
+	}
+}
+
+func pathSegment(key string) string {
+	if key != "" && !strings.ContainsAny(key, ".[]\"' ") {
+		return "." + key
+	}
+	return "[" + strconv.Quote(key) + "]"
+}
+
+func runExport(args []string, out io.Writer) error {
+	var sel selection
+	var format string
+
+	flags := newFlagSet("export")
+	flags.StringVar(&format, "format", "csv", "csv or jsonl")
+	sel.timeFlags(flags)
+	sel.valueFlags(flags)
+	_ = flags.Parse(args)
+
+	if err := sel.parse(time.Now()); err != nil {
+		return err
+	}
+
+	switch format {
+	case "csv":
+		return exportCSV(out, flags.Args(), &sel)
+	case "jsonl":
+		return exportJSONL(out, flags.Args(), &sel)
+	}
+
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// exportCSV writes a row per key and snapshot, or a row per snapshot
+// when the selected value is not an object.
+func exportCSV(w io.Writer, paths []string, sel *selection) error {
+	out := csv.NewWriter(w)
+
+	if err := out.Write([]string{"timestamp", "time", "key", "value"}); err != nil {
+		return err
+	}
+
+	err := eachSnapshot(paths, sel, func(snap *cynic.Snapshot) error {
+		value, ok, err := sel.value(snap)
+		if err != nil || !ok {
+			return err
+		}
+
+		stamp := strconv.FormatInt(snap.Timestamp, 10)
+		at := formatTimestamp(snap.Timestamp)
+
+		entries, isObject := value.(map[string]interface{})
+		if !isObject {
+			return out.Write([]string{stamp, at, sel.label(), formatValue(value)})
+		}
+
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if err := out.Write([]string{stamp, at, key, formatValue(entries[key])}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	out.Flush()
+	return errors.Join(err, out.Error())
+}
+
+// exportJSONL writes a json object per snapshot.
+func exportJSONL(w io.Writer, paths []string, sel *selection) error {
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	encoder := json.NewEncoder(out)
+
+	return eachSnapshot(paths, sel, func(snap *cynic.Snapshot) error {
+		value, ok, err := sel.value(snap)
+		if err != nil || !ok {
+			return err
+		}
+
+		return encoder.Encode(struct {
+			Timestamp int64       `json:"timestamp"`
+			Time      string      `json:"time"`
+			Value     interface{} `json:"value"`
+		}{snap.Timestamp, formatTimestamp(snap.Timestamp), value})
+	})
+}
+
+// replayer puts a snapshot into a status server: merged into what it
+// holds, or in place of it.
+type replayer interface {
+	replay(ctx context.Context, snap *cynic.Snapshot) error
+}
+
+func runReplay(args []string, out io.Writer) error {
+	var (
+		sel     selection
+		target  string
+		token   string
+		listen  string
+		replace bool
+		speed   float64
+		maxGap  time.Duration
+	)
+
+	flags := newFlagSet("replay")
+	flags.StringVar(&target, "target", "", "status endpoint of a running cynic, eg: http://localhost:9999/status/")
+	flags.StringVar(&token, "token", os.Getenv("CYNIC_API_TOKEN"), "the api token of the target (default: $CYNIC_API_TOKEN)")
+	flags.StringVar(&listen, "listen", "", "instead of a target, serve the snapshots on this address, eg: localhost:9999")
+	flags.BoolVar(&replace, "replace", false, "delete the keys a snapshot does not have, instead of merging it in")
+	flags.Float64Var(&speed, "speed", 1, "how many times faster than real time to replay; 0 is as fast as possible")
+	flags.DurationVar(&maxGap, "max-gap", 10*time.Second, "longest wait between two snapshots")
+	sel.timeFlags(flags)
+	_ = flags.Parse(args)
+
+	if err := sel.parse(time.Now()); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var rep replayer
+
+	switch {
+	case target != "" && listen != "":
+		return errors.New("-target and -listen are exclusive")
+
+	case target != "":
+		rep = &remoteReplayer{
+			target:  target,
+			token:   token,
+			replace: replace,
+			client:  &http.Client{Timeout: 10 * time.Second},
+		}
+
+	case listen != "":
+		host, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			return err
+		}
+
+		status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Host: host, Port: port})
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := status.Start(); err != nil {
+				log.Println("status server:", err)
+			}
+		}()
+		defer status.Stop()
+
+		log.Printf("serving snapshots on http://%s%s", listen, cynic.DefaultStatusEndpoint)
+		rep = &localReplayer{status: status, replace: replace}
+
+	default:
+		return errors.New("need a -target or -listen")
+	}
+
+	var previous int64
+	count := 0
+
+	err := eachSnapshot(flags.Args(), &sel, func(snap *cynic.Snapshot) error {
+		if count > 0 && speed > 0 {
+			gap := time.Duration(float64(time.Duration(snap.Timestamp-previous)*time.Second) / speed)
+			wait(ctx, min(gap, maxGap))
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		previous = snap.Timestamp
+		count++
+
+		log.Println("replaying", formatTimestamp(snap.Timestamp))
+		return rep.replay(ctx, snap)
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Println("replayed", count, "snapshots")
+
+	if listen != "" {
+		log.Println("still serving the last snapshot; interrupt to stop")
+		<-ctx.Done()
+	}
+
+	return nil
+}
+
+func wait(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// remoteReplayer sends snapshots to a cynic that accepts updates (see
+// StatusCache.AcceptUpdates).
+type remoteReplayer struct {
+	target  string
+	token   string
+	replace bool
+	client  *http.Client
+}
+
+func (s *remoteReplayer) replay(ctx context.Context, snap *cynic.Snapshot) error {
+	url := strings.TrimSuffix(s.target, "/") + "/"
+	if s.replace {
+		url += "?replace=true"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(snap.Data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// localReplayer puts snapshots in a status server of its own.
+type localReplayer struct {
+	status  *cynic.StatusCache
+	replace bool
+	keys    map[string]bool
+}
+
+func (s *localReplayer) replay(_ context.Context, snap *cynic.Snapshot) error {
+	var entries map[string]interface{}
+	if err := json.Unmarshal([]byte(snap.Data), &entries); err != nil {
+		return fmt.Errorf("snapshot at %d: %w", snap.Timestamp, err)
+	}
+
+	if s.replace {
+		for key := range s.keys {
+			if _, ok := entries[key]; !ok {
+				s.status.Delete(key)
+			}
+		}
+	}
+
+	s.keys = make(map[string]bool, len(entries))
+	for key, value := range entries {
+		s.status.Update(key, value)
+		s.keys[key] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,413 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// at is how the commands print a timestamp, in the local time zone.
+func at(timestamp int64) string {
+	return formatTimestamp(timestamp)
+}
+
+// lines runs the command on the store, and splits what it printed.
+func lines(run func([]string, io.Writer) error, args ...string) ([]string, error) {
+	var out bytes.Buffer
+	err := run(args, &out)
+
+	printed := strings.TrimSuffix(out.String(), "\n")
+	if printed == "" {
+		return nil, err
+	}
+	return strings.Split(printed, "\n"), err
+}
+
+func TestDump(t *testing.T) {
+	dir := writeStore(t, testSnapshots...)
+
+	got, err := lines(runDump, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"version: 2",
+		"1600000000:" + testSnapshots[0].Data,
+		"version: 2",
+		"1600000060:" + testSnapshots[1].Data,
+		"1600000120:" + testSnapshots[2].Data,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	dir := writeStore(t, testSnapshots...)
+
+	cases := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{"a value over time",
+			[]string{"-key", "web", "-path", "$.latency_ms"},
+			[]string{at(t0) + "\t10", at(t1) + "\t30", at(t2) + "\t20"}},
+		{"from",
+			[]string{"-from", "1600000060", "-key", "web", "-path", "$.latency_ms"},
+			[]string{at(t1) + "\t30", at(t2) + "\t20"}},
+		{"to",
+			[]string{"-to", "1600000060", "-key", "web", "-path", "up"},
+			[]string{at(t0) + "\ttrue", at(t1) + "\ttrue"}},
+		{"strings as they are",
+			[]string{"-key", "cache"},
+			[]string{at(t2) + "\twarm"}},
+		{"objects as json",
+			[]string{"-key", "db"},
+			[]string{at(t0) + "\t" + `{"latency_ms":5}`, at(t1) + "\t" + `{"latency_ms":5}`}},
+		{"snapshots without the value are skipped",
+			[]string{"-path", "$.db.latency_ms"},
+			[]string{at(t0) + "\t5", at(t1) + "\t5"}},
+		{"nothing",
+			[]string{"-key", "missing"},
+			nil},
+	}
+
+	for _, c := range cases {
+		got, err := lines(runQuery, append(c.args, dir)...)
+		if err != nil || !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %q, %v", c.name, got, err)
+		}
+	}
+
+	if _, err := lines(runQuery, "-from", "whenever", dir); err == nil {
+		t.Error("a bad time should fail")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := writeStore(t, testSnapshots...)
+
+	cases := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{"first to last",
+			nil,
+			[]string{
+				"--- " + at(t0),
+				"+++ " + at(t2),
+				`+ $.cache "warm"`,
+				"- $.db.latency_ms 5",
+				"~ $.web.latency_ms 10 -> 20",
+				"~ $.web.up true -> false",
+			}},
+		{"between times",
+			[]string{"-a", "1600000000", "-b", "1600000060", "-key", "web"},
+			[]string{
+				"--- " + at(t0),
+				"+++ " + at(t1),
+				"~ $.latency_ms 10 -> 30",
+			}},
+		{"the last snapshot at or before",
+			[]string{"-a", "1600000059", "-b", "1600000119", "-key", "db"},
+			[]string{
+				"--- " + at(t0),
+				"+++ " + at(t1),
+			}},
+		{"a path",
+			[]string{"-path", "$.web.up"},
+			[]string{
+				"--- " + at(t0),
+				"+++ " + at(t2),
+				"~ $ true -> false",
+			}},
+		{"a key that comes and goes",
+			[]string{"-key", "db"},
+			[]string{
+				"--- " + at(t0),
+				"+++ " + at(t2),
+				"- $.latency_ms 5",
+			}},
+	}
+
+	for _, c := range cases {
+		got, err := lines(runDiff, append(c.args, dir)...)
+		if err != nil || !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %q, %v", c.name, got, err)
+		}
+	}
+
+	if _, err := lines(runDiff, "-b", "1500000000", dir); err == nil {
+		t.Error("nothing to compare before the first snapshot")
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir := writeStore(t, testSnapshots...)
+
+	cases := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{"csv of an object",
+			[]string{"-key", "web", "-from", "1600000060"},
+			[]string{
+				"timestamp,time,key,value",
+				"1600000060," + at(t1) + ",latency_ms,30",
+				"1600000060," + at(t1) + ",up,true",
+				"1600000120," + at(t2) + ",latency_ms,20",
+				"1600000120," + at(t2) + ",up,false",
+			}},
+		{"csv of a value",
+			[]string{"-format", "csv", "-key", "web", "-path", "$.latency_ms", "-to", "1600000000"},
+			[]string{
+				"timestamp,time,key,value",
+				"1600000000," + at(t0) + ",web.latency_ms,10",
+			}},
+		{"csv of a path",
+			[]string{"-path", "$.db", "-to", "1600000000"},
+			[]string{
+				"timestamp,time,key,value",
+				"1600000000," + at(t0) + ",latency_ms,5",
+			}},
+		{"jsonl",
+			[]string{"-format", "jsonl", "-key", "cache"},
+			[]string{
+				`{"timestamp":1600000120,"time":"` + at(t2) + `","value":"warm"}`,
+			}},
+		{"jsonl of objects",
+			[]string{"-format", "jsonl", "-key", "db"},
+			[]string{
+				`{"timestamp":1600000000,"time":"` + at(t0) + `","value":{"latency_ms":5}}`,
+				`{"timestamp":1600000060,"time":"` + at(t1) + `","value":{"latency_ms":5}}`,
+			}},
+	}
+
+	for _, c := range cases {
+		got, err := lines(runExport, append(c.args, dir)...)
+		if err != nil || !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %q, %v", c.name, got, err)
+		}
+	}
+
+	if _, err := lines(runExport, "-format", "xml", dir); err == nil {
+		t.Error("an unknown format should fail")
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	var doc interface{}
+	data := `{"a":{"b":[1,{"c":"x"}],"empty":{},"none":[]},"odd key":null,"d.e":true,"":2}`
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	flat := make(map[string]string)
+	flatten("$", doc, flat)
+
+	expected := map[string]string{
+		`$.a.b[0]`:     "1",
+		`$.a.b[1].c`:   `"x"`,
+		`$.a.empty`:    "{}",
+		`$.a.none`:     "[]",
+		`$["odd key"]`: "null",
+		`$["d.e"]`:     "true",
+		`$[""]`:        "2",
+	}
+	if !reflect.DeepEqual(flat, expected) {
+		t.Errorf("got %v", flat)
+	}
+
+	scalar := make(map[string]string)
+	flatten("$", "just this", scalar)
+	if !reflect.DeepEqual(scalar, map[string]string{"$": `"just this"`}) {
+		t.Errorf("got %v", scalar)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		name          string
+		before, after map[string]string
+		expected      []string
+	}{
+		{"same", map[string]string{"$.a": "1"}, map[string]string{"$.a": "1"}, nil},
+		{"empty", nil, nil, nil},
+		{"added", nil, map[string]string{"$.a": "1"}, []string{"+ $.a 1"}},
+		{"removed", map[string]string{"$.a": "1"}, nil, []string{"- $.a 1"}},
+		{"changed", map[string]string{"$.a": "1"}, map[string]string{"$.a": `"1"`}, []string{`~ $.a 1 -> "1"`}},
+		{"sorted by path",
+			map[string]string{"$.c": "1", "$.a": "1", "$.b": "1"},
+			map[string]string{"$.b": "2", "$.a": "1", "$.d": "1"},
+			[]string{"~ $.b 1 -> 2", "- $.c 1", "+ $.d 1"}},
+	}
+
+	for _, c := range cases {
+		if got := diffLines(c.before, c.after); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: got %q", c.name, got)
+		}
+	}
+}
+
+// update is a request a status server got from replay.
+type update struct {
+	method, path, query, auth, body string
+}
+
+func TestReplayRemote(t *testing.T) {
+	dir := writeStore(t, testSnapshots...)
+
+	cases := []struct {
+		name   string
+		args   []string
+		status int
+		query  string
+		auth   string
+		fails  bool
+	}{
+		{"merges by default", nil, http.StatusNoContent, "", "", false},
+		{"replaces if asked", []string{"-replace"}, http.StatusNoContent, "replace=true", "", false},
+		{"with a token", []string{"-token", "secret"}, http.StatusNoContent, "", "Bearer secret", false},
+		{"refused", nil, http.StatusUnauthorized, "", "", true},
+	}
+
+	for _, c := range cases {
+		var (
+			mux     sync.Mutex
+			updates []update
+		)
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := io.ReadAll(req.Body)
+
+			mux.Lock()
+			updates = append(updates, update{req.Method, req.URL.Path, req.URL.RawQuery, req.Header.Get("Authorization"), string(body)})
+			mux.Unlock()
+
+			w.WriteHeader(c.status)
+		}))
+
+		args := append([]string{"-target", ts.URL + "/status", "-speed", "0", "-token", ""}, c.args...)
+		_, err := lines(runReplay, append(args, dir)...)
+		ts.Close()
+
+		if (err != nil) != c.fails {
+			t.Errorf("%s: got %v", c.name, err)
+			continue
+		}
+
+		// a refused update stops the replay
+		count := len(testSnapshots)
+		if c.fails {
+			count = 1
+		}
+		if len(updates) != count {
+			t.Errorf("%s: got %d updates", c.name, len(updates))
+			continue
+		}
+
+		for i, u := range updates {
+			expected := update{http.MethodPost, "/status/", c.query, c.auth, testSnapshots[i].Data}
+			if u != expected {
+				t.Errorf("%s: got %+v, expected %+v", c.name, u, expected)
+			}
+		}
+	}
+}
+
+func TestReplayIntoStatusCache(t *testing.T) {
+	dir := writeStore(t, testSnapshots...)
+
+	cases := []struct {
+		args     []string
+		keptDB   bool
+		expected int
+	}{
+		{nil, true, 4},
+		{[]string{"-replace"}, false, 2},
+	}
+
+	for _, c := range cases {
+		status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status.AcceptUpdates("secret")
+		status.Update("unrelated", 1)
+
+		ts := httptest.NewServer(status.Handler())
+
+		args := append([]string{"-target", ts.URL + cynic.DefaultStatusEndpoint, "-token", "secret", "-speed", "0"}, c.args...)
+		_, err = lines(runReplay, append(args, dir)...)
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, dbErr := status.Get("db")
+		_, unrelatedErr := status.Get("unrelated")
+		cache, _ := status.Get("cache")
+
+		if (dbErr == nil) != c.keptDB || (unrelatedErr == nil) != c.keptDB {
+			t.Errorf("%v: db %v, unrelated %v", c.args, dbErr, unrelatedErr)
+		}
+		if cache != "warm" || status.NumEntries() != c.expected {
+			t.Errorf("%v: cache %v, %d entries", c.args, cache, status.NumEntries())
+		}
+	}
+}
+
+func TestLocalReplayer(t *testing.T) {
+	for _, replace := range []bool{false, true} {
+		status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rep := &localReplayer{status: status, replace: replace}
+		for i := range testSnapshots {
+			if err := rep.replay(context.Background(), &testSnapshots[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = status.Get("db")
+		if (err == nil) == replace {
+			t.Errorf("replace %v: db %v", replace, err)
+		}
+
+		web, _ := status.Get("web")
+		expected := map[string]interface{}{"latency_ms": 20.0, "up": false}
+		if !reflect.DeepEqual(web, expected) {
+			t.Errorf("replace %v: web %v", replace, web)
+		}
+	}
+}
@@ -1,5 +1,6 @@
 /*
-Use this to do simple dumps of cynic-storage files.
+Use this to inspect cynic-storage files: dump them, query them over
+time, diff, export and replay them.
 
 Copyright 2018-2021 Simon Symeonidis (psyomn)
 
@@ -18,54 +19,82 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-
-	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+	"strings"
 )
 
-type session struct {
-	inFile string
+type command struct {
+	name  string
+	usage string
+}
+
+// commands are listed in the order usage shows them. What they run is
+// in runners; they are apart so that the commands can find their own
+// usage.
+var commands = []command{
+	{"dump", "[-input file] [paths...]: print every snapshot"},
+	{"query", "[-from t] [-to t] [-key k] [-path p] paths...: print a value over time"},
+	{"diff", "[-a t] [-b t] [-key k] [-path p] paths...: compare two snapshots"},
+	{"export", "[-format csv|jsonl] [-from t] [-to t] [-key k] [-path p] paths...: export for other tools"},
+	{"replay", "[-target url -token t | -listen addr] [-replace] [-speed n] paths...: replay into a status server"},
 }
 
-func parseFlags(s *session) {
-	flag.StringVar(&s.inFile, "input", s.inFile, "the cynic db store to dump")
-	flag.Parse()
+var runners = map[string]func(args []string, out io.Writer) error{
+	"dump":   runDump,
+	"query":  runQuery,
+	"diff":   runDiff,
+	"export": runExport,
+	"replay": runReplay,
 }
 
 func usage() {
-	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "usage: cynic-store <command> [flags] <files or directories>")
+	fmt.Fprintln(os.Stderr)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-7s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "times are rfc3339, unix timestamps, or relative to now (eg: -2h).")
+	fmt.Fprintln(os.Stderr, "run cynic-store <command> -h for the flags of a command.")
 }
 
 func main() {
-	sess := &session{}
-	parseFlags(sess)
+	args := os.Args[1:]
 
-	if sess.inFile == "" {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
 		usage()
+		os.Exit(1)
 	}
 
-	var buff bytes.Buffer
+	// cynic-store -input file, as it has always worked
+	if strings.HasPrefix(args[0], "-") {
+		args = append([]string{"dump"}, args...)
+	}
 
-	dat, err := os.ReadFile(sess.inFile)
-	if err != nil {
-		log.Fatal("problem opening file:", sess.inFile, ":", err)
+	run, ok := runners[args[0]]
+	if !ok {
+		usage()
 		os.Exit(1)
 	}
 
-	dec := gob.NewDecoder(&buff)
-	var snapstore cynic.SnapshotStore
-	buff.Write(dat)
-
-	err = dec.Decode(&snapstore)
-	if err != nil {
-		log.Println("problem decoding store: ", sess.inFile, ":", err)
-		os.Exit(1)
+	if err := run(args[1:], os.Stdout); err != nil {
+		log.Fatal(args[0], ": ", err)
 	}
+}
 
-	fmt.Println(snapstore.String())
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.name == name {
+				fmt.Fprintf(os.Stderr, "usage: cynic-store %s %s\n", cmd.name, cmd.usage)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags
 }
@@ -0,0 +1,205 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+var errNoInput = errors.New("no files or directories given")
+
+// selection is the part of the snapshots a command looks at.
+type selection struct {
+	from, to string
+	key      string
+	path     string
+
+	fromTime, toTime time.Time
+}
+
+func (s *selection) timeFlags(flags *flag.FlagSet) {
+	flags.StringVar(&s.from, "from", "", "only snapshots taken at or after this time")
+	flags.StringVar(&s.to, "to", "", "only snapshots taken at or before this time")
+}
+
+func (s *selection) valueFlags(flags *flag.FlagSet) {
+	flags.StringVar(&s.key, "key", "", "only look at this key of the status cache")
+	flags.StringVar(&s.path, "path", "", "json path into the snapshot (or the key, if given), eg: $.latency_ms")
+}
+
+func (s *selection) parse(now time.Time) error {
+	var err error
+
+	if s.fromTime, err = parseTime(s.from, now); err != nil {
+		return err
+	}
+
+	s.toTime, err = parseTime(s.to, now)
+	return err
+}
+
+func (s *selection) inRange(at time.Time) bool {
+	if !s.fromTime.IsZero() && at.Before(s.fromTime) {
+		return false
+	}
+	if !s.toTime.IsZero() && at.After(s.toTime) {
+		return false
+	}
+	return true
+}
+
+// value decodes the snapshot and picks the selected value out of it.
+// ok is false if the snapshot does not have it.
+func (s *selection) value(snap *cynic.Snapshot) (value interface{}, ok bool, err error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(snap.Data), &doc); err != nil {
+		return nil, false, fmt.Errorf("snapshot at %d: %w", snap.Timestamp, err)
+	}
+
+	if s.key != "" {
+		entries, _ := doc.(map[string]interface{})
+		if doc, ok = entries[s.key]; !ok {
+			return nil, false, nil
+		}
+	}
+
+	value, err = cynic.JSONPath(doc, s.path)
+	if errors.Is(err, cynic.ErrJSONPath) {
+		return nil, false, nil
+	}
+
+	return value, err == nil, err
+}
+
+// label names the selected value, for the formats that need one.
+func (s *selection) label() string {
+	switch {
+	case s.key != "" && s.path != "":
+		rest := strings.TrimPrefix(s.path, "$")
+		if !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "[") {
+			rest = "." + rest
+		}
+		return s.key + rest
+	case s.key != "":
+		return s.key
+	}
+	return s.path
+}
+
+// parseTime accepts rfc3339 times, unix timestamps, and durations
+// relative to now (eg: "-1h").
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+
+	if offset, err := time.ParseDuration(value); err == nil {
+		return now.Add(offset), nil
+	}
+
+	return time.Time{}, fmt.Errorf("bad time %q", value)
+}
+
+// snapshotFiles expands directories into the cynic files they hold.
+// Files are named after when they were dumped, so sorting them by name
+// puts them in order.
+func snapshotFiles(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, errNoInput
+	}
+
+	var files []string
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(p, "*.cynic"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// eachSnapshot calls fn for every snapshot of the files, in the time
+// range of the selection.
+func eachSnapshot(paths []string, sel *selection, fn func(*cynic.Snapshot) error) error {
+	files, err := snapshotFiles(paths)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err := cynic.ReadSnapshotFile(file, func(snap *cynic.Snapshot) error {
+			if !sel.inRange(time.Unix(snap.Timestamp, 0)) {
+				return nil
+			}
+			return fn(snap)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+func formatTimestamp(timestamp int64) string {
+	return time.Unix(timestamp, 0).Format(time.RFC3339)
+}
+
+// formatValue writes strings as they are, and everything else as json.
+func formatValue(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
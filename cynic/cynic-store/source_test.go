@@ -0,0 +1,210 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+var (
+	t0 = int64(1600000000)
+	t1 = t0 + 60
+	t2 = t0 + 120
+)
+
+var testSnapshots = []cynic.Snapshot{
+	{Timestamp: t0, Data: `{"web":{"latency_ms":10,"up":true},"db":{"latency_ms":5}}`},
+	{Timestamp: t1, Data: `{"web":{"latency_ms":30,"up":true},"db":{"latency_ms":5}}`},
+	{Timestamp: t2, Data: `{"web":{"latency_ms":20,"up":false},"cache":"warm"}`},
+}
+
+// writeStore writes the snapshots to two files of a new directory, the
+// way cynic dumps them, and returns the directory.
+func writeStore(t *testing.T, snaps ...cynic.Snapshot) string {
+	dir := t.TempDir()
+
+	for i := range snaps {
+		// the first snapshot in a file of its own, to read across files
+		name := "2.cynic"
+		if i == 0 {
+			name = "1.cynic"
+		}
+
+		file, err := cynic.SnapshotFileAppend(filepath.Join(dir, name), cynic.SnapshotGzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Write(&snaps[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		value    string
+		expected time.Time
+		fails    bool
+	}{
+		{"", time.Time{}, false},
+		{"2021-03-10T10:00:00Z", time.Date(2021, 3, 10, 10, 0, 0, 0, time.UTC), false},
+		{"2021-03-10T10:00:00-05:00", time.Date(2021, 3, 10, 15, 0, 0, 0, time.UTC), false},
+		{"1600000000", time.Unix(1600000000, 0), false},
+		{"-2h", now.Add(-2 * time.Hour), false},
+		{"90m", now.Add(90 * time.Minute), false},
+		{"yesterday", time.Time{}, true},
+		{"2021-03-10", time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		at, err := parseTime(c.value, now)
+		if (err != nil) != c.fails || !at.Equal(c.expected) {
+			t.Errorf("parseTime(%q): got %v, %v; expected %v", c.value, at, err, c.expected)
+		}
+	}
+}
+
+func TestSelectionValue(t *testing.T) {
+	snap := &testSnapshots[0]
+
+	cases := []struct {
+		key, path string
+		expected  interface{}
+		ok        bool
+	}{
+		{"", "", map[string]interface{}{
+			"web": map[string]interface{}{"latency_ms": 10.0, "up": true},
+			"db":  map[string]interface{}{"latency_ms": 5.0},
+		}, true},
+		{"web", "", map[string]interface{}{"latency_ms": 10.0, "up": true}, true},
+		{"web", "$.latency_ms", 10.0, true},
+		{"", "$.db.latency_ms", 5.0, true},
+		{"cache", "", nil, false},
+		{"web", "$.missing", nil, false},
+	}
+
+	for _, c := range cases {
+		sel := selection{key: c.key, path: c.path}
+
+		value, ok, err := sel.value(snap)
+		if err != nil || ok != c.ok || !reflect.DeepEqual(value, c.expected) {
+			t.Errorf("key %q, path %q: got %v, %v, %v", c.key, c.path, value, ok, err)
+		}
+	}
+
+	_, _, err := (&selection{}).value(&cynic.Snapshot{Timestamp: t0, Data: "{not json"})
+	if err == nil {
+		t.Error("a broken snapshot should not decode")
+	}
+}
+
+func TestSelectionLabel(t *testing.T) {
+	cases := []struct {
+		key, path, expected string
+	}{
+		{"", "", ""},
+		{"web", "", "web"},
+		{"", "$.latency_ms", "$.latency_ms"},
+		{"web", "$.latency_ms", "web.latency_ms"},
+		{"web", "latency_ms", "web.latency_ms"},
+		{"web", "$[0]", "web[0]"},
+	}
+
+	for _, c := range cases {
+		sel := selection{key: c.key, path: c.path}
+		if label := sel.label(); label != c.expected {
+			t.Errorf("key %q, path %q: got %q, expected %q", c.key, c.path, label, c.expected)
+		}
+	}
+}
+
+func TestEachSnapshot(t *testing.T) {
+	dir := writeStore(t, testSnapshots...)
+
+	cases := []struct {
+		from, to string
+		expected []int64
+	}{
+		{"", "", []int64{t0, t1, t2}},
+		{"1600000060", "", []int64{t1, t2}},
+		{"", time.Unix(t1, 0).UTC().Format(time.RFC3339), []int64{t0, t1}},
+		{"1600000001", "1600000119", []int64{t1}},
+		{"1700000000", "", nil},
+	}
+
+	for _, c := range cases {
+		sel := selection{from: c.from, to: c.to}
+		if err := sel.parse(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		var seen []int64
+		err := eachSnapshot([]string{dir}, &sel, func(snap *cynic.Snapshot) error {
+			seen = append(seen, snap.Timestamp)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(seen, c.expected) {
+			t.Errorf("from %q to %q: got %v, %v; expected %v", c.from, c.to, seen, err, c.expected)
+		}
+	}
+}
+
+func TestSnapshotFiles(t *testing.T) {
+	dir := writeStore(t, testSnapshots...)
+
+	// not a snapshot, so not picked up from the directory
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hi"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := snapshotFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{filepath.Join(dir, "1.cynic"), filepath.Join(dir, "2.cynic")}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("got %v, expected %v", files, expected)
+	}
+
+	// files are taken as they are
+	files, err = snapshotFiles([]string{filepath.Join(dir, "notes.txt")})
+	if err != nil || len(files) != 1 {
+		t.Errorf("got %v, %v", files, err)
+	}
+
+	if _, err := snapshotFiles(nil); !errors.Is(err, errNoInput) {
+		t.Errorf("no paths: got %v", err)
+	}
+
+	if _, err := snapshotFiles([]string{filepath.Join(dir, "missing")}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing path: got %v", err)
+	}
+}
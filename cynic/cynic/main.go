@@ -0,0 +1,106 @@
+/*
+The cynic daemon: runs the checks described in a config file.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/config"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+type session struct {
+	configPath string
+	generate   string
+	logPath    string
+	version    bool
+}
+
+func parseFlags(s *session) {
+	flag.StringVar(&s.configPath, "config", s.configPath, "the config file (yaml or json) describing the checks")
+	flag.StringVar(&s.generate, "generate", s.generate, "write a sample config file to the given path")
+	flag.StringVar(&s.logPath, "log", s.logPath, "path to log file")
+	flag.BoolVar(&s.version, "v", s.version, "print the version")
+	flag.Parse()
+}
+
+func usage() {
+	flag.PrintDefaults()
+}
+
+func handleLog(logPath string) {
+	if logPath == "" {
+		return
+	}
+
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.SetOutput(file)
+}
+
+func main() {
+	sess := &session{}
+	parseFlags(sess)
+
+	if sess.version {
+		fmt.Fprintf(os.Stderr, "cynic %s\n", cynic.VERSION)
+		os.Exit(0)
+	}
+
+	if sess.generate != "" {
+		if err := os.WriteFile(sess.generate, []byte(config.Sample), 0600); err != nil {
+			log.Fatal("problem writing sample config: ", err)
+		}
+		os.Exit(0)
+	}
+
+	if sess.configPath == "" {
+		usage()
+		os.Exit(1)
+	}
+
+	handleLog(sess.logPath)
+
+	conf, err := config.Load(sess.configPath)
+	if err != nil {
+		log.Fatal("problem loading config: ", err)
+	}
+
+	cynicSession, err := conf.Session()
+	if err != nil {
+		log.Fatal("problem building session: ", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Println("cynic", cynic.VERSION, "running", len(cynicSession.Events), "checks")
+
+	if err := cynic.Start(ctx, cynicSession); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Package cynictest provides what tests of cynic programs need to run
+planners and alerters deterministically: a clock that only moves when
+told to, sinks that record alerts, and hooks that record their runs.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynictest
+
+import (
+	"sync"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// Clock is a fake cynic.Clock: its time only moves with Advance and
+// Set.
+//
+// Unlike those of time.Ticker, its ticks are handed over one at a time:
+// Advance waits for the owner of each ticker to receive its tick (or to
+// stop the ticker) before moving on. So once Advance returns, every
+// tick that was due has been received, in the order they were due.
+// Timers, like those of time.Timer, have room for the one time they
+// deliver, so Advance does not wait for them to be received.
+type Clock struct {
+	mux     sync.Mutex
+	now     time.Time
+	tickers []*ticker
+	timers  []*timer
+}
+
+// ClockNew creates a clock that starts at the given time.
+func ClockNew(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now is the time of the clock.
+func (s *Clock) Now() time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.now
+}
+
+// NewTicker creates a ticker that ticks every period of the clock's
+// time. Like time.NewTicker, it panics if the period is not positive.
+func (s *Clock) NewTicker(d time.Duration) cynic.Ticker {
+	if d <= 0 {
+		panic("cynictest: non-positive interval for NewTicker")
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	t := &ticker{
+		clock:   s,
+		c:       make(chan time.Time),
+		period:  d,
+		next:    s.now.Add(d),
+		stopped: make(chan struct{}),
+	}
+	s.tickers = append(s.tickers, t)
+
+	return t
+}
+
+// NewTimer creates a timer that fires once the clock has moved by d.
+// Like time.NewTimer, it fires right away if d is not positive.
+func (s *Clock) NewTimer(d time.Duration) cynic.Timer {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	t := &timer{
+		clock: s,
+		c:     make(chan time.Time, 1),
+		when:  s.now.Add(d),
+	}
+
+	if d <= 0 {
+		t.c <- s.now
+		return t
+	}
+	s.timers = append(s.timers, t)
+
+	return t
+}
+
+// Tickers is how many tickers are running.
+func (s *Clock) Tickers() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.tickers)
+}
+
+// Timers is how many timers are waiting to fire.
+func (s *Clock) Timers() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.timers)
+}
+
+// Advance moves the clock forward, ticking every ticker and firing
+// every timer that comes due on the way.
+func (s *Clock) Advance(d time.Duration) {
+	s.mux.Lock()
+	end := s.now.Add(d)
+	s.mux.Unlock()
+
+	for {
+		s.mux.Lock()
+		due := s.nextDue(end)
+		if fired := s.nextTimer(end); fired != nil && (due == nil || !due.next.Before(fired.when)) {
+			s.now = fired.when
+			s.removeTimer(fired)
+			fired.c <- fired.when
+			s.mux.Unlock()
+			continue
+		}
+
+		if due == nil {
+			if end.After(s.now) {
+				s.now = end
+			}
+			s.mux.Unlock()
+			return
+		}
+
+		when := due.next
+		s.now = when
+		due.next = when.Add(due.period)
+		s.mux.Unlock()
+
+		select {
+		case due.c <- when:
+		case <-due.stopped:
+		}
+	}
+}
+
+// Set moves the clock to the given time, as Advance does. Times in the
+// past set the clock back, without any ticks.
+func (s *Clock) Set(t time.Time) {
+	s.mux.Lock()
+	if t.Before(s.now) {
+		s.now = t
+		s.mux.Unlock()
+		return
+	}
+	d := t.Sub(s.now)
+	s.mux.Unlock()
+
+	s.Advance(d)
+}
+
+// nextDue gives the ticker that is due the soonest, no later than end.
+func (s *Clock) nextDue(end time.Time) *ticker {
+	var ret *ticker
+	for _, t := range s.tickers {
+		if t.next.After(end) {
+			continue
+		}
+		if ret == nil || t.next.Before(ret.next) {
+			ret = t
+		}
+	}
+	return ret
+}
+
+// nextTimer gives the timer that fires the soonest, no later than end.
+func (s *Clock) nextTimer(end time.Time) *timer {
+	var ret *timer
+	for _, t := range s.timers {
+		if t.when.After(end) {
+			continue
+		}
+		if ret == nil || t.when.Before(ret.when) {
+			ret = t
+		}
+	}
+	return ret
+}
+
+// removeTimer must be called with the lock held. It says whether the
+// timer was still waiting.
+func (s *Clock) removeTimer(t *timer) bool {
+	for i, other := range s.timers {
+		if other == t {
+			s.timers = append(s.timers[:i], s.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Clock) remove(t *ticker) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for i, other := range s.tickers {
+		if other == t {
+			s.tickers = append(s.tickers[:i], s.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type ticker struct {
+	clock    *Clock
+	c        chan time.Time
+	period   time.Duration
+	next     time.Time
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func (s *ticker) C() <-chan time.Time {
+	return s.c
+}
+
+func (s *ticker) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+		s.clock.remove(s)
+	})
+}
+
+type timer struct {
+	clock *Clock
+	c     chan time.Time
+	when  time.Time
+}
+
+func (s *timer) C() <-chan time.Time {
+	return s.c
+}
+
+func (s *timer) Stop() bool {
+	s.clock.mux.Lock()
+	defer s.clock.mux.Unlock()
+	return s.clock.removeTimer(s)
+}
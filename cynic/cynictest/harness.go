@@ -0,0 +1,136 @@
+/*
+Package cynictest provides what tests of cynic programs need to run
+planners and alerters deterministically: a clock that only moves when
+told to, sinks that record alerts, and hooks that record their runs.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynictest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// Harness is a planner and an alerter on a fake clock, with the alerts
+// delivered to a recorder:
+//
+//	h := cynictest.HarnessNew(start, 5)
+//	defer h.Close()
+//
+//	probe := cynictest.ProbeNew(h.Clock)
+//	event := cynic.EventNew(10)
+//	event.Label = "web"
+//	event.Repeat(true)
+//	event.AddHook(probe.Hook)
+//	h.Add(&event)
+//
+//	probe.Fail("down")
+//	h.Advance(time.Minute)
+//	cynictest.ExpectRuns(t, probe, 5)
+//	cynictest.ExpectAlerts(t, h.Recorder, "web:firing")
+//
+// Nothing runs on its own: the planner ticks once per second of
+// Advance, as Planner.Run would, and the alerter delivers on the ticks
+// of the clock. Since Advance waits for the events it runs, events
+// that retry with a backoff would wait on the clock forever; trigger
+// those with Planner.Trigger instead, and Advance the Clock while they
+// wait (see Clock.Timers).
+type Harness struct {
+	Clock    *Clock
+	Planner  *cynic.Planner
+	Alerter  *cynic.Alerter
+	Recorder *Recorder
+}
+
+// HarnessNew creates a harness whose clock starts at the given time,
+// and whose alerter delivers every alertWait seconds. The alerter is
+// running; Close stops it.
+func HarnessNew(start time.Time, alertWait int) *Harness {
+	clock := ClockNew(start)
+	recorder := RecorderNew()
+
+	alerter := cynic.AlerterNew(alertWait, nil)
+	alerter.SetClock(clock)
+	alerter.AddSink(recorder)
+
+	planner := cynic.PlannerNew()
+	planner.SetClock(clock)
+	planner.SetAlerter(&alerter)
+
+	alerter.Start()
+
+	return &Harness{
+		Clock:    clock,
+		Planner:  planner,
+		Alerter:  &alerter,
+		Recorder: recorder,
+	}
+}
+
+// Add adds the events to the planner.
+func (s *Harness) Add(events ...*cynic.Event) {
+	for _, event := range events {
+		s.Planner.Add(event)
+	}
+}
+
+// Advance moves the clock forward, ticking the planner after every
+// whole second, and waiting for the events it runs to finish. A
+// fraction of a second left over moves the clock without a tick.
+func (s *Harness) Advance(d time.Duration) {
+	for ; d >= time.Second; d -= time.Second {
+		s.Clock.Advance(time.Second)
+		s.Planner.Tick()
+		s.Planner.Wait()
+	}
+
+	if d > 0 {
+		s.Clock.Advance(d)
+	}
+}
+
+// Close stops the alerter, which delivers whatever alerts it was
+// holding on to.
+func (s *Harness) Close() {
+	s.Alerter.Stop()
+}
+
+// ExpectRuns fails the test unless the probe ran the given number of
+// times.
+func ExpectRuns(t testing.TB, probe *Probe, want int) {
+	t.Helper()
+
+	if got := probe.Count(); got != want {
+		t.Errorf("expected %d runs, got %d at %v", want, got, probe.Runs())
+	}
+}
+
+// ExpectAlerts fails the test unless the recorder got exactly the
+// given alerts, as "label:state" (see Recorder.Transitions). It waits
+// for them to be delivered, up to WaitTimeout.
+func ExpectAlerts(t testing.TB, recorder *Recorder, want ...string) {
+	t.Helper()
+
+	recorder.Wait(len(want))
+
+	got := recorder.Transitions()
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected alerts %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Package cynictest provides what tests of cynic programs need to run
+planners and alerters deterministically: a clock that only moves when
+told to, sinks that record alerts, and hooks that record their runs.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynictest
+
+import (
+	"sync"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// Probe is a hook that records when it ran, and passes or fails as it
+// is told to. It passes until told otherwise.
+type Probe struct {
+	clock cynic.Clock
+
+	mux    sync.Mutex
+	runs   []time.Time
+	alert  bool
+	result interface{}
+}
+
+// ProbeNew creates a probe that records the runs on the time of the
+// clock; the wall clock if nil.
+func ProbeNew(clock cynic.Clock) *Probe {
+	if clock == nil {
+		clock = cynic.SystemClock
+	}
+	return &Probe{clock: clock}
+}
+
+// Hook is the hook to add to events.
+func (s *Probe) Hook(_ *cynic.HookParameters) (bool, interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.runs = append(s.runs, s.clock.Now())
+	return s.alert, s.result
+}
+
+// Fail makes the next runs fail with the result.
+func (s *Probe) Fail(result interface{}) {
+	s.set(true, result)
+}
+
+// Pass makes the next runs pass with the result.
+func (s *Probe) Pass(result interface{}) {
+	s.set(false, result)
+}
+
+func (s *Probe) set(alert bool, result interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.alert = alert
+	s.result = result
+}
+
+// Runs are the times the hook ran at, in order.
+func (s *Probe) Runs() []time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]time.Time(nil), s.runs...)
+}
+
+// Count is how many times the hook ran.
+func (s *Probe) Count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.runs)
+}
@@ -0,0 +1,126 @@
+/*
+Package cynictest provides what tests of cynic programs need to run
+planners and alerters deterministically: a clock that only moves when
+told to, sinks that record alerts, and hooks that record their runs.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynictest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// WaitTimeout bounds how long Recorder.Wait waits, in real time, for
+// alerts that are on their way. Alerters deliver on a goroutine of
+// their own, so even on a fake clock, delivery is not instant.
+const WaitTimeout = 5 * time.Second
+
+// Recorder is a cynic.Sink that keeps every alert it is sent.
+type Recorder struct {
+	mux      sync.Mutex
+	messages []cynic.AlertMessage
+	batches  int
+
+	// changed is closed, and replaced, on every batch
+	changed chan struct{}
+}
+
+// RecorderNew creates an empty recorder.
+func RecorderNew() *Recorder {
+	return &Recorder{changed: make(chan struct{})}
+}
+
+// Name of the sink.
+func (s *Recorder) Name() string {
+	return "recorder"
+}
+
+// Send records the batch.
+func (s *Recorder) Send(_ context.Context, messages []cynic.AlertMessage) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.messages = append(s.messages, messages...)
+	s.batches++
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	return nil
+}
+
+// Messages are the alerts recorded so far, in the order they came.
+func (s *Recorder) Messages() []cynic.AlertMessage {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]cynic.AlertMessage(nil), s.messages...)
+}
+
+// Batches is how many times alerts were delivered.
+func (s *Recorder) Batches() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.batches
+}
+
+// Transitions are the alerts recorded so far as "label:state", eg:
+// "web:firing", which is handy to compare against.
+func (s *Recorder) Transitions() []string {
+	messages := s.Messages()
+
+	ret := make([]string, len(messages))
+	for i, msg := range messages {
+		ret[i] = msg.Label + ":" + string(msg.State)
+	}
+	return ret
+}
+
+// Wait waits until at least n alerts were recorded, for up to
+// WaitTimeout, and gives what was recorded by then.
+func (s *Recorder) Wait(n int) []cynic.AlertMessage {
+	timeout := time.NewTimer(WaitTimeout)
+	defer timeout.Stop()
+
+	for {
+		s.mux.Lock()
+		if len(s.messages) >= n {
+			ret := append([]cynic.AlertMessage(nil), s.messages...)
+			s.mux.Unlock()
+			return ret
+		}
+		changed := s.changed
+		s.mux.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return s.Messages()
+		}
+	}
+}
+
+// Reset forgets what was recorded.
+func (s *Recorder) Reset() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.messages = nil
+	s.batches = 0
+}
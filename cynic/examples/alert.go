@@ -21,6 +21,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -65,7 +66,9 @@ func main() {
 		Alerter: &alertConfig,
 	}
 
-	cynic.Start(session)
+	if err := cynic.Start(context.Background(), session); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // output
@@ -0,0 +1,55 @@
+//go:build ignore
+// +build ignore
+
+/*
+Example code on cynic usage.
+
+Copyright 2019 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func main() {
+	loc, err := time.LoadLocation("America/Montreal")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 02:30, every weekday, Montreal time
+	event, err := cynic.EventCronNew("30 2 * * mon-fri", loc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		log.Println("good morning")
+		return false, 0
+	})
+
+	session := cynic.Session{
+		Events: []cynic.Event{event},
+	}
+
+	if err := cynic.Start(context.Background(), session); err != nil {
+		log.Fatal(err)
+	}
+}
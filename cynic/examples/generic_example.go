@@ -18,6 +18,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -26,6 +27,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
@@ -74,9 +77,12 @@ func exampleAlerter(messages []cynic.AlertMessage) {
 
 	for ix, el := range messages {
 		fmt.Println("# ", ix)
+		fmt.Println("#  event   : ", el.Label, el.EventID)
+		fmt.Println("#  state   : ", el.PrevState, "->", el.State)
 		fmt.Println("#  response: ", el.Response)
 		fmt.Println("#  now     : ", el.Now)
 		fmt.Println("#  cynichos: ", el.CynicHostname)
+		fmt.Println("#  attempts: ", el.Attempts)
 		fmt.Println("#        ##########################")
 	}
 
@@ -245,6 +251,12 @@ func main() {
 	}
 
 	alerter := cynic.AlerterNew(20, exampleAlerter)
+	if slackHook != "" {
+		// at most 10 messages a minute, so we do not get kicked out
+		sink := cynic.WebhookSinkNew(slackHook, cynic.WebhookSlack)
+		alerter.AddSink(cynic.RateLimit(sink, 10, time.Minute))
+	}
+
 	session := cynic.Session{
 		Events:      events,
 		Alerter:     &alerter,
@@ -256,5 +268,10 @@ func main() {
 		},
 	}
 
-	cynic.Start(session)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := cynic.Start(ctx, session); err != nil {
+		log.Fatal(err)
+	}
 }
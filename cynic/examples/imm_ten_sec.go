@@ -21,6 +21,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"log"
 
 	"git.sr.ht/~psyomn/ecophagy/cynic/lib"
@@ -42,7 +43,9 @@ func main() {
 		Events: events,
 	}
 
-	cynic.Start(session)
+	if err := cynic.Start(context.Background(), session); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // output
@@ -21,6 +21,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -52,7 +53,9 @@ func main() {
 		},
 	}
 
-	cynic.Start(session)
+	if err := cynic.Start(context.Background(), session); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // output
@@ -21,6 +21,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -54,7 +55,9 @@ func main() {
 		StatusCache: &status,
 	}
 
-	cynic.Start(session)
+	if err := cynic.Start(context.Background(), session); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // output
@@ -18,6 +18,8 @@ limitations under the License.
 package cynic
 
 import (
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -30,61 +32,191 @@ type Alerter struct {
 	alerts     []AlertMessage
 	Ch         chan AlertMessage
 	stopCh     chan int
+	doneCh     chan struct{}
+	running    bool
 	waitTime   int
-	waitTicker *time.Ticker
+	waitTicker Ticker
+	clock      Clock
 	alerterFn  AlertFunc
+	sinks      []Sink
+	metrics    *Metrics
+	broker     *Broker
+
+	states        map[uint64]*alertTracker
+	recent        []AlertMessage
+	stateMux      *sync.Mutex
+	flapThreshold int
+	flapWindow    time.Duration
 }
 
 // AlertMessage defines a simple alert structure that can be used by
 // users of the library, and decide how to show information about the
-// alerts.
+// alerts. Messages coming from events carry the event they are about,
+// and the state transition (eg: firing to resolved) they announce.
 type AlertMessage struct {
 	Response      interface{} `json:"response_text"`
 	Now           string      `json:"now"`
 	CynicHostname string      `json:"cynic_hostname"`
+	TimedOut      bool        `json:"timed_out,omitempty"`
+	Attempts      int         `json:"attempts"`
+	EventID       uint64      `json:"event_id"`
+	Label         string      `json:"label"`
+	State         AlertState  `json:"state"`
+	PrevState     AlertState  `json:"prev_state"`
+
+	// Locations and Nodes are set by clusters (see Cluster): the
+	// nodes that saw the event failing, out of how many.
+	Locations []string `json:"locations,omitempty"`
+	Nodes     int      `json:"nodes,omitempty"`
 }
 
-// AlerterNew creates a new alerter.
+// AlerterNew creates a new alerter. Every waitTime seconds, gathered
+// alerts are handed to the alerter function (if not nil), and to every
+// sink added with AddSink.
 func AlerterNew(waitTime int, alerter AlertFunc) Alerter {
 	var alerts []AlertMessage
 	ch := make(chan AlertMessage)
 	stop := make(chan int)
-	ticker := time.NewTicker(time.Second * time.Duration(waitTime))
 
 	return Alerter{
 		alerts:     alerts,
 		Ch:         ch,
 		stopCh:     stop,
+		doneCh:     nil,
+		running:    false,
 		waitTime:   waitTime,
-		waitTicker: ticker,
+		waitTicker: nil,
+		clock:      SystemClock,
 		alerterFn:  alerter,
+
+		states:        make(map[uint64]*alertTracker),
+		stateMux:      &sync.Mutex{},
+		flapThreshold: DefaultFlapThreshold,
+		flapWindow:    DefaultFlapWindow,
 	}
 }
 
 // Start begins the alerter.
 func (s *Alerter) Start() {
+	s.running = true
+	s.doneCh = make(chan struct{})
+	s.waitTicker = s.clock.NewTicker(time.Second * time.Duration(s.waitTime))
 	go s.run()
 }
 
-// Stop the alerter.
+// Stop the alerter. Any alerts that were received but not yet
+// delivered are flushed before Stop returns. Stopping an alerter that
+// was never started does nothing.
 func (s *Alerter) Stop() {
+	if !s.running {
+		return
+	}
+
 	s.stopCh <- 0
+	<-s.doneCh
+	s.running = false
+}
+
+// AddSink adds a sink that alerts are delivered to. Sinks should be
+// added before the alerter is started.
+func (s *Alerter) AddSink(sink Sink) {
+	s.sinks = append(s.sinks, sink)
+}
+
+// SetClock makes the alerter deliver alerts on the ticks of the clock,
+// and judge flapping by its time. It should be called before the
+// alerter is started.
+func (s *Alerter) SetClock(clock Clock) {
+	s.clock = orSystemClock(clock)
+}
+
+// SetMetrics makes the alerter count the alerts it delivers. It should
+// be called before the alerter is started.
+func (s *Alerter) SetMetrics(metrics *Metrics) {
+	s.metrics = metrics
+}
+
+// SetBroker makes the alerter publish the alerts it delivers. It
+// should be called before the alerter is started.
+func (s *Alerter) SetBroker(broker *Broker) {
+	s.broker = broker
+}
+
+func (s *Alerter) flush() {
+	for _, alert := range s.alerts {
+		if s.metrics != nil {
+			s.metrics.observeAlert(alert.State)
+		}
+
+		if s.broker != nil {
+			s.broker.Publish(StreamAlert, alertKey(alert), alert)
+		}
+	}
+
+	if len(s.alerts) > 0 {
+		s.remember(s.alerts)
+
+		if s.alerterFn != nil {
+			s.alerterFn(s.alerts)
+		}
+		sendAll(s.sinks, s.alerts)
+	}
+	var clear []AlertMessage
+	s.alerts = clear
+}
+
+// alertKey names alerts the way the status cache names the results
+// of events, so that both can be filtered on the same prefix.
+func alertKey(alert AlertMessage) string {
+	switch {
+	case alert.EventID == 0:
+		return ""
+	case alert.Label == "":
+		return strconv.FormatUint(alert.EventID, 10)
+	}
+	return alert.Label + "-" + strconv.FormatUint(alert.EventID, 10)
+}
+
+// maxRecentAlerts is how many delivered alerts are kept around, for
+// the dashboard.
+const maxRecentAlerts = 50
+
+func (s *Alerter) remember(alerts []AlertMessage) {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	s.recent = append(s.recent, alerts...)
+	if len(s.recent) > maxRecentAlerts {
+		s.recent = append([]AlertMessage(nil), s.recent[len(s.recent)-maxRecentAlerts:]...)
+	}
+}
+
+// RecentAlerts returns the last alerts that were delivered, newest
+// first.
+func (s *Alerter) RecentAlerts() []AlertMessage {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	ret := make([]AlertMessage, len(s.recent))
+	for i, alert := range s.recent {
+		ret[len(ret)-1-i] = alert
+	}
+	return ret
 }
 
 func (s *Alerter) run() {
+	defer close(s.doneCh)
 	defer s.waitTicker.Stop()
 
 	for {
 		select {
 		case recvAlert := <-s.Ch:
-			s.alerts = append(s.alerts, recvAlert)
-		case <-s.waitTicker.C:
-			if len(s.alerts) > 0 {
-				s.alerterFn(s.alerts)
-			}
-			var clear []AlertMessage
-			s.alerts = clear
+			s.alerts = append(s.alerts, s.track(recvAlert, s.clock.Now())...)
+		case <-s.waitTicker.C():
+			s.alerts = append(s.alerts, s.settleAll(s.clock.Now())...)
+			s.flush()
 		case <-s.stopCh:
+			s.flush()
 			return
 		}
 	}
@@ -0,0 +1,207 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"time"
+)
+
+// AlertState is the state of the alert of a single event.
+type AlertState string
+
+const (
+	// AlertOK means the event has not been failing.
+	AlertOK AlertState = "ok"
+
+	// AlertFiring means the event is failing.
+	AlertFiring AlertState = "firing"
+
+	// AlertResolved means the event was failing, and recovered.
+	AlertResolved AlertState = "resolved"
+
+	// AlertFlapping means the event keeps going back and forth
+	// between failing and recovering. Notifications are held back
+	// until it settles.
+	AlertFlapping AlertState = "flapping"
+)
+
+const (
+	// DefaultFlapThreshold is the number of state changes within
+	// the flap window that make an event flapping.
+	DefaultFlapThreshold = 6
+
+	// DefaultFlapWindow is how far back state changes are counted
+	// for flapping detection.
+	DefaultFlapWindow = 30 * time.Minute
+)
+
+// alertTracker keeps what the alerter knows about one event.
+type alertTracker struct {
+	// state is what the event is doing right now (ok or firing)
+	state AlertState
+
+	// notified is the last state the user was told about
+	notified AlertState
+
+	flapping bool
+	changes  []time.Time
+	last     AlertMessage
+}
+
+// track runs the message through the state machine of its event, and
+// returns the messages (if any) that should be delivered.
+func (s *Alerter) track(msg AlertMessage, now time.Time) []AlertMessage {
+	// messages that do not come from events, or do not carry a
+	// state, are delivered as they are
+	if msg.EventID == 0 || msg.State == "" {
+		return []AlertMessage{msg}
+	}
+
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	tracker, ok := s.states[msg.EventID]
+	if !ok {
+		tracker = &alertTracker{state: AlertOK, notified: AlertOK}
+		s.states[msg.EventID] = tracker
+	}
+
+	if msg.State == tracker.state {
+		// still down (or still up): nothing new to say, unless
+		// this is the end of a flap
+		return s.settle(tracker, now)
+	}
+
+	tracker.state = msg.State
+	tracker.last = msg
+	tracker.changes = append(tracker.changes, now)
+
+	wasFlapping := tracker.flapping
+	s.updateFlapping(tracker, now)
+
+	switch {
+	case tracker.flapping && !wasFlapping:
+		return []AlertMessage{tracker.notify(AlertFlapping)}
+	case tracker.flapping:
+		return nil
+	case wasFlapping:
+		return tracker.notifyCurrent()
+	}
+
+	if msg.State == AlertFiring {
+		return []AlertMessage{tracker.notify(AlertFiring)}
+	}
+
+	if tracker.notified == AlertFiring {
+		return []AlertMessage{tracker.notify(AlertResolved)}
+	}
+
+	return nil
+}
+
+// settle checks whether a flapping event has calmed down, and if so
+// tells the user where it ended up.
+func (s *Alerter) settle(tracker *alertTracker, now time.Time) []AlertMessage {
+	if !tracker.flapping {
+		return nil
+	}
+
+	s.updateFlapping(tracker, now)
+	if tracker.flapping {
+		return nil
+	}
+
+	return tracker.notifyCurrent()
+}
+
+// settleAll is settle, for every event the alerter knows about.
+func (s *Alerter) settleAll(now time.Time) []AlertMessage {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	var ret []AlertMessage
+	for _, tracker := range s.states {
+		ret = append(ret, s.settle(tracker, now)...)
+	}
+	return ret
+}
+
+func (s *Alerter) updateFlapping(tracker *alertTracker, now time.Time) {
+	cutoff := now.Add(-s.flapWindow)
+
+	recent := tracker.changes[:0]
+	for _, change := range tracker.changes {
+		if change.After(cutoff) {
+			recent = append(recent, change)
+		}
+	}
+	tracker.changes = recent
+
+	tracker.flapping = s.flapThreshold > 0 && len(tracker.changes) >= s.flapThreshold
+}
+
+func (s *alertTracker) notifyCurrent() []AlertMessage {
+	if s.state == AlertFiring {
+		return []AlertMessage{s.notify(AlertFiring)}
+	}
+
+	if s.notified == AlertOK || s.notified == AlertResolved {
+		return nil
+	}
+
+	return []AlertMessage{s.notify(AlertResolved)}
+}
+
+func (s *alertTracker) notify(state AlertState) AlertMessage {
+	msg := s.last
+	msg.PrevState = s.notified
+	msg.State = state
+	s.notified = state
+	return msg
+}
+
+// SetFlapping configures flapping detection: an event changing state
+// threshold times within the window is considered flapping. A
+// threshold of zero disables flapping detection.
+func (s *Alerter) SetFlapping(threshold int, window time.Duration) {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	s.flapThreshold = threshold
+	s.flapWindow = window
+}
+
+// State returns where the given event stands right now: AlertOK or
+// AlertFiring, or AlertFlapping while it goes back and forth. This is
+// not necessarily what the user was last notified of, since flapping
+// holds notifications back; it is never AlertResolved.
+func (s *Alerter) State(eventID uint64) AlertState {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	tracker, ok := s.states[eventID]
+	if !ok {
+		return AlertOK
+	}
+
+	if tracker.flapping {
+		return AlertFlapping
+	}
+
+	return tracker.state
+}
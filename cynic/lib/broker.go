@@ -0,0 +1,300 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStreamEndpoint is where the feed of updates is served on the
+// status server.
+const DefaultStreamEndpoint = "/stream"
+
+// DefaultStreamReplay is how many past updates the broker keeps, to
+// replay to clients that reconnect.
+const DefaultStreamReplay = 256
+
+// streamKeepAlive is how often an idle stream gets a comment, so that
+// proxies do not close it.
+var streamKeepAlive = 15 * time.Second
+
+// subscriberBuffer is how far behind a subscriber may fall before it
+// is dropped. Dropped sse clients reconnect, and catch up through
+// Last-Event-ID.
+const subscriberBuffer = 64
+
+// Kinds of stream events.
+const (
+	StreamStatus = "status"
+	StreamDelete = "delete"
+	StreamAlert  = "alert"
+)
+
+// StreamEvent is one update published by the broker.
+type StreamEvent struct {
+	ID    uint64      `json:"id"`
+	Kind  string      `json:"kind"`
+	Key   string      `json:"key"`
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type subscriber struct {
+	prefixes []string
+	kinds    map[string]bool
+	ch       chan StreamEvent
+}
+
+func (s *subscriber) wants(event StreamEvent) bool {
+	if len(s.kinds) > 0 && !s.kinds[event.Kind] {
+		return false
+	}
+
+	if len(s.prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(event.Key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Broker fans out status updates and alerts to whoever subscribed. It
+// keeps the last few events around, so that subscribers that went
+// away for a moment can pick up where they left off.
+type Broker struct {
+	mux         sync.Mutex
+	lastID      uint64
+	replay      []StreamEvent
+	replaySize  int
+	subscribers map[*subscriber]struct{}
+	done        <-chan struct{}
+}
+
+// BrokerNew creates a broker that keeps the last replay events.
+func BrokerNew(replay int) *Broker {
+	if replay < 0 {
+		replay = 0
+	}
+
+	return &Broker{
+		replaySize:  replay,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Publish sends an event to every interested subscriber. Subscribers
+// that can not keep up are dropped. Publishing to a nil broker does
+// nothing.
+func (s *Broker) Publish(kind, key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.lastID++
+	event := StreamEvent{
+		ID:    s.lastID,
+		Kind:  kind,
+		Key:   key,
+		Time:  time.Now(),
+		Value: value,
+	}
+
+	if s.replaySize > 0 {
+		if len(s.replay) >= s.replaySize {
+			copy(s.replay, s.replay[1:])
+			s.replay = s.replay[:len(s.replay)-1]
+		}
+		s.replay = append(s.replay, event)
+	}
+
+	for sub := range s.subscribers {
+		if !sub.wants(event) {
+			continue
+		}
+
+		select {
+		case sub.ch <- event:
+		default:
+			delete(s.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Subscribe registers interest in the events with keys starting with
+// any of the prefixes (or all, if none), and of the given kinds (or
+// all, if none). The events published after lastID, still in the
+// replay buffer, are returned so nothing is missed between the two.
+// The channel is closed when the subscriber falls too far behind, or
+// after cancel is called.
+func (s *Broker) Subscribe(prefixes, kinds []string, lastID uint64) ([]StreamEvent, <-chan StreamEvent, func()) {
+	sub := &subscriber{
+		prefixes: prefixes,
+		kinds:    make(map[string]bool),
+		ch:       make(chan StreamEvent, subscriberBuffer),
+	}
+	for _, kind := range kinds {
+		sub.kinds[kind] = true
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var missed []StreamEvent
+	if lastID > 0 {
+		// an id from the future means we restarted since; the
+		// whole buffer is new to the subscriber
+		if lastID > s.lastID {
+			lastID = 0
+		}
+
+		for _, event := range s.replay {
+			if event.ID > lastID && sub.wants(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	s.subscribers[sub] = struct{}{}
+
+	cancel := func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		if _, ok := s.subscribers[sub]; ok {
+			delete(s.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+
+	return missed, sub.ch, cancel
+}
+
+// Subscribers returns how many subscribers there are right now.
+func (s *Broker) Subscribers() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.subscribers)
+}
+
+// ServeHTTP streams the events as server sent events, one json object
+// per event. The query may narrow the stream down:
+//
+//	/stream?prefix=web-&prefix=db-&kind=alert
+//
+// Reconnecting clients send a Last-Event-ID header (browsers do that
+// on their own), or a last_event_id parameter, to get what they
+// missed.
+func (s *Broker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := req.URL.Query()
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("last_event_id")
+	}
+
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "bad last event id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	missed, events, cancel := s.Subscribe(query["prefix"], query["kind"], lastID)
+	defer cancel()
+
+	// the server write timeout would cut the stream otherwise
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Println("could not lift write deadline of stream:", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for _, event := range missed {
+		if err := writeStreamEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// dropped for being slow; the client will
+				// reconnect with its last id
+				return
+			}
+			if err := writeStreamEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-req.Context().Done():
+			return
+
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, event StreamEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("problem encoding stream event:", err)
+		return nil
+	}
+
+	return writeServerEvent(w, strconv.FormatUint(event.ID, 10), event.Kind, string(data))
+}
@@ -0,0 +1,95 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import "time"
+
+// Clock tells the time, and makes tickers and timers. Planners,
+// alerters and status caches read the time through one, and retried
+// hooks wait on the clock of their planner, so that tests can move it
+// along themselves instead of sleeping (see the cynictest package).
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker is what Clock.NewTicker gives: like time.Ticker, a channel
+// that delivers the time every period, until Stop.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is what Clock.NewTimer gives: like time.Timer, a channel that
+// delivers the time once, unless stopped first. Stop says whether it
+// stopped the timer before it fired.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the wall clock, and the default of everything that
+// takes a Clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{ticker: time.NewTicker(d)}
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (s systemTicker) C() <-chan time.Time {
+	return s.ticker.C
+}
+
+func (s systemTicker) Stop() {
+	s.ticker.Stop()
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (s systemTimer) C() <-chan time.Time {
+	return s.timer.C
+}
+
+func (s systemTimer) Stop() bool {
+	return s.timer.Stop()
+}
+
+// orSystemClock gives the clock, or the wall clock if there is none.
+func orSystemClock(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
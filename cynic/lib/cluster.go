@@ -0,0 +1,643 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultClusterEndpoint is where the cluster is mounted on the status
+// server. Peers gossip to DefaultClusterEndpoint + "gossip".
+const DefaultClusterEndpoint = "/cluster/"
+
+// DefaultGossipInterval is how often peers exchange results, unless
+// configured otherwise.
+const DefaultGossipInterval = 5 * time.Second
+
+// ErrClusterConfig is returned for cluster configurations that can not
+// work.
+var ErrClusterConfig = errors.New("bad cluster config")
+
+// maxGossipSize bounds what a peer may send in one gossip.
+const maxGossipSize = 8 << 20
+
+// ClusterConfig configures a cynic instance as one node of a cluster.
+type ClusterConfig struct {
+	// Node names this instance. It must be unique within the
+	// cluster; the hostname is used if empty.
+	Node string
+
+	// Peers are the status servers of the other nodes (eg:
+	// http://10.0.0.2:9999).
+	Peers []string
+
+	// Token is shared by every node, and authenticates gossip.
+	Token string
+
+	// Interval is how often results are gossiped to the peers.
+	Interval time.Duration
+
+	// LeaseTTL is how long a node is considered alive after it was
+	// last heard from, and how long a lease on LeaseFile lasts.
+	// Defaults to three intervals.
+	LeaseTTL time.Duration
+
+	// LeaseFile, if set, is a file every node can reach (eg: on a
+	// shared volume), and whoever holds the lease in it is the
+	// leader. Otherwise, the live node with the lowest name leads.
+	LeaseFile string
+
+	// Quorum is how many nodes must see an event failing for it to
+	// alert. Zero is a majority of the live nodes. It is capped to
+	// the number of live nodes, so that a shrinking cluster still
+	// alerts.
+	Quorum int
+
+	// Client is used to reach the peers; http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// ClusterResult is what a node last saw of an event.
+type ClusterResult struct {
+	Failing  bool        `json:"failing"`
+	Since    time.Time   `json:"since"`
+	Response interface{} `json:"response,omitempty"`
+}
+
+// Cluster lets several cynic instances run the same events without
+// alerting several times. The nodes gossip the results of their events
+// to each other, and one of them, the leader, delivers the alerts:
+// an event fires once enough nodes (see ClusterConfig.Quorum) see it
+// failing, which also means that a single vantage point with a bad
+// network does not wake anyone up.
+//
+// Events are matched across nodes by label, so every node should run
+// the same configuration.
+type Cluster struct {
+	config ClusterConfig
+	client *http.Client
+	now    func() time.Time
+
+	planner *Planner
+
+	mux    sync.Mutex
+	local  map[string]ClusterResult
+	peers  map[string]*clusterPeer
+	leader string
+
+	// firing are the events the leader has announced as firing
+	firing map[string]bool
+}
+
+type clusterPeer struct {
+	seen    time.Time
+	results map[string]ClusterResult
+}
+
+type clusterGossip struct {
+	Node    string                   `json:"node"`
+	Results map[string]ClusterResult `json:"results"`
+}
+
+// ClusterNew creates a cluster node. It does nothing until it is given
+// to a planner (see Planner.SetCluster), mounted on the status server,
+// and Run.
+func ClusterNew(config ClusterConfig) (*Cluster, error) {
+	if config.Node == "" {
+		config.Node = currentHost()
+	}
+
+	if config.Token == "" {
+		return nil, fmt.Errorf("%w: a token is required", ErrClusterConfig)
+	}
+
+	if config.Interval == 0 {
+		config.Interval = DefaultGossipInterval
+	}
+	if config.LeaseTTL == 0 {
+		config.LeaseTTL = 3 * config.Interval
+	}
+
+	switch {
+	case config.Interval < 0:
+		return nil, fmt.Errorf("%w: negative interval", ErrClusterConfig)
+	case config.LeaseTTL <= config.Interval:
+		return nil, fmt.Errorf("%w: the lease must outlast the interval", ErrClusterConfig)
+	case config.Quorum < 0:
+		return nil, fmt.Errorf("%w: negative quorum", ErrClusterConfig)
+	}
+
+	for i, peer := range config.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("%w: bad peer %q", ErrClusterConfig, peer)
+		}
+		config.Peers[i] = strings.TrimSuffix(peer, "/")
+	}
+
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Cluster{
+		config: config,
+		client: client,
+		now:    time.Now,
+		local:  make(map[string]ClusterResult),
+		peers:  make(map[string]*clusterPeer),
+		firing: make(map[string]bool),
+	}, nil
+}
+
+// SetCluster makes the planner part of a cluster: the results of its
+// events are gossiped instead of alerting right away. It should be
+// called before Run.
+func (s *Planner) SetCluster(cluster *Cluster) {
+	s.cluster = cluster
+	cluster.planner = s
+}
+
+// Node is the name of this node.
+func (s *Cluster) Node() string {
+	return s.config.Node
+}
+
+// Leader is the node that delivers the alerts, as far as this node
+// knows. It is empty until the first gossip round.
+func (s *Cluster) Leader() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.leader
+}
+
+// IsLeader says whether this node delivers the alerts.
+func (s *Cluster) IsLeader() bool {
+	return s.Leader() == s.config.Node
+}
+
+// Nodes lists the nodes that are alive, this one included.
+func (s *Cluster) Nodes() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.alive(s.now())
+}
+
+// alive must be called with the lock held.
+func (s *Cluster) alive(now time.Time) []string {
+	nodes := []string{s.config.Node}
+	for name, peer := range s.peers {
+		if now.Sub(peer.seen) < s.config.LeaseTTL {
+			nodes = append(nodes, name)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// clusterKey is how nodes refer to an event: by label, since ids are
+// handed out by each planner.
+func clusterKey(event *Event) string {
+	if event.Label != "" {
+		return event.Label
+	}
+	return event.UniqStr()
+}
+
+// observe records what the event just said about itself.
+func (s *Cluster) observe(event *Event, msg AlertMessage) {
+	key := clusterKey(event)
+	failing := msg.State == AlertFiring
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	result := s.local[key]
+	if result.Failing != failing || result.Since.IsZero() {
+		result.Since = s.now()
+	}
+	result.Failing = failing
+	result.Response = msg.Response
+	s.local[key] = result
+}
+
+// Run gossips with the peers every interval, until the context is
+// cancelled.
+func (s *Cluster) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.Gossip(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Gossip runs a single round: results are exchanged with every peer,
+// the leader is picked, and if this node leads, the alerts of the
+// cluster are sent to the alerter.
+func (s *Cluster) Gossip(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Interval)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, peer := range s.config.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := s.exchange(ctx, peer); err != nil {
+				log.Println("cluster: could not gossip with", peer+":", err)
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	s.elect()
+
+	if s.IsLeader() {
+		s.evaluate()
+	}
+}
+
+func (s *Cluster) gossip() clusterGossip {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	results := make(map[string]ClusterResult, len(s.local))
+	for key, result := range s.local {
+		results[key] = result
+	}
+
+	return clusterGossip{Node: s.config.Node, Results: results}
+}
+
+func (s *Cluster) merge(msg clusterGossip) {
+	if msg.Node == "" || msg.Node == s.config.Node {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.peers[msg.Node] = &clusterPeer{seen: s.now(), results: msg.Results}
+}
+
+// exchange sends our results to the peer, which answers with its own.
+func (s *Cluster) exchange(ctx context.Context, peer string) error {
+	body, err := json.Marshal(s.gossip())
+	if err != nil {
+		return err
+	}
+
+	endpoint := peer + DefaultClusterEndpoint + "gossip"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.config.Token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var answer clusterGossip
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxGossipSize)).Decode(&answer); err != nil {
+		return err
+	}
+
+	s.merge(answer)
+	return nil
+}
+
+func (s *Cluster) elect() {
+	var leader string
+
+	if s.config.LeaseFile != "" {
+		holder, err := s.acquireLease()
+		if err != nil {
+			log.Println("cluster: problem with lease:", err)
+		}
+		leader = holder
+	} else {
+		s.mux.Lock()
+		leader = s.alive(s.now())[0]
+		s.mux.Unlock()
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if leader != s.leader {
+		log.Println("cluster: leader of", s.config.Node, "is now", leader)
+
+		// a new leader starts over, and announces what is failing
+		// then; the alerts of the old one may be repeated
+		s.firing = make(map[string]bool)
+		s.leader = leader
+	}
+}
+
+type clusterLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// acquireLease takes (or renews) the lease if it is free or ours, and
+// returns who holds it. Two nodes writing at the same time both read
+// the file back, and only the one that was written last leads.
+func (s *Cluster) acquireLease() (string, error) {
+	now := s.now()
+
+	lease, err := readLease(s.config.LeaseFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if lease.Holder != "" && lease.Holder != s.config.Node && now.Before(lease.Expires) {
+		return lease.Holder, nil
+	}
+
+	lease = clusterLease{Holder: s.config.Node, Expires: now.Add(s.config.LeaseTTL)}
+	if err := writeLease(s.config.LeaseFile, lease); err != nil {
+		return "", err
+	}
+
+	lease, err = readLease(s.config.LeaseFile)
+	return lease.Holder, err
+}
+
+func readLease(path string) (clusterLease, error) {
+	var lease clusterLease
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return lease, err
+	}
+
+	err = json.Unmarshal(data, &lease)
+	return lease, err
+}
+
+func writeLease(path string, lease clusterLease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// ClusterCheck is how an event fares across the cluster.
+type ClusterCheck struct {
+	Failing []string `json:"failing"`
+	Nodes   int      `json:"nodes"`
+	Firing  bool     `json:"firing"`
+}
+
+// Checks reports every event any live node knows about, by label.
+func (s *Cluster) Checks() map[string]ClusterCheck {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.checks(s.now())
+}
+
+// checks must be called with the lock held.
+func (s *Cluster) checks(now time.Time) map[string]ClusterCheck {
+	nodes := s.alive(now)
+	ret := make(map[string]ClusterCheck)
+
+	for _, node := range nodes {
+		results := s.local
+		if node != s.config.Node {
+			results = s.peers[node].results
+		}
+
+		for key, result := range results {
+			check := ret[key]
+			check.Nodes = len(nodes)
+			if result.Failing {
+				check.Failing = append(check.Failing, node)
+			}
+			ret[key] = check
+		}
+	}
+
+	quorum := s.quorum(len(nodes))
+	for key, check := range ret {
+		check.Firing = len(check.Failing) >= quorum
+		ret[key] = check
+	}
+
+	return ret
+}
+
+func (s *Cluster) quorum(nodes int) int {
+	quorum := s.config.Quorum
+	if quorum == 0 {
+		quorum = nodes/2 + 1
+	}
+	if quorum > nodes {
+		quorum = nodes
+	}
+	return quorum
+}
+
+// response picks what to tell about a failing event: ours if we see it
+// failing, or else what the first failing node said.
+func (s *Cluster) response(key string, check ClusterCheck) interface{} {
+	if result := s.local[key]; result.Failing {
+		return result.Response
+	}
+
+	for _, node := range check.Failing {
+		if peer, ok := s.peers[node]; ok {
+			return peer.results[key].Response
+		}
+	}
+
+	return nil
+}
+
+// evaluate sends the alerter whatever changed across the cluster since
+// the last round.
+func (s *Cluster) evaluate() {
+	if s.planner == nil || s.planner.alerter == nil {
+		return
+	}
+
+	var messages []AlertMessage
+
+	s.mux.Lock()
+	for key, check := range s.checks(s.now()) {
+		if check.Firing == s.firing[key] {
+			continue
+		}
+
+		summary := fmt.Sprintf("failing from %d of %d locations", len(check.Failing), check.Nodes)
+		if len(check.Failing) > 0 {
+			summary += " (" + strings.Join(check.Failing, ", ") + ")"
+		}
+
+		msg := AlertMessage{
+			Response:  summary,
+			State:     AlertOK,
+			Label:     key,
+			Locations: check.Failing,
+			Nodes:     check.Nodes,
+		}
+		if check.Firing {
+			msg.State = AlertFiring
+			msg.Response = fmt.Sprintf("%s: %v", summary, s.response(key, check))
+		}
+		messages = append(messages, msg)
+	}
+	s.mux.Unlock()
+
+	for _, msg := range messages {
+		key := msg.Label
+
+		event := s.planner.eventByLabel(key)
+		if event == nil {
+			// the event is only known to the other nodes
+			s.setFiring(key, msg.State == AlertFiring)
+			continue
+		}
+
+		// a muted check stays resolved as far as the cluster is
+		// concerned, so that it fires if it is still failing once the
+		// mute is over
+		if msg.State == AlertFiring {
+			if reason, muted := s.planner.Muted(event); muted {
+				log.Println("alert of", event.UniqStr(), "muted:", reason)
+				continue
+			}
+		}
+
+		msg.Now = s.now().Format(time.RFC3339)
+		msg.CynicHostname = currentHost()
+		msg.EventID = event.ID()
+		msg.Label = event.Label
+
+		s.planner.alerter.Ch <- msg
+		s.setFiring(key, msg.State == AlertFiring)
+	}
+}
+
+func (s *Cluster) setFiring(key string, firing bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.firing[key] = firing
+}
+
+// eventByLabel finds the event a cluster key refers to.
+func (s *Planner) eventByLabel(key string) *Event {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, event := range s.uniqueEvents {
+		if !event.IsDeleted() && clusterKey(event) == key {
+			return event
+		}
+	}
+	return nil
+}
+
+// ServeHTTP answers the gossip of the peers, and describes the cluster
+// on GET.
+func (s *Cluster) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rest := req.URL.Path
+	if i := strings.Index(rest, DefaultClusterEndpoint); i >= 0 {
+		rest = rest[i+len(DefaultClusterEndpoint):]
+	}
+
+	switch {
+	case rest == "gossip" && req.Method == http.MethodPost:
+		if !bearerAuthorized(w, req, []byte(s.config.Token)) {
+			return
+		}
+
+		var msg clusterGossip
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxGossipSize)).Decode(&msg); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad gossip: "+err.Error())
+			return
+		}
+
+		s.merge(msg)
+		writeJSON(w, http.StatusOK, s.gossip())
+
+	case rest == "" && req.Method == http.MethodGet:
+		s.mux.Lock()
+		now := s.now()
+		state := struct {
+			Node   string                  `json:"node"`
+			Leader string                  `json:"leader"`
+			Nodes  []string                `json:"nodes"`
+			Checks map[string]ClusterCheck `json:"checks"`
+		}{s.config.Node, s.leader, s.alive(now), s.checks(now)}
+		s.mux.Unlock()
+
+		writeJSON(w, http.StatusOK, state)
+
+	case rest == "" || rest == "gossip":
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCron is returned when a cron expression can not be
+// parsed.
+var ErrInvalidCron = errors.New("invalid cron expression")
+
+// cronBound describes the allowed values of a single cron field.
+type cronBound struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronSeconds = cronBound{0, 59, nil}
+	cronMinutes = cronBound{0, 59, nil}
+	cronHours   = cronBound{0, 23, nil}
+	cronDom     = cronBound{1, 31, nil}
+	cronMonths  = cronBound{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronBound{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// CronSchedule is a parsed cron expression. It answers the question
+// "when is the next time this should run?", in wall clock time.
+type CronSchedule struct {
+	expr string
+	loc  *time.Location
+
+	second, minute, hour, dom, month, dow uint64
+
+	// if either of the day fields is a wildcard, both have to
+	// match. Otherwise matching any of the two is enough, like
+	// in good old crontab.
+	domStar, dowStar bool
+}
+
+// CronParse parses a cron expression. Both the classic 5 field form
+// (minute hour day-of-month month day-of-week) and the 6 field form
+// with leading seconds are supported, as well as the usual
+// descriptors (@hourly, @daily, ...). The expression may be prefixed
+// with TZ=<zone> or CRON_TZ=<zone>, which overrides loc. A nil loc
+// means local time.
+func CronParse(expr string, loc *time.Location) (*CronSchedule, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	spec := strings.TrimSpace(expr)
+	if strings.HasPrefix(spec, "TZ=") || strings.HasPrefix(spec, "CRON_TZ=") {
+		parts := strings.SplitN(spec, " ", 2)
+		zone := parts[0][strings.Index(parts[0], "=")+1:]
+
+		var err error
+		loc, err = time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad timezone %q: %v", ErrInvalidCron, zone, err)
+		}
+
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%w: missing fields after timezone", ErrInvalidCron)
+		}
+		spec = strings.TrimSpace(parts[1])
+	}
+
+	if desc, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = desc
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("%w: expected 5 or 6 fields, got %d", ErrInvalidCron, len(fields))
+	}
+
+	sched := &CronSchedule{expr: expr, loc: loc}
+
+	var err error
+	if sched.second, err = parseCronField(fields[0], cronSeconds); err != nil {
+		return nil, err
+	}
+	if sched.minute, err = parseCronField(fields[1], cronMinutes); err != nil {
+		return nil, err
+	}
+	if sched.hour, err = parseCronField(fields[2], cronHours); err != nil {
+		return nil, err
+	}
+	if sched.dom, err = parseCronField(fields[3], cronDom); err != nil {
+		return nil, err
+	}
+	if sched.month, err = parseCronField(fields[4], cronMonths); err != nil {
+		return nil, err
+	}
+	if sched.dow, err = parseCronField(fields[5], cronDow); err != nil {
+		return nil, err
+	}
+
+	// 7 is sunday too
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+
+	sched.domStar = isCronWildcard(fields[3])
+	sched.dowStar = isCronWildcard(fields[5])
+
+	return sched, nil
+}
+
+func isCronWildcard(field string) bool {
+	return field == "*" || field == "?"
+}
+
+func parseCronField(field string, bound cronBound) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		rng := part
+
+		if ix := strings.Index(part, "/"); ix >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[ix+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("%w: bad step in %q", ErrInvalidCron, part)
+			}
+			rng = part[:ix]
+		}
+
+		var lo, hi int
+		switch {
+		case isCronWildcard(rng):
+			lo, hi = bound.min, bound.max
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+
+			var err error
+			if lo, err = cronValue(bounds[0], bound); err != nil {
+				return 0, err
+			}
+			if hi, err = cronValue(bounds[1], bound); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if lo, err = cronValue(rng, bound); err != nil {
+				return 0, err
+			}
+			hi = lo
+
+			// "5/10" means from 5 up to the max, every 10
+			if strings.Contains(part, "/") {
+				hi = bound.max
+			}
+		}
+
+		if lo > hi {
+			return 0, fmt.Errorf("%w: range %q is backwards", ErrInvalidCron, rng)
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+func cronValue(str string, bound cronBound) (int, error) {
+	if val, ok := bound.names[strings.ToLower(str)]; ok {
+		return val, nil
+	}
+
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad value %q", ErrInvalidCron, str)
+	}
+
+	if val < bound.min || val > bound.max {
+		return 0, fmt.Errorf("%w: value %d out of range [%d, %d]",
+			ErrInvalidCron, val, bound.min, bound.max)
+	}
+
+	return val, nil
+}
+
+func cronHas(bits uint64, val int) bool {
+	return bits&(1<<uint(val)) != 0
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := cronHas(s.dom, t.Day())
+	dowMatch := cronHas(s.dow, int(t.Weekday()))
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
+
+// Next returns the first time strictly after t that matches the
+// schedule. A zero time is returned if nothing matches within the
+// next five years (think 30th of February).
+//
+// Around daylight saving changes, it goes by the clocks of the
+// location: times that happen twice (when clocks fall back) match
+// twice, and times that are skipped (when clocks spring forward) match
+// once, at the end of the gap, as crontab does.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	// the schedule is searched in wall clock time, which is what UTC
+	// is without any daylight saving. The search starts at the
+	// earliest wall time t may have, since it may come again.
+	_, before := t.Add(-24 * time.Hour).In(s.loc).Zone()
+	_, after := t.Add(24 * time.Hour).In(s.loc).Zone()
+	wall := time.Unix(t.Unix(), 0).UTC().
+		Add(time.Duration(min(before, after)) * time.Second).
+		Add(-time.Second)
+
+	var best, bestWall time.Time
+	for {
+		wall = s.nextWall(wall)
+		if wall.IsZero() || (!best.IsZero() && wall.Sub(bestWall) > cronMaxShift) {
+			return best
+		}
+
+		instants, shifting := cronInstants(wall, s.loc)
+		for _, at := range instants {
+			if at.After(t) && (best.IsZero() || at.Before(best)) {
+				best, bestWall = at, wall
+			}
+		}
+
+		// away from daylight saving changes, wall times are in the
+		// same order as the times they show
+		if !best.IsZero() && !shifting {
+			return best
+		}
+	}
+}
+
+// cronMaxShift is the most clocks move by on a daylight saving change.
+const cronMaxShift = 3 * time.Hour
+
+// cronInstants gives the times at which clocks in the location show
+// the wall time (in UTC): none but the end of the gap if it is
+// skipped, two if it happens twice. It also says whether the clocks
+// change within a day of it.
+func cronInstants(wall time.Time, loc *time.Location) ([]time.Time, bool) {
+	_, before := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := wall.Add(24 * time.Hour).In(loc).Zone()
+
+	var ret []time.Time
+	for _, offset := range []int{before, after} {
+		at := wall.Add(-time.Duration(offset) * time.Second)
+
+		local := at.In(loc)
+		shown := time.Date(local.Year(), local.Month(), local.Day(),
+			local.Hour(), local.Minute(), local.Second(), 0, time.UTC)
+		if !shown.Equal(wall) || (len(ret) > 0 && ret[0].Equal(at)) {
+			continue
+		}
+		ret = append(ret, at)
+	}
+
+	if len(ret) == 0 {
+		// skipped: the clocks jumped over it, at the end of the zone
+		// that was in effect before
+		earliest := wall.Add(-time.Duration(max(before, after)) * time.Second)
+		_, end := earliest.In(loc).ZoneBounds()
+		ret = append(ret, end)
+	}
+
+	return ret, before != after
+}
+
+// nextWall is the first wall clock time (in UTC) strictly after t that
+// matches the schedule, or zero.
+func (s *CronSchedule) nextWall(t time.Time) time.Time {
+	loc := time.UTC
+	t = t.Add(time.Second)
+
+	yearLimit := t.Year() + 5
+
+wrap:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for !cronHas(s.month, int(t.Month())) {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !s.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for !cronHas(s.hour, t.Hour()) {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc).Add(time.Hour)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for !cronHas(s.minute, t.Minute()) {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	for !cronHas(s.second, t.Second()) {
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto wrap
+		}
+	}
+
+	return t
+}
+
+// Location returns the timezone the schedule is evaluated in.
+func (s *CronSchedule) Location() *time.Location {
+	return s.loc
+}
+
+func (s *CronSchedule) String() string {
+	return s.expr
+}
@@ -0,0 +1,440 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultDashboardEndpoint is where the dashboard is served on the
+// status server.
+const DefaultDashboardEndpoint = "/dashboard/"
+
+// DashboardRefresh is how often the dashboard pushes fresh tiles to
+// the browsers watching it.
+var DashboardRefresh = 5 * time.Second
+
+const (
+	dashboardStreamPath = "stream"
+	sparklineWidth      = 120
+	sparklineHeight     = 28
+	sparklinePoints     = 60
+	maxAlertResponse    = 200
+	maxDashboardAlerts  = 15
+)
+
+// Dashboard is an html page showing how every event is doing, meant to
+// be left open on a wall display. It keeps itself up to date through
+// server sent events.
+type Dashboard struct {
+	planner *Planner
+	status  *StatusCache
+	alerter *Alerter
+	done    <-chan struct{}
+}
+
+// DashboardNew creates a dashboard for the events of the planner. The
+// status cache and the alerter are optional: with them, tiles get
+// sparklines of their history, and recent alerts are shown.
+func DashboardNew(planner *Planner, status *StatusCache, alerter *Alerter) *Dashboard {
+	dashboard := &Dashboard{
+		planner: planner,
+		status:  status,
+		alerter: alerter,
+	}
+
+	if status != nil {
+		dashboard.done = status.stopCh
+	}
+
+	return dashboard
+}
+
+type dashboardTile struct {
+	ID        uint64
+	Name      string
+	Key       string
+	State     string
+	LastRun   string
+	NextRun   string
+	Muted     string
+	Sparkline string
+}
+
+type dashboardAlert struct {
+	Time     string
+	Event    string
+	State    string
+	Response string
+}
+
+type dashboardPage struct {
+	Title      string
+	Generated  string
+	StatusRoot string
+	Stream     string
+	Tiles      []dashboardTile
+	Alerts     []dashboardAlert
+	Failing    int
+}
+
+func (s *Dashboard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/"+dashboardStreamPath) {
+		s.stream(w, req)
+		return
+	}
+
+	page := s.page(time.Now())
+	page.Stream = strings.TrimSuffix(req.URL.Path, "/") + "/" + dashboardStreamPath
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.ExecuteTemplate(w, "page", page); err != nil {
+		log.Println("problem rendering dashboard:", err)
+	}
+}
+
+// stream sends the board as a server sent event, every
+// DashboardRefresh, until the browser goes away or the server stops.
+func (s *Dashboard) stream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// the server write timeout would cut the stream otherwise
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Println("could not lift write deadline of dashboard stream:", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(DashboardRefresh)
+	defer ticker.Stop()
+
+	for {
+		var board bytes.Buffer
+		if err := dashboardTemplate.ExecuteTemplate(&board, "board", s.page(time.Now())); err != nil {
+			log.Println("problem rendering dashboard:", err)
+			return
+		}
+
+		if err := writeServerEvent(w, "", "board", board.String()); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeServerEvent writes one server sent event. Multi line data is
+// split in as many data fields.
+func writeServerEvent(w http.ResponseWriter, id, event, data string) error {
+	var builder strings.Builder
+
+	if id != "" {
+		fmt.Fprintf(&builder, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(&builder, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&builder, "data: %s\n", line)
+	}
+	builder.WriteString("\n")
+
+	_, err := w.Write([]byte(builder.String()))
+	return err
+}
+
+func (s *Dashboard) page(now time.Time) dashboardPage {
+	page := dashboardPage{
+		Title:     "cynic@" + currentHost(),
+		Generated: now.Format(time.RFC1123),
+	}
+
+	if s.status != nil {
+		page.StatusRoot = s.status.root
+	}
+
+	for _, info := range s.planner.Events() {
+		tile := dashboardTile{
+			ID:      info.ID,
+			Name:    info.Label,
+			Key:     eventKey(info),
+			State:   s.state(info),
+			LastRun: humanAge(now, info.LastRun),
+			NextRun: humanIn(now, info.NextRun),
+			Muted:   info.Muted,
+		}
+
+		if tile.Name == "" {
+			tile.Name = tile.Key
+		}
+
+		tile.Sparkline = s.sparkline(tile.Key)
+
+		if tile.State == string(AlertFiring) || tile.State == string(AlertFlapping) {
+			page.Failing++
+		}
+
+		page.Tiles = append(page.Tiles, tile)
+	}
+
+	if s.alerter != nil {
+		for i, alert := range s.alerter.RecentAlerts() {
+			if i >= maxDashboardAlerts {
+				break
+			}
+
+			response := fmt.Sprint(alert.Response)
+			if len(response) > maxAlertResponse {
+				cut := maxAlertResponse
+				for cut > 0 && !utf8.RuneStart(response[cut]) {
+					cut--
+				}
+				response = response[:cut] + "..."
+			}
+
+			event := alert.Label
+			if event == "" && alert.EventID != 0 {
+				event = fmt.Sprint(alert.EventID)
+			}
+
+			page.Alerts = append(page.Alerts, dashboardAlert{
+				Time:     alert.Now,
+				Event:    event,
+				State:    string(alert.State),
+				Response: response,
+			})
+		}
+	}
+
+	return page
+}
+
+func eventKey(info EventInfo) string {
+	if info.Label != "" {
+		return fmt.Sprintf("%s-%d", info.Label, info.ID)
+	}
+	return fmt.Sprintf("%d", info.ID)
+}
+
+// state is what the tile shows: paused, muted, pending (never ran), or
+// the alert state of the event.
+func (s *Dashboard) state(info EventInfo) string {
+	switch {
+	case info.Paused:
+		return "paused"
+	case info.Muted != "" && info.Failing:
+		return "muted"
+	case info.LastRun.IsZero():
+		return "pending"
+	case s.alerter != nil:
+		return string(s.alerter.State(info.ID))
+	case info.Failing:
+		return string(AlertFiring)
+	}
+
+	return string(AlertOK)
+}
+
+// sparkline gives the points of an svg polyline of the recent numeric
+// history of the key. Check results are plotted by their latency.
+func (s *Dashboard) sparkline(key string) string {
+	if s.status == nil || s.status.history == nil {
+		return ""
+	}
+
+	points, err := s.status.History(key, HistoryQuery{})
+	if err != nil || len(points) == 0 {
+		return ""
+	}
+
+	if _, ok := toFloat(points[0].Value); !ok {
+		points, err = s.status.History(key, HistoryQuery{Path: "$.latency_ms"})
+		if err != nil {
+			return ""
+		}
+	}
+
+	var values []float64
+	for _, point := range points {
+		if number, ok := toFloat(point.Value); ok {
+			values = append(values, number)
+		}
+	}
+
+	if len(values) < 2 {
+		return ""
+	}
+	if len(values) > sparklinePoints {
+		values = values[len(values)-sparklinePoints:]
+	}
+
+	low, high := values[0], values[0]
+	for _, value := range values {
+		low = min(low, value)
+		high = max(high, value)
+	}
+
+	spread := high - low
+	if spread == 0 {
+		spread = 1
+	}
+
+	coords := make([]string, len(values))
+	for i, value := range values {
+		x := float64(i) * sparklineWidth / float64(len(values)-1)
+		y := sparklineHeight - (value-low)/spread*sparklineHeight
+		coords[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+
+	return strings.Join(coords, " ")
+}
+
+func humanAge(now, then time.Time) string {
+	if then.IsZero() {
+		return "never"
+	}
+	return humanDuration(now.Sub(then)) + " ago"
+}
+
+func humanIn(now, then time.Time) string {
+	if then.IsZero() {
+		return "not scheduled"
+	}
+
+	if !then.After(now) {
+		return "now"
+	}
+	return "in " + humanDuration(then.Sub(now))
+}
+
+func humanDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`
+{{define "page"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { background: #111; color: #ddd; font-family: sans-serif; margin: 1em; }
+h1 { font-size: 1.4em; }
+a { color: inherit; }
+.tiles { display: grid; grid-template-columns: repeat(auto-fill, minmax(14em, 1fr)); gap: .8em; }
+.tile { border-radius: .4em; padding: .8em; background: #2a2a2a; border-left: .5em solid #666; }
+.tile h2 { font-size: 1.1em; margin: 0 0 .4em 0; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+.tile .meta { font-size: .8em; color: #aaa; }
+.tile svg { display: block; margin-top: .4em; }
+.tile polyline { fill: none; stroke: #8cf; stroke-width: 1.5; }
+.ok { border-left-color: #3c3; }
+.firing { border-left-color: #e33; background: #3a1e1e; }
+.flapping { border-left-color: #fa0; background: #3a2e1a; }
+.paused { border-left-color: #68a; }
+.muted { border-left-color: #a6c; }
+.pending { border-left-color: #666; }
+table { border-collapse: collapse; width: 100%; font-size: .85em; margin-top: .5em; }
+td, th { text-align: left; padding: .3em .6em; border-bottom: 1px solid #333; }
+.state { font-weight: bold; text-transform: uppercase; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div id="board">{{template "board" .}}</div>
+<script>
+(function () {
+  if (!window.EventSource) { setTimeout(function () { location.reload(); }, 30000); return; }
+  var source = new EventSource({{.Stream}});
+  source.addEventListener("board", function (e) {
+    document.getElementById("board").innerHTML = e.data;
+  });
+})();
+</script>
+</body>
+</html>
+{{end}}
+
+{{define "board"}}
+<p class="meta">{{len .Tiles}} events, {{.Failing}} failing. Updated {{.Generated}}.</p>
+{{if .Tiles}}
+<div class="tiles">
+{{range .Tiles}}
+  <div class="tile {{.State}}">
+    <h2>{{if $.StatusRoot}}<a href="{{$.StatusRoot}}{{.Key}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</h2>
+    <div class="state">{{.State}}</div>
+    <div class="meta">ran {{.LastRun}}, next {{.NextRun}}</div>
+    {{if .Muted}}<div class="meta">{{.Muted}}</div>{{end}}
+    {{if .Sparkline}}<svg width="120" height="28" viewBox="0 0 120 28"><polyline points="{{.Sparkline}}"/></svg>{{end}}
+  </div>
+{{end}}
+</div>
+{{else}}
+<p>No events are scheduled.</p>
+{{end}}
+
+<h1>Recent alerts</h1>
+{{if .Alerts}}
+<table>
+<tr><th>When</th><th>Event</th><th>State</th><th>Response</th></tr>
+{{range .Alerts}}
+<tr><td>{{.Time}}</td><td>{{.Event}}</td><td class="state {{.State}}">{{.State}}</td><td>{{.Response}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>Nothing to report.</p>
+{{end}}
+{{end}}
+`))
+
+var linksTemplate = template.Must(template.New("links").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>cynic</title></head><body>
+{{if .Keys}}<h1>Links to services</h1>
+<ul>
+{{range .Keys}}<li><a href="{{$.Root}}{{.}}" target="_blank">{{.}}</a></li>
+{{end}}</ul>
+{{else}}<h1>No links here yet.</h1>
+{{end}}</body></html>
+`))
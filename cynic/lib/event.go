@@ -18,6 +18,7 @@ limitations under the License.
 package cynic
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -49,6 +50,14 @@ type HookParameters struct {
 	// Extra is meant to be used by the user for any extra state
 	// that needs to be passed to the hooks.
 	Extra interface{}
+
+	// Event is the event the hook belongs to.
+	Event *Event
+
+	// Context is cancelled when the hook exceeds the timeout of
+	// its event, or when the planner is shutting down. Long
+	// running hooks (eg: http requests) should respect it.
+	Context context.Context
 }
 
 // HookSignature specifies what the event hooks should look like.
@@ -68,14 +77,29 @@ type Event struct {
 	immediate bool
 	offset    int
 	repeat    bool
+	cron      *CronSchedule
 	Label     string
 	planner   *Planner
 
 	repo *StatusCache
 
+	timeout time.Duration
+	retry   RetryPolicy
+	running int32
+	failing int32
+	paused  int32
+	deleted int32
+	lastRun int64
+
 	index    int
 	priority int
-	deleted  bool
+
+	tags      []string
+	dependsOn []string
+
+	// onDelete cleans up after the event, the first time it is
+	// deleted
+	onDelete func()
 
 	extra interface{}
 }
@@ -92,7 +116,9 @@ func EventNew(secs int) Event {
 	hooks := make([]HookSignature, 0)
 	id := atomic.AddUint64(&lastID, 1)
 
-	priority := secs + int(time.Now().Unix())
+	// the planner sets the actual expiry when the event is added;
+	// until then, events sort by their period
+	priority := secs
 
 	return Event{
 		secs:      secs,
@@ -102,7 +128,6 @@ func EventNew(secs int) Event {
 		repeat:    false,
 		id:        id,
 		priority:  priority,
-		deleted:   false,
 
 		Label:   "",
 		planner: nil,
@@ -112,6 +137,35 @@ func EventNew(secs int) Event {
 	}
 }
 
+// EventCronNew creates a new event that fires on the wall clock
+// times described by the cron expression (see CronParse), evaluated in
+// the given location. Cron events are always repeating.
+func EventCronNew(expr string, loc *time.Location) (Event, error) {
+	sched, err := CronParse(expr, loc)
+	if err != nil {
+		return Event{}, err
+	}
+
+	id := atomic.AddUint64(&lastID, 1)
+
+	return Event{
+		secs:      0,
+		hooks:     make([]HookSignature, 0),
+		immediate: false,
+		offset:    0,
+		repeat:    true,
+		cron:      sched,
+		id:        id,
+		priority:  0,
+
+		Label:   "",
+		planner: nil,
+		repo:    nil,
+		index:   0,
+		extra:   nil,
+	}, nil
+}
+
 // AddHook appends a hook to the event.
 func (s *Event) AddHook(fn HookSignature) {
 	s.hooks = append(s.hooks, fn)
@@ -181,6 +235,40 @@ func (s *Event) UniqStr() string {
 	return ret
 }
 
+// GetCron returns the cron schedule of the event, or nil if the event
+// is not cron based.
+func (s *Event) GetCron() *CronSchedule {
+	return s.cron
+}
+
+// IsCron says whether the event follows a cron schedule.
+func (s *Event) IsCron() bool {
+	return s.cron != nil
+}
+
+// SetTimeout sets the maximum time each hook of the event may take. A
+// hook exceeding it is reported to the alerter, and the event moves
+// on. Zero means no timeout.
+func (s *Event) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// GetTimeout returns the per hook timeout of the event.
+func (s *Event) GetTimeout() time.Duration {
+	return s.timeout
+}
+
+// SetRetryPolicy sets how failing hooks of this event are retried
+// before alerting.
+func (s *Event) SetRetryPolicy(policy RetryPolicy) {
+	s.retry = policy
+}
+
+// GetRetryPolicy returns the retry policy of the event.
+func (s *Event) GetRetryPolicy() RetryPolicy {
+	return s.retry
+}
+
 // SetDataRepo sets where the data processed should be stored in.
 func (s *Event) SetDataRepo(repo *StatusCache) {
 	s.repo = repo
@@ -188,15 +276,217 @@ func (s *Event) SetDataRepo(repo *StatusCache) {
 
 // Execute the event.
 func (s *Event) Execute() {
-	for _, hook := range s.hooks {
-		ok, result := hook(&HookParameters{
-			s.planner,
-			s.repo,
-			s.extra,
+	s.ExecuteContext(context.Background())
+}
+
+// ExecuteContext executes the event, passing the context down to the
+// hooks. Failing hooks are retried according to the retry policy of
+// the event, and only alert once all attempts are exhausted.
+func (s *Event) ExecuteContext(ctx context.Context) {
+	failed := false
+	for ix, hook := range s.hooks {
+		if s.executeHook(ctx, ix, hook) {
+			failed = true
+		}
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	now := s.now()
+	atomic.StoreInt64(&s.lastRun, now.UnixNano())
+
+	if metrics := s.metrics(); metrics != nil {
+		metrics.observeExecution(s.UniqStr(), failed, now)
+	}
+
+	if failed {
+		atomic.StoreInt32(&s.failing, 1)
+		return
+	}
+
+	// let the alerter know that this event is fine again
+	if atomic.SwapInt32(&s.failing, 0) == 1 {
+		s.sendAlert(AlertMessage{
+			Response: fmt.Sprintf("event %s recovered", s.UniqStr()),
+			State:    AlertOK,
 		})
+	}
+}
+
+type hookResult struct {
+	alert  bool
+	result interface{}
+}
+
+// executeHook runs the hook, retrying as needed. Returns true if the
+// hook ended up failing.
+func (s *Event) executeHook(ctx context.Context, ix int, hook HookSignature) bool {
+	attempts := s.retry.Attempts()
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		res, timedOut := s.callHook(ctx, hook)
+		if metrics := s.metrics(); metrics != nil {
+			metrics.observeLatency(s.UniqStr(), time.Since(start))
+		}
+		if ctx.Err() != nil {
+			// planner shutting down; not the hook's fault
+			return false
+		}
+
+		if !res.alert && !timedOut {
+			return false
+		}
+
+		if attempt >= attempts {
+			msg := AlertMessage{
+				Response: res.result,
+				Attempts: attempt,
+				State:    AlertFiring,
+			}
+
+			if timedOut {
+				log.Println("hook", ix, "of event", s.UniqStr(), "timed out after", s.timeout)
+				msg.Response = fmt.Sprintf("hook %d of event %s timed out after %v", ix, s.UniqStr(), s.timeout)
+				msg.TimedOut = true
+			}
+
+			s.sendAlert(msg)
+			return true
+		}
+
+		if !sleepContext(ctx, s.clock(), s.retry.Backoff(attempt)) {
+			return false
+		}
+	}
+}
+
+// callHook runs the hook once, enforcing the timeout of the event if
+// there is one.
+func (s *Event) callHook(ctx context.Context, hook HookSignature) (hookResult, bool) {
+	if s.timeout <= 0 {
+		alert, result := hook(s.hookParameters(ctx))
+		return hookResult{alert, result}, false
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	// buffered, so that a hook that ignores its context can still
+	// finish and go away on its own
+	resultCh := make(chan hookResult, 1)
+	go func() {
+		alert, result := hook(s.hookParameters(hookCtx))
+		resultCh <- hookResult{alert, result}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res, false
+	case <-hookCtx.Done():
+		return hookResult{}, true
+	}
+}
+
+func (s *Event) metrics() *Metrics {
+	if s.planner == nil {
+		return nil
+	}
+	return s.planner.metrics
+}
+
+func (s *Event) hookParameters(ctx context.Context) *HookParameters {
+	return &HookParameters{
+		Planner: s.planner,
+		Status:  s.repo,
+		Extra:   s.extra,
+		Event:   s,
+		Context: ctx,
+	}
+}
 
-		s.maybeAlert(ok, result)
+// Pause stops the hooks of the event from executing, while keeping it
+// on its schedule.
+func (s *Event) Pause() {
+	atomic.StoreInt32(&s.paused, 1)
+}
+
+// Resume lets a paused event execute again.
+func (s *Event) Resume() {
+	atomic.StoreInt32(&s.paused, 0)
+}
+
+// IsPaused says whether the event is paused.
+func (s *Event) IsPaused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
+// IsFailing says whether the last execution of the event ended in an
+// alert.
+func (s *Event) IsFailing() bool {
+	return atomic.LoadInt32(&s.failing) == 1
+}
+
+// SetTags replaces the tags of the event. Maintenance windows can
+// match events by tag.
+func (s *Event) SetTags(tags ...string) {
+	s.tags = append([]string(nil), tags...)
+}
+
+// Tags returns the tags of the event.
+func (s *Event) Tags() []string {
+	return s.tags
+}
+
+// HasTag says whether the event is tagged with tag.
+func (s *Event) HasTag(tag string) bool {
+	for _, t := range s.tags {
+		if t == tag {
+			return true
+		}
 	}
+	return false
+}
+
+// DependsOn declares that the event relies on the events with the
+// given labels: while any of them is failing, the alerts of this event
+// are muted. Its hooks still run, and still report to the status
+// cache.
+func (s *Event) DependsOn(labels ...string) {
+	s.dependsOn = append(s.dependsOn, labels...)
+}
+
+// Dependencies returns the labels of the events this event depends
+// on.
+func (s *Event) Dependencies() []string {
+	return s.dependsOn
+}
+
+// LastRun is when the event last finished executing, or the zero time
+// if it never did.
+func (s *Event) LastRun() time.Time {
+	nanos := atomic.LoadInt64(&s.lastRun)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// IsRunning says whether the hooks of the event are executing right
+// now.
+func (s *Event) IsRunning() bool {
+	return atomic.LoadInt32(&s.running) == 1
+}
+
+// tryRun marks the event as running. Returns false if it already was.
+func (s *Event) tryRun() bool {
+	return atomic.CompareAndSwapInt32(&s.running, 0, 1)
+}
+
+func (s *Event) doneRun() {
+	atomic.StoreInt32(&s.running, 0)
 }
 
 // SetAbsExpiry sets the timestamp that the event is supposed to
@@ -212,8 +502,9 @@ func (s *Event) GetAbsExpiry() int64 {
 
 func (s *Event) String() string {
 	return fmt.Sprintf(
-		"Event<secs:%d hooks:%v immediate:%t offset:%d repeat:%t label:%v id:%d repo:%v>",
+		"Event<secs:%d cron:%v hooks:%v immediate:%t offset:%d repeat:%t label:%v id:%d repo:%v>",
 		s.secs,
+		s.cron,
 		s.hooks,
 		s.immediate,
 		s.offset,
@@ -225,12 +516,14 @@ func (s *Event) String() string {
 
 // Delete marks event for deletion.
 func (s *Event) Delete() {
-	s.deleted = true
+	if atomic.SwapInt32(&s.deleted, 1) == 0 && s.onDelete != nil {
+		s.onDelete()
+	}
 }
 
 // IsDeleted returns if event is marked for deletion.
 func (s *Event) IsDeleted() bool {
-	return s.deleted
+	return atomic.LoadInt32(&s.deleted) == 1
 }
 
 // SetExtra state you may want passed to hooks.
@@ -242,16 +535,45 @@ func (s *Event) setPlanner(planner *Planner) {
 	s.planner = planner
 }
 
-func (s *Event) maybeAlert(shouldAlert bool, result interface{}) {
-	if !shouldAlert || s.planner == nil || s.planner.alerter == nil {
+// clock is the clock of the planner of the event.
+func (s *Event) clock() Clock {
+	if s.planner == nil {
+		return SystemClock
+	}
+	return s.planner.clock
+}
+
+// now is the time on the clock of the planner of the event.
+func (s *Event) now() time.Time {
+	return s.clock().Now()
+}
+
+func (s *Event) sendAlert(msg AlertMessage) {
+	if s.planner == nil {
+		return
+	}
+
+	// in a cluster, the leader alerts once enough nodes agree
+	if s.planner.cluster != nil {
+		s.planner.cluster.observe(s, msg)
 		return
 	}
 
-	alerter := s.planner.alerter
+	if s.planner.alerter == nil {
+		return
+	}
 
-	alerter.Ch <- AlertMessage{
-		Response:      result,
-		Now:           time.Now().Format(time.RFC3339),
-		CynicHostname: currentHost(),
+	if msg.State == AlertFiring {
+		if reason, muted := s.planner.Muted(s); muted {
+			log.Println("alert of", s.UniqStr(), "muted:", reason)
+			return
+		}
 	}
+
+	msg.Now = s.now().Format(time.RFC3339)
+	msg.CynicHostname = currentHost()
+	msg.EventID = s.id
+	msg.Label = s.Label
+
+	s.planner.alerter.Ch <- msg
 }
@@ -0,0 +1,329 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEventsEndpoint is where the event api is mounted on the status
+// server.
+const DefaultEventsEndpoint = "/events/"
+
+// maxEventBodySize is the largest event definition the api accepts.
+const maxEventBodySize = 1 << 16
+
+// ErrNoAPIToken is returned when creating an event api without a
+// token. The api changes what cynic runs, so it is never left open.
+var ErrNoAPIToken = errors.New("the event api needs a token")
+
+// EventFactory creates an event out of the body of a request to add
+// one. The config package provides one that understands check
+// definitions.
+type EventFactory = func(data []byte) (*Event, error)
+
+// EventAPI is an http handler to inspect and change the events of a
+// running planner. Every request needs an "Authorization: Bearer
+// <token>" header. Mounted on root (eg: /events/) it serves:
+//
+//	GET    /events/             list the scheduled events
+//	POST   /events/             add an event (needs an EventFactory)
+//	GET    /events/{id}         describe an event
+//	DELETE /events/{id}         delete an event
+//	POST   /events/{id}/pause   stop executing an event
+//	POST   /events/{id}/resume  execute a paused event again
+//	POST   /events/{id}/trigger execute an event right now
+//	GET    /events/maintenance  list the maintenance windows
+//	POST   /events/maintenance  add a maintenance window, or silence
+//	DELETE /events/maintenance/{id} remove a maintenance window
+//
+// Maintenance windows are described as json:
+//
+//	{"tags": ["db"], "duration": "2h", "reason": "upgrade"}
+//	{"labels": ["web"], "start": "2021-03-10T02:00:00Z", "end": "2021-03-10T03:00:00Z"}
+//	{"cron": "0 2 * * sun", "timezone": "UTC", "duration": "1h"}
+type EventAPI struct {
+	planner *Planner
+	token   []byte
+	factory EventFactory
+	mux     *http.ServeMux
+}
+
+// EventAPINew creates the api for the planner, mounted on root.
+func EventAPINew(planner *Planner, root, token string) (*EventAPI, error) {
+	if token == "" {
+		return nil, ErrNoAPIToken
+	}
+
+	root = "/" + strings.Trim(root, "/") + "/"
+	if root == "//" {
+		root = "/"
+	}
+
+	api := &EventAPI{
+		planner: planner,
+		token:   []byte(token),
+		mux:     http.NewServeMux(),
+	}
+
+	api.mux.HandleFunc("GET "+root+"{$}", api.list)
+	api.mux.HandleFunc("POST "+root+"{$}", api.add)
+	api.mux.HandleFunc("GET "+root+"{id}", api.withEvent(api.get))
+	api.mux.HandleFunc("DELETE "+root+"{id}", api.withEvent(api.delete))
+	api.mux.HandleFunc("POST "+root+"{id}/pause", api.withEvent(api.pause))
+	api.mux.HandleFunc("POST "+root+"{id}/resume", api.withEvent(api.resume))
+	api.mux.HandleFunc("POST "+root+"{id}/trigger", api.withEvent(api.trigger))
+	api.mux.HandleFunc("GET "+root+"maintenance", api.listMaintenance)
+	api.mux.HandleFunc("POST "+root+"maintenance", api.addMaintenance)
+	api.mux.HandleFunc("DELETE "+root+"maintenance/{id}", api.removeMaintenance)
+
+	return api, nil
+}
+
+// SetEventFactory enables adding events through the api.
+func (s *EventAPI) SetEventFactory(factory EventFactory) {
+	s.factory = factory
+}
+
+func (s *EventAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !bearerAuthorized(w, req, s.token) {
+		return
+	}
+
+	s.mux.ServeHTTP(w, req)
+}
+
+// bearerAuthorized checks that the request carries the token, and
+// answers with a 401 if not.
+func bearerAuthorized(w http.ResponseWriter, req *http.Request, token []byte) bool {
+	given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(given), token) == 1 {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="cynic"`)
+	writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+	return false
+}
+
+func (s *EventAPI) list(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.planner.Events())
+}
+
+func (s *EventAPI) add(w http.ResponseWriter, req *http.Request) {
+	if s.factory == nil {
+		writeJSONError(w, http.StatusNotImplemented, "adding events is not enabled")
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxEventBodySize))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	event, err := s.factory(data)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.planner.Add(event)
+	log.Println("event added through api:", event.UniqStr())
+
+	info, _ := s.planner.Info(event.ID())
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *EventAPI) get(w http.ResponseWriter, _ *http.Request, event *Event) {
+	info, _ := s.planner.Info(event.ID())
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *EventAPI) delete(w http.ResponseWriter, _ *http.Request, event *Event) {
+	s.planner.DeleteID(event.ID())
+	log.Println("event deleted through api:", event.UniqStr())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *EventAPI) pause(w http.ResponseWriter, req *http.Request, event *Event) {
+	event.Pause()
+	log.Println("event paused through api:", event.UniqStr())
+	s.get(w, req, event)
+}
+
+func (s *EventAPI) resume(w http.ResponseWriter, req *http.Request, event *Event) {
+	event.Resume()
+	log.Println("event resumed through api:", event.UniqStr())
+	s.get(w, req, event)
+}
+
+func (s *EventAPI) trigger(w http.ResponseWriter, req *http.Request, event *Event) {
+	err := s.planner.Trigger(event.ID())
+	if errors.Is(err, ErrEventRunning) {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"triggered": event.UniqStr()})
+}
+
+func (s *EventAPI) listMaintenance(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.planner.Maintenance())
+}
+
+// maintenanceRequest describes a maintenance window to add.
+type maintenanceRequest struct {
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Duration string   `json:"duration"`
+	Cron     string   `json:"cron"`
+	Timezone string   `json:"timezone"`
+	Labels   []string `json:"labels"`
+	Tags     []string `json:"tags"`
+	Reason   string   `json:"reason"`
+}
+
+func (s *maintenanceRequest) window(now time.Time) (MaintenanceWindow, error) {
+	window := MaintenanceWindow{
+		Labels: s.Labels,
+		Tags:   s.Tags,
+		Reason: s.Reason,
+	}
+
+	var err error
+
+	if s.Duration != "" {
+		if window.Duration, err = time.ParseDuration(s.Duration); err != nil {
+			return window, fmt.Errorf("%w: %v", ErrBadMaintenance, err)
+		}
+	}
+
+	if s.Cron != "" {
+		loc := time.UTC
+		if s.Timezone != "" {
+			if loc, err = time.LoadLocation(s.Timezone); err != nil {
+				return window, fmt.Errorf("%w: %v", ErrBadMaintenance, err)
+			}
+		}
+
+		if window.Schedule, err = CronParse(s.Cron, loc); err != nil {
+			return window, fmt.Errorf("%w: %v", ErrBadMaintenance, err)
+		}
+		return window, nil
+	}
+
+	window.Start = now
+	if s.Start != "" {
+		if window.Start, err = time.Parse(time.RFC3339, s.Start); err != nil {
+			return window, fmt.Errorf("%w: %v", ErrBadMaintenance, err)
+		}
+	}
+
+	switch {
+	case s.End != "":
+		if window.End, err = time.Parse(time.RFC3339, s.End); err != nil {
+			return window, fmt.Errorf("%w: %v", ErrBadMaintenance, err)
+		}
+	default:
+		window.End = window.Start.Add(window.Duration)
+		window.Duration = 0
+	}
+
+	return window, nil
+}
+
+func (s *EventAPI) addMaintenance(w http.ResponseWriter, req *http.Request) {
+	var body maintenanceRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxEventBodySize)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	window, err := body.window(s.planner.now())
+	if err == nil {
+		window.ID, err = s.planner.AddMaintenance(window)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Println("maintenance window added through api:", window.ID, window.Reason)
+	writeJSON(w, http.StatusCreated, window)
+}
+
+func (s *EventAPI) removeMaintenance(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad maintenance id")
+		return
+	}
+
+	if !s.planner.RemoveMaintenance(id) {
+		writeJSONError(w, http.StatusNotFound, "no such maintenance window")
+		return
+	}
+
+	log.Println("maintenance window removed through api:", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *EventAPI) withEvent(fn func(http.ResponseWriter, *http.Request, *Event)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad event id")
+			return
+		}
+
+		event, ok := s.planner.Get(id)
+		if !ok || event.IsDeleted() {
+			writeJSONError(w, http.StatusNotFound, ErrEventNotFound.Error())
+			return
+		}
+
+		fn(w, req, event)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("problem writing json response:", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
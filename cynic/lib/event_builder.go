@@ -17,6 +17,33 @@ limitations under the License.
 */
 package cynic
 
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// ErrEventBuilder is wrapped by the errors Build returns.
+var ErrEventBuilder = errors.New("bad event builder")
+
+// GroupBy picks how the builder groups events, so that each group can
+// be distributed over its own window.
+type GroupBy int
+
+const (
+	// GroupNone distributes every event over the same window.
+	GroupNone GroupBy = iota
+
+	// GroupByLabel groups events that share a label.
+	GroupByLabel
+
+	// GroupByTag groups events by their first tag. Events without
+	// tags are in the "" group.
+	GroupByTag
+)
+
 type distributionParams struct {
 	maxTime int
 }
@@ -25,6 +52,10 @@ type distributionParams struct {
 // events. For example, if you have 10 events you want to run
 // within 100 seconds, you can use this builder in oder to disperse
 // everything over 10 seconds.
+//
+// Events can also be grouped (by label or tag), and each group spread
+// over a window of its own, nudged by some random jitter, staggered so
+// that few start in the same second, and aligned on the calendar.
 type EventBuilder struct {
 	events []Event
 
@@ -32,6 +63,14 @@ type EventBuilder struct {
 	allRepeatable  bool
 
 	distribution *distributionParams
+
+	groupBy GroupBy
+	windows map[string]int
+	jitter  int
+	stagger int
+	align   time.Duration
+
+	now func() time.Time
 }
 
 // EventBuilderNew creates a new events builder. Simple
@@ -43,59 +82,237 @@ func EventBuilderNew(events []Event) EventBuilder {
 		evenDistribute: false,
 		allRepeatable:  false,
 		distribution:   nil,
+		windows:        make(map[string]int),
+		now:            time.Now,
 	}
 }
 
 // Build takes all the things you gave the builder, puts them
 // together, and gives you a session object to do whatever you
-// will with it.
-func (s *EventBuilder) Build() (Session, bool) {
-	ret := s.makeRepeatable() && s.makeDistributeEvents()
+// will with it. Whatever is wrong with the configuration is
+// returned; the session is only usable if there are no errors.
+func (s *EventBuilder) Build() (Session, []error) {
+	errs := s.validate()
+
+	if len(errs) == 0 {
+		s.makeRepeatable()
+		s.makeDistributeEvents()
+		s.makeJitter()
+		s.makeAligned()
+		s.makeStaggerOffsets()
+	}
 
 	sess := Session{
 		Events:  s.events,
 		Alerter: nil,
 	}
 
-	return sess, ret
+	return sess, errs
 }
 
-// DistributeEvents over a max time interval.
+// DistributeEvents over a max time interval. With groups, this is the
+// window of the groups that do not have one of their own.
 func (s *EventBuilder) DistributeEvents(maxTime int) {
+	s.evenDistribute = true
 	s.distribution = &distributionParams{
 		maxTime: maxTime,
 	}
 }
 
-func (s *EventBuilder) makeDistributeEvents() bool {
-	if s.distribution == nil ||
-		s.distribution.maxTime <= 0 ||
+// GroupBy makes the builder distribute each group of events on its
+// own.
+func (s *EventBuilder) GroupBy(by GroupBy) {
+	s.groupBy = by
+}
+
+// GroupWindow distributes the events of a group over maxTime seconds,
+// instead of the window given to DistributeEvents.
+func (s *EventBuilder) GroupWindow(group string, maxTime int) {
+	s.windows[group] = maxTime
+}
+
+// Jitter delays each event by a random number of seconds, up to
+// maxSecs, so that instances sharing a configuration do not all run
+// the same event at the same time.
+func (s *EventBuilder) Jitter(maxSecs int) {
+	s.jitter = maxSecs
+}
+
+// StaggerOffsets spreads the offsets of the events, so that at most n
+// of them run for the first time within the same second; events over
+// that are pushed to the next second that has room. It is not a cap
+// on what the planner runs: only the first executions are looked at.
+// Events of a group share their period, so they keep apart, but events
+// with different periods may meet again later on.
+func (s *EventBuilder) StaggerOffsets(n int) {
+	s.stagger = n
+}
+
+// AlignTo starts the distribution windows on the calendar: on the next
+// multiple of the duration since the zero time (eg: time.Hour starts
+// them at the top of the next hour, in UTC).
+func (s *EventBuilder) AlignTo(d time.Duration) {
+	s.align = d
+}
+
+// Repeatable will mark all events as repeatable.
+func (s *EventBuilder) Repeatable() {
+	s.allRepeatable = true
+}
+
+// groups returns the indices of the events of each group, by group
+// name.
+func (s *EventBuilder) groups() map[string][]int {
+	ret := make(map[string][]int)
+
+	for i := range s.events {
+		var name string
+		switch s.groupBy {
+		case GroupByLabel:
+			name = s.events[i].Label
+		case GroupByTag:
+			if tags := s.events[i].Tags(); len(tags) > 0 {
+				name = tags[0]
+			}
+		}
+		ret[name] = append(ret[name], i)
+	}
+
+	return ret
+}
+
+// window is how many seconds the events of the group are spread over;
+// zero if there is no window for the group.
+func (s *EventBuilder) window(group string) int {
+	if maxTime, ok := s.windows[group]; ok {
+		return maxTime
+	}
+	if s.distribution != nil {
+		return s.distribution.maxTime
+	}
+	return 0
+}
+
+func (s *EventBuilder) validate() []error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]interface{}{ErrEventBuilder}, args...)...))
+	}
+
+	if len(s.events) == 0 {
+		invalid("no events")
+	}
+
+	if s.jitter < 0 {
+		invalid("negative jitter")
+	}
+	if s.stagger < 0 {
+		invalid("negative stagger")
+	}
+	if s.align < 0 || (s.align > 0 && s.align < time.Second) {
+		invalid("alignment must be of at least a second")
+	}
+
+	groups := s.groups()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		maxTime := s.window(name)
+		count := len(groups[name])
+
+		switch {
+		case maxTime <= 0:
+			invalid("group %q: no distribution window", name)
 
 		// min granularity is a sec, so 11 events in 10 secs
 		// do not guarantee some sort of distribution
-		len(s.events) > s.distribution.maxTime {
-		return false
+		case count > maxTime:
+			invalid("group %q: %d events do not fit in %d seconds", name, count, maxTime)
+		}
+	}
+
+	return errs
+}
+
+func (s *EventBuilder) makeDistributeEvents() {
+	for name, indices := range s.groups() {
+		maxTime := s.window(name)
+		eventCount := len(indices)
+		interval := maxTime / eventCount
+
+		for i, ix := range indices {
+			s.events[ix].SetSecs(interval)
+
+			// multiply first, so that the remainder of the
+			// division is spread over the window too
+			s.events[ix].SetOffset(maxTime * i / eventCount)
+		}
+	}
+}
+
+func (s *EventBuilder) makeJitter() {
+	if s.jitter == 0 {
+		return
 	}
 
-	eventCount := len(s.events)
-	interval := s.distribution.maxTime / eventCount
+	for i := range s.events {
+		//nolint:gosec // jitter does not need a secure source
+		delay := rand.Intn(s.jitter + 1)
+		s.events[i].SetOffset(s.events[i].GetOffset() + delay)
+	}
+}
 
-	for i := 0; i < eventCount; i++ {
-		s.events[i].SetSecs(interval)
-		s.events[i].SetOffset(interval * i)
+func (s *EventBuilder) makeAligned() {
+	if s.align == 0 {
+		return
 	}
 
-	return true
+	now := s.now()
+	start := now.Truncate(s.align)
+	if start.Before(now) {
+		start = start.Add(s.align)
+	}
+	shift := int((start.Sub(now) + time.Second - 1) / time.Second)
+
+	for i := range s.events {
+		s.events[i].SetOffset(s.events[i].GetOffset() + shift)
+	}
 }
 
-// Repeatable will mark all events as repeatable.
-func (s *EventBuilder) Repeatable() {
-	s.allRepeatable = true
+func (s *EventBuilder) makeStaggerOffsets() {
+	if s.stagger == 0 {
+		return
+	}
+
+	order := make([]int, len(s.events))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return s.events[order[i]].GetOffset() < s.events[order[j]].GetOffset()
+	})
+
+	perTick := make(map[int]int)
+	for _, ix := range order {
+		offset := s.events[ix].GetOffset()
+		for perTick[offset] >= s.stagger {
+			offset++
+		}
+		perTick[offset]++
+		s.events[ix].SetOffset(offset)
+	}
 }
 
-func (s *EventBuilder) makeRepeatable() bool {
-	for _, el := range s.events {
-		el.Repeat(true)
+func (s *EventBuilder) makeRepeatable() {
+	if !s.allRepeatable {
+		return
+	}
+
+	for i := range s.events {
+		s.events[i].Repeat(true)
 	}
-	return true
 }
@@ -0,0 +1,341 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatEndpoint is where heartbeats are received, when
+// mounted on the status server.
+const DefaultHeartbeatEndpoint = "/heartbeat/"
+
+// maxHeartbeatMessage bounds the message a heartbeat may carry.
+const maxHeartbeatMessage = 1 << 10
+
+var (
+	// ErrUnknownHeartbeat is returned for heartbeats of checks that
+	// were never registered.
+	ErrUnknownHeartbeat = errors.New("unknown heartbeat")
+
+	// ErrBadHeartbeat is returned for heartbeat checks that can not
+	// work.
+	ErrBadHeartbeat = errors.New("bad heartbeat check")
+)
+
+// Heartbeats receives the heartbeats of passive checks: cron jobs and
+// scripts that say they ran, rather than cynic probing them. A check
+// fails when no heartbeat arrives in time, or when the job reports a
+// failure.
+//
+// Over http, mounted on DefaultHeartbeatEndpoint:
+//
+//	POST /heartbeat/{name}       the job ran; the body is an optional message
+//	POST /heartbeat/{name}/fail  the job ran, and failed
+//	GET  /heartbeat/             every check, and when it was last heard from
+//
+// GET works in place of POST, for the simplest of scripts.
+type Heartbeats struct {
+	mux    sync.Mutex
+	checks map[string]*heartbeat
+	token  []byte
+	clock  Clock
+}
+
+type heartbeat struct {
+	name     string
+	every    time.Duration
+	schedule *CronSchedule
+	grace    time.Duration
+
+	// since is when the check started waiting, for checks that
+	// never got a heartbeat
+	since   time.Time
+	last    time.Time
+	failed  bool
+	message string
+	pings   int
+}
+
+// HeartbeatStatus is where a heartbeat check stands.
+type HeartbeatStatus struct {
+	Name     string    `json:"name"`
+	LastPing time.Time `json:"last_ping"`
+	Deadline time.Time `json:"deadline"`
+	Overdue  bool      `json:"overdue"`
+	Failed   bool      `json:"failed"`
+	Message  string    `json:"message,omitempty"`
+	Pings    int       `json:"pings"`
+}
+
+// HeartbeatsNew creates an empty heartbeat registry. If the token is
+// not empty, heartbeats must carry it as a bearer token.
+func HeartbeatsNew(token string) *Heartbeats {
+	return &Heartbeats{
+		checks: make(map[string]*heartbeat),
+		token:  []byte(token),
+		clock:  SystemClock,
+	}
+}
+
+// SetClock makes the registry tell the time of heartbeats, and when
+// they are due, by the clock. It should be called before any check is
+// registered.
+func (s *Heartbeats) SetClock(clock Clock) {
+	s.clock = orSystemClock(clock)
+}
+
+// HeartbeatEventNew creates an event that fails when the named check
+// does not get a heartbeat at least every interval, give or take the
+// grace period.
+func HeartbeatEventNew(heartbeats *Heartbeats, name string, every, grace time.Duration) (Event, error) {
+	if every <= 0 {
+		return Event{}, fmt.Errorf("%w: %s: no interval", ErrBadHeartbeat, name)
+	}
+	return heartbeats.event(&heartbeat{name: name, every: every, grace: grace})
+}
+
+// HeartbeatCronEventNew creates an event that fails when the named
+// check does not get a heartbeat within the grace period of each time
+// the schedule fires: the schedule is that of the job.
+func HeartbeatCronEventNew(heartbeats *Heartbeats, name string, schedule *CronSchedule, grace time.Duration) (Event, error) {
+	if schedule == nil {
+		return Event{}, fmt.Errorf("%w: %s: no schedule", ErrBadHeartbeat, name)
+	}
+	return heartbeats.event(&heartbeat{name: name, schedule: schedule, grace: grace})
+}
+
+func (s *Heartbeats) event(check *heartbeat) (Event, error) {
+	switch {
+	case check.name == "" || strings.Contains(check.name, "/"):
+		return Event{}, fmt.Errorf("%w: bad name %q", ErrBadHeartbeat, check.name)
+	case check.grace < 0:
+		return Event{}, fmt.Errorf("%w: %s: negative grace", ErrBadHeartbeat, check.name)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.checks[check.name]; ok {
+		return Event{}, fmt.Errorf("%w: %s is already registered", ErrBadHeartbeat, check.name)
+	}
+	check.since = s.clock.Now()
+	s.checks[check.name] = check
+
+	// look often enough to notice within the grace period, without
+	// busy looping on short ones
+	secs := int(check.grace / 2 / time.Second)
+	if secs < 1 {
+		secs = 1
+	} else if secs > 60 {
+		secs = 60
+	}
+
+	event := EventNew(secs)
+	event.Label = check.name
+	event.Repeat(true)
+	event.AddHook(s.hook(check.name))
+
+	// deleting the event frees the name, and stops the heartbeats
+	event.onDelete = func() { s.unregister(check) }
+
+	return event, nil
+}
+
+// unregister removes the check, unless another took its name since.
+func (s *Heartbeats) unregister(check *heartbeat) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.checks[check.name] == check {
+		delete(s.checks, check.name)
+	}
+}
+
+func (s *Heartbeats) hook(name string) HookSignature {
+	return func(params *HookParameters) (bool, interface{}) {
+		status, err := s.Status(name)
+		if err != nil {
+			return true, err.Error()
+		}
+
+		failing := status.Overdue || status.Failed
+
+		if params != nil && params.Status != nil && params.Event != nil {
+			severity := SeverityInfo
+			if failing {
+				severity = SeverityCritical
+			}
+			params.Status.UpdateEntry(params.Event.UniqStr(), params.Event.StatusEntry(status, severity))
+		}
+
+		switch {
+		case status.Failed:
+			return true, fmt.Sprintf("%s reported a failure: %s", name, status.Message)
+		case status.Overdue && status.LastPing.IsZero():
+			return true, fmt.Sprintf("no heartbeat from %s yet, due by %s", name, status.Deadline.Format(time.RFC3339))
+		case status.Overdue:
+			return true, fmt.Sprintf("no heartbeat from %s since %s, due by %s",
+				name, status.LastPing.Format(time.RFC3339), status.Deadline.Format(time.RFC3339))
+		}
+
+		return false, status
+	}
+}
+
+// Ping records a heartbeat of the named check.
+func (s *Heartbeats) Ping(name, message string) error {
+	return s.record(name, message, false)
+}
+
+// Fail records a heartbeat of the named check, that says the job
+// failed. The check fails until the next Ping.
+func (s *Heartbeats) Fail(name, message string) error {
+	return s.record(name, message, true)
+}
+
+func (s *Heartbeats) record(name, message string, failed bool) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	check, ok := s.checks[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownHeartbeat, name)
+	}
+
+	check.last = s.clock.Now()
+	check.failed = failed
+	check.message = message
+	check.pings++
+
+	return nil
+}
+
+// Status tells where the named check stands.
+func (s *Heartbeats) Status(name string) (HeartbeatStatus, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	check, ok := s.checks[name]
+	if !ok {
+		return HeartbeatStatus{}, fmt.Errorf("%w: %s", ErrUnknownHeartbeat, name)
+	}
+
+	return check.status(s.clock.Now()), nil
+}
+
+// List tells where every check stands, by name.
+func (s *Heartbeats) List() []HeartbeatStatus {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.clock.Now()
+	ret := make([]HeartbeatStatus, 0, len(s.checks))
+	for _, check := range s.checks {
+		ret = append(ret, check.status(now))
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret
+}
+
+func (s *heartbeat) status(now time.Time) HeartbeatStatus {
+	from := s.last
+	if from.IsZero() {
+		from = s.since
+	}
+
+	var deadline time.Time
+	if s.schedule != nil {
+		// the first run after the last heartbeat is the one we
+		// are waiting to hear from
+		if next := s.schedule.Next(from); !next.IsZero() {
+			deadline = next.Add(s.grace)
+		}
+	} else {
+		deadline = from.Add(s.every + s.grace)
+	}
+
+	return HeartbeatStatus{
+		Name:     s.name,
+		LastPing: s.last,
+		Deadline: deadline,
+		Overdue:  !deadline.IsZero() && now.After(deadline),
+		Failed:   s.failed,
+		Message:  s.message,
+		Pings:    s.pings,
+	}
+}
+
+// ServeHTTP receives heartbeats; see Heartbeats.
+func (s *Heartbeats) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(s.token) > 0 && !bearerAuthorized(w, req, s.token) {
+		return
+	}
+
+	rest := req.URL.Path
+	if i := strings.Index(rest, DefaultHeartbeatEndpoint); i >= 0 {
+		rest = rest[i+len(DefaultHeartbeatEndpoint):]
+	}
+
+	if rest == "" {
+		if req.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.List())
+		return
+	}
+
+	if req.Method != http.MethodPost && req.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name, fail := strings.CutSuffix(rest, "/fail")
+
+	message, err := io.ReadAll(io.LimitReader(req.Body, maxHeartbeatMessage))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if fail {
+		err = s.Fail(name, strings.TrimSpace(string(message)))
+	} else {
+		err = s.Ping(name, strings.TrimSpace(string(message)))
+	}
+
+	if errors.Is(err, ErrUnknownHeartbeat) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	status, _ := s.Status(name)
+	writeJSON(w, http.StatusOK, status)
+}
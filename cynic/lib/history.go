@@ -0,0 +1,360 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHistoryCapacity is how many values are kept per key, when
+// not configured.
+const DefaultHistoryCapacity = 1024
+
+const historyEndpoint = "/history/"
+
+// ErrBadHistoryQuery is returned for history queries that make no
+// sense, like a range that ends before it starts.
+var ErrBadHistoryQuery = errors.New("bad history query")
+
+// HistoryConfig is how much history the status cache keeps for each
+// key. Values are dropped once there are more than Capacity of them,
+// or when they get older than MaxAge (if not zero).
+type HistoryConfig struct {
+	Capacity int
+	MaxAge   time.Duration
+}
+
+// HistoryPoint is a value a key held at some point.
+type HistoryPoint struct {
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+// HistoryBucket summarizes the numeric values of a key within a step.
+type HistoryBucket struct {
+	Time  time.Time `json:"time"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+	Count int       `json:"count"`
+}
+
+// HistoryQuery selects part of the history of a key. Zero times leave
+// the range open on that side. With a Step, numeric values are
+// downsampled into buckets of that size. Path picks a number out of
+// structured values (eg: "$.latency_ms"), see JSONPath.
+type HistoryQuery struct {
+	From time.Time
+	To   time.Time
+	Step time.Duration
+	Path string
+}
+
+// historyRing is a fixed size ring of the latest values of a key.
+type historyRing struct {
+	points []HistoryPoint
+	head   int
+	size   int
+}
+
+func historyRingNew(capacity int) *historyRing {
+	return &historyRing{points: make([]HistoryPoint, capacity)}
+}
+
+func (s *historyRing) add(point HistoryPoint) {
+	s.points[(s.head+s.size)%len(s.points)] = point
+	if s.size < len(s.points) {
+		s.size++
+	} else {
+		s.head = (s.head + 1) % len(s.points)
+	}
+}
+
+// dropBefore forgets everything older than cutoff.
+func (s *historyRing) dropBefore(cutoff time.Time) {
+	for s.size > 0 && s.points[s.head].Time.Before(cutoff) {
+		s.points[s.head] = HistoryPoint{}
+		s.head = (s.head + 1) % len(s.points)
+		s.size--
+	}
+}
+
+// between returns a copy of the points within [from, to], oldest
+// first.
+func (s *historyRing) between(from, to time.Time) []HistoryPoint {
+	points := make([]HistoryPoint, 0, s.size)
+
+	for i := 0; i < s.size; i++ {
+		point := s.points[(s.head+i)%len(s.points)]
+		if !from.IsZero() && point.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && point.Time.After(to) {
+			continue
+		}
+		points = append(points, point)
+	}
+
+	return points
+}
+
+// statusHistory holds the rings of all the keys of a status cache.
+type statusHistory struct {
+	mux    sync.Mutex
+	config HistoryConfig
+	rings  map[string]*historyRing
+}
+
+func statusHistoryNew(config HistoryConfig) *statusHistory {
+	if config.Capacity <= 0 {
+		config.Capacity = DefaultHistoryCapacity
+	}
+
+	return &statusHistory{
+		config: config,
+		rings:  make(map[string]*historyRing),
+	}
+}
+
+func (s *statusHistory) add(key string, value interface{}, now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	ring, ok := s.rings[key]
+	if !ok {
+		ring = historyRingNew(s.config.Capacity)
+		s.rings[key] = ring
+	}
+
+	ring.add(HistoryPoint{Time: now, Value: value})
+	if s.config.MaxAge > 0 {
+		ring.dropBefore(now.Add(-s.config.MaxAge))
+	}
+}
+
+func (s *statusHistory) remove(key string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.rings, key)
+}
+
+func (s *statusHistory) between(key string, from, to, now time.Time) ([]HistoryPoint, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	ring, ok := s.rings[key]
+	if !ok {
+		return nil, false
+	}
+
+	if s.config.MaxAge > 0 {
+		ring.dropBefore(now.Add(-s.config.MaxAge))
+	}
+
+	return ring.between(from, to), true
+}
+
+// WithHistory makes the cache remember past values of every key, not
+// only the latest.
+func (s *StatusCache) WithHistory(config HistoryConfig) {
+	s.history = statusHistoryNew(config)
+}
+
+// History returns the values the key held within the range of the
+// query, oldest first. Structured values are narrowed down with the
+// path of the query, if there is one.
+func (s *StatusCache) History(key string, query HistoryQuery) ([]HistoryPoint, error) {
+	if s.history == nil {
+		return nil, ErrStatusValueNotFound
+	}
+
+	if !query.From.IsZero() && !query.To.IsZero() && query.To.Before(query.From) {
+		return nil, ErrBadHistoryQuery
+	}
+
+	points, ok := s.history.between(key, query.From, query.To, s.clock.Now())
+	if !ok {
+		return nil, ErrStatusValueNotFound
+	}
+
+	if query.Path == "" {
+		return points, nil
+	}
+
+	narrowed := points[:0]
+	for _, point := range points {
+		value, err := valueAtPath(point.Value, query.Path)
+		if err != nil {
+			continue
+		}
+		narrowed = append(narrowed, HistoryPoint{Time: point.Time, Value: value})
+	}
+
+	return narrowed, nil
+}
+
+// HistoryBuckets downsamples the numeric history of the key into
+// buckets of query.Step, aligned on multiples of the step. Values that
+// are not numbers are skipped. Empty buckets are left out.
+func (s *StatusCache) HistoryBuckets(key string, query HistoryQuery) ([]HistoryBucket, error) {
+	if query.Step <= 0 {
+		return nil, ErrBadHistoryQuery
+	}
+
+	points, err := s.History(key, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []HistoryBucket
+
+	for _, point := range points {
+		number, ok := toFloat(point.Value)
+		if !ok {
+			continue
+		}
+
+		start := point.Time.Truncate(query.Step)
+
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Time.Equal(start) {
+			buckets = append(buckets, HistoryBucket{
+				Time: start,
+				Min:  math.Inf(1),
+				Max:  math.Inf(-1),
+			})
+		}
+
+		bucket := &buckets[len(buckets)-1]
+		bucket.Min = math.Min(bucket.Min, number)
+		bucket.Max = math.Max(bucket.Max, number)
+		bucket.Avg += (number - bucket.Avg) / float64(bucket.Count+1)
+		bucket.Count++
+	}
+
+	return buckets, nil
+}
+
+// valueAtPath looks into a value the way its json would be looked
+// into.
+func valueAtPath(value interface{}, path string) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return JSONPath(doc, path)
+}
+
+func (s *StatusCache) historyRoot() string {
+	return strings.TrimSuffix(s.root, "/") + historyEndpoint
+}
+
+// makeHistory serves /<root>/history/<key>?from=&to=&step=&path=
+func (s *StatusCache) makeHistory(w http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(req.URL.Path, s.historyRoot())
+
+	query, err := parseHistoryQuery(req, s.clock.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var result interface{}
+	if query.Step > 0 {
+		result, err = s.HistoryBuckets(key, query)
+	} else {
+		result, err = s.History(key, query)
+	}
+
+	switch {
+	case errors.Is(err, ErrStatusValueNotFound):
+		writeJSONError(w, http.StatusNotFound, "no history for "+key)
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"key":    key,
+		"step":   query.Step.String(),
+		"points": result,
+	})
+}
+
+func parseHistoryQuery(req *http.Request, now time.Time) (HistoryQuery, error) {
+	values := req.URL.Query()
+
+	var (
+		query HistoryQuery
+		err   error
+	)
+
+	if query.From, err = parseHistoryTime(values.Get("from"), now); err != nil {
+		return query, err
+	}
+
+	if query.To, err = parseHistoryTime(values.Get("to"), now); err != nil {
+		return query, err
+	}
+
+	if step := values.Get("step"); step != "" {
+		query.Step, err = time.ParseDuration(step)
+		if err != nil || query.Step <= 0 {
+			return query, ErrBadHistoryQuery
+		}
+	}
+
+	query.Path = values.Get("path")
+
+	return query, nil
+}
+
+// parseHistoryTime accepts rfc3339 times, unix timestamps, and
+// durations relative to now (eg: "-1h").
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+
+	if offset, err := time.ParseDuration(value); err == nil {
+		return now.Add(offset), nil
+	}
+
+	return time.Time{}, ErrBadHistoryQuery
+}
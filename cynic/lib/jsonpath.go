@@ -0,0 +1,118 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrJSONPath is returned when a path is malformed, or does not lead
+// anywhere in the document.
+var ErrJSONPath = errors.New("bad json path")
+
+// JSONPath looks up a value in a decoded json document (as given by
+// json.Unmarshal into an interface{}). Only the simple subset of json
+// path is supported:
+//
+//	$.data.items[0].status
+//	data.items.0.status
+//	$["key.with.dots"].value
+//
+// The leading "$" is optional. The empty path, or "$", is the document
+// itself.
+func JSONPath(doc interface{}, path string) (interface{}, error) {
+	segments, err := jsonPathSplit(path)
+	if err != nil {
+		return nil, err
+	}
+
+	current := doc
+	for _, segment := range segments {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return nil, fmt.Errorf("%w: no key %q in %q", ErrJSONPath, segment, path)
+			}
+			current = value
+
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q is not an index in %q", ErrJSONPath, segment, path)
+			}
+
+			if index < 0 {
+				index += len(node)
+			}
+
+			if index < 0 || index >= len(node) {
+				return nil, fmt.Errorf("%w: index %s out of range in %q", ErrJSONPath, segment, path)
+			}
+			current = node[index]
+
+		default:
+			return nil, fmt.Errorf("%w: can not descend into %q in %q", ErrJSONPath, segment, path)
+		}
+	}
+
+	return current, nil
+}
+
+func jsonPathSplit(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+
+	var segments []string
+
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unclosed bracket", ErrJSONPath)
+			}
+
+			inner := path[1:end]
+			if unquoted, err := strconv.Unquote(inner); err == nil {
+				inner = unquoted
+			} else if len(inner) >= 2 && inner[0] == '\'' && inner[len(inner)-1] == '\'' {
+				inner = inner[1 : len(inner)-1]
+			}
+
+			segments = append(segments, inner)
+			path = path[end+1:]
+
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+
+			segments = append(segments, path[:end])
+			path = path[end:]
+		}
+	}
+
+	return segments, nil
+}
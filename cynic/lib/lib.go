@@ -19,21 +19,14 @@ limitations under the License.
 package cynic
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
 	"time"
 )
 
-const (
-	// StopEvent is the signal to stop the running querying event.
-	StopEvent = iota
-
-	// AddEvent adds a event to a running cynic instance.
-	AddEvent
-
-	// DeleteEvent removes a event from a running cynic instance.
-	DeleteEvent
-)
-
 // Session is the configuration a cynic instance requires to start
 // running and working.
 type Session struct {
@@ -41,42 +34,215 @@ type Session struct {
 	StatusCache    *StatusCache
 	Alerter        *Alerter
 	SnapshotConfig *SnapshotConfig
+
+	// Workers is the number of events that may execute at the
+	// same time. Zero executes them one after the other.
+	Workers int
+
+	// StatePath, if set, is where the planner state is saved, so
+	// that schedules carry over when cynic restarts. See
+	// Planner.SaveState.
+	StatePath string
+
+	// APIToken, if set, mounts the event api (see EventAPI) on the
+	// status server, on DefaultEventsEndpoint, and lets the status
+	// cache be written to (see StatusCache.AcceptUpdates). Requests
+	// must carry it as a bearer token.
+	APIToken string
+
+	// EventFactory, if set, allows adding events through the event
+	// api.
+	EventFactory EventFactory
+
+	// Metrics, if set, is where cynic records what it does. When
+	// there is a status cache, the metrics are served on
+	// DefaultMetricsEndpoint; one is created if need be.
+	Metrics *Metrics
+
+	// Maintenance windows mute the alerts of the events they match
+	// (see MaintenanceWindow). More can be added through the event
+	// api.
+	Maintenance []MaintenanceWindow
+
+	// Cluster, if set, makes this instance one node of a cluster
+	// (see Cluster). It is mounted on the status server, on
+	// DefaultClusterEndpoint, which is how the peers reach it. The
+	// gossip is authenticated by the cluster token, and the rest of
+	// the endpoint by the credentials of the cache.
+	Cluster *Cluster
+
+	// Heartbeats, if set, receives the heartbeats of passive checks
+	// (see HeartbeatEventNew). It is mounted on the status server, on
+	// DefaultHeartbeatEndpoint.
+	Heartbeats *Heartbeats
 }
 
-// Start starts a cynic instance, with any provided hooks.
-func Start(session Session) {
-	if session.Alerter != nil {
-		session.Alerter.Start()
-		defer session.Alerter.Stop()
+// Start starts a cynic instance, with any provided hooks. It blocks
+// until the context is cancelled, or the status server fails. On the
+// way out, in-flight hooks are allowed to finish, the alerter and
+// status cache are stopped, and the planner state is saved if there is
+// a StatePath.
+func Start(ctx context.Context, session Session) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the status cache listens since it was created, so giving up
+	// before serving it must close it
+	abort := func(err error) error {
+		if session.StatusCache != nil {
+			_ = session.StatusCache.Stop()
+		}
+		return err
+	}
+
+	metrics := session.Metrics
+	if metrics == nil && session.StatusCache != nil {
+		metrics = MetricsNew()
 	}
 
 	planner := PlannerNew()
 	planner.alerter = session.Alerter
+	planner.SetWorkers(session.Workers)
+	planner.SetMetrics(metrics)
+
+	if session.Alerter != nil {
+		session.Alerter.SetMetrics(metrics)
+
+		if session.StatusCache != nil {
+			session.Alerter.SetBroker(session.StatusCache.Broker())
+		}
+	}
+
+	if metrics != nil && session.StatusCache != nil {
+		metrics.SetStatusCache(session.StatusCache)
+		session.StatusCache.Handle(DefaultMetricsEndpoint, metrics)
+	}
+
+	if session.Cluster != nil {
+		if session.StatusCache == nil {
+			return fmt.Errorf("%w: a cluster needs a status server", ErrClusterConfig)
+		}
+		planner.SetCluster(session.Cluster)
+
+		// only the gossip checks the cluster token; the state of the
+		// cluster is as protected as the rest of the cache
+		session.StatusCache.Handle(DefaultClusterEndpoint, session.Cluster)
+		session.StatusCache.HandleAuthenticated(DefaultClusterEndpoint+"gossip", session.Cluster)
+	}
+
+	if session.Heartbeats != nil && session.StatusCache != nil {
+		if len(session.Heartbeats.token) > 0 {
+			session.StatusCache.HandleAuthenticated(DefaultHeartbeatEndpoint, session.Heartbeats)
+		} else {
+			session.StatusCache.Handle(DefaultHeartbeatEndpoint, session.Heartbeats)
+		}
+	}
+
+	if session.StatusCache != nil {
+		dashboard := DashboardNew(planner, session.StatusCache, session.Alerter)
+		session.StatusCache.Handle(DefaultDashboardEndpoint, dashboard)
+	}
 
 	for i := 0; i < len(session.Events); i++ {
 		planner.Add(&session.Events[i])
 	}
 
-	if session.SnapshotConfig != nil {
-		session.StatusCache.WithSnapshots(session.SnapshotConfig)
+	for _, window := range session.Maintenance {
+		if _, err := planner.AddMaintenance(window); err != nil {
+			return abort(err)
+		}
 	}
 
-	ticker := time.NewTicker(time.Second)
+	if session.StatePath != "" {
+		restored, err := planner.LoadState(session.StatePath)
+		if err != nil {
+			return abort(err)
+		}
+		log.Println("restored", restored, "event schedules from", session.StatePath)
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		for range ticker.C {
-			planner.Tick()
+	if session.APIToken != "" && session.StatusCache != nil {
+		api, err := EventAPINew(planner, DefaultEventsEndpoint, session.APIToken)
+		if err != nil {
+			return abort(err)
 		}
-		wg.Done()
-	}()
-	defer ticker.Stop()
+		api.SetEventFactory(session.EventFactory)
+		session.StatusCache.HandleAuthenticated(DefaultEventsEndpoint, api)
+		session.StatusCache.AcceptUpdates(session.APIToken)
+	}
+
+	if session.Alerter != nil {
+		session.Alerter.Start()
+	}
+
+	if session.SnapshotConfig != nil && session.StatusCache != nil {
+		session.StatusCache.WithSnapshots(session.SnapshotConfig)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		serverErr error
+	)
 
 	if session.StatusCache != nil {
-		session.StatusCache.Start()
-		defer session.StatusCache.Stop()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := session.StatusCache.Start(); err != nil {
+				serverErr = err
+				cancel()
+			}
+		}()
+	}
+
+	if session.StatePath != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			saveStatePeriodically(ctx, planner, session.StatePath)
+		}()
+	}
+
+	if session.Cluster != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.Cluster.Run(ctx)
+		}()
 	}
 
+	runErr := planner.Run(ctx)
+
+	if session.Alerter != nil {
+		session.Alerter.Stop()
+	}
+
+	var stopErr error
+	if session.StatusCache != nil {
+		stopErr = session.StatusCache.Stop()
+	}
 	wg.Wait()
+
+	var saveErr error
+	if session.StatePath != "" {
+		saveErr = planner.SaveState(session.StatePath)
+	}
+
+	return errors.Join(runErr, serverErr, stopErr, saveErr)
+}
+
+func saveStatePeriodically(ctx context.Context, planner *Planner, path string) {
+	ticker := time.NewTicker(DefaultStateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := planner.SaveState(path); err != nil {
+				log.Println("problem saving planner state:", err)
+			}
+		}
+	}
 }
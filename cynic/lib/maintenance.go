@@ -0,0 +1,262 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrBadMaintenance is returned for maintenance windows that can never
+// be active.
+var ErrBadMaintenance = errors.New("bad maintenance window")
+
+// MaintenanceWindow mutes the alerts of the events it matches while it
+// is active. The events still run, and their results still reach the
+// status cache; only the alerts are held back.
+//
+// A window is either a time range (Start to End; a zero Start means
+// right away), or recurring: active for Duration every time Schedule
+// fires (eg: "0 2 * * sun" for 2h).
+type MaintenanceWindow struct {
+	ID uint64
+
+	Start time.Time
+	End   time.Time
+
+	Schedule *CronSchedule
+	Duration time.Duration
+
+	// Labels and Tags pick the events the window applies to: an event
+	// matches if it has any of the labels, or any of the tags. A
+	// window without either matches every event.
+	Labels []string
+	Tags   []string
+
+	Reason string
+}
+
+// Active says whether the window is in effect at the given time.
+func (s *MaintenanceWindow) Active(now time.Time) bool {
+	if s.Schedule != nil {
+		// the last time the schedule fired, if within Duration
+		fired := s.Schedule.Next(now.Add(-s.Duration))
+		return !fired.IsZero() && !fired.After(now)
+	}
+
+	return !now.Before(s.Start) && now.Before(s.End)
+}
+
+// expired says whether a one off window is over for good.
+func (s *MaintenanceWindow) expired(now time.Time) bool {
+	return s.Schedule == nil && !now.Before(s.End)
+}
+
+// Matches says whether the window applies to the event.
+func (s *MaintenanceWindow) Matches(event *Event) bool {
+	if len(s.Labels) == 0 && len(s.Tags) == 0 {
+		return true
+	}
+
+	for _, label := range s.Labels {
+		if label == event.Label {
+			return true
+		}
+	}
+
+	for _, tag := range s.Tags {
+		if event.HasTag(tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *MaintenanceWindow) validate() error {
+	switch {
+	case s.Schedule != nil && s.Duration <= 0:
+		return fmt.Errorf("%w: a recurring window needs a duration", ErrBadMaintenance)
+	case s.Schedule == nil && !s.End.After(s.Start):
+		return fmt.Errorf("%w: the window must end after it starts", ErrBadMaintenance)
+	}
+	return nil
+}
+
+// MarshalJSON describes the window for the event api.
+func (s MaintenanceWindow) MarshalJSON() ([]byte, error) {
+	type window struct {
+		ID       uint64     `json:"id"`
+		Start    *time.Time `json:"start,omitempty"`
+		End      *time.Time `json:"end,omitempty"`
+		Cron     string     `json:"cron,omitempty"`
+		Timezone string     `json:"timezone,omitempty"`
+		Duration string     `json:"duration,omitempty"`
+		Labels   []string   `json:"labels,omitempty"`
+		Tags     []string   `json:"tags,omitempty"`
+		Reason   string     `json:"reason,omitempty"`
+	}
+
+	ret := window{
+		ID:     s.ID,
+		Labels: s.Labels,
+		Tags:   s.Tags,
+		Reason: s.Reason,
+	}
+
+	if s.Schedule != nil {
+		ret.Cron = s.Schedule.String()
+		ret.Timezone = s.Schedule.Location().String()
+		ret.Duration = s.Duration.String()
+	} else {
+		ret.Start = &s.Start
+		ret.End = &s.End
+	}
+
+	return json.Marshal(ret)
+}
+
+// AddMaintenance adds a maintenance window to the planner, and returns
+// its id. A zero Start is now.
+func (s *Planner) AddMaintenance(window MaintenanceWindow) (uint64, error) {
+	if window.Schedule == nil && window.Start.IsZero() {
+		window.Start = s.now()
+	}
+
+	if err := window.validate(); err != nil {
+		return 0, err
+	}
+
+	s.maintMux.Lock()
+	defer s.maintMux.Unlock()
+
+	if s.maintenance == nil {
+		s.maintenance = make(map[uint64]*MaintenanceWindow)
+	}
+
+	s.maintenanceID++
+	window.ID = s.maintenanceID
+	s.maintenance[window.ID] = &window
+
+	return window.ID, nil
+}
+
+// RemoveMaintenance removes a maintenance window. It returns false if
+// there was no such window.
+func (s *Planner) RemoveMaintenance(id uint64) bool {
+	s.maintMux.Lock()
+	defer s.maintMux.Unlock()
+
+	if _, ok := s.maintenance[id]; !ok {
+		return false
+	}
+
+	delete(s.maintenance, id)
+	return true
+}
+
+// Maintenance lists the maintenance windows that are active, or yet to
+// come. Windows that are over are forgotten.
+func (s *Planner) Maintenance() []MaintenanceWindow {
+	now := s.now()
+
+	s.maintMux.Lock()
+	defer s.maintMux.Unlock()
+
+	windows := make([]MaintenanceWindow, 0, len(s.maintenance))
+	for id, window := range s.maintenance {
+		if window.expired(now) {
+			delete(s.maintenance, id)
+			continue
+		}
+		windows = append(windows, *window)
+	}
+
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].ID < windows[j].ID
+	})
+
+	return windows
+}
+
+// Muted says whether the alerts of the event are held back, and why:
+// either a maintenance window applies to it, or an event it depends on
+// is failing.
+func (s *Planner) Muted(event *Event) (string, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.muted(event, s.now())
+}
+
+// muted must be called with the lock held.
+func (s *Planner) muted(event *Event, now time.Time) (string, bool) {
+	if window := s.activeMaintenance(event, now); window != nil {
+		reason := "maintenance"
+		if window.Reason != "" {
+			reason += ": " + window.Reason
+		}
+		return reason, true
+	}
+
+	if len(event.dependsOn) == 0 {
+		return "", false
+	}
+
+	var failing []string
+	for _, other := range s.uniqueEvents {
+		if other == event || other.IsDeleted() || !other.IsFailing() {
+			continue
+		}
+
+		for _, label := range event.dependsOn {
+			if other.Label == label {
+				failing = append(failing, other.UniqStr())
+				break
+			}
+		}
+	}
+
+	if len(failing) == 0 {
+		return "", false
+	}
+
+	sort.Strings(failing)
+	return "depends on failing " + strings.Join(failing, ", "), true
+}
+
+func (s *Planner) activeMaintenance(event *Event, now time.Time) *MaintenanceWindow {
+	s.maintMux.Lock()
+	defer s.maintMux.Unlock()
+
+	var found *MaintenanceWindow
+	for _, window := range s.maintenance {
+		if !window.Active(now) || !window.Matches(event) {
+			continue
+		}
+		if found == nil || window.ID < found.ID {
+			found = window
+		}
+	}
+
+	return found
+}
@@ -0,0 +1,391 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMetricsEndpoint is where the metrics are served on the status
+// server.
+const DefaultMetricsEndpoint = "/metrics"
+
+const (
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	contentTypePrometheus  = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the hook
+// latency histogram.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// ErrInvalidMetric is returned when registering a metric with a bad or
+// already taken name.
+var ErrInvalidMetric = errors.New("invalid metric")
+
+var metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Metrics collects numbers about a running cynic instance, and serves
+// them in the OpenMetrics text format, for prometheus and friends to
+// scrape. Besides what cynic measures on its own (executions,
+// failures, hook latencies, alerts), numeric values put in the status
+// cache are exposed as gauges, and users can register their own
+// gauges and counters.
+type Metrics struct {
+	mux     sync.Mutex
+	buckets []float64
+	events  map[string]*eventMetrics
+	alerts  map[AlertState]uint64
+	custom  map[string]customMetric
+	status  *StatusCache
+}
+
+type eventMetrics struct {
+	executions uint64
+	failures   uint64
+	lastRun    time.Time
+
+	bucketCounts []uint64
+	latencySum   float64
+	latencyCount uint64
+}
+
+type customMetric interface {
+	help() string
+	kind() string
+	value() float64
+}
+
+// MetricsNew creates an empty metrics registry.
+func MetricsNew() *Metrics {
+	return &Metrics{
+		buckets: DefaultLatencyBuckets,
+		events:  make(map[string]*eventMetrics),
+		alerts:  make(map[AlertState]uint64),
+		custom:  make(map[string]customMetric),
+	}
+}
+
+// SetStatusCache exposes the numeric values of the status cache.
+func (s *Metrics) SetStatusCache(status *StatusCache) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.status = status
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	mux   sync.Mutex
+	val   float64
+	about string
+}
+
+// Set sets the value of the gauge.
+func (s *Gauge) Set(value float64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.val = value
+}
+
+// Add adds to the value of the gauge. Use a negative delta to go down.
+func (s *Gauge) Add(delta float64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.val += delta
+}
+
+func (s *Gauge) help() string { return s.about }
+func (s *Gauge) kind() string { return "gauge" }
+func (s *Gauge) value() float64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.val
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	mux   sync.Mutex
+	val   float64
+	about string
+}
+
+// Inc adds one to the counter.
+func (s *Counter) Inc() {
+	s.Add(1)
+}
+
+// Add adds to the counter. Negative deltas are ignored, since counters
+// never go down.
+func (s *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.val += delta
+}
+
+func (s *Counter) help() string { return s.about }
+func (s *Counter) kind() string { return "counter" }
+func (s *Counter) value() float64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.val
+}
+
+// RegisterGauge adds a gauge to the registry, served under name.
+func (s *Metrics) RegisterGauge(name, help string) (*Gauge, error) {
+	gauge := &Gauge{about: help}
+	return gauge, s.register(name, gauge)
+}
+
+// RegisterCounter adds a counter to the registry. The sample is served
+// as name_total; name should not end in _total itself.
+func (s *Metrics) RegisterCounter(name, help string) (*Counter, error) {
+	counter := &Counter{about: help}
+	return counter, s.register(name, counter)
+}
+
+func (s *Metrics) register(name string, metric customMetric) error {
+	if !metricNameRegex.MatchString(name) || strings.HasPrefix(name, "cynic_") {
+		return fmt.Errorf("%w: bad name %q", ErrInvalidMetric, name)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.custom[name]; ok {
+		return fmt.Errorf("%w: %q is already registered", ErrInvalidMetric, name)
+	}
+
+	s.custom[name] = metric
+	return nil
+}
+
+func (s *Metrics) event(name string) *eventMetrics {
+	stats, ok := s.events[name]
+	if !ok {
+		stats = &eventMetrics{bucketCounts: make([]uint64, len(s.buckets))}
+		s.events[name] = stats
+	}
+	return stats
+}
+
+// observeExecution records that an event ran, and whether it failed.
+func (s *Metrics) observeExecution(event string, failed bool, at time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	stats := s.event(event)
+	stats.executions++
+	stats.lastRun = at
+	if failed {
+		stats.failures++
+	}
+}
+
+// observeLatency records how long one call to a hook took.
+func (s *Metrics) observeLatency(event string, latency time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	stats := s.event(event)
+	secs := latency.Seconds()
+
+	for i, bound := range s.buckets {
+		if secs <= bound {
+			stats.bucketCounts[i]++
+		}
+	}
+	stats.latencySum += secs
+	stats.latencyCount++
+}
+
+func (s *Metrics) observeAlert(state AlertState) {
+	if state == "" {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.alerts[state]++
+}
+
+func (s *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	openMetrics := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+
+	if openMetrics {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Set("Content-Type", contentTypePrometheus)
+	}
+
+	if _, err := w.Write([]byte(s.Render(openMetrics))); err != nil {
+		log.Println("problem writing metrics:", err)
+	}
+}
+
+// Render writes out all the metrics. With openMetrics, the output is
+// in the OpenMetrics format; otherwise it is in the older prometheus
+// text format, which only differs in how counters are declared.
+func (s *Metrics) Render(openMetrics bool) string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	out := metricsWriter{openMetrics: openMetrics}
+
+	events := sortedKeys(s.events)
+
+	out.family("cynic_event_executions", "counter", "Number of times the event was executed.")
+	for _, name := range events {
+		out.sample("cynic_event_executions_total", float64(s.events[name].executions), "event", name)
+	}
+
+	out.family("cynic_event_failures", "counter", "Number of executions of the event that ended in an alert.")
+	for _, name := range events {
+		out.sample("cynic_event_failures_total", float64(s.events[name].failures), "event", name)
+	}
+
+	out.family("cynic_event_last_run_timestamp_seconds", "gauge", "When the event last ran.")
+	for _, name := range events {
+		lastRun := float64(s.events[name].lastRun.UnixNano()) / 1e9
+		out.sample("cynic_event_last_run_timestamp_seconds", lastRun, "event", name)
+	}
+
+	out.family("cynic_hook_duration_seconds", "histogram", "How long the hooks of the event took.")
+	for _, name := range events {
+		stats := s.events[name]
+		for i, bound := range s.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			out.sample("cynic_hook_duration_seconds_bucket", float64(stats.bucketCounts[i]), "event", name, "le", le)
+		}
+		out.sample("cynic_hook_duration_seconds_bucket", float64(stats.latencyCount), "event", name, "le", "+Inf")
+		out.sample("cynic_hook_duration_seconds_sum", stats.latencySum, "event", name)
+		out.sample("cynic_hook_duration_seconds_count", float64(stats.latencyCount), "event", name)
+	}
+
+	out.family("cynic_alerts", "counter", "Number of alert messages delivered, by state.")
+	for _, state := range sortedKeys(s.alerts) {
+		out.sample("cynic_alerts_total", float64(s.alerts[state]), "state", string(state))
+	}
+
+	if s.status != nil {
+		out.family("cynic_status_value", "gauge", "Numeric values of the status cache.")
+		values := s.status.numericValues()
+		for _, key := range sortedKeys(values) {
+			out.sample("cynic_status_value", values[key], "key", key)
+		}
+	}
+
+	for _, name := range sortedKeys(s.custom) {
+		metric := s.custom[name]
+		out.family(name, metric.kind(), metric.help())
+
+		sampleName := name
+		if metric.kind() == "counter" {
+			sampleName += "_total"
+		}
+		out.sample(sampleName, metric.value())
+	}
+
+	if openMetrics {
+		out.builder.WriteString("# EOF\n")
+	}
+
+	return out.builder.String()
+}
+
+type metricsWriter struct {
+	builder     strings.Builder
+	openMetrics bool
+}
+
+func (s *metricsWriter) family(name, kind, help string) {
+	// the older format wants the name of the samples
+	if !s.openMetrics && kind == "counter" {
+		name += "_total"
+	}
+
+	fmt.Fprintf(&s.builder, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(&s.builder, "# HELP %s %s\n", name, escapeMetricHelp(help))
+}
+
+// sample writes one sample; labels are given as name, value pairs.
+func (s *metricsWriter) sample(name string, value float64, labels ...string) {
+	s.builder.WriteString(name)
+
+	if len(labels) > 0 {
+		s.builder.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				s.builder.WriteByte(',')
+			}
+			fmt.Fprintf(&s.builder, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		s.builder.WriteByte('}')
+	}
+
+	s.builder.WriteByte(' ')
+	s.builder.WriteString(formatMetricValue(value))
+	s.builder.WriteByte('\n')
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\"", `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func escapeMetricHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -19,12 +19,27 @@ package cynic
 
 import (
 	"container/heap"
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
 type eventMap map[uint64]*Event
 
+var (
+	// ErrEventNotFound is returned when no event in the planner has
+	// the given id.
+	ErrEventNotFound = errors.New("no such event")
+
+	// ErrEventRunning is returned when triggering an event that is
+	// already executing.
+	ErrEventRunning = errors.New("event is already running")
+)
+
 // Planner is a structure that manages events inserted with expiration
 // timestamps. The underlying data structures are magic, and you
 // shouldn't care about them, unless you're opening up the hatch and
@@ -35,6 +50,20 @@ type Planner struct {
 	uniqueEvents eventMap
 	mux          sync.Mutex
 	alerter      *Alerter
+	metrics      *Metrics
+	clock        Clock
+
+	// workers bounds the number of hooks that run at the same
+	// time. When nil, events are executed within the tick.
+	workers  chan struct{}
+	inflight sync.WaitGroup
+	ctx      context.Context
+
+	maintenance   map[uint64]*MaintenanceWindow
+	maintenanceID uint64
+	maintMux      sync.Mutex
+
+	cluster *Cluster
 }
 
 // PlannerNew creates a new, empty, timing wheel.
@@ -42,6 +71,8 @@ func PlannerNew() *Planner {
 	var tw Planner
 	tw.events = make(EventQueue, 0)
 	tw.uniqueEvents = make(eventMap)
+	tw.clock = SystemClock
+	tw.ctx = context.Background()
 	return &tw
 }
 
@@ -73,30 +104,129 @@ func (s *Planner) String() string {
 // Tick moves the cursor of the timing wheel, by one second.
 func (s *Planner) Tick() {
 	for {
-		if s.events.Len() == 0 {
+		event := s.popExpired()
+		if event == nil {
 			break
 		}
 
-		rootTimestamp, _ := s.events.PeekTimestamp()
+		switch {
+		case event.IsPaused():
+		case s.workers == nil:
+			s.execute(event)
+		default:
+			s.dispatch(event)
+		}
 
-		if s.ticks >= int(rootTimestamp) {
-			event := heap.Pop(&s.events).(*Event)
+		if event.IsRepeating() && !s.isDeleted(event) {
+			s.Add(event)
+		}
+	}
 
-			if event.IsDeleted() {
-				continue
-			}
+	s.mux.Lock()
+	s.ticks++
+	s.mux.Unlock()
+}
 
-			event.Execute()
+func (s *Planner) isDeleted(event *Event) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return event.IsDeleted()
+}
 
-			if event.IsRepeating() {
-				s.Add(event)
-			}
-		} else {
-			break
+// popExpired removes and returns the next event due on the current
+// tick, or nil if there is none.
+func (s *Planner) popExpired() *Event {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for s.events.Len() > 0 {
+		rootTimestamp, _ := s.events.PeekTimestamp()
+		if s.ticks < int(rootTimestamp) {
+			return nil
 		}
+
+		event := heap.Pop(&s.events).(*Event)
+		if event.IsDeleted() {
+			continue
+		}
+
+		return event
 	}
 
-	s.ticks++
+	return nil
+}
+
+// execute runs the event within the tick.
+func (s *Planner) execute(event *Event) {
+	if !event.tryRun() {
+		log.Println("event still running, skipping this round:", event.UniqStr())
+		return
+	}
+	defer event.doneRun()
+
+	event.ExecuteContext(s.context())
+}
+
+// dispatch executes the event on the worker pool. An event that is
+// still running from a previous expiry is skipped, rather than piled
+// up.
+func (s *Planner) dispatch(event *Event) {
+	if !event.tryRun() {
+		log.Println("event still running, skipping this round:", event.UniqStr())
+		return
+	}
+
+	ctx := s.context()
+
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		defer event.doneRun()
+
+		s.workers <- struct{}{}
+		defer func() { <-s.workers }()
+
+		event.ExecuteContext(ctx)
+	}()
+}
+
+// SetClock makes the planner read the time from the clock: cron
+// schedules, maintenance windows, the last runs of events and the
+// ticker of Run all follow it. It should be called before the planner
+// is used.
+func (s *Planner) SetClock(clock Clock) {
+	s.clock = orSystemClock(clock)
+}
+
+func (s *Planner) now() time.Time {
+	return s.clock.Now()
+}
+
+// SetWorkers makes the planner execute hooks concurrently, with at
+// most n events running at the same time. With n <= 0 (the default)
+// events are executed one after the other, within Tick.
+func (s *Planner) SetWorkers(n int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if n <= 0 {
+		s.workers = nil
+		return
+	}
+
+	s.workers = make(chan struct{}, n)
+}
+
+// Wait blocks until all the events dispatched to workers have
+// finished executing.
+func (s *Planner) Wait() {
+	s.inflight.Wait()
+}
+
+func (s *Planner) context() context.Context {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.ctx
 }
 
 // Add adds an event to the planner.
@@ -114,35 +244,76 @@ func (s *Planner) Add(event *Event) {
 		}
 		event.Immediate(false)
 		event.SetOffset(0)
+	} else if event.IsCron() {
+		expiry = int64(s.ticks + s.cronDelay(event.GetCron()))
 	} else {
 		expiry = int64(event.GetOffset() + event.GetSecs() + s.ticks)
 	}
 
 	s.uniqueEvents[event.ID()] = event
 	event.SetAbsExpiry(expiry)
-	event.setPlanner(s)
+	if event.planner != s {
+		// the event may be executing on a worker right now, so
+		// avoid writing the same value from under it
+		event.setPlanner(s)
+	}
 	heap.Push(&s.events, event)
 }
 
-// Run runs the wheel, with a 1s tick.
-func (s *Planner) Run() {
-	ticker := time.NewTicker(time.Second)
-	go func() {
-		for range ticker.C {
+// cronDelay gives the number of ticks until the next wall clock time
+// the schedule fires on. It is always at least one tick, so that an
+// event can not run twice within the same tick.
+func (s *Planner) cronDelay(sched *CronSchedule) int {
+	now := s.now()
+	next := sched.Next(now)
+
+	if next.IsZero() {
+		// nothing will ever match; park the event a year from now
+		// instead of spinning on it
+		return 365 * 24 * 60 * 60
+	}
+
+	delay := int(math.Ceil(next.Sub(now).Seconds()))
+	if delay < 1 {
+		delay = 1
+	}
+
+	return delay
+}
+
+// Run runs the wheel, with a 1s tick. It blocks until the context is
+// cancelled. The context is passed down to the hooks, and any hooks
+// still executing have finished by the time Run returns.
+func (s *Planner) Run(ctx context.Context) error {
+	s.mux.Lock()
+	s.ctx = ctx
+	s.mux.Unlock()
+
+	ticker := s.clock.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.Wait()
+			return nil
+		case <-ticker.C():
 			s.Tick()
 		}
-	}()
-	defer ticker.Stop()
+	}
 }
 
 // Delete marks a Event to be deleted. Returns true if event
 // found and marked for deletion, false if not.
 func (s *Planner) Delete(event *Event) bool {
+	return s.DeleteID(event.ID())
+}
+
+// DeleteID is like Delete, for when only the id of the event is known.
+func (s *Planner) DeleteID(id uint64) bool {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	id := event.ID()
-
 	if value, ok := s.uniqueEvents[id]; ok {
 		value.Delete()
 		delete(s.uniqueEvents, id)
@@ -152,11 +323,159 @@ func (s *Planner) Delete(event *Event) bool {
 	return false
 }
 
+// Get returns the event with the given id.
+func (s *Planner) Get(id uint64) (*Event, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	event, ok := s.uniqueEvents[id]
+	return event, ok
+}
+
+// Trigger executes the event right away, outside of its schedule,
+// which is left untouched. The event runs in the background, on the
+// worker pool if there is one.
+func (s *Planner) Trigger(id uint64) error {
+	event, ok := s.Get(id)
+	if !ok {
+		return ErrEventNotFound
+	}
+
+	if !event.tryRun() {
+		return ErrEventRunning
+	}
+
+	ctx := s.context()
+
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		defer event.doneRun()
+
+		if workers := s.workerPool(); workers != nil {
+			workers <- struct{}{}
+			defer func() { <-workers }()
+		}
+
+		event.ExecuteContext(ctx)
+	}()
+
+	return nil
+}
+
+func (s *Planner) workerPool() chan struct{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.workers
+}
+
+// EventInfo describes a scheduled event.
+type EventInfo struct {
+	ID      uint64    `json:"id"`
+	Label   string    `json:"label"`
+	NextRun time.Time `json:"next_run"`
+	Secs    int       `json:"secs,omitempty"`
+	Cron    string    `json:"cron,omitempty"`
+	Repeat  bool      `json:"repeat"`
+	LastRun time.Time `json:"last_run"`
+	Paused  bool      `json:"paused"`
+	Running bool      `json:"running"`
+	Failing bool      `json:"failing"`
+
+	Tags      []string `json:"tags,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// Muted says why the alerts of the event are held back, if they
+	// are (see Planner.Muted).
+	Muted string `json:"muted,omitempty"`
+}
+
+// Events lists the events that are scheduled to run, soonest first.
+func (s *Planner) Events() []EventInfo {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.now()
+	infos := make([]EventInfo, 0, len(s.events))
+
+	for _, event := range s.events {
+		if event.IsDeleted() {
+			continue
+		}
+		infos = append(infos, s.info(event, now))
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].NextRun.Equal(infos[j].NextRun) {
+			return infos[i].ID < infos[j].ID
+		}
+		return infos[i].NextRun.Before(infos[j].NextRun)
+	})
+
+	return infos
+}
+
+// Info describes the event with the given id.
+func (s *Planner) Info(id uint64) (EventInfo, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	event, ok := s.uniqueEvents[id]
+	if !ok {
+		return EventInfo{}, false
+	}
+
+	return s.info(event, s.now()), true
+}
+
+// info must be called with the lock held. Events that are not
+// scheduled (eg: one off events that already ran) have no NextRun.
+func (s *Planner) info(event *Event, now time.Time) EventInfo {
+	info := EventInfo{
+		ID:      event.ID(),
+		Label:   event.Label,
+		Secs:    event.secs,
+		Repeat:  event.repeat,
+		LastRun: event.LastRun(),
+		Paused:  event.IsPaused(),
+		Running: event.IsRunning(),
+		Failing: event.IsFailing(),
+
+		Tags:      event.Tags(),
+		DependsOn: event.Dependencies(),
+	}
+
+	info.Muted, _ = s.muted(event, now)
+
+	if event.cron != nil {
+		info.Cron = event.cron.String()
+		info.Secs = 0
+	}
+
+	if event.index >= 0 {
+		info.NextRun = s.nextRun(event, now)
+	}
+
+	return info
+}
+
+// nextRun must be called with the lock held.
+func (s *Planner) nextRun(event *Event, now time.Time) time.Time {
+	remaining := time.Duration(event.GetAbsExpiry()-int64(s.ticks)) * time.Second
+	return now.Add(remaining).Truncate(time.Second)
+}
+
 // GetAlerter gets the assigned alerter of planner.
 func (s *Planner) GetAlerter() *Alerter {
 	return s.alerter
 }
 
+// SetMetrics makes the events of the planner record their executions
+// and hook latencies. It should be called before Run.
+func (s *Planner) SetMetrics(metrics *Metrics) {
+	s.metrics = metrics
+}
+
 // SetAlerter sets the alerter.
 func (s *Planner) SetAlerter(alerter *Alerter) {
 	s.alerter = alerter
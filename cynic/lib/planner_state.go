@@ -0,0 +1,217 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// plannerStateVersion is bumped whenever PlannerState changes in a way
+// older versions of cynic can not read.
+const plannerStateVersion = 1
+
+// DefaultStateSaveInterval is how often a running cynic instance writes
+// the planner state to disk, when a state path is configured.
+const DefaultStateSaveInterval = 30 * time.Second
+
+// PlannerState is what is persisted of a planner, so that schedules
+// survive restarts. Expiries are kept as wall clock times, since the
+// tick counter of the planner starts over with every process.
+type PlannerState struct {
+	Version int          `json:"version"`
+	SavedAt time.Time    `json:"saved_at"`
+	LastID  uint64       `json:"last_id"`
+	Events  []EventState `json:"events"`
+}
+
+// EventState is the schedule of one event.
+type EventState struct {
+	ID      uint64    `json:"id"`
+	Label   string    `json:"label"`
+	NextRun time.Time `json:"next_run"`
+	Secs    int       `json:"secs,omitempty"`
+	Cron    string    `json:"cron,omitempty"`
+	Repeat  bool      `json:"repeat"`
+}
+
+// State returns the schedules of the events currently in the
+// planner. Events without a label are left out, as there would be no
+// way to match them back to an event after a restart.
+func (s *Planner) State() PlannerState {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.now()
+	state := PlannerState{
+		Version: plannerStateVersion,
+		SavedAt: now,
+		LastID:  atomic.LoadUint64(&lastID),
+		Events:  make([]EventState, 0, len(s.events)),
+	}
+
+	for _, event := range s.events {
+		if event.IsDeleted() || event.Label == "" {
+			continue
+		}
+
+		state.Events = append(state.Events, EventState{
+			ID:      event.ID(),
+			Label:   event.Label,
+			NextRun: s.nextRun(event, now),
+			Secs:    event.secs,
+			Cron:    cronString(event.cron),
+			Repeat:  event.repeat,
+		})
+	}
+
+	return state
+}
+
+// Restore reschedules the events of the planner to the wall clock
+// times in the state. Events are matched by label, and only restored
+// if their schedule (interval or cron expression) has not changed
+// since the state was saved. Events that should have run while cynic
+// was down run on the next tick. Returns the number of events
+// restored.
+func (s *Planner) Restore(state PlannerState) (int, error) {
+	if state.Version != plannerStateVersion {
+		return 0, fmt.Errorf("unsupported planner state version: %d", state.Version)
+	}
+
+	// make sure new events never reuse the ids of the previous run
+	for {
+		current := atomic.LoadUint64(&lastID)
+		if current >= state.LastID || atomic.CompareAndSwapUint64(&lastID, current, state.LastID) {
+			break
+		}
+	}
+
+	saved := make(map[string]EventState, len(state.Events))
+	for _, event := range state.Events {
+		saved[event.Label] = event
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	labels := make(map[string]int)
+	for _, event := range s.events {
+		if !event.IsDeleted() {
+			labels[event.Label]++
+		}
+	}
+
+	now := s.now()
+	restored := 0
+
+	for _, event := range s.events {
+		prev, ok := saved[event.Label]
+		if !ok || event.IsDeleted() {
+			continue
+		}
+
+		if labels[event.Label] > 1 {
+			log.Println("not restoring ambiguous event label:", event.Label)
+			continue
+		}
+
+		if prev.Secs != event.secs || prev.Cron != cronString(event.cron) || prev.Repeat != event.repeat {
+			log.Println("schedule changed, not restoring:", event.UniqStr())
+			continue
+		}
+
+		delay := int(math.Ceil(prev.NextRun.Sub(now).Seconds()))
+		if delay < 1 {
+			delay = 1
+		}
+
+		event.SetAbsExpiry(int64(s.ticks + delay))
+		restored++
+	}
+
+	heap.Init(&s.events)
+
+	return restored, nil
+}
+
+// SaveState writes the planner state to path as json. The file is
+// replaced atomically, so a crash while saving leaves the previous
+// state in place.
+func (s *Planner) SaveState(path string) error {
+	data, err := json.MarshalIndent(s.State(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState reads the state at path and restores it (see Restore). A
+// missing file is not an error: there is simply nothing to restore.
+func (s *Planner) LoadState(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var state PlannerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("bad planner state %s: %w", path, err)
+	}
+
+	return s.Restore(state)
+}
+
+func cronString(sched *CronSchedule) string {
+	if sched == nil {
+		return ""
+	}
+	return sched.Location().String() + ": " + sched.String()
+}
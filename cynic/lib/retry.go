@@ -0,0 +1,107 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how many times a failing hook is retried
+// before an alert is raised, and how long to wait between attempts.
+// The wait doubles on every failure, starting at Base and never going
+// over Cap.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times a hook is run,
+	// including the first. Anything below 2 means no retries.
+	MaxAttempts int
+
+	// Base is the wait after the first failure.
+	Base time.Duration
+
+	// Cap is the longest wait between two attempts. Zero means no
+	// cap.
+	Cap time.Duration
+
+	// Jitter is the fraction (0 to 1) of each wait that is
+	// randomized away, so that many failing checks do not retry in
+	// lockstep.
+	Jitter float64
+}
+
+// Attempts returns the number of times a hook should be run under
+// this policy.
+func (s RetryPolicy) Attempts() int {
+	if s.MaxAttempts < 1 {
+		return 1
+	}
+	return s.MaxAttempts
+}
+
+// Backoff returns how long to wait after the given failed attempt
+// (starting at 1), before trying again.
+func (s RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 || s.Base <= 0 {
+		return 0
+	}
+
+	wait := s.Base
+	for i := 1; i < attempt; i++ {
+		if (s.Cap > 0 && wait >= s.Cap) || wait > math.MaxInt64/2 {
+			break
+		}
+		wait *= 2
+	}
+
+	if s.Cap > 0 && wait > s.Cap {
+		wait = s.Cap
+	}
+
+	if s.Jitter > 0 {
+		jitter := s.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+
+		//nolint:gosec // jitter does not need a secure source
+		wait -= time.Duration(rand.Float64() * jitter * float64(wait))
+	}
+
+	return wait
+}
+
+// sleepContext waits for the duration on the clock, or until the
+// context is done, whichever comes first. Returns false if the context
+// ended the wait.
+func sleepContext(ctx context.Context, clock Clock, wait time.Duration) bool {
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := clock.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
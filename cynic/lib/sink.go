@@ -0,0 +1,341 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSinkRateLimited is returned by rate limited sinks when a batch of
+// alerts was dropped.
+var ErrSinkRateLimited = errors.New("sink rate limited, alerts dropped")
+
+// Sink is somewhere alerts get delivered to. The alerter hands every
+// sink the same batch of messages.
+type Sink interface {
+	// Name is used when logging delivery problems.
+	Name() string
+
+	// Send delivers a batch of alerts.
+	Send(ctx context.Context, messages []AlertMessage) error
+}
+
+// FormatAlerts renders alerts as human readable text, one line per
+// alert. Used for chat and email sinks.
+func FormatAlerts(messages []AlertMessage) string {
+	var builder strings.Builder
+
+	for _, msg := range messages {
+		name := msg.Label
+		if name == "" {
+			name = fmt.Sprintf("%d", msg.EventID)
+		}
+
+		state := msg.State
+		if state == "" {
+			state = AlertFiring
+		}
+
+		fmt.Fprintf(&builder, "[%s] %s on %s at %s: %v",
+			strings.ToUpper(string(state)), name, msg.CynicHostname, msg.Now, msg.Response)
+
+		if msg.Attempts > 1 {
+			fmt.Fprintf(&builder, " (after %d attempts)", msg.Attempts)
+		}
+
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+// WebhookFormat is the shape of the payload posted by a webhook sink.
+type WebhookFormat int
+
+const (
+	// WebhookJSON posts the alert messages as a json array.
+	WebhookJSON WebhookFormat = iota
+
+	// WebhookSlack posts a slack compatible {"text": ...} payload.
+	WebhookSlack
+
+	// WebhookMatrix posts a matrix m.text message payload.
+	WebhookMatrix
+)
+
+// WebhookSink posts alerts to an http endpoint.
+type WebhookSink struct {
+	URL    string
+	Format WebhookFormat
+	Client *http.Client
+}
+
+// WebhookSinkNew creates a sink that posts to the given url.
+func WebhookSinkNew(url string, format WebhookFormat) *WebhookSink {
+	return &WebhookSink{
+		URL:    url,
+		Format: format,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Name of the sink.
+func (s *WebhookSink) Name() string {
+	return "webhook:" + s.URL
+}
+
+func (s *WebhookSink) payload(messages []AlertMessage) ([]byte, error) {
+	switch s.Format {
+	case WebhookSlack:
+		return json.Marshal(map[string]string{
+			"text": FormatAlerts(messages),
+		})
+	case WebhookMatrix:
+		return json.Marshal(map[string]string{
+			"msgtype": "m.text",
+			"body":    FormatAlerts(messages),
+		})
+	case WebhookJSON:
+		return json.Marshal(messages)
+	}
+
+	return nil, fmt.Errorf("unknown webhook format: %d", s.Format)
+}
+
+// Send posts the alerts.
+func (s *WebhookSink) Send(ctx context.Context, messages []AlertMessage) error {
+	body, err := s.payload(messages)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// SMTPSink emails alerts.
+type SMTPSink struct {
+	Addr    string
+	From    string
+	To      []string
+	Auth    smtp.Auth
+	Subject string
+}
+
+// SMTPSinkNew creates a sink that sends mail through the server at
+// addr (host:port). Auth may be nil for servers that do not need it.
+func SMTPSinkNew(addr, from string, to []string, auth smtp.Auth) *SMTPSink {
+	return &SMTPSink{
+		Addr:    addr,
+		From:    from,
+		To:      to,
+		Auth:    auth,
+		Subject: "cynic alerts",
+	}
+}
+
+// Name of the sink.
+func (s *SMTPSink) Name() string {
+	return "smtp:" + s.Addr
+}
+
+// Send emails the alerts. The context is only checked before sending,
+// since net/smtp has no notion of one.
+func (s *SMTPSink) Send(ctx context.Context, messages []AlertMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", s.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s (%d)\r\n", s.Subject, len(messages))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	body.WriteString("\r\n")
+	body.WriteString(strings.ReplaceAll(FormatAlerts(messages), "\n", "\r\n"))
+
+	return smtp.SendMail(s.Addr, s.Auth, s.From, s.To, []byte(body.String()))
+}
+
+// ExecSink runs a local command for every batch of alerts, with the
+// alerts as a json array on its standard input.
+type ExecSink struct {
+	Command string
+	Args    []string
+}
+
+// ExecSinkNew creates a sink that runs the given command.
+func ExecSinkNew(command string, args ...string) *ExecSink {
+	return &ExecSink{
+		Command: command,
+		Args:    args,
+	}
+}
+
+// Name of the sink.
+func (s *ExecSink) Name() string {
+	return "exec:" + s.Command
+}
+
+// Send runs the command, and fails if it exits with non zero status.
+func (s *ExecSink) Send(ctx context.Context, messages []AlertMessage) error {
+	input, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+
+	//nolint:gosec // running the configured command is the point
+	cmd := exec.CommandContext(ctx, s.Command, s.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", s.Command, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// RateLimitedSink lets through at most burst batches every interval.
+// Anything over that is dropped, so a storm of alerts does not get us
+// banned from the chat server. It is a token bucket: tokens come back
+// a fraction at a time, at burst per interval.
+type RateLimitedSink struct {
+	sink     Sink
+	burst    int
+	interval time.Duration
+	clock    Clock
+
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit wraps a sink, so that at most burst batches are delivered
+// per interval.
+func RateLimit(sink Sink, burst int, interval time.Duration) *RateLimitedSink {
+	return &RateLimitedSink{
+		sink:     sink,
+		burst:    burst,
+		interval: interval,
+		clock:    SystemClock,
+		tokens:   float64(burst),
+	}
+}
+
+// SetClock makes the sink refill by the time of the clock. It should be
+// called before anything is sent.
+func (s *RateLimitedSink) SetClock(clock Clock) {
+	s.clock = orSystemClock(clock)
+}
+
+// Name is the name of the wrapped sink.
+func (s *RateLimitedSink) Name() string {
+	return s.sink.Name()
+}
+
+func (s *RateLimitedSink) take() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.clock.Now()
+	if s.last.IsZero() {
+		s.last = now
+	}
+
+	if elapsed := now.Sub(s.last); s.interval > 0 && elapsed > 0 {
+		s.tokens += float64(elapsed) / float64(s.interval) * float64(s.burst)
+		if s.tokens > float64(s.burst) {
+			s.tokens = float64(s.burst)
+		}
+		s.last = now
+	}
+
+	if s.tokens < 1 {
+		return false
+	}
+
+	s.tokens--
+	return true
+}
+
+// Send delivers the messages to the wrapped sink, or drops them with
+// ErrSinkRateLimited if there is no token left.
+func (s *RateLimitedSink) Send(ctx context.Context, messages []AlertMessage) error {
+	if !s.take() {
+		return fmt.Errorf("%w: %d alerts", ErrSinkRateLimited, len(messages))
+	}
+
+	return s.sink.Send(ctx, messages)
+}
+
+// sendAll fans the messages out to all the sinks at the same time, and
+// waits for all of them.
+func sendAll(sinks []Sink, messages []AlertMessage) {
+	var wg sync.WaitGroup
+
+	for _, sink := range sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+			defer cancel()
+
+			if err := sink.Send(ctx, messages); err != nil {
+				log.Println("problem sending alerts to", sink.Name(), ":", err)
+			}
+		}(sink)
+	}
+
+	wg.Wait()
+}
+
+const sinkTimeout = 30 * time.Second
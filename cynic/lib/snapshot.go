@@ -19,11 +19,8 @@ limitations under the License.
 package cynic
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
 	"log"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -31,28 +28,33 @@ import (
 
 const (
 	storeMagic   = 0x43594E4943535452
-	storeVersion = 1
+	storeVersion = 2
 )
 
 // SnapshotConfig is the configuration for the snapshots to be taken
 type SnapshotConfig struct {
-	Interval  time.Duration
-	DumpEvery time.Duration
-	Path      string
+	Interval    time.Duration
+	DumpEvery   time.Duration
+	Path        string
+	Compression SnapshotCompression
+
+	// Retention, if set, is applied to Path after every dump.
+	Retention *RetentionPolicy
 }
 
 // Snapshot is a copy of the state of the map currently being
 // monitored.
-type snapshot struct {
+type Snapshot struct {
 	Timestamp int64  // unix timestamp
 	Data      string // json
 }
 
-// SnapshotStore is storage of states of the map at different times
+// SnapshotStore is storage of states of the map at different times.
+// Version 1 snapshot files are this, gob encoded.
 type SnapshotStore struct {
 	Magic     uint64
 	Version   uint8 // storage version
-	Snapshots []*snapshot
+	Snapshots []*Snapshot
 }
 
 var snapshotMutex sync.Mutex
@@ -76,7 +78,7 @@ func (s *SnapshotStore) String() string {
 }
 
 func snapshotStoreNew() SnapshotStore {
-	snps := make([]*snapshot, 0)
+	snps := make([]*Snapshot, 0)
 	return SnapshotStore{
 		Magic:     storeMagic,
 		Version:   storeVersion,
@@ -84,42 +86,45 @@ func snapshotStoreNew() SnapshotStore {
 	}
 }
 
-func (s *SnapshotStore) add(snapshot *snapshot) {
+func (s *SnapshotStore) add(snapshot *Snapshot) {
 	snapshotMutex.Lock()
 	defer snapshotMutex.Unlock()
 
 	s.Snapshots = append(s.Snapshots, snapshot)
 }
 
-func (s *SnapshotStore) encode() (bytes.Buffer, error) {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
+// encodeToFile appends the snapshots to the file at path.
+func (s *SnapshotStore) encodeToFile(path string, compression SnapshotCompression) error {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
 
-	err := enc.Encode(*s)
+	file, err := SnapshotFileAppend(path, compression)
 	if err != nil {
-		log.Println("problem encoding cynic store file: ", err)
+		log.Println("problem opening cynic store file: ", err)
+		return err
 	}
 
-	return buffer, err
+	for _, snap := range s.Snapshots {
+		if err := file.Write(snap); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	return file.Close()
 }
 
-func (s *SnapshotStore) encodeToFile(path string) error {
+func (s *SnapshotStore) count() int {
 	snapshotMutex.Lock()
 	defer snapshotMutex.Unlock()
 
-	buffer, err := s.encode()
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	return os.WriteFile(path, buffer.Bytes(), 0600)
+	return len(s.Snapshots)
 }
 
 func (s *SnapshotStore) clear() {
 	snapshotMutex.Lock()
 	defer snapshotMutex.Unlock()
 
-	snp := make([]*snapshot, 0)
+	snp := make([]*Snapshot, 0)
 	s.Snapshots = snp
 }
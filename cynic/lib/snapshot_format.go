@@ -0,0 +1,384 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The snapshot file format, version 2, is a header followed by
+// records, appended one after the other:
+//
+//	header: magic (8 bytes) | version (1 byte) | compression (1 byte)
+//	record: length (4 bytes) | crc32c of payload (4 bytes) | payload
+//	payload: unix timestamp (8 bytes) | json data
+//
+// All integers are big endian. With compression, everything after the
+// header is compressed; appending to a compressed file adds a new
+// compressed stream, which readers handle transparently. Version 1
+// files are a single gob encoded SnapshotStore; they can still be read,
+// but must be loaded into memory whole.
+
+const (
+	snapshotHeaderSize = 10
+	recordHeaderSize   = 8
+	maxRecordSize      = 64 << 20
+)
+
+// SnapshotCompression is how the records of a snapshot file are
+// compressed.
+type SnapshotCompression uint8
+
+const (
+	// SnapshotUncompressed stores records as they are.
+	SnapshotUncompressed SnapshotCompression = 0
+
+	// SnapshotGzip compresses records with gzip.
+	SnapshotGzip SnapshotCompression = 1
+
+	// SnapshotZstd compresses records with zstd.
+	SnapshotZstd SnapshotCompression = 2
+)
+
+var (
+	// ErrSnapshotCorrupt is returned when a record fails its
+	// checksum, or is cut short.
+	ErrSnapshotCorrupt = errors.New("corrupt snapshot record")
+
+	// ErrSnapshotFormat is returned for files that are not cynic
+	// snapshots, or of an unknown version or compression.
+	ErrSnapshotFormat = errors.New("unsupported snapshot format")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SnapshotWriter appends snapshots to a stream, in the version 2
+// format.
+type SnapshotWriter struct {
+	out        io.Writer
+	compressor io.WriteCloser
+}
+
+// SnapshotWriterNew starts a new snapshot stream, writing the header.
+func SnapshotWriterNew(w io.Writer, compression SnapshotCompression) (*SnapshotWriter, error) {
+	header := make([]byte, snapshotHeaderSize)
+	binary.BigEndian.PutUint64(header, storeMagic)
+	header[8] = storeVersion
+	header[9] = byte(compression)
+
+	if err := checkCompression(compression); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return snapshotWriterContinue(w, compression)
+}
+
+// snapshotWriterContinue writes records to a stream that already has
+// its header.
+func snapshotWriterContinue(w io.Writer, compression SnapshotCompression) (*SnapshotWriter, error) {
+	writer := &SnapshotWriter{out: w}
+
+	switch compression {
+	case SnapshotGzip:
+		writer.compressor = gzip.NewWriter(w)
+	case SnapshotZstd:
+		encoder, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		writer.compressor = encoder
+	}
+
+	if writer.compressor != nil {
+		writer.out = writer.compressor
+	}
+	return writer, nil
+}
+
+func checkCompression(compression SnapshotCompression) error {
+	switch compression {
+	case SnapshotUncompressed, SnapshotGzip, SnapshotZstd:
+		return nil
+	}
+	return fmt.Errorf("%w: compression %d", ErrSnapshotFormat, compression)
+}
+
+// Write appends one snapshot.
+func (s *SnapshotWriter) Write(snap *Snapshot) error {
+	payload := make([]byte, 8+len(snap.Data))
+	binary.BigEndian.PutUint64(payload, uint64(snap.Timestamp))
+	copy(payload[8:], snap.Data)
+
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+
+	if _, err := s.out.Write(header); err != nil {
+		return err
+	}
+
+	_, err := s.out.Write(payload)
+	return err
+}
+
+// Close flushes whatever is left to compress. It does not close the
+// underlying writer.
+func (s *SnapshotWriter) Close() error {
+	if s.compressor != nil {
+		return s.compressor.Close()
+	}
+	return nil
+}
+
+// SnapshotFile is a snapshot file opened for appending.
+type SnapshotFile struct {
+	*SnapshotWriter
+	file *os.File
+}
+
+// SnapshotFileAppend opens the snapshot file at path for appending,
+// creating it (and writing its header) if needed. An existing file
+// keeps its own compression.
+func SnapshotFileAppend(path string, compression SnapshotCompression) (*SnapshotFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var writer *SnapshotWriter
+
+	if info.Size() == 0 {
+		writer, err = SnapshotWriterNew(file, compression)
+	} else {
+		writer, err = appendToExisting(file)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &SnapshotFile{SnapshotWriter: writer, file: file}, nil
+}
+
+func appendToExisting(file *os.File) (*SnapshotWriter, error) {
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotFormat, err)
+	}
+
+	version, compression, err := parseSnapshotHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if version != storeVersion {
+		return nil, fmt.Errorf("%w: can not append to version %d", ErrSnapshotFormat, version)
+	}
+
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+
+	return snapshotWriterContinue(file, compression)
+}
+
+// Close finishes the records, and closes the file.
+func (s *SnapshotFile) Close() error {
+	return errors.Join(s.SnapshotWriter.Close(), s.file.Sync(), s.file.Close())
+}
+
+func parseSnapshotHeader(header []byte) (uint8, SnapshotCompression, error) {
+	if binary.BigEndian.Uint64(header) != storeMagic {
+		return 0, 0, fmt.Errorf("%w: bad magic", ErrSnapshotFormat)
+	}
+
+	version := header[8]
+	compression := SnapshotCompression(header[9])
+
+	if version != storeVersion {
+		return 0, 0, fmt.Errorf("%w: version %d", ErrSnapshotFormat, version)
+	}
+
+	return version, compression, checkCompression(compression)
+}
+
+// SnapshotReader reads snapshots one at a time, so that big files do
+// not need to fit in memory. Version 1 files are read too.
+type SnapshotReader struct {
+	version uint8
+	in      *bufio.Reader
+	legacy  []*Snapshot
+	closer  io.Closer
+}
+
+// SnapshotReaderNew detects the version of the stream, and prepares to
+// read it.
+func SnapshotReaderNew(r io.Reader) (*SnapshotReader, error) {
+	in := bufio.NewReader(r)
+
+	header, err := in.Peek(snapshotHeaderSize)
+	if err == nil && binary.BigEndian.Uint64(header) == storeMagic {
+		_, compression, err := parseSnapshotHeader(header)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := in.Discard(snapshotHeaderSize); err != nil {
+			return nil, err
+		}
+
+		reader := &SnapshotReader{version: storeVersion, in: in}
+
+		if compression == SnapshotGzip {
+			decompressor, err := gzip.NewReader(in)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+			}
+			reader.in = bufio.NewReader(decompressor)
+			reader.closer = decompressor
+		}
+
+		if compression == SnapshotZstd {
+			decompressor, err := zstd.NewReader(in)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+			}
+			reader.in = bufio.NewReader(decompressor)
+			reader.closer = decompressor.IOReadCloser()
+		}
+
+		return reader, nil
+	}
+
+	// version 1: a gob of the whole store
+	var store SnapshotStore
+	if err := gob.NewDecoder(in).Decode(&store); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotFormat, err)
+	}
+
+	if store.Magic != storeMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrSnapshotFormat)
+	}
+
+	return &SnapshotReader{version: store.Version, legacy: store.Snapshots}, nil
+}
+
+// Version is the format version of the stream being read.
+func (s *SnapshotReader) Version() int {
+	return int(s.version)
+}
+
+// Next returns the next snapshot, or io.EOF once there are no more.
+func (s *SnapshotReader) Next() (*Snapshot, error) {
+	if s.in == nil {
+		if len(s.legacy) == 0 {
+			return nil, io.EOF
+		}
+		snap := s.legacy[0]
+		s.legacy = s.legacy[1:]
+		return snap, nil
+	}
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(s.in, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	checksum := binary.BigEndian.Uint32(header[4:])
+
+	if length < 8 || length > maxRecordSize {
+		return nil, fmt.Errorf("%w: bad length %d", ErrSnapshotCorrupt, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(s.in, payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+
+	return &Snapshot{
+		Timestamp: int64(binary.BigEndian.Uint64(payload)),
+		Data:      string(payload[8:]),
+	}, nil
+}
+
+// Close releases the decompressor, if any. It does not close the
+// underlying reader.
+func (s *SnapshotReader) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// ReadSnapshotFile calls fn for every snapshot in the file, in order,
+// stopping at the first error.
+func ReadSnapshotFile(path string, fn func(*Snapshot) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := SnapshotReaderNew(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		snap, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(snap); err != nil {
+			return err
+		}
+	}
+}
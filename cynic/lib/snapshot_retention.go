@@ -0,0 +1,441 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot files are named after when they were dumped:
+//
+//	2006-01-02T15:04:05-07:00.2.cynic
+//
+// and, once compacted, after the day they hold:
+//
+//	2006-01-02.daily.2.cynic
+//	2006-01-02.daily-300s.2.cynic (downsampled to one every 5 minutes)
+//
+// Files that do not look like either are never touched.
+const (
+	snapshotExtension = ".cynic"
+	dailyPrefix       = "daily"
+	dayLayout         = "2006-01-02"
+)
+
+// RetentionPolicy keeps the snapshot directory from growing forever.
+// It is applied after every dump, in this order: compaction,
+// downsampling, and then removal of the oldest files. Zero values
+// disable the matching part of the policy.
+type RetentionPolicy struct {
+	// MaxAge removes files whose newest snapshot is older than this.
+	MaxAge time.Duration
+
+	// MaxFiles keeps at most this many files, removing the oldest.
+	MaxFiles int
+
+	// MaxBytes keeps the total size of the files under this many bytes,
+	// removing the oldest.
+	MaxBytes int64
+
+	// CompactAfter merges dumps older than this into one file per day.
+	CompactAfter time.Duration
+
+	// Downsample thins out compacted days as they get older. Only
+	// daily files are downsampled.
+	Downsample []DownsampleRule
+}
+
+// DownsampleRule keeps one snapshot every Every, for days that ended
+// more than After ago.
+type DownsampleRule struct {
+	After time.Duration
+	Every time.Duration
+}
+
+// snapshotFile is a file in the snapshot directory.
+type snapshotFile struct {
+	path string
+	size int64
+
+	// start and end bound the snapshots in the file: the dump time for
+	// dumps, or the day for daily files.
+	start, end time.Time
+
+	daily bool
+	step  time.Duration
+}
+
+func parseSnapshotFilename(name string) (snapshotFile, bool) {
+	base, ok := strings.CutSuffix(name, snapshotExtension)
+	if !ok {
+		return snapshotFile{}, false
+	}
+
+	// drop the version
+	dot := strings.LastIndexByte(base, '.')
+	if dot < 0 {
+		return snapshotFile{}, false
+	}
+	if _, err := strconv.Atoi(base[dot+1:]); err != nil {
+		return snapshotFile{}, false
+	}
+	base = base[:dot]
+
+	if at, err := time.Parse(time.RFC3339, base); err == nil {
+		return snapshotFile{start: at, end: at}, true
+	}
+
+	day, kind, ok := strings.Cut(base, ".")
+	if !ok {
+		return snapshotFile{}, false
+	}
+
+	start, err := time.ParseInLocation(dayLayout, day, time.Local)
+	if err != nil {
+		return snapshotFile{}, false
+	}
+
+	file := snapshotFile{start: start, end: start.AddDate(0, 0, 1), daily: true}
+
+	switch {
+	case kind == dailyPrefix:
+	case strings.HasPrefix(kind, dailyPrefix+"-") && strings.HasSuffix(kind, "s"):
+		secs, err := strconv.Atoi(strings.TrimSuffix(kind[len(dailyPrefix)+1:], "s"))
+		if err != nil || secs <= 0 {
+			return snapshotFile{}, false
+		}
+		file.step = time.Duration(secs) * time.Second
+	default:
+		return snapshotFile{}, false
+	}
+
+	return file, true
+}
+
+func dailyFilename(day time.Time, step time.Duration) string {
+	kind := dailyPrefix
+	if step > 0 {
+		kind = fmt.Sprintf("%s-%ds", dailyPrefix, int(step/time.Second))
+	}
+	return fmt.Sprintf("%s.%s.%d%s", day.Format(dayLayout), kind, storeVersion, snapshotExtension)
+}
+
+// listSnapshotFiles returns the snapshot files in dir, oldest first.
+func listSnapshotFiles(dir string) ([]snapshotFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []snapshotFile
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		file, ok := parseSnapshotFilename(entry.Name())
+		if !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		file.path = filepath.Join(dir, entry.Name())
+		file.size = info.Size()
+		files = append(files, file)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].end.Before(files[j].end)
+	})
+
+	return files, nil
+}
+
+// ApplyRetention enforces the retention policy of the config on the
+// snapshot directory. It is called by the status cache after every
+// dump, but can be run by hand (eg: from cron, with cynic-store).
+func (s *SnapshotConfig) ApplyRetention(now time.Time) error {
+	if s.Retention == nil {
+		return nil
+	}
+
+	dir := s.Path
+	if dir == "" {
+		dir = "."
+	}
+
+	policy := s.Retention
+	var errs []error
+
+	if policy.CompactAfter > 0 {
+		errs = append(errs, s.compact(dir, now))
+	}
+
+	if len(policy.Downsample) > 0 {
+		errs = append(errs, s.downsample(dir, now))
+	}
+
+	errs = append(errs, policy.prune(dir, now))
+
+	return errors.Join(errs...)
+}
+
+// stepFor is the coarsest downsampling step that applies to a day that
+// ended at end.
+func (s *RetentionPolicy) stepFor(end, now time.Time) time.Duration {
+	var step time.Duration
+	for _, rule := range s.Downsample {
+		if now.Sub(end) >= rule.After && rule.Every > step {
+			step = rule.Every
+		}
+	}
+	return step.Truncate(time.Second)
+}
+
+// compact merges old dumps into daily files. Existing daily files are
+// merged with the new dumps; the dumps are only removed once the daily
+// file is safely written.
+func (s *SnapshotConfig) compact(dir string, now time.Time) error {
+	files, err := listSnapshotFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-s.Retention.CompactAfter)
+
+	days := make(map[string][]snapshotFile)
+	var order []string
+
+	for _, file := range files {
+		if file.daily || !file.end.Before(cutoff) {
+			continue
+		}
+
+		day := file.start.In(time.Local).Format(dayLayout)
+		if _, ok := days[day]; !ok {
+			order = append(order, day)
+		}
+		days[day] = append(days[day], file)
+	}
+
+	var errs []error
+
+	for _, day := range order {
+		sources := days[day]
+
+		start, _ := time.ParseInLocation(dayLayout, day, time.Local)
+		var previous []snapshotFile
+		for _, file := range files {
+			if file.daily && file.start.Equal(start) {
+				previous = append(previous, file)
+			}
+		}
+
+		step := s.Retention.stepFor(start.AddDate(0, 0, 1), now)
+		for _, file := range previous {
+			step = max(step, file.step)
+		}
+
+		if err := s.rewrite(dir, start, step, append(previous, sources...)); err != nil {
+			errs = append(errs, fmt.Errorf("compacting %s: %w", day, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// downsample thins out daily files that got old enough for a coarser
+// step than the one they have.
+func (s *SnapshotConfig) downsample(dir string, now time.Time) error {
+	files, err := listSnapshotFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, file := range files {
+		if !file.daily {
+			continue
+		}
+
+		step := s.Retention.stepFor(file.end, now)
+		if step <= file.step {
+			continue
+		}
+
+		if err := s.rewrite(dir, file.start, step, []snapshotFile{file}); err != nil {
+			errs = append(errs, fmt.Errorf("downsampling %s: %w", file.path, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// rewrite reads all the snapshots of sources, and writes them, sorted,
+// without duplicates and downsampled to step, in the daily file of the
+// day. The sources are removed afterwards. If anything fails to be
+// read, nothing is written or removed.
+func (s *SnapshotConfig) rewrite(dir string, day time.Time, step time.Duration, sources []snapshotFile) error {
+	var snaps []*Snapshot
+
+	for _, source := range sources {
+		err := ReadSnapshotFile(source.path, func(snap *Snapshot) error {
+			snaps = append(snaps, snap)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", source.path, err)
+		}
+	}
+
+	sort.SliceStable(snaps, func(i, j int) bool {
+		return snaps[i].Timestamp < snaps[j].Timestamp
+	})
+
+	snaps = thin(snaps, step)
+
+	target := filepath.Join(dir, dailyFilename(day, step))
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(target)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer, err := SnapshotWriterNew(tmp, s.Compression)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	for _, snap := range snaps {
+		if err := writer.Write(snap); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := errors.Join(writer.Close(), tmp.Sync()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, source := range sources {
+		if source.path == target {
+			continue
+		}
+		errs = append(errs, os.Remove(source.path))
+	}
+
+	return errors.Join(errs...)
+}
+
+// thin keeps the first snapshot of every step, and drops snapshots
+// with the same timestamp. The snapshots must be sorted.
+func thin(snaps []*Snapshot, step time.Duration) []*Snapshot {
+	secs := int64(step / time.Second)
+
+	kept := snaps[:0]
+	for _, snap := range snaps {
+		if len(kept) > 0 {
+			last := kept[len(kept)-1].Timestamp
+			if snap.Timestamp == last {
+				continue
+			}
+			if secs > 0 && floorDiv(snap.Timestamp, secs) == floorDiv(last, secs) {
+				continue
+			}
+		}
+		kept = append(kept, snap)
+	}
+
+	return kept
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// prune removes the oldest files, until the age, count and size limits
+// are respected.
+func (s *RetentionPolicy) prune(dir string, now time.Time) error {
+	if s.MaxAge <= 0 && s.MaxFiles <= 0 && s.MaxBytes <= 0 {
+		return nil
+	}
+
+	files, err := listSnapshotFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+
+	var errs []error
+	count := len(files)
+
+	for _, file := range files {
+		tooOld := s.MaxAge > 0 && now.Sub(file.end) > s.MaxAge
+		tooMany := s.MaxFiles > 0 && count > s.MaxFiles
+		tooBig := s.MaxBytes > 0 && total > s.MaxBytes
+
+		if !tooOld && !tooMany && !tooBig {
+			break
+		}
+
+		if err := os.Remove(file.path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		log.Println("removed old snapshot file:", file.path)
+		count--
+		total -= file.size
+	}
+
+	return errors.Join(errs...)
+}
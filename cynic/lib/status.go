@@ -19,13 +19,16 @@ package cynic
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -43,6 +46,26 @@ type StatusCache struct {
 
 	snapshot       *SnapshotStore
 	snapshotConfig *SnapshotConfig
+
+	stopCh   chan struct{}
+	stopOnce *sync.Once
+	workers  *sync.WaitGroup
+
+	handlers    map[string]http.Handler
+	history     *statusHistory
+	broker      *Broker
+	updateToken []byte
+
+	// mux is what the server serves; each cache has its own, so that
+	// several can live in the same process
+	mux        *http.ServeMux
+	routesOnce *sync.Once
+	routed     *bool
+	selfAuthed map[string]bool
+	auth       *statusAuth
+
+	defaultTTL time.Duration
+	clock      Clock
 }
 
 const (
@@ -55,33 +78,131 @@ const (
 	DefaultStatusEndpoint = "/status/"
 
 	defaultLinksEndpoint = "/links"
+
+	// maxUpdateBodySize is how big updates sent over http can be: big
+	// enough for a whole snapshot.
+	maxUpdateBodySize = 16 << 20
 )
 
-// StatusServerNew creates a new status server for cynic.
+// StatusServerNew creates a new status server for cynic. It panics if
+// it can not listen on the address; StatusCacheNew returns an error
+// instead, and has more options.
 func StatusServerNew(host, port, root string) StatusCache {
+	status, err := StatusCacheNew(StatusCacheConfig{Host: host, Port: port, Root: root})
+	if err != nil {
+		panic(err)
+	}
+	return *status
+}
+
+// StatusCacheNew creates a status cache, and the listener of its
+// server. Nothing is served until Start; alternatively, Handler can be
+// mounted on a server of your own.
+func StatusCacheNew(config StatusCacheConfig) (*StatusCache, error) {
+	if config.Port == "" {
+		config.Port = StatusPort
+	}
+	if config.Root == "" {
+		config.Root = DefaultStatusEndpoint
+	}
+	if !strings.HasSuffix(config.Root, "/") {
+		config.Root += "/"
+	}
+
+	auth, err := config.auth()
+	if err != nil {
+		return nil, err
+	}
+
 	server := &http.Server{
-		Addr:           host + ":" + port,
+		Addr:           net.JoinHostPort(config.Host, config.Port),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	listener, err := net.Listen("tcp", server.Addr)
-	if err != nil {
-		panic(err)
+	if config.TLS != nil {
+		if server.TLSConfig, err = config.TLS.load(); err != nil {
+			return nil, err
+		}
 	}
 
-	return StatusCache{
+	var listener net.Listener
+	if !config.Embedded {
+		if listener, err = net.Listen("tcp", server.Addr); err != nil {
+			return nil, err
+		}
+
+		if server.TLSConfig != nil {
+			listener = tls.NewListener(listener, server.TLSConfig)
+		}
+	}
+
+	stopCh := make(chan struct{})
+
+	broker := BrokerNew(DefaultStreamReplay)
+	broker.done = stopCh
+
+	return &StatusCache{
 		contractResults: &sync.Map{},
 		listener:        listener,
 		server:          server,
 		alerter:         nil,
-		root:            root,
+		root:            config.Root,
 		snapshot:        nil,
 		snapshotConfig:  nil,
+		stopCh:          stopCh,
+		stopOnce:        &sync.Once{},
+		workers:         &sync.WaitGroup{},
+		handlers:        make(map[string]http.Handler),
+		broker:          broker,
+		mux:             http.NewServeMux(),
+		routesOnce:      &sync.Once{},
+		routed:          new(bool),
+		selfAuthed:      make(map[string]bool),
+		auth:            auth,
+		defaultTTL:      config.DefaultTTL,
+		clock:           orSystemClock(config.Clock),
+	}, nil
+}
+
+// Broker is where the updates to the cache are published. Alerts can
+// be published there too (see Alerter.SetBroker), so that a single
+// stream carries everything.
+func (s *StatusCache) Broker() *Broker {
+	return s.broker
+}
+
+// Handle serves more endpoints on the status server, next to the
+// status and links endpoints. It should be called before Start.
+func (s *StatusCache) Handle(pattern string, handler http.Handler) {
+	s.handlers[pattern] = handler
+	if *s.routed {
+		s.mux.Handle(pattern, handler)
 	}
 }
 
+// HandleAuthenticated is Handle, for handlers that check credentials
+// of their own (eg: EventAPI): the protection of the cache (see
+// StatusCacheConfig) does not apply to them.
+func (s *StatusCache) HandleAuthenticated(pattern string, handler http.Handler) {
+	s.selfAuthed[pattern] = true
+	s.Handle(pattern, handler)
+}
+
+// AcceptUpdates lets clients holding the token (as a bearer token)
+// write to the cache over http, which is how cynic-store replays
+// snapshots into a running server:
+//
+//	PUT  /status/{key}  set the key to the json in the body
+//	POST /status/       set every key of the json object in the body;
+//	                    with ?replace=true, the other keys are deleted
+//
+// It must be called before Start.
+func (s *StatusCache) AcceptUpdates(token string) {
+	s.updateToken = []byte(token)
+}
+
 // WithSnapshots will make the cache dump snapshots of the data with
 // given intervals when the service starts.
 func (s *StatusCache) WithSnapshots(config *SnapshotConfig) {
@@ -92,62 +213,131 @@ func (s *StatusCache) WithSnapshots(config *SnapshotConfig) {
 
 // Start starts all services associated with status caches. This
 // includes the web interface if enabled, and the dumping of statuses
-// in files.
-func (s *StatusCache) Start() {
+// in files. It blocks until the server is stopped, and only returns
+// an error if the server failed for reasons other than Stop.
+func (s *StatusCache) Start() error {
 	if s.snapshotConfig != nil {
-		tickerSnap := time.NewTicker(s.snapshotConfig.Interval)
-		go func() {
-			for range tickerSnap.C {
-				s.snap()
-			}
-		}()
+		s.workers.Add(1)
+		go s.runSnapshots()
+	}
 
-		tickerDump := time.NewTicker(s.snapshotConfig.DumpEvery)
-		go func() {
-			for range tickerDump.C {
-				s.dump()
-			}
-		}()
+	if s.listener == nil {
+		// embedded: someone else serves the handler
+		<-s.stopCh
+		return nil
 	}
 
-	http.HandleFunc(s.root, s.makeResponse)
-	http.HandleFunc(defaultLinksEndpoint, s.makeLinks)
+	s.server.Handler = s.Handler()
 	err := s.server.Serve(s.listener)
 
-	if !errors.Is(err, http.ErrServerClosed) {
-		log.Fatal("problem shutting down status http server: ", err)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
 	}
+
+	return err
+}
+
+// Handler serves everything the cache serves, behind its protection
+// if it has any. Services that already run a server can mount it,
+// instead of calling Start; handlers added with Handle later on are
+// served too.
+func (s *StatusCache) Handler() http.Handler {
+	s.routesOnce.Do(func() {
+		s.mux.HandleFunc(s.root, s.makeResponse)
+		if bare := strings.TrimSuffix(s.root, "/"); bare != "" {
+			s.mux.HandleFunc(bare, s.makeResponse)
+		}
+		s.mux.HandleFunc(defaultLinksEndpoint, s.makeLinks)
+		s.mux.Handle(DefaultStreamEndpoint, s.broker)
+		if s.history != nil {
+			s.mux.HandleFunc(s.historyRoot(), s.makeHistory)
+		}
+		for pattern, handler := range s.handlers {
+			s.mux.Handle(pattern, handler)
+		}
+		*s.routed = true
+	})
+
+	if s.auth == nil {
+		return s.mux
+	}
+
+	return http.HandlerFunc(s.serveProtected)
 }
 
-// Stop gracefully shuts down the server.
-func (s *StatusCache) Stop() {
+// Stop gracefully shuts down the server, and the snapshot
+// routines. Snapshots which were not dumped yet are written to disk
+// before returning.
+func (s *StatusCache) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	s.stopOnce.Do(func() { close(s.stopCh) })
+
 	err := s.server.Shutdown(ctx)
 	if err != nil {
 		log.Println("could not shutdown status server gracefully: ", err)
 	}
+
+	// in case the server was never started
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+
+	s.workers.Wait()
+
+	return err
+}
+
+func (s *StatusCache) runSnapshots() {
+	defer s.workers.Done()
+
+	tickerSnap := s.clock.NewTicker(s.snapshotConfig.Interval)
+	defer tickerSnap.Stop()
+
+	tickerDump := s.clock.NewTicker(s.snapshotConfig.DumpEvery)
+	defer tickerDump.Stop()
+
+	for {
+		select {
+		case <-tickerSnap.C():
+			s.snap()
+		case <-tickerDump.C():
+			s.dump()
+		case <-s.stopCh:
+			if s.snapshot.count() > 0 {
+				s.dump()
+			}
+			return
+		}
+	}
 }
 
 // Update updates the information about all the contracts that are
-// running on different endpoints.
+// running on different endpoints. The entry gets the default ttl of
+// the cache; see UpdateEntry for more.
 func (s *StatusCache) Update(key string, value interface{}) {
-	s.contractResults.Store(key, value)
+	s.UpdateEntry(key, StatusEntry{Value: value})
 }
 
-// Delete removes an entry from the sync map.
+// Delete removes an entry from the sync map, along with its history.
 func (s *StatusCache) Delete(key string) {
 	s.contractResults.Delete(key)
+
+	if s.history != nil {
+		s.history.remove(key)
+	}
+
+	s.broker.Publish(StreamDelete, key, nil)
 }
 
 // Get gets the value inside the contract results.
 func (s *StatusCache) Get(key string) (interface{}, error) {
-	value, ok := s.contractResults.Load(key)
-	if !ok {
-		return nil, ErrStatusValueNotFound
+	entry, err := s.Entry(key)
+	if err != nil {
+		return nil, err
 	}
-	return value, nil
+	return entry.Value, nil
 }
 
 // NumEntries returns the number of entries in the map.
@@ -159,18 +349,97 @@ func (s *StatusCache) NumEntries() (count int) {
 	return
 }
 
+// numericValues gives the entries of the cache that hold a number (or a
+// bool, as 0 or 1). Stale entries are left out, rather than reported
+// as if they were current.
+func (s *StatusCache) numericValues() map[string]float64 {
+	values := make(map[string]float64)
+	now := s.clock.Now()
+
+	for key, entry := range s.entries("") {
+		if entry.Stale(now) {
+			continue
+		}
+		if number, ok := toFloat(entry.Value); ok {
+			values[key] = number
+		}
+	}
+
+	return values
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
 // GetPort this will return the port where the server was
 // started. This is useful if you assign port 0 when initializing.
+// Embedded caches have no port, and return 0.
 func (s *StatusCache) GetPort() int {
+	if s.listener == nil {
+		return 0
+	}
 	port := s.listener.Addr().(*net.TCPAddr).Port
 	return port
 }
 
+// isRoot says whether the mux pattern is the root, with or without its
+// trailing slash.
+func (s *StatusCache) isRoot(pattern string) bool {
+	return pattern == s.root || pattern == strings.TrimSuffix(s.root, "/")
+}
+
 // Dump will dump the contents of the map into a snapshot file.
 func (s *StatusCache) makeResponse(w http.ResponseWriter, req *http.Request) {
-	query := req.URL.Path[len(s.root):]
+	// the root is served with and without its trailing slash
+	var query string
+	if len(req.URL.Path) > len(s.root) {
+		query = req.URL.Path[len(s.root):]
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		s.makeUpdate(w, req, query)
+		return
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
 
-	jsonBuff, err := s.statusCacheToJSON(query)
+	jsonBuff, err := s.statusCacheToJSON(query, req.URL.Query().Get("meta") == "true")
 
 	w.Header().Set("Content-Type", "application/json")
 
@@ -185,77 +454,157 @@ func (s *StatusCache) makeResponse(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "%s", ret)
 }
 
-func (s *StatusCache) makeLinks(w http.ResponseWriter, req *http.Request) {
-	var builder strings.Builder
-	builder.WriteString("<html><head></head><body><ul>")
+func (s *StatusCache) makeUpdate(w http.ResponseWriter, req *http.Request, key string) {
+	if len(s.updateToken) == 0 {
+		writeJSONError(w, http.StatusMethodNotAllowed, "updates are not enabled")
+		return
+	}
 
-	if s.NumEntries() == 0 {
-		builder.WriteString("<h1>No links here yet.</h1>")
-		goto end
+	if !bearerAuthorized(w, req, s.updateToken) {
+		return
 	}
 
-	builder.WriteString("<h1>Links to services</h1>")
-	s.contractResults.Range(func(k interface{}, v interface{}) bool {
-		keyStr, _ := k.(string)
+	var value interface{}
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxUpdateBodySize)).Decode(&value); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodPut && key != "":
+		s.Update(key, value)
+
+	case req.Method == http.MethodPost && key == "":
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "expected a json object")
+			return
+		}
+
+		if req.URL.Query().Get("replace") == "true" {
+			s.contractResults.Range(func(k, _ interface{}) bool {
+				if keyStr, _ := k.(string); !hasKey(entries, keyStr) {
+					s.Delete(keyStr)
+				}
+				return true
+			})
+		}
+
+		for _, k := range sortedKeys(entries) {
+			// from a listing that was posted back
+			if k == StaleKey {
+				continue
+			}
+			s.Update(k, entries[k])
+		}
 
-		link := fmt.Sprintf("%v%v", s.root, keyStr)
-		atag := fmt.Sprintf(`<a href="%v" target="_blank">%v</a>`, link, keyStr)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "PUT a key, or POST to the root")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func hasKey(entries map[string]interface{}, key string) bool {
+	_, ok := entries[key]
+	return ok
+}
+
+// makeLinks lists the keys of the cache. When the dashboard is
+// mounted, it has taken over this page.
+func (s *StatusCache) makeLinks(w http.ResponseWriter, req *http.Request) {
+	if _, ok := s.handlers[DefaultDashboardEndpoint]; ok {
+		http.Redirect(w, req, DefaultDashboardEndpoint, http.StatusFound)
+		return
+	}
 
-		builder.WriteString("<li>")
-		builder.WriteString(atag)
-		builder.WriteString("</li>")
+	var keys []string
+	s.contractResults.Range(func(k interface{}, _ interface{}) bool {
+		keyStr, _ := k.(string)
+		keys = append(keys, keyStr)
 		return true
 	})
+	sort.Strings(keys)
 
-end:
-	// TODO this needs cleanup
-	builder.WriteString("</body></html>")
-	if _, err := w.Write([]byte(builder.String())); err != nil {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := linksTemplate.Execute(w, struct {
+		Root string
+		Keys []string
+	}{s.root, keys})
+	if err != nil {
 		log.Println(err)
 	}
 }
 
-func (s *StatusCache) statusCacheToJSON(query string) ([]byte, error) {
-	tmp := make(map[string]interface{})
-	s.contractResults.Range(func(k interface{}, v interface{}) bool {
-		keyStr, _ := k.(string)
-		tmp[keyStr] = v
-		return true
-	})
+// statusCacheToJSON encodes a single key, or with an empty query (or
+// one ending in the namespace separator), every key under it. Stale
+// keys are listed under StaleKey. With meta, entries come with what is
+// known about them instead of bare values.
+func (s *StatusCache) statusCacheToJSON(query string, meta bool) ([]byte, error) {
+	now := s.clock.Now()
+
+	if query != "" && !strings.HasSuffix(query, NamespaceSeparator) {
+		entry, err := s.Entry(query)
+		switch {
+		case err != nil:
+			return json.Marshal(nil)
+		case meta:
+			return json.Marshal(entry.view(now))
+		}
+		return json.Marshal(entry.Value)
+	}
 
-	var toEncode interface{}
-	if len(query) > 0 {
-		toEncode = tmp[query]
-	} else {
-		toEncode = tmp
+	entries := s.entries(query)
+	tmp := make(map[string]interface{}, len(entries)+1)
+
+	var stale []string
+	for key, entry := range entries {
+		if entry.Stale(now) {
+			stale = append(stale, key)
+		}
+
+		if meta {
+			tmp[key] = entry.view(now)
+		} else {
+			tmp[key] = entry.Value
+		}
+	}
+
+	if len(stale) > 0 && !meta {
+		sort.Strings(stale)
+		tmp[StaleKey] = stale
 	}
 
-	jsonEnc, err := json.Marshal(toEncode)
-	return jsonEnc, err
+	return json.Marshal(tmp)
 }
 
 func (s *StatusCache) snap() {
-	data, err := s.statusCacheToJSON("")
+	data, err := json.Marshal(s.values(""))
 	if err != nil {
 		log.Println("problem snapping map data")
 		return
 	}
 
-	snp := snapshot{
-		Timestamp: time.Now().Unix(),
+	snp := Snapshot{
+		Timestamp: s.clock.Now().Unix(),
 		Data:      string(data),
 	}
 	s.snapshot.add(&snp)
 }
 
 func (s *StatusCache) dump() {
-	strDate := time.Now().Format(time.RFC3339)
+	strDate := s.clock.Now().Format(time.RFC3339)
 	filename := fmt.Sprintf("%s.%v.cynic", strDate, s.snapshot.Version)
 
 	dumpPath := path.Join(s.snapshotConfig.Path, filename)
-	if err := s.snapshot.encodeToFile(dumpPath); err != nil {
+	if err := s.snapshot.encodeToFile(dumpPath, s.snapshotConfig.Compression); err != nil {
 		log.Println("problem encoding and dumping to file:", err)
 	}
 
 	s.snapshot.clear()
+
+	if err := s.snapshotConfig.ApplyRetention(s.clock.Now()); err != nil {
+		log.Println("problem applying snapshot retention:", err)
+	}
 }
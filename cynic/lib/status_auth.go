@@ -0,0 +1,180 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrStatusConfig is returned for status cache configurations that
+// can not work.
+var ErrStatusConfig = errors.New("bad status config")
+
+// StatusCacheConfig configures a status cache, and its server.
+type StatusCacheConfig struct {
+	Host string
+
+	// Port defaults to StatusPort. "0" picks a free one.
+	Port string
+
+	// Root is where the status is served; DefaultStatusEndpoint if
+	// empty. It gets a trailing slash if it has none, since the keys
+	// are served under it.
+	Root string
+
+	// DefaultTTL is how long entries hold, unless they say otherwise
+	// (see StatusEntry). Zero never expires.
+	DefaultTTL time.Duration
+
+	// TLS, if set, serves https.
+	TLS *StatusTLSConfig
+
+	// Embedded caches do not listen at all: their Handler is meant
+	// to be mounted on a server of your own. Start only runs the
+	// snapshots, until Stop.
+	Embedded bool
+
+	// Token, Username and Password protect everything the cache
+	// serves: requests need the token as a bearer token, or the
+	// username and password as basic auth. Either is enough when both
+	// are set. Handlers that check credentials of their own (see
+	// HandleAuthenticated), and updates (see AcceptUpdates), are
+	// left to do so.
+	Token    string
+	Username string
+	Password string
+
+	// Clock tells the time of updates and snapshots, and paces the
+	// snapshots; SystemClock if nil.
+	Clock Clock
+}
+
+// StatusTLSConfig are the files the status server needs to serve
+// https.
+type StatusTLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile, if set, requires clients to present a
+	// certificate signed by one of its authorities.
+	ClientCAFile string
+}
+
+func (s *StatusTLSConfig) load() (*tls.Config, error) {
+	if s.CertFile == "" || s.KeyFile == "" {
+		return nil, fmt.Errorf("%w: tls needs a cert and a key file", ErrStatusConfig)
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if s.ClientCAFile != "" {
+		pem, err := os.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates in %s", ErrStatusConfig, s.ClientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+type statusAuth struct {
+	token    []byte
+	username []byte
+	password []byte
+}
+
+func (s *StatusCacheConfig) auth() (*statusAuth, error) {
+	if (s.Username == "") != (s.Password == "") {
+		return nil, fmt.Errorf("%w: basic auth needs a username and a password", ErrStatusConfig)
+	}
+
+	if s.Token == "" && s.Username == "" {
+		return nil, nil
+	}
+
+	return &statusAuth{
+		token:    []byte(s.Token),
+		username: []byte(s.Username),
+		password: []byte(s.Password),
+	}, nil
+}
+
+func (s *statusAuth) authorized(req *http.Request) bool {
+	if len(s.token) > 0 {
+		given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(given), s.token) == 1 {
+			return true
+		}
+	}
+
+	if len(s.username) > 0 {
+		username, password, ok := req.BasicAuth()
+		if ok &&
+			subtle.ConstantTimeCompare([]byte(username), s.username) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), s.password) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveProtected lets through the requests that carry the credentials
+// of the cache, and those that are authenticated further down.
+func (s *StatusCache) serveProtected(w http.ResponseWriter, req *http.Request) {
+	_, pattern := s.mux.Handler(req)
+
+	update := s.isRoot(pattern) && len(s.updateToken) > 0 &&
+		(req.Method == http.MethodPut || req.Method == http.MethodPost)
+
+	if s.selfAuthed[pattern] || update || s.auth.authorized(req) {
+		s.mux.ServeHTTP(w, req)
+		return
+	}
+
+	if len(s.auth.username) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cynic"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cynic"`)
+	}
+	writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+}
@@ -0,0 +1,231 @@
+/*
+Package cynic monitors you from the ceiling.
+
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cynic
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Severity says how bad the value of a status entry is.
+type Severity string
+
+const (
+	// SeverityInfo is for values that are fine.
+	SeverityInfo Severity = "info"
+
+	// SeverityWarning is for values worth a look.
+	SeverityWarning Severity = "warning"
+
+	// SeverityCritical is for values of something that is broken.
+	SeverityCritical Severity = "critical"
+)
+
+const (
+	// NamespaceSeparator splits the namespace from the rest of a key:
+	// "web/homepage" is the homepage key of the web namespace, served
+	// on /status/web/homepage.
+	NamespaceSeparator = "/"
+
+	// StaleKey lists the stale keys in the json of the status
+	// endpoint, when there are any.
+	StaleKey = "_stale"
+
+	// DefaultStaleFactor is how many periods an event may go without
+	// reporting before its entries are stale.
+	DefaultStaleFactor = 3
+)
+
+// StatusEntry is a value of the status cache, along with what is known
+// about it.
+type StatusEntry struct {
+	Value     interface{}
+	UpdatedAt time.Time
+
+	// TTL is how long the value holds. Past it, the entry is stale:
+	// it is still served, but marked as such. Zero never expires.
+	TTL time.Duration
+
+	// Source is the id of the event that reported the value, if any.
+	Source uint64
+
+	Severity Severity
+}
+
+// Stale says whether the entry outlived its ttl.
+func (s StatusEntry) Stale(now time.Time) bool {
+	return s.TTL > 0 && now.Sub(s.UpdatedAt) > s.TTL
+}
+
+// statusEntryView is how entries are served, with ?meta=true.
+type statusEntryView struct {
+	Value     interface{} `json:"value"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	TTL       string      `json:"ttl,omitempty"`
+	Source    uint64      `json:"source,omitempty"`
+	Severity  Severity    `json:"severity,omitempty"`
+	Stale     bool        `json:"stale,omitempty"`
+}
+
+func (s StatusEntry) view(now time.Time) statusEntryView {
+	ret := statusEntryView{
+		Value:     s.Value,
+		UpdatedAt: s.UpdatedAt,
+		Source:    s.Source,
+		Severity:  s.Severity,
+		Stale:     s.Stale(now),
+	}
+	if s.TTL > 0 {
+		ret.TTL = s.TTL.String()
+	}
+	return ret
+}
+
+// StatusEntry wraps a value reported by the event: the event is its
+// source, and it goes stale once the event has not reported for
+// DefaultStaleFactor of its periods.
+func (s *Event) StatusEntry(value interface{}, severity Severity) StatusEntry {
+	var period time.Duration
+	if s.cron != nil {
+		next := s.cron.Next(s.now())
+		period = s.cron.Next(next).Sub(next)
+	} else {
+		period = time.Duration(s.secs) * time.Second
+	}
+
+	return StatusEntry{
+		Value:    value,
+		TTL:      DefaultStaleFactor * period,
+		Source:   s.id,
+		Severity: severity,
+	}
+}
+
+// UpdateEntry stores the entry under the key. A zero UpdatedAt is now,
+// and a zero TTL is the default of the cache.
+func (s *StatusCache) UpdateEntry(key string, entry StatusEntry) {
+	if entry.UpdatedAt.IsZero() {
+		entry.UpdatedAt = s.clock.Now()
+	}
+	if entry.TTL == 0 {
+		entry.TTL = s.defaultTTL
+	}
+
+	s.contractResults.Store(key, entry)
+
+	if s.history != nil {
+		s.history.add(key, entry.Value, entry.UpdatedAt)
+	}
+
+	s.broker.Publish(StreamStatus, key, entry.Value)
+}
+
+// Entry gets the entry under the key, value and all.
+func (s *StatusCache) Entry(key string) (StatusEntry, error) {
+	value, ok := s.contractResults.Load(key)
+	if !ok {
+		return StatusEntry{}, ErrStatusValueNotFound
+	}
+	return value.(StatusEntry), nil
+}
+
+// Stale lists the keys of the entries that outlived their ttl.
+func (s *StatusCache) Stale() []string {
+	now := s.clock.Now()
+
+	var keys []string
+	s.contractResults.Range(func(k, v interface{}) bool {
+		if v.(StatusEntry).Stale(now) {
+			keys = append(keys, k.(string))
+		}
+		return true
+	})
+	sort.Strings(keys)
+
+	return keys
+}
+
+// entries gives the entries whose key starts with the prefix, by key
+// without the prefix.
+func (s *StatusCache) entries(prefix string) map[string]StatusEntry {
+	ret := make(map[string]StatusEntry)
+
+	s.contractResults.Range(func(k, v interface{}) bool {
+		if rest, ok := strings.CutPrefix(k.(string), prefix); ok {
+			ret[rest] = v.(StatusEntry)
+		}
+		return true
+	})
+
+	return ret
+}
+
+// values gives the bare values of the entries under the prefix.
+func (s *StatusCache) values(prefix string) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for key, entry := range s.entries(prefix) {
+		ret[key] = entry.Value
+	}
+	return ret
+}
+
+// StatusNamespace is a part of the status cache, whose keys all start
+// with the name of the namespace.
+type StatusNamespace struct {
+	cache  *StatusCache
+	prefix string
+}
+
+// Namespace gives the part of the cache under the namespace.
+func (s *StatusCache) Namespace(namespace string) StatusNamespace {
+	return StatusNamespace{cache: s, prefix: namespace + NamespaceSeparator}
+}
+
+// Update stores the value under the key, within the namespace.
+func (s StatusNamespace) Update(key string, value interface{}) {
+	s.cache.Update(s.prefix+key, value)
+}
+
+// UpdateEntry stores the entry under the key, within the namespace.
+func (s StatusNamespace) UpdateEntry(key string, entry StatusEntry) {
+	s.cache.UpdateEntry(s.prefix+key, entry)
+}
+
+// Get gets the value under the key, within the namespace.
+func (s StatusNamespace) Get(key string) (interface{}, error) {
+	return s.cache.Get(s.prefix + key)
+}
+
+// Delete removes the key from the namespace.
+func (s StatusNamespace) Delete(key string) {
+	s.cache.Delete(s.prefix + key)
+}
+
+// Keys lists the keys of the namespace, without the namespace.
+func (s StatusNamespace) Keys() []string {
+	entries := s.cache.entries(s.prefix)
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,335 @@
+/*
+Package script runs checks written in a small scripting language, so
+that checks can be written without knowing go.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package script
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// builtin is a function scripts can call. These are all a script can
+// do outside of itself: there is no file or process access.
+type builtin struct {
+	name    string
+	minArgs int
+	// maxArgs is -1 for any number
+	maxArgs int
+	call    func(*interp, []interface{}) (interface{}, error)
+}
+
+var builtins = map[string]*builtin{
+	"fetch":    {"fetch", 1, 2, builtinFetch},
+	"json":     {"json", 1, 1, builtinJSON},
+	"jsonpath": {"jsonpath", 2, 2, builtinJSONPath},
+	"status":   {"status", 2, 2, builtinStatus},
+	"len":      {"len", 1, 1, builtinLen},
+	"str":      {"str", 1, 1, builtinStr},
+	"num":      {"num", 1, 1, builtinNum},
+	"contains": {"contains", 2, 2, builtinContains},
+	"matches":  {"matches", 2, 2, builtinMatches},
+	"keys":     {"keys", 1, 1, builtinKeys},
+	"now":      {"now", 0, 0, builtinNow},
+	"log":      {"log", 0, -1, builtinLog},
+}
+
+// builtinFetch does an http request:
+//
+//	fetch(url)
+//	fetch(url, {"method": "POST", "body": "...", "headers": {...}})
+//
+// and gives {status, body, headers, latency_ms}. Requests that could
+// not be made give a status of 0 and an error, rather than stopping
+// the script, so that the script decides what that means.
+func builtinFetch(in *interp, args []interface{}) (interface{}, error) {
+	target, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("the url is text, not %s", typeName(args[0]))
+	}
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, fmt.Errorf("%q is not an http url", target)
+	}
+
+	method := http.MethodGet
+	var body io.Reader
+	headers := map[string]interface{}{}
+
+	if len(args) > 1 {
+		options, ok := args[1].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("the options are a map, not %s", typeName(args[1]))
+		}
+		if m, ok := options["method"].(string); ok {
+			method = strings.ToUpper(m)
+		}
+		if b, ok := options["body"].(string); ok {
+			body = strings.NewReader(b)
+		}
+		if h, ok := options["headers"].(map[string]interface{}); ok {
+			headers = h
+		}
+	}
+
+	req, err := http.NewRequestWithContext(in.ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, str(value))
+	}
+
+	start := time.Now()
+
+	resp, err := in.client.Do(req)
+	if err != nil {
+		return map[string]interface{}{"status": 0.0, "error": err.Error()}, nil
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, in.maxBody))
+	latency := time.Since(start)
+	if err != nil {
+		return map[string]interface{}{"status": 0.0, "error": err.Error()}, nil
+	}
+
+	respHeaders := make(map[string]interface{}, len(resp.Header))
+	for key := range resp.Header {
+		respHeaders[strings.ToLower(key)] = resp.Header.Get(key)
+	}
+
+	return map[string]interface{}{
+		"status":     float64(resp.StatusCode),
+		"body":       string(content),
+		"headers":    respHeaders,
+		"latency_ms": float64(latency) / float64(time.Millisecond),
+	}, nil
+}
+
+func builtinJSON(_ *interp, args []interface{}) (interface{}, error) {
+	text, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("expected text, not %s", typeName(args[0]))
+	}
+
+	var ret interface{}
+	if err := json.Unmarshal([]byte(text), &ret); err != nil {
+		return nil, fmt.Errorf("bad json: %w", err)
+	}
+	return ret, nil
+}
+
+// builtinJSONPath looks up a path, as cynic.JSONPath does; paths that
+// lead nowhere give null.
+func builtinJSONPath(_ *interp, args []interface{}) (interface{}, error) {
+	path, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("the path is text, not %s", typeName(args[1]))
+	}
+
+	ret, err := cynic.JSONPath(args[0], path)
+	if errors.Is(err, cynic.ErrJSONPath) {
+		return nil, nil
+	}
+	return ret, err
+}
+
+// builtinStatus stores a value in the status cache, in the namespace
+// of the event: status("depth", 3) of the event "queue" is served on
+// /status/queue/depth.
+func builtinStatus(in *interp, args []interface{}) (interface{}, error) {
+	key, ok := args[0].(string)
+	if !ok || key == "" {
+		return nil, fmt.Errorf("the key is text, not %s", typeName(args[0]))
+	}
+
+	params := in.params
+	if params == nil || params.Status == nil || params.Event == nil {
+		return nil, nil
+	}
+
+	namespace := params.Event.Label
+	if namespace == "" {
+		namespace = params.Event.UniqStr()
+	}
+	params.Status.Namespace(namespace).Update(key, args[1])
+
+	return nil, nil
+}
+
+func builtinLen(_ *interp, args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case string:
+		return float64(len([]rune(v))), nil
+	case []interface{}:
+		return float64(len(v)), nil
+	case map[string]interface{}:
+		return float64(len(v)), nil
+	case nil:
+		return 0.0, nil
+	}
+	return nil, fmt.Errorf("%s has no length", typeName(args[0]))
+}
+
+func builtinStr(_ *interp, args []interface{}) (interface{}, error) {
+	return str(args[0]), nil
+}
+
+// str prints values the way json would, except for text, which is
+// left as is.
+func str(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case *builtin:
+		return "builtin " + v.name
+	}
+
+	out, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(out)
+}
+
+func builtinNum(_ *interp, args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1.0, nil
+		}
+		return 0.0, nil
+	case string:
+		ret, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("%s is not a number", typeName(args[0]))
+}
+
+// builtinContains looks for text in text, items in lists, and keys in
+// maps.
+func builtinContains(_ *interp, args []interface{}) (interface{}, error) {
+	switch haystack := args[0].(type) {
+	case string:
+		needle, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("can not look for %s in text", typeName(args[1]))
+		}
+		return strings.Contains(haystack, needle), nil
+
+	case []interface{}:
+		for _, item := range haystack {
+			if equal(item, args[1]) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case map[string]interface{}:
+		key, ok := args[1].(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := haystack[key]
+		return found, nil
+	}
+	return nil, fmt.Errorf("can not look in %s", typeName(args[0]))
+}
+
+func builtinMatches(_ *interp, args []interface{}) (interface{}, error) {
+	text, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("can only match text, not %s", typeName(args[0]))
+	}
+	pattern, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("the pattern is text, not %s", typeName(args[1]))
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(text), nil
+}
+
+func builtinKeys(_ *interp, args []interface{}) (interface{}, error) {
+	m, ok := args[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s has no keys", typeName(args[0]))
+	}
+
+	keys := sortedKeys(m)
+	ret := make([]interface{}, len(keys))
+	for i, key := range keys {
+		ret[i] = key
+	}
+	return ret, nil
+}
+
+// builtinNow gives the time in seconds since the epoch.
+func builtinNow(_ *interp, _ []interface{}) (interface{}, error) {
+	return float64(time.Now().UnixNano()) / float64(time.Second), nil
+}
+
+func builtinLog(in *interp, args []interface{}) (interface{}, error) {
+	if in.logger == nil || in.logged > maxLogLines {
+		return nil, nil
+	}
+
+	in.logged++
+	if in.logged > maxLogLines {
+		in.logger.Println(in.name+":", "too many lines, the rest of this run is not logged")
+		return nil, nil
+	}
+
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = str(arg)
+	}
+
+	line := strings.Join(parts, " ")
+	if len(line) > maxLogLineSize {
+		cut := maxLogLineSize
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		line = line[:cut] + "..."
+	}
+	in.logger.Println(in.name+":", line)
+
+	return nil, nil
+}
@@ -0,0 +1,672 @@
+/*
+Package script runs checks written in a small scripting language, so
+that checks can be written without knowing go.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// Values of scripts are those of decoded json: nil, bool, float64,
+// string, []interface{} and map[string]interface{}; and builtins.
+
+// maxValueSize bounds the text and lists that scripts can build up,
+// as the step limit alone would let them double in size every step.
+const maxValueSize = 1 << 22
+
+// errDone unwinds the program once alert or ok ran.
+var errDone = errors.New("done")
+
+type stmt interface {
+	exec(*interp) error
+}
+
+type expr interface {
+	eval(*interp) (interface{}, error)
+}
+
+// interp is the state of one run of a program.
+type interp struct {
+	name     string
+	vars     map[string]interface{}
+	steps    int
+	maxSteps int
+	maxBody  int64
+
+	ctx    context.Context
+	client *http.Client
+	params *cynic.HookParameters
+
+	logger *log.Logger
+	logged int
+
+	alert  bool
+	result interface{}
+}
+
+func (s *interp) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s:%d: %s", ErrRuntime, s.name, line, fmt.Sprintf(format, args...))
+}
+
+// step counts the work done, so that a script can not loop forever.
+func (s *interp) step(line int) error {
+	s.steps++
+	if s.steps > s.maxSteps {
+		return s.errorf(line, "too many steps, the limit is %d", s.maxSteps)
+	}
+	if s.steps%1000 == 0 && s.ctx.Err() != nil {
+		return s.errorf(line, "%v", s.ctx.Err())
+	}
+	return nil
+}
+
+func (s *interp) run(program []stmt) error {
+	err := execBlock(s, program)
+	if errors.Is(err, errDone) {
+		return nil
+	}
+	return err
+}
+
+func execBlock(s *interp, block []stmt) error {
+	for _, statement := range block {
+		if err := statement.exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type letStmt struct {
+	line  int
+	name  string
+	value expr
+}
+
+func (s *letStmt) exec(in *interp) error {
+	if err := in.step(s.line); err != nil {
+		return err
+	}
+	if _, ok := builtins[s.name]; ok {
+		return in.errorf(s.line, "%s is a builtin", s.name)
+	}
+
+	value, err := s.value.eval(in)
+	if err != nil {
+		return err
+	}
+	in.vars[s.name] = value
+	return nil
+}
+
+type assignStmt struct {
+	line   int
+	target expr
+	value  expr
+}
+
+func (s *assignStmt) exec(in *interp) error {
+	if err := in.step(s.line); err != nil {
+		return err
+	}
+
+	value, err := s.value.eval(in)
+	if err != nil {
+		return err
+	}
+
+	switch target := s.target.(type) {
+	case *identExpr:
+		if _, ok := in.vars[target.name]; !ok {
+			return in.errorf(s.line, "%s is not defined; declare it with let", target.name)
+		}
+		in.vars[target.name] = value
+		return nil
+
+	case *memberExpr:
+		of, err := target.of.eval(in)
+		if err != nil {
+			return err
+		}
+		m, ok := of.(map[string]interface{})
+		if !ok {
+			return in.errorf(s.line, "can not set field %s of %s", target.name, typeName(of))
+		}
+		m[target.name] = value
+		return nil
+
+	case *indexExpr:
+		of, err := target.of.eval(in)
+		if err != nil {
+			return err
+		}
+		index, err := target.index.eval(in)
+		if err != nil {
+			return err
+		}
+
+		switch container := of.(type) {
+		case map[string]interface{}:
+			key, ok := index.(string)
+			if !ok {
+				return in.errorf(s.line, "map keys are strings, not %s", typeName(index))
+			}
+			container[key] = value
+			return nil
+		case []interface{}:
+			i, err := listIndex(in, s.line, container, index)
+			if err != nil {
+				return err
+			}
+			container[i] = value
+			return nil
+		}
+		return in.errorf(s.line, "can not index %s", typeName(of))
+	}
+
+	return in.errorf(s.line, "can not assign to that")
+}
+
+type ifStmt struct {
+	line      int
+	cond      expr
+	then      []stmt
+	otherwise []stmt
+}
+
+func (s *ifStmt) exec(in *interp) error {
+	if err := in.step(s.line); err != nil {
+		return err
+	}
+
+	cond, err := s.cond.eval(in)
+	if err != nil {
+		return err
+	}
+	if truthy(cond) {
+		return execBlock(in, s.then)
+	}
+	return execBlock(in, s.otherwise)
+}
+
+type forStmt struct {
+	line int
+	name string
+	over expr
+	body []stmt
+}
+
+func (s *forStmt) exec(in *interp) error {
+	if err := in.step(s.line); err != nil {
+		return err
+	}
+
+	over, err := s.over.eval(in)
+	if err != nil {
+		return err
+	}
+
+	var items []interface{}
+	switch container := over.(type) {
+	case []interface{}:
+		items = append(items, container...)
+	case map[string]interface{}:
+		for _, key := range sortedKeys(container) {
+			items = append(items, key)
+		}
+	case nil:
+	default:
+		return in.errorf(s.line, "can not loop over %s", typeName(over))
+	}
+
+	for _, item := range items {
+		if err := in.step(s.line); err != nil {
+			return err
+		}
+		in.vars[s.name] = item
+		if err := execBlock(in, s.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type resultStmt struct {
+	line  int
+	alert bool
+	value expr
+}
+
+func (s *resultStmt) exec(in *interp) error {
+	var value interface{}
+	if s.value != nil {
+		var err error
+		if value, err = s.value.eval(in); err != nil {
+			return err
+		}
+	}
+
+	in.alert = s.alert
+	in.result = value
+	return errDone
+}
+
+type exprStmt struct {
+	line  int
+	value expr
+}
+
+func (s *exprStmt) exec(in *interp) error {
+	if err := in.step(s.line); err != nil {
+		return err
+	}
+	_, err := s.value.eval(in)
+	return err
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (s *literalExpr) eval(*interp) (interface{}, error) {
+	return s.value, nil
+}
+
+type identExpr struct {
+	line int
+	name string
+}
+
+func (s *identExpr) eval(in *interp) (interface{}, error) {
+	if value, ok := in.vars[s.name]; ok {
+		return value, nil
+	}
+	if fn, ok := builtins[s.name]; ok {
+		return fn, nil
+	}
+	return nil, in.errorf(s.line, "%s is not defined", s.name)
+}
+
+type listExpr struct {
+	items []expr
+}
+
+func (s *listExpr) eval(in *interp) (interface{}, error) {
+	ret := make([]interface{}, 0, len(s.items))
+	for _, item := range s.items {
+		value, err := item.eval(in)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, value)
+	}
+	return ret, nil
+}
+
+type mapExpr struct {
+	line   int
+	keys   []string
+	values []expr
+}
+
+func (s *mapExpr) eval(in *interp) (interface{}, error) {
+	ret := make(map[string]interface{}, len(s.keys))
+	for i, key := range s.keys {
+		value, err := s.values[i].eval(in)
+		if err != nil {
+			return nil, err
+		}
+		ret[key] = value
+	}
+	return ret, nil
+}
+
+type unaryExpr struct {
+	line    int
+	op      string
+	operand expr
+}
+
+func (s *unaryExpr) eval(in *interp) (interface{}, error) {
+	value, err := s.operand.eval(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.op == "!" {
+		return !truthy(value), nil
+	}
+
+	number, ok := value.(float64)
+	if !ok {
+		return nil, in.errorf(s.line, "can not negate %s", typeName(value))
+	}
+	return -number, nil
+}
+
+type binaryExpr struct {
+	line  int
+	op    string
+	left  expr
+	right expr
+}
+
+func (s *binaryExpr) eval(in *interp) (interface{}, error) {
+	if err := in.step(s.line); err != nil {
+		return nil, err
+	}
+
+	left, err := s.left.eval(in)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || only look at the right when they need to, and give
+	// back the operand that decided, like most scripting languages
+	switch s.op {
+	case "&&":
+		if !truthy(left) {
+			return left, nil
+		}
+		return s.right.eval(in)
+	case "||":
+		if truthy(left) {
+			return left, nil
+		}
+		return s.right.eval(in)
+	}
+
+	right, err := s.right.eval(in)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "+":
+		return s.add(in, left, right)
+	}
+
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			break
+		}
+		switch s.op {
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			if r == 0 {
+				return nil, in.errorf(s.line, "division by zero")
+			}
+			return l / r, nil
+		case "%":
+			if r == 0 {
+				return nil, in.errorf(s.line, "division by zero")
+			}
+			return math.Mod(l, r), nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		}
+
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			break
+		}
+		switch s.op {
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		}
+	}
+
+	return nil, in.errorf(s.line, "can not %s %s and %s", s.op, typeName(left), typeName(right))
+}
+
+func (s *binaryExpr) add(in *interp, left, right interface{}) (interface{}, error) {
+	switch l := left.(type) {
+	case float64:
+		if r, ok := right.(float64); ok {
+			return l + r, nil
+		}
+	case string:
+		if r, ok := right.(string); ok {
+			if len(l)+len(r) > maxValueSize {
+				return nil, in.errorf(s.line, "text too long, the limit is %d bytes", maxValueSize)
+			}
+			return l + r, nil
+		}
+	case []interface{}:
+		if r, ok := right.([]interface{}); ok {
+			if len(l)+len(r) > maxValueSize {
+				return nil, in.errorf(s.line, "list too long, the limit is %d items", maxValueSize)
+			}
+			ret := make([]interface{}, 0, len(l)+len(r))
+			return append(append(ret, l...), r...), nil
+		}
+	}
+	return nil, in.errorf(s.line, "can not + %s and %s; use str() to join text", typeName(left), typeName(right))
+}
+
+type memberExpr struct {
+	line int
+	of   expr
+	name string
+}
+
+func (s *memberExpr) eval(in *interp) (interface{}, error) {
+	of, err := s.of.eval(in)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := of.(map[string]interface{})
+	if !ok {
+		return nil, in.errorf(s.line, "%s has no field %s", typeName(of), s.name)
+	}
+	// missing fields are null, as json fields often are optional
+	return m[s.name], nil
+}
+
+type indexExpr struct {
+	line  int
+	of    expr
+	index expr
+}
+
+func (s *indexExpr) eval(in *interp) (interface{}, error) {
+	of, err := s.of.eval(in)
+	if err != nil {
+		return nil, err
+	}
+	index, err := s.index.eval(in)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := of.(type) {
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, in.errorf(s.line, "map keys are strings, not %s", typeName(index))
+		}
+		return container[key], nil
+
+	case []interface{}:
+		i, err := listIndex(in, s.line, container, index)
+		if err != nil {
+			return nil, err
+		}
+		return container[i], nil
+
+	case string:
+		chars := []rune(container)
+		items := make([]interface{}, len(chars))
+		for i, c := range chars {
+			items[i] = string(c)
+		}
+		i, err := listIndex(in, s.line, items, index)
+		if err != nil {
+			return nil, err
+		}
+		return items[i], nil
+	}
+
+	return nil, in.errorf(s.line, "can not index %s", typeName(of))
+}
+
+// listIndex checks the index of a list; negative ones count from the
+// end.
+func listIndex(in *interp, line int, list []interface{}, index interface{}) (int, error) {
+	number, ok := index.(float64)
+	if !ok || number != math.Trunc(number) {
+		return 0, in.errorf(line, "list indices are whole numbers, not %s", typeName(index))
+	}
+
+	i := int(number)
+	if i < 0 {
+		i += len(list)
+	}
+	if i < 0 || i >= len(list) {
+		return 0, in.errorf(line, "index %d out of range, the list has %d items", int(number), len(list))
+	}
+	return i, nil
+}
+
+type callExpr struct {
+	line int
+	fn   expr
+	args []expr
+}
+
+func (s *callExpr) eval(in *interp) (interface{}, error) {
+	if err := in.step(s.line); err != nil {
+		return nil, err
+	}
+
+	value, err := s.fn.eval(in)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := value.(*builtin)
+	if !ok {
+		return nil, in.errorf(s.line, "can not call %s", typeName(value))
+	}
+
+	args := make([]interface{}, 0, len(s.args))
+	for _, arg := range s.args {
+		value, err := arg.eval(in)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	if len(args) < fn.minArgs || fn.maxArgs >= 0 && len(args) > fn.maxArgs {
+		return nil, in.errorf(s.line, "%s: wrong number of arguments: %d", fn.name, len(args))
+	}
+
+	ret, err := fn.call(in, args)
+	if err != nil {
+		if errors.Is(err, ErrRuntime) {
+			return nil, err
+		}
+		return nil, in.errorf(s.line, "%s: %v", fn.name, err)
+	}
+	return ret, nil
+}
+
+func equal(left, right interface{}) bool {
+	return reflect.DeepEqual(left, right)
+}
+
+// truthy is false for null, false, zero, and empty text, lists and
+// maps.
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a bool"
+	case float64:
+		return "a number"
+	case string:
+		return "text"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a map"
+	case *builtin:
+		return "a builtin"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,179 @@
+/*
+Package script runs checks written in a small scripting language, so
+that checks can be written without knowing go.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNewline
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokKeyword
+)
+
+var keywords = map[string]bool{
+	"let":   true,
+	"if":    true,
+	"else":  true,
+	"for":   true,
+	"in":    true,
+	"alert": true,
+	"ok":    true,
+	"true":  true,
+	"false": true,
+	"null":  true,
+}
+
+// operators, longest first, so that "==" is not read as "=" twice
+var operators = []string{
+	"==", "!=", "<=", ">=", "&&", "||",
+	"+", "-", "*", "/", "%", "<", ">", "!", "=",
+	"(", ")", "[", "]", "{", "}", ",", ".", ":",
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+
+	// number and str hold the value of literals
+	number float64
+	str    string
+}
+
+func (s token) String() string {
+	switch s.kind {
+	case tokEOF:
+		return "end of file"
+	case tokNewline:
+		return "end of line"
+	}
+	return fmt.Sprintf("%q", s.text)
+}
+
+func (s token) is(kind tokenKind, text string) bool {
+	return s.kind == kind && s.text == text
+}
+
+// lex splits the source into tokens. Comments run from # to the end
+// of the line.
+func lex(name, src string) ([]token, error) {
+	var tokens []token
+	line := 1
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == '\n':
+			tokens = append(tokens, token{kind: tokNewline, text: "\n", line: line})
+			line++
+			i++
+
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				if end < len(src) && src[end] == '\n' {
+					break
+				}
+				end++
+			}
+			if end >= len(src) || src[end] != '"' {
+				return nil, fmt.Errorf("%w: %s:%d: unterminated string", ErrSyntax, name, line)
+			}
+
+			text := src[i : end+1]
+			value, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s:%d: bad string %s", ErrSyntax, name, line, text)
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, line: line, str: value})
+			i = end + 1
+
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(src) && (src[end] >= '0' && src[end] <= '9' || src[end] == '.' || src[end] == '_') {
+				end++
+			}
+
+			text := src[i:end]
+			value, err := strconv.ParseFloat(strings.ReplaceAll(text, "_", ""), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s:%d: bad number %s", ErrSyntax, name, line, text)
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: text, line: line, number: value})
+			i = end
+
+		case isIdentStart(c):
+			end := i
+			for end < len(src) && (isIdentStart(src[end]) || src[end] >= '0' && src[end] <= '9') {
+				end++
+			}
+
+			text := src[i:end]
+			kind := tokIdent
+			if keywords[text] {
+				kind = tokKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: text, line: line})
+			i = end
+
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("%w: %s:%d: unexpected %q", ErrSyntax, name, line, c)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, line: line})
+			i += len(op)
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokEOF, line: line})
+	return tokens, nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
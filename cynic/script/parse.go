@@ -0,0 +1,462 @@
+/*
+Package script runs checks written in a small scripting language, so
+that checks can be written without knowing go.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package script
+
+import (
+	"fmt"
+)
+
+// binding powers of the binary operators; higher binds tighter
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+const unaryPrecedence = 7
+
+type parser struct {
+	name   string
+	tokens []token
+	pos    int
+}
+
+// parse turns the source into the statements of a program.
+func parse(name, src string) ([]stmt, error) {
+	tokens, err := lex(name, src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{name: name, tokens: tokens}
+
+	var program []stmt
+	for {
+		p.skipNewlines()
+		if p.peek().kind == tokEOF {
+			return program, nil
+		}
+
+		statement, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		program = append(program, statement)
+
+		if err := p.endOfStatement(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *parser) peek() token {
+	return s.tokens[s.pos]
+}
+
+func (s *parser) next() token {
+	tok := s.tokens[s.pos]
+	if tok.kind != tokEOF {
+		s.pos++
+	}
+	return tok
+}
+
+func (s *parser) skipNewlines() {
+	for s.peek().kind == tokNewline {
+		s.pos++
+	}
+}
+
+func (s *parser) errorf(tok token, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s:%d: %s", ErrSyntax, s.name, tok.line, fmt.Sprintf(format, args...))
+}
+
+// expect consumes the operator or keyword, or fails.
+func (s *parser) expect(kind tokenKind, text string) (token, error) {
+	tok := s.next()
+	if !tok.is(kind, text) {
+		return tok, s.errorf(tok, "expected %q, got %s", text, tok)
+	}
+	return tok, nil
+}
+
+func (s *parser) ident() (token, error) {
+	tok := s.next()
+	if tok.kind != tokIdent {
+		return tok, s.errorf(tok, "expected a name, got %s", tok)
+	}
+	return tok, nil
+}
+
+func (s *parser) endOfStatement() error {
+	tok := s.peek()
+	switch {
+	case tok.kind == tokNewline || tok.kind == tokEOF:
+		return nil
+	case tok.is(tokOp, "}"):
+		// the block ends on the same line
+		return nil
+	}
+	return s.errorf(tok, "expected the end of the line, got %s", tok)
+}
+
+func (s *parser) statement() (stmt, error) {
+	tok := s.peek()
+
+	switch {
+	case tok.is(tokKeyword, "let"):
+		s.next()
+		name, err := s.ident()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.expect(tokOp, "="); err != nil {
+			return nil, err
+		}
+		value, err := s.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		return &letStmt{line: tok.line, name: name.text, value: value}, nil
+
+	case tok.is(tokKeyword, "if"):
+		return s.ifStatement()
+
+	case tok.is(tokKeyword, "for"):
+		s.next()
+		name, err := s.ident()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.expect(tokKeyword, "in"); err != nil {
+			return nil, err
+		}
+		over, err := s.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		body, err := s.block()
+		if err != nil {
+			return nil, err
+		}
+		return &forStmt{line: tok.line, name: name.text, over: over, body: body}, nil
+
+	case tok.is(tokKeyword, "alert") || tok.is(tokKeyword, "ok"):
+		s.next()
+		ret := &resultStmt{line: tok.line, alert: tok.text == "alert"}
+
+		if next := s.peek(); next.kind != tokNewline && next.kind != tokEOF && !next.is(tokOp, "}") {
+			value, err := s.expression(0)
+			if err != nil {
+				return nil, err
+			}
+			ret.value = value
+		}
+		return ret, nil
+	}
+
+	target, err := s.expression(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.peek().is(tokOp, "=") {
+		return &exprStmt{line: tok.line, value: target}, nil
+	}
+
+	switch target.(type) {
+	case *identExpr, *memberExpr, *indexExpr:
+	default:
+		return nil, s.errorf(tok, "can not assign to that")
+	}
+
+	s.next()
+	value, err := s.expression(0)
+	if err != nil {
+		return nil, err
+	}
+	return &assignStmt{line: tok.line, target: target, value: value}, nil
+}
+
+func (s *parser) ifStatement() (stmt, error) {
+	tok, err := s.expect(tokKeyword, "if")
+	if err != nil {
+		return nil, err
+	}
+
+	cond, err := s.expression(0)
+	if err != nil {
+		return nil, err
+	}
+	then, err := s.block()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &ifStmt{line: tok.line, cond: cond, then: then}
+
+	if !s.peek().is(tokKeyword, "else") {
+		return ret, nil
+	}
+	s.next()
+
+	if s.peek().is(tokKeyword, "if") {
+		elseIf, err := s.ifStatement()
+		if err != nil {
+			return nil, err
+		}
+		ret.otherwise = []stmt{elseIf}
+		return ret, nil
+	}
+
+	ret.otherwise, err = s.block()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *parser) block() ([]stmt, error) {
+	if _, err := s.expect(tokOp, "{"); err != nil {
+		return nil, err
+	}
+
+	var ret []stmt
+	for {
+		s.skipNewlines()
+
+		tok := s.peek()
+		switch {
+		case tok.is(tokOp, "}"):
+			s.next()
+			return ret, nil
+		case tok.kind == tokEOF:
+			return nil, s.errorf(tok, "missing \"}\"")
+		}
+
+		statement, err := s.statement()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, statement)
+
+		if err := s.endOfStatement(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// expression parses operators by precedence climbing: only operators
+// that bind tighter than minPrecedence are taken.
+func (s *parser) expression(minPrecedence int) (expr, error) {
+	left, err := s.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := s.peek()
+		prec, ok := precedence[tok.text]
+		if tok.kind != tokOp || !ok || prec <= minPrecedence {
+			return left, nil
+		}
+		s.next()
+
+		// operators may end a line, to continue on the next
+		s.skipNewlines()
+
+		right, err := s.expression(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{line: tok.line, op: tok.text, left: left, right: right}
+	}
+}
+
+func (s *parser) unary() (expr, error) {
+	tok := s.peek()
+	if tok.is(tokOp, "!") || tok.is(tokOp, "-") {
+		s.next()
+		operand, err := s.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{line: tok.line, op: tok.text, operand: operand}, nil
+	}
+	return s.postfix()
+}
+
+func (s *parser) postfix() (expr, error) {
+	ret, err := s.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := s.peek()
+		switch {
+		case tok.is(tokOp, "."):
+			s.next()
+			name := s.next()
+			if name.kind != tokIdent && name.kind != tokKeyword {
+				return nil, s.errorf(name, "expected a field name, got %s", name)
+			}
+			ret = &memberExpr{line: tok.line, of: ret, name: name.text}
+
+		case tok.is(tokOp, "["):
+			s.next()
+			s.skipNewlines()
+			index, err := s.expression(0)
+			if err != nil {
+				return nil, err
+			}
+			s.skipNewlines()
+			if _, err := s.expect(tokOp, "]"); err != nil {
+				return nil, err
+			}
+			ret = &indexExpr{line: tok.line, of: ret, index: index}
+
+		case tok.is(tokOp, "("):
+			s.next()
+			args, err := s.list(")")
+			if err != nil {
+				return nil, err
+			}
+			ret = &callExpr{line: tok.line, fn: ret, args: args}
+
+		default:
+			return ret, nil
+		}
+	}
+}
+
+// list parses comma separated expressions up to the closing operator,
+// which is consumed. Newlines are allowed anywhere within.
+func (s *parser) list(closing string) ([]expr, error) {
+	var ret []expr
+	for {
+		s.skipNewlines()
+		if s.peek().is(tokOp, closing) {
+			s.next()
+			return ret, nil
+		}
+
+		item, err := s.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, item)
+
+		s.skipNewlines()
+		tok := s.next()
+		switch {
+		case tok.is(tokOp, closing):
+			return ret, nil
+		case !tok.is(tokOp, ","):
+			return nil, s.errorf(tok, "expected \",\" or %q, got %s", closing, tok)
+		}
+	}
+}
+
+func (s *parser) primary() (expr, error) {
+	tok := s.next()
+
+	switch {
+	case tok.kind == tokNumber:
+		return &literalExpr{value: tok.number}, nil
+	case tok.kind == tokString:
+		return &literalExpr{value: tok.str}, nil
+	case tok.is(tokKeyword, "true"):
+		return &literalExpr{value: true}, nil
+	case tok.is(tokKeyword, "false"):
+		return &literalExpr{value: false}, nil
+	case tok.is(tokKeyword, "null"):
+		return &literalExpr{value: nil}, nil
+	case tok.kind == tokIdent:
+		return &identExpr{line: tok.line, name: tok.text}, nil
+
+	case tok.is(tokOp, "("):
+		s.skipNewlines()
+		inner, err := s.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		s.skipNewlines()
+		if _, err := s.expect(tokOp, ")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+
+	case tok.is(tokOp, "["):
+		items, err := s.list("]")
+		if err != nil {
+			return nil, err
+		}
+		return &listExpr{items: items}, nil
+
+	case tok.is(tokOp, "{"):
+		return s.mapLiteral(tok)
+	}
+
+	return nil, s.errorf(tok, "unexpected %s", tok)
+}
+
+// mapLiteral parses {"key": value, other: value}; keys are strings or
+// bare names.
+func (s *parser) mapLiteral(open token) (expr, error) {
+	ret := &mapExpr{line: open.line}
+	for {
+		s.skipNewlines()
+
+		key := s.next()
+		switch {
+		case key.is(tokOp, "}"):
+			return ret, nil
+		case key.kind == tokString:
+			ret.keys = append(ret.keys, key.str)
+		case key.kind == tokIdent || key.kind == tokKeyword:
+			ret.keys = append(ret.keys, key.text)
+		default:
+			return nil, s.errorf(key, "expected a key, got %s", key)
+		}
+
+		if _, err := s.expect(tokOp, ":"); err != nil {
+			return nil, err
+		}
+		s.skipNewlines()
+
+		value, err := s.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		ret.values = append(ret.values, value)
+
+		s.skipNewlines()
+		tok := s.next()
+		switch {
+		case tok.is(tokOp, "}"):
+			return ret, nil
+		case !tok.is(tokOp, ","):
+			return nil, s.errorf(tok, "expected \",\" or \"}\", got %s", tok)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Package script runs checks written in a small scripting language, so
+that checks can be written without knowing go.
+
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+const (
+	// DefaultTimeout bounds a run of a script, fetches and all, when
+	// no timeout is given.
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultMaxSteps bounds how much work a run of a script may do,
+	// when no limit is given.
+	DefaultMaxSteps = 100000
+
+	// maxBodySize is how much of a fetched body a script gets.
+	maxBodySize = 1 << 20
+
+	// maxLogLines and maxLogLineSize bound what a run may log.
+	maxLogLines    = 100
+	maxLogLineSize = 1 << 10
+)
+
+var (
+	// ErrSyntax is returned for scripts that can not be parsed.
+	ErrSyntax = errors.New("script syntax error")
+
+	// ErrRuntime is returned for scripts that failed while running.
+	ErrRuntime = errors.New("script error")
+)
+
+// Options configures a script check.
+type Options struct {
+	// Path is the file of the script.
+	Path string
+
+	// Timeout bounds each run of the script.
+	Timeout time.Duration
+
+	// MaxSteps bounds how many statements and operations each run may
+	// go through, so that a script can not loop forever.
+	MaxSteps int
+
+	// Client is used by fetch, if given. Otherwise a client with
+	// Timeout is made.
+	Client *http.Client
+
+	// Logger gets the lines of log, up to maxLogLines a run, and a
+	// notice whenever the file is reloaded. Nothing is logged if nil.
+	Logger *log.Logger
+}
+
+// Script is a check written in the cynic scripting language:
+//
+//	# alert when the queue backs up
+//	let resp = fetch("http://localhost:8080/stats")
+//	if resp.status != 200 {
+//	    alert "stats are down: " + str(resp.status)
+//	}
+//	let depth = jsonpath(json(resp.body), "queue.depth")
+//	status("depth", depth)
+//	if depth > 1000 {
+//	    alert {"message": "queue is backing up", "depth": depth}
+//	}
+//	ok depth
+//
+// A script runs top to bottom. "alert value" stops it and fails the
+// check with the value; "ok value" stops it and passes the check. A
+// script that reaches its end passes.
+//
+// There are numbers, text, true, false, null, lists [1, 2] and maps
+// {"key": value}, as in json. Variables are declared with let, and
+// assigned with =. There are if/else, for item in list (or in the
+// sorted keys of a map), the usual arithmetic and comparisons, &&, ||
+// and !. Fields of maps are read with map.key or map["key"]; missing
+// ones are null.
+//
+// Scripts can not touch files or run programs. The builtins are:
+//
+//	fetch(url, options)   http request; options has method, body, headers
+//	json(text)            parse json
+//	jsonpath(value, path) look up a path, see cynic.JSONPath; null if missing
+//	status(key, value)    store a value in the status cache, under the event
+//	len, str, num         length, text and number of a value
+//	contains(x, item)     text in text, item in list, key in map
+//	matches(text, regex)  whether the regex matches
+//	keys(map)             the sorted keys of a map
+//	now()                 seconds since the epoch
+//	log(values...)        log a line, see Options.Logger
+//
+// The file is read again whenever it changes, so that checks can be
+// edited without restarting cynic.
+type Script struct {
+	options Options
+	client  *http.Client
+
+	mux     sync.Mutex
+	loaded  bool
+	program []stmt
+	modTime time.Time
+	size    int64
+	err     error
+}
+
+// Load reads and parses the script, so that mistakes show up at
+// startup rather than at the first run.
+func Load(options Options) (*Script, error) {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.MaxSteps <= 0 {
+		options.MaxSteps = DefaultMaxSteps
+	}
+
+	client := options.Client
+	if client == nil {
+		client = &http.Client{Timeout: options.Timeout}
+	}
+
+	ret := &Script{options: options, client: client}
+
+	ret.mux.Lock()
+	defer ret.mux.Unlock()
+
+	if err := ret.reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Hook loads the script, and gives a hook that runs it.
+func Hook(options Options) (cynic.HookSignature, error) {
+	script, err := Load(options)
+	if err != nil {
+		return nil, err
+	}
+	return script.Run, nil
+}
+
+// reload parses the file again if it changed since it was last read.
+// A script that no longer parses keeps failing until it is fixed.
+func (s *Script) reload() error {
+	info, err := os.Stat(s.options.Path)
+	if err != nil {
+		return err
+	}
+
+	if s.loaded && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.err
+	}
+
+	src, err := os.ReadFile(s.options.Path)
+	if err != nil {
+		return err
+	}
+
+	reloading := s.loaded
+	s.loaded = true
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	program, err := parse(s.options.Path, string(src))
+	if err != nil {
+		s.err = err
+		return err
+	}
+
+	s.program = program
+	s.err = nil
+	if reloading && s.options.Logger != nil {
+		s.options.Logger.Println("script: reloaded", s.options.Path)
+	}
+
+	return nil
+}
+
+// Eval runs the script once, and gives whether it alerted, and its
+// value.
+func (s *Script) Eval(ctx context.Context, params *cynic.HookParameters) (bool, interface{}, error) {
+	s.mux.Lock()
+	err := s.reload()
+	program := s.program
+	s.mux.Unlock()
+
+	if err != nil {
+		return true, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.options.Timeout)
+	defer cancel()
+
+	in := &interp{
+		name:     s.options.Path,
+		vars:     make(map[string]interface{}),
+		maxSteps: s.options.MaxSteps,
+		maxBody:  maxBodySize,
+		ctx:      ctx,
+		client:   s.client,
+		params:   params,
+		logger:   s.options.Logger,
+	}
+
+	if err := in.run(program); err != nil {
+		return true, nil, err
+	}
+
+	return in.alert, in.result, nil
+}
+
+// Run is the hook of the script. Its value is stored in the status
+// cache under the unique name of the event. Scripts that fail to parse
+// or run alert with the error.
+func (s *Script) Run(params *cynic.HookParameters) (bool, interface{}) {
+	ctx := context.Background()
+	if params != nil && params.Context != nil {
+		ctx = params.Context
+	}
+
+	alert, value, err := s.Eval(ctx, params)
+	if err != nil {
+		value = err.Error()
+	} else if alert && value == nil {
+		value = fmt.Sprintf("%s alerted", s.options.Path)
+	}
+
+	if params != nil && params.Status != nil && params.Event != nil {
+		severity := cynic.SeverityInfo
+		if alert {
+			severity = cynic.SeverityCritical
+		}
+		params.Status.UpdateEntry(params.Event.UniqStr(), params.Event.StatusEntry(value, severity))
+	}
+
+	return alert, value
+}
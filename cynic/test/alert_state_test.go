@@ -0,0 +1,177 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func collectAlerts(alerter *cynic.Alerter, messages []cynic.AlertMessage) {
+	alerter.Start()
+	for _, msg := range messages {
+		alerter.Ch <- msg
+	}
+}
+
+func stateMessage(id uint64, state cynic.AlertState) cynic.AlertMessage {
+	return cynic.AlertMessage{
+		EventID: id,
+		Label:   "state-machine",
+		State:   state,
+	}
+}
+
+func assertStates(t *testing.T, received []cynic.AlertMessage, expected ...cynic.AlertState) {
+	if len(received) != len(expected) {
+		log.Println("expected: ", expected)
+		log.Println("received: ", received)
+		t.Fatal("unexpected number of alerts")
+	}
+
+	for i := range expected {
+		if received[i].State != expected[i] {
+			log.Println("at", i, "expected", expected[i], "got", received[i].State)
+		}
+		assert(t, received[i].State == expected[i])
+	}
+}
+
+func TestAlertDedup(t *testing.T) {
+	var received []cynic.AlertMessage
+	alerter := cynic.AlerterNew(3600, func(messages []cynic.AlertMessage) {
+		received = append(received, messages...)
+	})
+
+	collectAlerts(&alerter, []cynic.AlertMessage{
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(2, cynic.AlertFiring),
+	})
+	alerter.Stop()
+
+	assertStates(t, received, cynic.AlertFiring, cynic.AlertFiring)
+	assert(t, received[0].EventID == 1)
+	assert(t, received[0].PrevState == cynic.AlertOK)
+	assert(t, received[1].EventID == 2)
+}
+
+func TestAlertResolved(t *testing.T) {
+	var received []cynic.AlertMessage
+	alerter := cynic.AlerterNew(3600, func(messages []cynic.AlertMessage) {
+		received = append(received, messages...)
+	})
+
+	collectAlerts(&alerter, []cynic.AlertMessage{
+		stateMessage(1, cynic.AlertOK),
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(1, cynic.AlertOK),
+	})
+	alerter.Stop()
+
+	assertStates(t, received, cynic.AlertFiring, cynic.AlertResolved)
+	assert(t, received[1].PrevState == cynic.AlertFiring)
+	assert(t, alerter.State(1) == cynic.AlertOK)
+}
+
+func TestAlertFlapping(t *testing.T) {
+	var received []cynic.AlertMessage
+	alerter := cynic.AlerterNew(3600, func(messages []cynic.AlertMessage) {
+		received = append(received, messages...)
+	})
+	alerter.SetFlapping(3, 200*time.Millisecond)
+
+	collectAlerts(&alerter, []cynic.AlertMessage{
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(1, cynic.AlertOK),
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(1, cynic.AlertOK),
+		stateMessage(1, cynic.AlertFiring),
+	})
+
+	assert(t, alerter.State(1) == cynic.AlertFlapping)
+
+	// let the flap window pass, and keep failing
+	time.Sleep(300 * time.Millisecond)
+	alerter.Ch <- stateMessage(1, cynic.AlertFiring)
+	alerter.Stop()
+
+	assertStates(t, received,
+		cynic.AlertFiring,
+		cynic.AlertResolved,
+		cynic.AlertFlapping,
+		cynic.AlertFiring)
+	assert(t, received[3].PrevState == cynic.AlertFlapping)
+}
+
+func TestAlertFlappingDisabled(t *testing.T) {
+	var received []cynic.AlertMessage
+	alerter := cynic.AlerterNew(3600, func(messages []cynic.AlertMessage) {
+		received = append(received, messages...)
+	})
+	alerter.SetFlapping(0, time.Hour)
+
+	collectAlerts(&alerter, []cynic.AlertMessage{
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(1, cynic.AlertOK),
+		stateMessage(1, cynic.AlertFiring),
+		stateMessage(1, cynic.AlertOK),
+	})
+	alerter.Stop()
+
+	assertStates(t, received,
+		cynic.AlertFiring,
+		cynic.AlertResolved,
+		cynic.AlertFiring,
+		cynic.AlertResolved)
+}
+
+func TestEventReportsRecovery(t *testing.T) {
+	var calls int
+	var received []cynic.AlertMessage
+
+	alerter := cynic.AlerterNew(3600, func(messages []cynic.AlertMessage) {
+		received = append(received, messages...)
+	})
+	alerter.Start()
+
+	event := cynic.EventNew(1)
+	event.Label = "recovering"
+	event.Repeat(true)
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		calls++
+		return calls <= 2, calls
+	})
+
+	planner := cynic.PlannerNew()
+	planner.SetAlerter(&alerter)
+	planner.Add(&event)
+
+	for i := 0; i < 5; i++ {
+		planner.Tick()
+	}
+	alerter.Stop()
+
+	assertStates(t, received, cynic.AlertFiring, cynic.AlertResolved)
+	assert(t, received[0].EventID == event.ID())
+	assert(t, received[0].Label == "recovering")
+	assert(t, received[1].EventID == event.ID())
+}
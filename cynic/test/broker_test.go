@@ -0,0 +1,224 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func receive(t *testing.T, events <-chan cynic.StreamEvent) cynic.StreamEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	return cynic.StreamEvent{}
+}
+
+func TestBrokerFilters(t *testing.T) {
+	broker := cynic.BrokerNew(10)
+
+	_, web, cancelWeb := broker.Subscribe([]string{"web-"}, nil, 0)
+	defer cancelWeb()
+	_, alerts, cancelAlerts := broker.Subscribe(nil, []string{cynic.StreamAlert}, 0)
+	defer cancelAlerts()
+
+	broker.Publish(cynic.StreamStatus, "db-1", 1)
+	broker.Publish(cynic.StreamStatus, "web-2", 2)
+	broker.Publish(cynic.StreamAlert, "db-1", "down")
+
+	event := receive(t, web)
+	assert(t, event.Key == "web-2")
+	assert(t, event.Value == 2)
+	assert(t, event.ID == 2)
+
+	event = receive(t, alerts)
+	assert(t, event.Kind == cynic.StreamAlert)
+	assert(t, event.Value == "down")
+
+	assert(t, len(web) == 0)
+	assert(t, len(alerts) == 0)
+
+	cancelWeb()
+	cancelWeb() // twice is fine
+	assert(t, broker.Subscribers() == 1)
+}
+
+func TestBrokerReplay(t *testing.T) {
+	broker := cynic.BrokerNew(3)
+
+	for i := 1; i <= 5; i++ {
+		broker.Publish(cynic.StreamStatus, fmt.Sprintf("key-%d", i), i)
+	}
+
+	missed, _, cancel := broker.Subscribe(nil, nil, 3)
+	cancel()
+	assert(t, len(missed) == 2)
+	assert(t, missed[0].ID == 4)
+	assert(t, missed[1].ID == 5)
+
+	// only what is still in the buffer can be replayed
+	missed, _, cancel = broker.Subscribe(nil, nil, 1)
+	cancel()
+	assert(t, len(missed) == 3)
+
+	// the server restarted: everything is new
+	missed, _, cancel = broker.Subscribe(nil, nil, 1000)
+	cancel()
+	assert(t, len(missed) == 3)
+
+	// filters apply to the replay too
+	missed, _, cancel = broker.Subscribe([]string{"key-5"}, nil, 1)
+	cancel()
+	assert(t, len(missed) == 1)
+
+	// a fresh subscriber gets nothing old
+	missed, _, cancel = broker.Subscribe(nil, nil, 0)
+	cancel()
+	assert(t, len(missed) == 0)
+}
+
+func TestBrokerDropsSlowSubscribers(t *testing.T) {
+	broker := cynic.BrokerNew(0)
+	_, events, cancel := broker.Subscribe(nil, nil, 0)
+	defer cancel()
+
+	for i := 0; i < 1000; i++ {
+		broker.Publish(cynic.StreamStatus, "flood", i)
+	}
+
+	count := 0
+	for range events {
+		count++
+	}
+
+	assert(t, count > 0 && count < 1000)
+	assert(t, broker.Subscribers() == 0)
+}
+
+func TestBrokerStatusAndAlerts(t *testing.T) {
+	status := cynic.StatusServerNew("", "0", "/TestBrokerStatusAndAlerts/")
+	_, events, cancel := status.Broker().Subscribe(nil, nil, 0)
+	defer cancel()
+
+	status.Update("temperature", 21)
+	status.Delete("temperature")
+
+	event := receive(t, events)
+	assert(t, event.Kind == cynic.StreamStatus && event.Key == "temperature")
+	event = receive(t, events)
+	assert(t, event.Kind == cynic.StreamDelete && event.Key == "temperature")
+
+	alerter := cynic.AlerterNew(3600, nil)
+	alerter.SetBroker(status.Broker())
+	alerter.Start()
+	alerter.Ch <- cynic.AlertMessage{EventID: 7, Label: "web", State: cynic.AlertFiring}
+	alerter.Stop()
+
+	event = receive(t, events)
+	assert(t, event.Kind == cynic.StreamAlert)
+	assert(t, event.Key == "web-7")
+	assert(t, event.Value.(cynic.AlertMessage).State == cynic.AlertFiring)
+}
+
+// readStreamEvent reads one server sent event, returning its fields.
+func readStreamEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	fields := make(map[string]string)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(fields) == 0 {
+				continue
+			}
+			return fields
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, ": ")
+		fields[name] = value
+	}
+}
+
+func TestBrokerServerSentEvents(t *testing.T) {
+	broker := cynic.BrokerNew(10)
+	ts := httptest.NewServer(broker)
+	defer ts.Close()
+
+	connect := func(lastID string) (*bufio.Reader, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/stream?prefix=web-", nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, resp.Header.Get("Content-Type") == "text/event-stream")
+
+		return bufio.NewReader(resp.Body), func() {
+			cancel()
+			resp.Body.Close()
+		}
+	}
+
+	reader, disconnect := connect("")
+
+	// the handler has subscribed once the headers arrived
+	broker.Publish(cynic.StreamStatus, "db-1", "ignored")
+	broker.Publish(cynic.StreamStatus, "web-1", map[string]int{"latency": 12})
+
+	fields := readStreamEvent(t, reader)
+	assert(t, fields["event"] == cynic.StreamStatus)
+	assert(t, fields["id"] == "2")
+
+	var event cynic.StreamEvent
+	assert(t, json.Unmarshal([]byte(fields["data"]), &event) == nil)
+	assert(t, event.Key == "web-1")
+
+	disconnect()
+
+	// missed while away
+	broker.Publish(cynic.StreamStatus, "web-2", 2)
+	broker.Publish(cynic.StreamStatus, "web-3", 3)
+
+	reader, disconnect = connect("2")
+	defer disconnect()
+
+	assert(t, readStreamEvent(t, reader)["id"] == "3")
+	assert(t, readStreamEvent(t, reader)["id"] == "4")
+}
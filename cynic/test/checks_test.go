@@ -0,0 +1,318 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/checks"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// runCheck runs the hook the same way an event would, with a status
+// cache attached, and returns what the hook reported.
+func runCheck(t *testing.T, hook cynic.HookSignature) (bool, checks.Result, *cynic.StatusCache) {
+	status := cynic.StatusServerNew("", "0", "/status/"+t.Name())
+
+	event := cynic.EventNew(1)
+	event.Label = "check"
+	event.SetDataRepo(&status)
+
+	var alert bool
+	var result checks.Result
+	event.AddHook(func(params *cynic.HookParameters) (bool, interface{}) {
+		var res interface{}
+		alert, res = hook(params)
+		result = res.(checks.Result)
+		return alert, res
+	})
+	event.Execute()
+
+	stored, err := status.Get(event.UniqStr())
+	assert(t, err == nil)
+	assert(t, reflect.DeepEqual(stored.(checks.Result), result))
+
+	entry, err := status.Entry(event.UniqStr())
+	assert(t, err == nil)
+	assert(t, entry.Source == event.ID())
+	assert(t, entry.TTL == cynic.DefaultStaleFactor*time.Second)
+	assert(t, (entry.Severity == cynic.SeverityCritical) == alert)
+
+	return alert, result, &status
+}
+
+func TestCheckHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintln(w, `{"status": "all good"}`)
+	}))
+	defer ts.Close()
+
+	type testCase struct {
+		name  string
+		opts  checks.HTTPOptions
+		alert bool
+	}
+
+	cases := [...]testCase{
+		{"plain 2xx", checks.HTTPOptions{URL: ts.URL}, false},
+		{"expected status", checks.HTTPOptions{URL: ts.URL, ExpectStatus: 200}, false},
+		{"unexpected status", checks.HTTPOptions{URL: ts.URL + "/broken"}, true},
+		{"expected 502", checks.HTTPOptions{URL: ts.URL + "/broken", ExpectStatus: 502}, false},
+		{"body matches", checks.HTTPOptions{URL: ts.URL, BodyRegex: "all go+d"}, false},
+		{"body does not match", checks.HTTPOptions{URL: ts.URL, BodyRegex: "on fire"}, true},
+		{"unreachable", checks.HTTPOptions{URL: "http://127.0.0.1:1/", Timeout: time.Second}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hook, err := checks.HTTP(c.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			alert, result, _ := runCheck(t, hook)
+			assert(t, alert == c.alert)
+			assert(t, result.OK == !c.alert)
+		})
+	}
+}
+
+func TestCheckHTTPLatency(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	hook, _ := checks.HTTP(checks.HTTPOptions{URL: ts.URL, MaxLatency: 10 * time.Millisecond})
+	alert, result, _ := runCheck(t, hook)
+	assert(t, alert)
+	assert(t, result.LatencyMS >= 100)
+	assert(t, result.Details["status_code"] == 200)
+
+	hook, _ = checks.HTTP(checks.HTTPOptions{URL: ts.URL, MaxLatency: 10 * time.Second})
+	alert, _, _ = runCheck(t, hook)
+	assert(t, !alert)
+}
+
+func TestCheckHTTPCertExpiry(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	notAfter := ts.Certificate().NotAfter
+	validFor := time.Until(notAfter)
+
+	hook, _ := checks.HTTP(checks.HTTPOptions{
+		URL:             ts.URL,
+		MinCertValidity: validFor - 24*time.Hour,
+		Client:          ts.Client(),
+	})
+	alert, result, _ := runCheck(t, hook)
+	assert(t, !alert)
+	assert(t, result.Details["cert_expires_at"] == notAfter.Format(time.RFC3339))
+
+	hook, _ = checks.HTTP(checks.HTTPOptions{
+		URL:             ts.URL,
+		MinCertValidity: validFor + 24*time.Hour,
+		Client:          ts.Client(),
+	})
+	alert, result, _ = runCheck(t, hook)
+	log.Println(result.Message)
+	assert(t, alert)
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	hook, _ = checks.HTTP(checks.HTTPOptions{URL: plain.URL, MinCertValidity: time.Hour})
+	alert, _, _ = runCheck(t, hook)
+	assert(t, alert)
+}
+
+func TestCheckHTTPBadRegex(t *testing.T) {
+	_, err := checks.HTTP(checks.HTTPOptions{URL: "http://localhost", BodyRegex: "("})
+	assert(t, err != nil)
+}
+
+func TestCheckTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+
+	alert, _, _ := runCheck(t, checks.TCP(addr, time.Second))
+	assert(t, !alert)
+
+	listener.Close()
+
+	alert, _, _ = runCheck(t, checks.TCP(addr, time.Second))
+	assert(t, alert)
+}
+
+func TestCheckPing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	alert, result, _ := runCheck(t, checks.Ping("127.0.0.1", port, time.Second))
+	assert(t, !alert)
+	assert(t, result.LatencyMS > 0)
+
+	// a refused connection still means the host is up
+	listener.Close()
+	alert, _, _ = runCheck(t, checks.Ping("127.0.0.1", port, time.Second))
+	assert(t, !alert)
+
+	alert, _, _ = runCheck(t, checks.Ping("this-does-not-exist.invalid", 80, time.Second))
+	assert(t, alert)
+}
+
+func TestCheckDNS(t *testing.T) {
+	alert, result, _ := runCheck(t, checks.DNS("localhost", time.Second))
+	assert(t, !alert)
+	assert(t, result.Message != "")
+
+	alert, _, _ = runCheck(t, checks.DNS("this-does-not-exist.invalid", time.Second))
+	assert(t, alert)
+}
+
+func TestCheckCommand(t *testing.T) {
+	alert, result, _ := runCheck(t, checks.Command("sh", []string{"-c", "echo hi"}, 0))
+	assert(t, !alert)
+	assert(t, strings.Contains(result.Message, "hi"))
+
+	alert, _, _ = runCheck(t, checks.Command("sh", []string{"-c", "exit 2"}, 0))
+	assert(t, alert)
+
+	alert, _, _ = runCheck(t, checks.Command("sh", []string{"-c", "exit 2"}, 2))
+	assert(t, !alert)
+
+	alert, _, _ = runCheck(t, checks.Command("/does/not/exist", nil, 0))
+	assert(t, alert)
+}
+
+func TestCheckFileAge(t *testing.T) {
+	file := path.Join(t.TempDir(), "backup")
+	if err := os.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	alert, _, _ := runCheck(t, checks.FileAge(file, time.Hour))
+	assert(t, !alert)
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	alert, _, _ = runCheck(t, checks.FileAge(file, time.Hour))
+	assert(t, alert)
+
+	alert, _, _ = runCheck(t, checks.FileAge(file+".missing", time.Hour))
+	assert(t, alert)
+}
+
+func TestCheckDiskUsage(t *testing.T) {
+	alert, result, _ := runCheck(t, checks.DiskUsage(t.TempDir(), 100))
+	assert(t, !alert)
+	assert(t, result.Details["total_bytes"].(uint64) > 0)
+
+	alert, _, _ = runCheck(t, checks.DiskUsage("/", 0))
+	assert(t, alert)
+
+	alert, _, _ = runCheck(t, checks.DiskUsage("/does/not/exist", 100))
+	assert(t, alert)
+}
+
+func TestCheckProcess(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip("can not start sleep:", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	alert, result, _ := runCheck(t, checks.Process("sleep"))
+	assert(t, !alert)
+
+	found := false
+	for _, pid := range result.Details["pids"].([]int) {
+		found = found || pid == cmd.Process.Pid
+	}
+	assert(t, found)
+
+	alert, _, _ = runCheck(t, checks.Process("surely-nobody-runs-this"))
+	assert(t, alert)
+}
+
+func TestCheckJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/text" {
+			fmt.Fprintln(w, "not json")
+			return
+		}
+		fmt.Fprintln(w, `{"status": "ok", "db": {"replicas": [{"lag": 3}, {"lag": 12}]}, "ready": true}`)
+	}))
+	defer ts.Close()
+
+	type testCase struct {
+		name   string
+		url    string
+		path   string
+		expect string
+		alert  bool
+	}
+
+	cases := [...]testCase{
+		{"string", ts.URL, "$.status", "ok", false},
+		{"string mismatch", ts.URL, "$.status", "down", true},
+		{"number", ts.URL, "$.db.replicas[1].lag", "12", false},
+		{"bool", ts.URL, "ready", "true", false},
+		{"exists", ts.URL, "$.db.replicas", "", false},
+		{"missing", ts.URL, "$.db.primary", "", true},
+		{"not json", ts.URL + "/text", "$.status", "ok", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			alert, result, _ := runCheck(t, checks.JSON(checks.JSONOptions{
+				URL:    c.url,
+				Path:   c.path,
+				Expect: c.expect,
+			}))
+			log.Println(result.Message)
+			assert(t, alert == c.alert)
+		})
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/cynictest"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+var epoch = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeClockTickers(t *testing.T) {
+	clock := cynictest.ClockNew(epoch)
+
+	two := clock.NewTicker(2 * time.Second)
+	three := clock.NewTicker(3 * time.Second)
+	assert(t, clock.Tickers() == 2)
+
+	var got []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(got) < 5 {
+			select {
+			case at := <-two.C():
+				got = append(got, "2@"+at.Sub(epoch).String())
+			case at := <-three.C():
+				got = append(got, "3@"+at.Sub(epoch).String())
+			}
+		}
+	}()
+
+	clock.Advance(6500 * time.Millisecond)
+	<-done
+
+	log.Println("ticks:", got)
+	assert(t, len(got) == 5)
+	assert(t, got[0] == "2@2s" && got[1] == "3@3s" && got[2] == "2@4s")
+	assert(t, got[3] == "2@6s" && got[4] == "3@6s")
+	assert(t, clock.Now().Equal(epoch.Add(6500*time.Millisecond)))
+
+	// stopped tickers are not waited on
+	two.Stop()
+	three.Stop()
+	assert(t, clock.Tickers() == 0)
+	clock.Advance(time.Hour)
+
+	// and the clock can be set back, without ticks
+	clock.Set(epoch)
+	assert(t, clock.Now().Equal(epoch))
+}
+
+func TestHarnessAlerts(t *testing.T) {
+	h := cynictest.HarnessNew(epoch, 5)
+	defer h.Close()
+
+	probe := cynictest.ProbeNew(h.Clock)
+	event := cynic.EventNew(10)
+	event.Label = "web"
+	event.Repeat(true)
+	event.AddHook(probe.Hook)
+	h.Add(&event)
+
+	h.Advance(time.Minute)
+	cynictest.ExpectRuns(t, probe, 5)
+	assert(t, probe.Runs()[0].Equal(epoch.Add(11*time.Second)))
+	assert(t, event.LastRun().Equal(epoch.Add(51*time.Second)))
+	assert(t, h.Recorder.Batches() == 0)
+
+	probe.Fail("down")
+	h.Advance(time.Minute)
+	cynictest.ExpectAlerts(t, h.Recorder, "web:firing")
+
+	firing := h.Recorder.Messages()[0]
+	assert(t, firing.Response == "down")
+	assert(t, firing.Now == epoch.Add(61*time.Second).Format(time.RFC3339))
+
+	probe.Pass("up")
+	h.Advance(time.Minute)
+	cynictest.ExpectAlerts(t, h.Recorder, "web:firing", "web:resolved")
+	cynictest.ExpectRuns(t, probe, 17)
+}
+
+func TestHarnessCron(t *testing.T) {
+	h := cynictest.HarnessNew(epoch, 5)
+	defer h.Close()
+
+	probe := cynictest.ProbeNew(h.Clock)
+	event, err := cynic.EventCronNew("*/5 * * * *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.AddHook(probe.Hook)
+	h.Add(&event)
+
+	h.Advance(15*time.Minute + 2*time.Second)
+	cynictest.ExpectRuns(t, probe, 3)
+
+	for i, run := range probe.Runs() {
+		mark := epoch.Add(time.Duration(i+1) * 5 * time.Minute)
+		late := run.Sub(mark)
+		log.Println("cron run", i, "at", run, "late by", late)
+		assert(t, late >= 0 && late <= time.Second)
+	}
+}
+
+// waitUntil polls the condition, in real time, for up to
+// cynictest.WaitTimeout: for what goroutines do on their own.
+func waitUntil(cond func() bool) bool {
+	deadline := time.Now().Add(cynictest.WaitTimeout)
+	for !cond() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+func TestFakeClockTimers(t *testing.T) {
+	clock := cynictest.ClockNew(epoch)
+
+	late := clock.NewTimer(3 * time.Second)
+	early := clock.NewTimer(time.Second)
+	stopped := clock.NewTimer(2 * time.Second)
+	assert(t, clock.Timers() == 3)
+
+	assert(t, stopped.Stop())
+	assert(t, !stopped.Stop())
+
+	clock.Advance(2 * time.Second)
+	assert(t, (<-early.C()).Equal(epoch.Add(time.Second)))
+	assert(t, clock.Timers() == 1)
+	assert(t, !early.Stop())
+
+	clock.Advance(time.Hour)
+	assert(t, (<-late.C()).Equal(epoch.Add(3*time.Second)))
+	assert(t, clock.Timers() == 0)
+
+	// like time.NewTimer, no wait fires right away
+	now := clock.NewTimer(0)
+	assert(t, (<-now.C()).Equal(clock.Now()))
+}
+
+func TestRetryFakeClock(t *testing.T) {
+	clock := cynictest.ClockNew(epoch)
+	recorder := cynictest.RecorderNew()
+
+	alerter := cynic.AlerterNew(3600, nil)
+	alerter.SetClock(clock)
+	alerter.AddSink(recorder)
+	alerter.Start()
+
+	planner := cynic.PlannerNew()
+	planner.SetClock(clock)
+	planner.SetAlerter(&alerter)
+
+	probe := cynictest.ProbeNew(clock)
+	probe.Fail("down")
+
+	event := cynic.EventNew(3600)
+	event.Label = "flaky"
+	event.SetRetryPolicy(cynic.RetryPolicy{MaxAttempts: 3, Base: time.Minute})
+	event.AddHook(probe.Hook)
+	planner.Add(&event)
+
+	if err := planner.Trigger(event.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hook waits on the clock between attempts: one, then two
+	// minutes
+	for attempt, wait := range []time.Duration{time.Minute, 2 * time.Minute} {
+		assert(t, waitUntil(func() bool { return clock.Timers() == 1 }))
+		cynictest.ExpectRuns(t, probe, attempt+1)
+		clock.Advance(wait)
+	}
+	planner.Wait()
+	alerter.Stop()
+
+	runs := probe.Runs()
+	log.Println("attempts at:", runs)
+	assert(t, len(runs) == 3)
+	assert(t, runs[0].Equal(epoch))
+	assert(t, runs[1].Equal(epoch.Add(time.Minute)))
+	assert(t, runs[2].Equal(epoch.Add(3*time.Minute)))
+
+	cynictest.ExpectAlerts(t, recorder, "flaky:firing")
+	assert(t, recorder.Messages()[0].Attempts == 3)
+}
+
+func TestStatusSnapshotsFakeClock(t *testing.T) {
+	clock := cynictest.ClockNew(epoch)
+	dir := t.TempDir()
+
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status.WithSnapshots(&cynic.SnapshotConfig{
+		Interval:  time.Minute,
+		DumpEvery: 5 * time.Minute,
+		Path:      dir,
+	})
+
+	go func() { _ = status.Start() }()
+
+	// the snapshots start on a goroutine of their own
+	assert(t, waitUntil(func() bool { return clock.Tickers() == 2 }))
+
+	status.Update("answer", 42)
+	entry, _ := status.Entry("answer")
+	assert(t, entry.UpdatedAt.Equal(epoch))
+
+	clock.Advance(5 * time.Minute)
+	status.Stop()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.cynic"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Println("dumped:", files)
+	assert(t, len(files) == 1)
+	assert(t, strings.HasPrefix(filepath.Base(files[0]), epoch.Add(5*time.Minute).Format(time.RFC3339)+"."))
+
+	info, err := os.Stat(files[0])
+	assert(t, err == nil && info.Size() > 0)
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/cynictest"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+const clusterToken = "cluster-sekrit"
+
+// clusterNode is one cynic of a test cluster, on its own server.
+type clusterNode struct {
+	cluster  *cynic.Cluster
+	planner  *cynic.Planner
+	recorder *alertRecorder
+	server   *httptest.Server
+	event    *cynic.Event
+	down     int32
+}
+
+// clusterNew starts a cluster of nodes on localhost, that all run a
+// "web" event.
+func clusterNew(t *testing.T, interval time.Duration, names ...string) []*clusterNode {
+	t.Helper()
+
+	nodes := make([]*clusterNode, len(names))
+	for i := range nodes {
+		node := &clusterNode{}
+		node.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			node.cluster.ServeHTTP(w, req)
+		}))
+		t.Cleanup(node.server.Close)
+		nodes[i] = node
+	}
+
+	for i, node := range nodes {
+		var peers []string
+		for j, other := range nodes {
+			if j != i {
+				peers = append(peers, other.server.URL)
+			}
+		}
+
+		cluster, err := cynic.ClusterNew(cynic.ClusterConfig{
+			Node:     names[i],
+			Peers:    peers,
+			Token:    clusterToken,
+			Interval: interval,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node.cluster = cluster
+		node.recorder = alertRecorderNew()
+		node.planner = cynic.PlannerNew()
+		node.planner.SetAlerter(&node.recorder.alerter)
+		node.planner.SetCluster(cluster)
+		node.event = switchEvent("web", &node.down)
+		node.planner.Add(node.event)
+	}
+
+	return nodes
+}
+
+// round runs the event on every node, then gossips twice, so that
+// every node hears from every other.
+func round(t *testing.T, nodes []*clusterNode) {
+	t.Helper()
+
+	for _, node := range nodes {
+		run(t, node.planner, node.event)
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, node := range nodes {
+			node.cluster.Gossip(context.Background())
+		}
+	}
+}
+
+func TestClusterConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		config cynic.ClusterConfig
+	}{
+		{"no token", cynic.ClusterConfig{Node: "a"}},
+		{"bad peer", cynic.ClusterConfig{Node: "a", Token: "t", Peers: []string{"localhost:9999"}}},
+		{"short lease", cynic.ClusterConfig{Node: "a", Token: "t", Interval: time.Second, LeaseTTL: time.Second}},
+		{"negative quorum", cynic.ClusterConfig{Node: "a", Token: "t", Quorum: -1}},
+	}
+
+	for _, c := range cases {
+		_, err := cynic.ClusterNew(c.config)
+		if !errors.Is(err, cynic.ErrClusterConfig) {
+			log.Println("expected a config error for:", c.name, err)
+		}
+		assert(t, errors.Is(err, cynic.ErrClusterConfig))
+	}
+}
+
+func TestClusterQuorum(t *testing.T) {
+	nodes := clusterNew(t, time.Second, "a", "b", "c")
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	round(t, nodes)
+	for _, node := range nodes {
+		assert(t, node.cluster.Leader() == "a")
+		assert(t, len(node.cluster.Nodes()) == 3)
+	}
+	assert(t, a.cluster.IsLeader())
+	assert(t, !b.cluster.IsLeader())
+
+	// a single vantage point is not enough
+	atomic.StoreInt32(&c.down, 1)
+	round(t, nodes)
+
+	check := a.cluster.Checks()["web"]
+	assert(t, !check.Firing)
+	assert(t, strings.Join(check.Failing, ",") == "c")
+
+	// two out of three are
+	atomic.StoreInt32(&b.down, 1)
+	round(t, nodes)
+
+	check = a.cluster.Checks()["web"]
+	assert(t, check.Firing)
+	assert(t, check.Nodes == 3)
+
+	// back up everywhere
+	atomic.StoreInt32(&b.down, 0)
+	atomic.StoreInt32(&c.down, 0)
+	round(t, nodes)
+
+	delivered := a.recorder.delivered()
+	log.Println("delivered by a:", delivered)
+	assert(t, strings.Join(delivered, " ") == "web:firing web:resolved")
+
+	firing := a.recorder.messages[0]
+	log.Println("firing:", firing.Response)
+	assert(t, strings.HasPrefix(firing.Response.(string), "failing from 2 of 3 locations (b, c)"))
+	assert(t, strings.Join(firing.Locations, ",") == "b,c")
+	assert(t, firing.Nodes == 3)
+	assert(t, firing.EventID == a.event.ID())
+
+	// the followers did not alert at all
+	assert(t, len(b.recorder.delivered()) == 0)
+	assert(t, len(c.recorder.delivered()) == 0)
+}
+
+func TestClusterMaintenanceExpires(t *testing.T) {
+	nodes := clusterNew(t, time.Second, "a", "b")
+	a, b := nodes[0], nodes[1]
+
+	clock := cynictest.ClockNew(epoch)
+	a.planner.SetClock(clock)
+
+	_, err := a.planner.AddMaintenance(cynic.MaintenanceWindow{
+		End:    epoch.Add(time.Hour),
+		Reason: "migration",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// down everywhere, during the window
+	atomic.StoreInt32(&a.down, 1)
+	atomic.StoreInt32(&b.down, 1)
+	round(t, nodes)
+	assert(t, a.cluster.Checks()["web"].Firing)
+
+	// the window is over, and the check is still down
+	clock.Advance(2 * time.Hour)
+	round(t, nodes)
+
+	delivered := a.recorder.delivered()
+	log.Println("delivered by a:", delivered)
+	assert(t, strings.Join(delivered, " ") == "web:firing")
+}
+
+func TestClusterFailover(t *testing.T) {
+	interval := 50 * time.Millisecond
+	nodes := clusterNew(t, interval, "a", "b")
+	a, b := nodes[0], nodes[1]
+
+	round(t, nodes)
+	assert(t, b.cluster.Leader() == "a")
+
+	// a goes away; once its lease runs out, b takes over
+	a.server.Close()
+	time.Sleep(4 * interval)
+
+	atomic.StoreInt32(&b.down, 1)
+	run(t, b.planner, b.event)
+	b.cluster.Gossip(context.Background())
+
+	assert(t, b.cluster.IsLeader())
+	assert(t, len(b.cluster.Nodes()) == 1)
+
+	a.recorder.alerter.Stop()
+	delivered := b.recorder.delivered()
+	log.Println("delivered by b:", delivered)
+	assert(t, strings.Join(delivered, " ") == "web:firing")
+	assert(t, strings.HasPrefix(b.recorder.messages[0].Response.(string), "failing from 1 of 1 locations (b)"))
+}
+
+func TestClusterLeaseFile(t *testing.T) {
+	interval := 50 * time.Millisecond
+	lease := filepath.Join(t.TempDir(), "leader.json")
+
+	node := func(name string) *cynic.Cluster {
+		cluster, err := cynic.ClusterNew(cynic.ClusterConfig{
+			Node:      name,
+			Token:     clusterToken,
+			Interval:  interval,
+			LeaseFile: lease,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cluster
+	}
+
+	a, b := node("a"), node("b")
+	ctx := context.Background()
+
+	b.Gossip(ctx)
+	a.Gossip(ctx)
+	assert(t, b.IsLeader())
+	assert(t, a.Leader() == "b")
+
+	// b keeps renewing; a keeps following
+	time.Sleep(2 * interval)
+	b.Gossip(ctx)
+	time.Sleep(2 * interval)
+	a.Gossip(ctx)
+	assert(t, a.Leader() == "b")
+
+	// b stops renewing
+	time.Sleep(4 * interval)
+	a.Gossip(ctx)
+	b.Gossip(ctx)
+	assert(t, a.IsLeader())
+	assert(t, b.Leader() == "a")
+}
+
+func TestClusterGossipAuth(t *testing.T) {
+	nodes := clusterNew(t, time.Second, "a")
+	url := nodes[0].server.URL + cynic.DefaultClusterEndpoint
+
+	resp, err := http.Post(url+"gossip", "application/json", strings.NewReader(`{"node":"evil"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert(t, resp.StatusCode == http.StatusUnauthorized)
+	assert(t, len(nodes[0].cluster.Nodes()) == 1)
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert(t, resp.StatusCode == http.StatusOK)
+
+	nodes[0].recorder.alerter.Stop()
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/config"
+	"git.sr.ht/~psyomn/ecophagy/cynic/script"
+)
+
+const yamlConfig = `
+alerts:
+  wait: 5s
+  sinks:
+    - type: webhook
+      format: matrix
+      url: http://localhost:1/hook
+      rate_limit: {burst: 2, per: 1m}
+    - type: exec
+      command: cat
+workers: 4
+checks:
+  - name: homepage
+    type: http
+    interval: 30s
+    timeout: 5s
+    url: http://localhost:1/
+    expect_status: 200
+    body_regex: "ok"
+    retry: {attempts: 3, base: 1s, cap: 5s}
+  - name: db
+    type: tcp
+    interval: 10s
+    address: localhost:5432
+  - name: backups
+    type: file_age
+    cron: "30 2 * * mon-fri"
+    timezone: UTC
+    path: /tmp/backup
+    max_age: 26h
+  - name: health
+    type: json
+    interval: 1m
+    url: http://localhost:1/health
+    json_path: $.status
+    expect: ok
+  - name: root-disk
+    type: disk
+    interval: 5m
+    path: /
+    max_percent: 90
+`
+
+const jsonConfig = `{
+  "checks": [
+    {"name": "resolver", "type": "dns", "interval": "1m", "host": "localhost"},
+    {"name": "script", "type": "command", "interval": "5m",
+     "command": "true", "args": ["a", "b"], "expect_exit": 0}
+  ]
+}`
+
+func writeConfig(t *testing.T, name, contents string) string {
+	confPath := path.Join(t.TempDir(), name)
+	if err := os.WriteFile(confPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return confPath
+}
+
+func TestConfigLoadYAML(t *testing.T) {
+	conf, err := config.Load(writeConfig(t, "cynic.yaml", yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, conf.Workers == 4)
+	assert(t, len(conf.Checks) == 5)
+	assert(t, conf.Checks[3].JSONPath == "$.status")
+	assert(t, conf.Checks[4].MaxPercent == 90)
+	assert(t, conf.Checks[0].Interval == 30*time.Second)
+	assert(t, conf.Checks[0].Retry.Attempts == 3)
+	assert(t, conf.Alerts.Sinks[0].RateLimit.Per == time.Minute)
+
+	session, err := conf.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, session.Workers == 4)
+	assert(t, session.Alerter != nil)
+	assert(t, session.StatusCache == nil)
+	assert(t, len(session.Events) == 5)
+
+	homepage := session.Events[0]
+	assert(t, homepage.Label == "homepage")
+	assert(t, homepage.GetSecs() == 30)
+	assert(t, homepage.IsRepeating())
+	assert(t, homepage.GetTimeout() == 5*time.Second)
+	assert(t, homepage.GetRetryPolicy().MaxAttempts == 3)
+	assert(t, homepage.NumHooks() == 1)
+
+	backups := session.Events[2]
+	assert(t, backups.IsCron())
+	assert(t, backups.GetCron().Location() == time.UTC)
+}
+
+func TestConfigLoadJSON(t *testing.T) {
+	conf, err := config.Load(writeConfig(t, "cynic.json", jsonConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, len(conf.Checks) == 2)
+	assert(t, conf.Checks[0].Interval == time.Minute)
+	assert(t, len(conf.Checks[1].Args) == 2)
+
+	session, err := conf.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(session.Events) == 2)
+	assert(t, session.Alerter == nil)
+}
+
+func TestConfigValidation(t *testing.T) {
+	bad := map[string]string{
+		"no checks":        `workers: 1`,
+		"no name":          "checks:\n  - {type: tcp, interval: 1s, address: a:1}",
+		"no interval":      "checks:\n  - {name: a, type: tcp, address: a:1}",
+		"both schedules":   "checks:\n  - {name: a, type: tcp, interval: 1s, cron: '* * * * *', address: a:1}",
+		"unknown type":     "checks:\n  - {name: a, type: carrier-pigeon, interval: 1s}",
+		"missing url":      "checks:\n  - {name: a, type: http, interval: 1s}",
+		"missing max age":  "checks:\n  - {name: a, type: file_age, interval: 1s, path: /tmp}",
+		"duplicate names":  "checks:\n  - {name: a, type: dns, interval: 1s, host: x}\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"bad sink":         "alerts: {sinks: [{type: pager}]}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"bad webhook":      "alerts: {sinks: [{type: webhook, url: x, format: xml}]}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"bad smtp":         "alerts: {sinks: [{type: smtp, addr: x}]}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"bad rate limit":   "alerts: {sinks: [{type: exec, command: x, rate_limit: {burst: 0}}]}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"disk over 100":    "checks:\n  - {name: a, type: disk, interval: 1s, path: /, max_percent: 120}",
+		"json no path":     "checks:\n  - {name: a, type: json, interval: 1s, url: x}",
+		"not yaml at all":  "checks: [",
+		"snapshot no serv": "snapshots: {interval: 1s, dump_every: 1s}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"bad compression":  "status: {}\nsnapshots: {interval: 1s, dump_every: 1s, compression: lzma}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"downsample only":  "status: {}\nsnapshots: {interval: 1s, dump_every: 1s, retention: {downsample: [{after: 1h, every: 1m}]}}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"tls no key":       "status: {tls: {cert_file: x}}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"auth no password": "status: {auth: {username: x}}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"cluster no token": "status: {}\ncluster: {peers: [http://b:9999]}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"cluster quorum":   "status: {}\ncluster: {token: t, peers: [http://b:9999], quorum: 3}\nchecks:\n  - {name: a, type: dns, interval: 1s, host: x}",
+		"script no path":   "checks:\n  - {name: a, type: script, interval: 1s}",
+	}
+
+	for name, contents := range bad {
+		_, err := config.Parse([]byte(contents))
+		if !errors.Is(err, config.ErrInvalidConfig) {
+			log.Println("expected invalid config for:", name, "got:", err)
+		}
+		assert(t, errors.Is(err, config.ErrInvalidConfig))
+	}
+}
+
+func TestConfigBadCron(t *testing.T) {
+	_, err := config.BuildEvent(config.CheckConfig{
+		Name:    "a",
+		Type:    config.CheckDNS,
+		Host:    "localhost",
+		Cron:    "not a cron",
+		Timeout: time.Second,
+	})
+	assert(t, errors.Is(err, config.ErrInvalidConfig))
+}
+
+func TestConfigParseCheck(t *testing.T) {
+	check, err := config.ParseCheck([]byte(`{"name": "x", "type": "tcp", "interval": "2s", "address": "localhost:1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := config.BuildEvent(*check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, event.GetSecs() == 2)
+	assert(t, event.Label == "x")
+}
+
+func TestConfigEventAPI(t *testing.T) {
+	conf, err := config.Parse([]byte(`
+status: {host: localhost, port: "0", api_token: sekret}
+checks:
+  - {name: a, type: dns, interval: 1s, host: localhost}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := conf.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, session.StatusCache != nil)
+	assert(t, session.APIToken == "sekret")
+	assert(t, session.EventFactory != nil)
+
+	event, err := session.EventFactory([]byte("{name: b, type: tcp, interval: 5s, address: 'localhost:1'}"))
+	assert(t, err == nil)
+	assert(t, event.Label == "b")
+}
+
+func TestConfigDependenciesAndMaintenance(t *testing.T) {
+	conf, err := config.Parse([]byte(`
+checks:
+  - {name: gateway, type: ping, interval: 10s, host: localhost}
+  - {name: app, type: tcp, interval: 10s, address: "localhost:1", depends_on: [gateway], tags: [web]}
+maintenance:
+  - {start: 2021-03-10T02:00:00Z, end: 2021-03-10T03:00:00Z, checks: [app], reason: move}
+  - {cron: "0 2 * * sun", timezone: UTC, duration: 1h, tags: [web]}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := conf.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := session.Events[1]
+	assert(t, app.Dependencies()[0] == "gateway")
+	assert(t, app.HasTag("web"))
+
+	assert(t, len(session.Maintenance) == 2)
+	assert(t, session.Maintenance[0].Labels[0] == "app")
+	assert(t, session.Maintenance[0].End.Sub(session.Maintenance[0].Start) == time.Hour)
+	assert(t, session.Maintenance[1].Schedule.Location() == time.UTC)
+	assert(t, session.Maintenance[1].Active(time.Date(2021, time.March, 7, 2, 30, 0, 0, time.UTC)))
+
+	bad := map[string]string{
+		"unknown parent": "checks:\n  - {name: a, type: dns, interval: 1s, host: x, depends_on: [b]}",
+		"self":           "checks:\n  - {name: a, type: dns, interval: 1s, host: x, depends_on: [a]}",
+		"cycle":          "checks:\n  - {name: a, type: dns, interval: 1s, host: x, depends_on: [c]}\n  - {name: b, type: dns, interval: 1s, host: x, depends_on: [a]}\n  - {name: c, type: dns, interval: 1s, host: x, depends_on: [b]}",
+		"no end":         "checks:\n  - {name: a, type: dns, interval: 1s, host: x}\nmaintenance:\n  - {start: 2021-03-10T02:00:00Z}",
+		"no duration":    "checks:\n  - {name: a, type: dns, interval: 1s, host: x}\nmaintenance:\n  - {cron: '0 2 * * sun'}",
+	}
+
+	for name, contents := range bad {
+		_, err := config.Parse([]byte(contents))
+		if !errors.Is(err, config.ErrInvalidConfig) {
+			log.Println("expected invalid config for:", name, "got:", err)
+		}
+		assert(t, errors.Is(err, config.ErrInvalidConfig))
+	}
+}
+
+func TestConfigHeartbeat(t *testing.T) {
+	conf, err := config.Parse([]byte(`
+status: {host: localhost, port: "0", heartbeat_token: beat}
+checks:
+  - {name: backup, type: heartbeat, cron: "0 3 * * *", timezone: UTC, grace: 1h, tags: [storage]}
+  - {name: sync, type: heartbeat, interval: 15m}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := conf.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.StatusCache.Stop()
+
+	assert(t, session.Heartbeats != nil)
+	assert(t, len(session.Heartbeats.List()) == 2)
+	assert(t, session.Events[0].Label == "backup")
+	assert(t, session.Events[0].HasTag("storage"))
+
+	// they need somewhere to receive heartbeats
+	_, err = config.Parse([]byte("checks:\n  - {name: a, type: heartbeat, interval: 1m}"))
+	assert(t, errors.Is(err, config.ErrInvalidConfig))
+
+	// and can not come in through the event api
+	_, err = config.BuildEvent(config.CheckConfig{Name: "a", Type: config.CheckHeartbeat, Interval: time.Minute})
+	assert(t, errors.Is(err, config.ErrInvalidConfig))
+}
+
+func TestConfigScript(t *testing.T) {
+	file := path.Join(t.TempDir(), "check.cynic")
+	if err := os.WriteFile(file, []byte("ok \"fine\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := config.BuildEvent(config.CheckConfig{Name: "a", Type: config.CheckScript, Interval: time.Minute, Path: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, event.Label == "a")
+
+	// scripts that do not parse are caught when the config is loaded
+	if err := os.WriteFile(file, []byte("let = 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.BuildEvent(config.CheckConfig{Name: "a", Type: config.CheckScript, Interval: time.Minute, Path: file})
+	assert(t, errors.Is(err, script.ErrSyntax))
+
+	_, err = config.BuildEvent(config.CheckConfig{Name: "a", Type: config.CheckScript, Interval: time.Minute, Path: file + ".missing"})
+	assert(t, err != nil)
+}
+
+func TestConfigSample(t *testing.T) {
+	conf, err := config.Parse([]byte(config.Sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the port of the sample may be taken
+	conf.Status.Host = "localhost"
+	conf.Status.Port = "0"
+
+	session, err := conf.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.StatusCache.Stop()
+
+	log.Println("sample checks:", len(session.Events))
+	assert(t, len(session.Events) == len(conf.Checks))
+	assert(t, session.Alerter != nil)
+	assert(t, session.Heartbeats != nil)
+}
+
+func TestConfigSessionClosesStatus(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	_, port, _ := net.SplitHostPort(address)
+	conf, err := config.Parse([]byte(`
+status: {host: 127.0.0.1, port: "` + port + `"}
+checks:
+  - {name: a, type: script, interval: 1m, path: /nonexistent/check.cynic}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the script is missing, so the session can not be built...
+	_, err = conf.Session()
+	assert(t, err != nil)
+
+	// ...and the status server it had opened is closed
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2018 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func TestCronNext(t *testing.T) {
+	setup := func(expr, from, expected string) func(t *testing.T) {
+		return func(t *testing.T) {
+			sched, err := cynic.CronParse(expr, time.UTC)
+			if err != nil {
+				t.Fatal("could not parse:", err)
+			}
+
+			fromTime, _ := time.Parse(time.RFC3339, from)
+			expectedTime, _ := time.Parse(time.RFC3339, expected)
+
+			actual := sched.Next(fromTime)
+			if !actual.Equal(expectedTime) {
+				log.Println("expr:     ", expr)
+				log.Println("expected: ", expectedTime)
+				log.Println("actual:   ", actual)
+			}
+			assert(t, actual.Equal(expectedTime))
+		}
+	}
+
+	type testCase struct {
+		name     string
+		expr     string
+		from     string
+		expected string
+	}
+
+	testCases := [...]testCase{
+		{"every minute", "* * * * *", "2024-03-01T10:00:30Z", "2024-03-01T10:01:00Z"},
+		{"every second", "* * * * * *", "2024-03-01T10:00:30Z", "2024-03-01T10:00:31Z"},
+		{"strictly after", "30 2 * * *", "2024-03-01T02:30:00Z", "2024-03-02T02:30:00Z"},
+		{"02:30 weekdays from friday", "30 2 * * 1-5", "2024-03-01T03:00:00Z", "2024-03-04T02:30:00Z"},
+		{"02:30 weekdays names", "30 2 * * mon-fri", "2024-03-02T00:00:00Z", "2024-03-04T02:30:00Z"},
+		{"first of the month", "0 0 1 * *", "2024-01-15T12:00:00Z", "2024-02-01T00:00:00Z"},
+		{"first of month wraps year", "0 0 1 * *", "2024-12-15T12:00:00Z", "2025-01-01T00:00:00Z"},
+		{"every 15 minutes", "*/15 * * * *", "2024-03-01T10:16:00Z", "2024-03-01T10:30:00Z"},
+		{"list of hours", "0 6,18 * * *", "2024-03-01T07:00:00Z", "2024-03-01T18:00:00Z"},
+		{"leap day", "0 0 29 2 *", "2023-03-01T00:00:00Z", "2024-02-29T00:00:00Z"},
+		{"sunday as 7", "0 0 * * 7", "2024-03-01T00:00:00Z", "2024-03-03T00:00:00Z"},
+		{"dom or dow", "0 0 15 * fri", "2024-03-02T00:00:00Z", "2024-03-08T00:00:00Z"},
+		{"hourly descriptor", "@hourly", "2024-03-01T10:20:00Z", "2024-03-01T11:00:00Z"},
+		{"daily descriptor", "@daily", "2024-03-01T10:20:00Z", "2024-03-02T00:00:00Z"},
+		{"range with step", "10-30/10 * * * * *", "2024-03-01T10:00:15Z", "2024-03-01T10:00:20Z"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, setup(tc.expr, tc.from, tc.expected))
+	}
+}
+
+func TestCronTimezone(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	sched, err := cynic.CronParse("30 2 * * *", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, _ := time.Parse(time.RFC3339, "2024-03-01T00:00:00Z")
+	next := sched.Next(from)
+
+	expected, _ := time.Parse(time.RFC3339, "2024-03-01T07:30:00Z")
+	assert(t, next.Equal(expected))
+	assert(t, sched.Location() == loc)
+}
+
+func TestCronDaylightSaving(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone database:", err)
+	}
+
+	cases := []struct {
+		name     string
+		expr     string
+		from     string
+		expected string
+	}{
+		// clocks fall back at 06:00Z on 2024-11-03, from 01:59 EDT to 01:00 EST
+		{"fall back, later that day", "0 0 5 * * *", "2024-11-03T06:30:00Z", "2024-11-03T10:00:00Z"},
+		{"fall back, first of twice", "30 1 * * *", "2024-11-03T05:00:00Z", "2024-11-03T05:30:00Z"},
+		{"fall back, second of twice", "30 1 * * *", "2024-11-03T05:30:00Z", "2024-11-03T06:30:00Z"},
+		{"fall back, once a day again", "30 1 * * *", "2024-11-03T06:30:00Z", "2024-11-04T06:30:00Z"},
+		{"fall back, before the change", "*/5 * * * *", "2024-11-03T05:50:00Z", "2024-11-03T05:55:00Z"},
+		{"fall back, across the change", "*/5 * * * *", "2024-11-03T05:55:00Z", "2024-11-03T06:00:00Z"},
+		{"fall back, minutes go on", "*/20 * * * *", "2024-11-03T05:50:00Z", "2024-11-03T06:00:00Z"},
+		{"fall back, hours go on", "0 * * * *", "2024-11-03T06:10:00Z", "2024-11-03T07:00:00Z"},
+		{"fall back, weekly", "0 3 * * sun", "2024-11-03T05:30:00Z", "2024-11-03T08:00:00Z"},
+
+		// clocks spring forward at 07:00Z on 2024-03-10, from 01:59 EST to 03:00 EDT
+		{"spring forward, skipped", "30 2 * * *", "2024-03-10T05:00:00Z", "2024-03-10T07:00:00Z"},
+		{"spring forward, next day", "30 2 * * *", "2024-03-10T07:00:00Z", "2024-03-11T06:30:00Z"},
+		{"spring forward, once", "*/15 2 * * *", "2024-03-10T06:50:00Z", "2024-03-10T07:00:00Z"},
+		{"spring forward, after", "*/15 2 * * *", "2024-03-10T07:00:00Z", "2024-03-11T06:00:00Z"},
+		{"spring forward, minutes go on", "*/20 * * * *", "2024-03-10T06:50:00Z", "2024-03-10T07:00:00Z"},
+	}
+
+	for _, c := range cases {
+		sched, err := cynic.CronParse(c.expr, newYork)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		from, _ := time.Parse(time.RFC3339, c.from)
+		expected, _ := time.Parse(time.RFC3339, c.expected)
+
+		next := make(chan time.Time, 1)
+		go func() { next <- sched.Next(from) }()
+
+		select {
+		case actual := <-next:
+			if !actual.Equal(expected) {
+				log.Println(c.name, "expected", expected.In(newYork), "got", actual.In(newYork))
+			}
+			assert(t, actual.Equal(expected))
+		case <-time.After(5 * time.Second):
+			t.Fatal(c.name, ": Next did not return")
+		}
+	}
+}
+
+func TestCronImpossible(t *testing.T) {
+	sched, err := cynic.CronParse("0 0 30 2 *", time.UTC)
+	assert(t, err == nil)
+	assert(t, sched.Next(time.Now()).IsZero())
+}
+
+func TestCronParseErrors(t *testing.T) {
+	bad := [...]string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"potato * * * *",
+		"TZ=Not/AZone * * * * *",
+	}
+
+	for _, expr := range bad {
+		_, err := cynic.CronParse(expr, time.UTC)
+		if !errors.Is(err, cynic.ErrInvalidCron) {
+			log.Println("expected error for:", expr)
+		}
+		assert(t, errors.Is(err, cynic.ErrInvalidCron))
+	}
+}
+
+func TestCronEventInPlanner(t *testing.T) {
+	var count int
+
+	event, err := cynic.EventCronNew("* * * * * *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, event.IsCron())
+	assert(t, event.IsRepeating())
+
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		count++
+		return false, 0
+	})
+
+	planner := cynic.PlannerNew()
+	planner.Add(&event)
+
+	planner.Tick()
+	for i := 0; i < 10; i++ {
+		planner.Tick()
+	}
+
+	assert(t, count == 10)
+}
+
+func TestCronEventExpiry(t *testing.T) {
+	event, err := cynic.EventCronNew("0 * * * * *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planner := cynic.PlannerNew()
+	planner.Add(&event)
+
+	expiry := event.GetAbsExpiry()
+	assert(t, expiry >= 1 && expiry <= 60)
+}
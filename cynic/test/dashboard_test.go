@@ -0,0 +1,225 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func dashboardFixture(t *testing.T) *httptest.Server {
+	status := cynic.StatusServerNew("", "0", "/TestDashboard/")
+	status.WithHistory(cynic.HistoryConfig{})
+
+	alerter := cynic.AlerterNew(3600, nil)
+
+	healthy := cynic.EventNew(1)
+	healthy.Label = "healthy<script>"
+	healthy.SetDataRepo(&status)
+	healthy.AddHook(func(params *cynic.HookParameters) (bool, interface{}) {
+		for _, latency := range []int{10, 30, 20} {
+			params.Status.Update(params.Event.UniqStr(), latency)
+		}
+		return false, nil
+	})
+
+	broken := cynic.EventNew(1)
+	broken.Label = "broken"
+	broken.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		return true, "connection refused"
+	})
+
+	paused := cynic.EventNew(1)
+	paused.Label = "paused"
+	paused.Pause()
+
+	pending := cynic.EventNew(3600)
+	pending.Label = "pending"
+
+	planner := cynic.PlannerNew()
+	planner.SetAlerter(&alerter)
+	for _, event := range []*cynic.Event{&healthy, &broken, &paused, &pending} {
+		event.Repeat(true)
+		planner.Add(event)
+	}
+
+	alerter.Start()
+	planner.Tick()
+	planner.Tick()
+	alerter.Stop()
+
+	ts := httptest.NewServer(cynic.DashboardNew(planner, &status, &alerter))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestDashboardPage(t *testing.T) {
+	ts := dashboardFixture(t)
+
+	resp, err := http.Get(ts.URL + cynic.DefaultDashboardEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	page := string(body)
+
+	assert(t, resp.StatusCode == http.StatusOK)
+	assert(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"))
+
+	for _, expected := range []string{
+		`class="tile ok"`,
+		`class="tile firing"`,
+		`class="tile paused"`,
+		`class="tile pending"`,
+		"healthy&lt;script&gt;",
+		"<polyline points=",
+		"connection refused",
+		"4 events, 1 failing",
+		`new EventSource("/dashboard/stream")`,
+	} {
+		if !strings.Contains(page, expected) {
+			log.Println("dashboard is missing:", expected)
+			t.Fail()
+		}
+	}
+
+	assert(t, !strings.Contains(page, "healthy<script>"))
+}
+
+func TestDashboardStream(t *testing.T) {
+	ts := dashboardFixture(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/dashboard/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert(t, resp.Header.Get("Content-Type") == "text/event-stream")
+
+	reader := bufio.NewReader(resp.Body)
+
+	first, err := reader.ReadString('\n')
+	assert(t, err == nil)
+	assert(t, first == "event: board\n")
+
+	sawTiles := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil || line == "\n" {
+			break
+		}
+		assert(t, strings.HasPrefix(line, "data: "))
+		sawTiles = sawTiles || strings.Contains(line, `class="tile firing"`)
+	}
+	assert(t, sawTiles)
+}
+
+func TestDashboardLongAlert(t *testing.T) {
+	status := cynic.StatusServerNew("", "0", "/TestDashboardLongAlert/")
+	alerter := cynic.AlerterNew(3600, nil)
+
+	// three bytes a rune, so that the cut falls within one
+	euros := strings.Repeat("€", 100)
+
+	broken := cynic.EventNew(1)
+	broken.Label = "broken"
+	broken.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		return true, euros
+	})
+
+	planner := cynic.PlannerNew()
+	planner.SetAlerter(&alerter)
+	planner.Add(&broken)
+
+	alerter.Start()
+	planner.Tick()
+	planner.Tick()
+	alerter.Stop()
+
+	ts := httptest.NewServer(cynic.DashboardNew(planner, &status, &alerter))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + cynic.DefaultDashboardEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	assert(t, utf8.Valid(body))
+	assert(t, strings.Contains(string(body), "<td>"+strings.Repeat("€", 66)+"...</td>"))
+}
+
+func TestStatusLinks(t *testing.T) {
+	for _, root := range []string{"/TestStatusLinks/", "/TestStatusLinks"} {
+		status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true, Root: root})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts := httptest.NewServer(status.Handler())
+
+		resp, err := http.Get(ts.URL + "/links")
+		if err != nil {
+			t.Fatal(err)
+		}
+		empty, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		status.Update("hello", "kitty")
+
+		resp, err = http.Get(ts.URL + "/links")
+		if err != nil {
+			t.Fatal(err)
+		}
+		links, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// and the links lead somewhere
+		resp, err = http.Get(ts.URL + "/TestStatusLinks/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		ts.Close()
+		status.Stop()
+
+		log.Println("links under", root+":", string(links))
+		assert(t, strings.Contains(string(empty), "No links here yet."))
+		assert(t, strings.Contains(string(links), `<a href="/TestStatusLinks/hello" target="_blank">hello</a>`))
+		assert(t, resp.StatusCode == http.StatusOK)
+		assert(t, strings.Contains(string(value), "kitty"))
+	}
+}
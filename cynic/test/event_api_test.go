@@ -0,0 +1,269 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/config"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+const apiToken = "sekret"
+
+func apiRequest(t *testing.T, method, url, body string) (int, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, data
+}
+
+func eventAPIServer(t *testing.T, planner *cynic.Planner) *httptest.Server {
+	api, err := cynic.EventAPINew(planner, cynic.DefaultEventsEndpoint, apiToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetEventFactory(config.EventFactory(nil))
+
+	ts := httptest.NewServer(api)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestEventAPINeedsToken(t *testing.T) {
+	_, err := cynic.EventAPINew(cynic.PlannerNew(), cynic.DefaultEventsEndpoint, "")
+	assert(t, errors.Is(err, cynic.ErrNoAPIToken))
+
+	ts := eventAPIServer(t, cynic.PlannerNew())
+
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + apiToken, apiToken} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/events/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		assert(t, resp.StatusCode == http.StatusUnauthorized)
+		assert(t, resp.Header.Get("WWW-Authenticate") != "")
+	}
+}
+
+func TestEventAPIListPauseResume(t *testing.T) {
+	var count int32
+
+	event := cynic.EventNew(1)
+	event.Label = "counter"
+	event.Repeat(true)
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		atomic.AddInt32(&count, 1)
+		return false, nil
+	})
+
+	other := cynic.EventNew(100)
+	other.Label = "later"
+
+	planner := cynic.PlannerNew()
+	planner.Add(&event)
+	planner.Add(&other)
+
+	ts := eventAPIServer(t, planner)
+	eventURL := fmt.Sprintf("%s/events/%d", ts.URL, event.ID())
+
+	status, body := apiRequest(t, http.MethodGet, ts.URL+"/events/", "")
+	assert(t, status == http.StatusOK)
+
+	var infos []cynic.EventInfo
+	assert(t, json.Unmarshal(body, &infos) == nil)
+	assert(t, len(infos) == 2)
+	assert(t, infos[0].Label == "counter")
+	assert(t, infos[1].Label == "later")
+	assert(t, infos[0].NextRun.Before(infos[1].NextRun))
+
+	status, body = apiRequest(t, http.MethodPost, eventURL+"/pause", "")
+	assert(t, status == http.StatusOK)
+
+	var info cynic.EventInfo
+	assert(t, json.Unmarshal(body, &info) == nil)
+	assert(t, info.Paused)
+
+	for i := 0; i < 3; i++ {
+		planner.Tick()
+	}
+	assert(t, atomic.LoadInt32(&count) == 0)
+
+	// paused events stay on their schedule
+	_, ok := planner.Info(event.ID())
+	assert(t, ok)
+	assert(t, planner.Len() == 2)
+
+	status, _ = apiRequest(t, http.MethodPost, eventURL+"/resume", "")
+	assert(t, status == http.StatusOK)
+
+	planner.Tick()
+	assert(t, atomic.LoadInt32(&count) == 1)
+}
+
+func TestEventAPITriggerDelete(t *testing.T) {
+	var count int32
+
+	event := cynic.EventNew(3600)
+	event.Repeat(true)
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		atomic.AddInt32(&count, 1)
+		return false, nil
+	})
+
+	planner := cynic.PlannerNew()
+	planner.Add(&event)
+
+	ts := eventAPIServer(t, planner)
+	eventURL := fmt.Sprintf("%s/events/%d", ts.URL, event.ID())
+
+	status, _ := apiRequest(t, http.MethodPost, eventURL+"/trigger", "")
+	assert(t, status == http.StatusAccepted)
+
+	planner.Wait()
+	assert(t, atomic.LoadInt32(&count) == 1)
+
+	status, _ = apiRequest(t, http.MethodDelete, eventURL, "")
+	assert(t, status == http.StatusNoContent)
+
+	status, _ = apiRequest(t, http.MethodGet, eventURL, "")
+	assert(t, status == http.StatusNotFound)
+
+	status, _ = apiRequest(t, http.MethodPost, eventURL+"/trigger", "")
+	assert(t, status == http.StatusNotFound)
+
+	status, _ = apiRequest(t, http.MethodGet, ts.URL+"/events/not-a-number", "")
+	assert(t, status == http.StatusBadRequest)
+
+	status, _ = apiRequest(t, http.MethodPut, eventURL, "")
+	assert(t, status == http.StatusMethodNotAllowed)
+}
+
+func TestEventAPIAdd(t *testing.T) {
+	planner := cynic.PlannerNew()
+	ts := eventAPIServer(t, planner)
+
+	check := `{"name": "added", "type": "tcp", "interval": "30s", "address": "localhost:1"}`
+	status, body := apiRequest(t, http.MethodPost, ts.URL+"/events/", check)
+	assert(t, status == http.StatusCreated)
+
+	var info cynic.EventInfo
+	assert(t, json.Unmarshal(body, &info) == nil)
+	assert(t, info.Label == "added")
+	assert(t, info.Secs == 30)
+	assert(t, info.Repeat)
+
+	event, ok := planner.Get(info.ID)
+	assert(t, ok)
+	assert(t, event.NumHooks() == 1)
+	assert(t, planner.Len() == 1)
+
+	status, _ = apiRequest(t, http.MethodPost, ts.URL+"/events/", `{"name": "broken"}`)
+	assert(t, status == http.StatusBadRequest)
+	assert(t, planner.Len() == 1)
+
+	// without a factory, events can not be added
+	api, _ := cynic.EventAPINew(planner, "/events", apiToken)
+	bare := httptest.NewServer(api)
+	defer bare.Close()
+
+	status, _ = apiRequest(t, http.MethodPost, bare.URL+"/events/", check)
+	assert(t, status == http.StatusNotImplemented)
+}
+
+func TestEventAPIMaintenance(t *testing.T) {
+	planner := cynic.PlannerNew()
+	ts := eventAPIServer(t, planner)
+	url := ts.URL + "/events/maintenance"
+
+	bad := []string{
+		`not json`,
+		`{"duration": "sideways"}`,
+		`{}`,
+		`{"cron": "0 2 * * sun"}`,
+		`{"cron": "0 2 * * someday", "duration": "1h"}`,
+		`{"start": "2021-03-10T03:00:00Z", "end": "2021-03-10T02:00:00Z"}`,
+	}
+	for _, body := range bad {
+		status, _ := apiRequest(t, http.MethodPost, url, body)
+		assert(t, status == http.StatusBadRequest)
+	}
+
+	status, body := apiRequest(t, http.MethodPost, url, `{"tags": ["db"], "duration": "2h", "reason": "upgrade"}`)
+	assert(t, status == http.StatusCreated)
+
+	var silence map[string]interface{}
+	if err := json.Unmarshal(body, &silence); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, silence["reason"] == "upgrade")
+	assert(t, silence["start"] != nil && silence["end"] != nil)
+
+	status, _ = apiRequest(t, http.MethodPost, url, `{"cron": "0 2 * * sun", "timezone": "UTC", "duration": "1h"}`)
+	assert(t, status == http.StatusCreated)
+
+	status, body = apiRequest(t, http.MethodGet, url, "")
+	assert(t, status == http.StatusOK)
+
+	var windows []map[string]interface{}
+	if err := json.Unmarshal(body, &windows); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(windows) == 2)
+	assert(t, windows[1]["cron"] == "0 2 * * sun")
+	assert(t, windows[1]["timezone"] == "UTC")
+	assert(t, windows[1]["duration"] == "1h0m0s")
+
+	status, _ = apiRequest(t, http.MethodDelete, fmt.Sprintf("%s/%v", url, silence["id"]), "")
+	assert(t, status == http.StatusNoContent)
+
+	status, _ = apiRequest(t, http.MethodDelete, fmt.Sprintf("%s/%v", url, silence["id"]), "")
+	assert(t, status == http.StatusNotFound)
+
+	status, _ = apiRequest(t, http.MethodDelete, url+"/nope", "")
+	assert(t, status == http.StatusBadRequest)
+
+	assert(t, len(planner.Maintenance()) == 1)
+}
@@ -17,7 +17,9 @@ limitations under the License.
 package test
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"git.sr.ht/~psyomn/ecophagy/cynic/lib"
 )
@@ -35,11 +37,13 @@ func TestSimpleBuilder(t *testing.T) {
 			builder := cynic.EventBuilderNew(events)
 			builder.DistributeEvents(maxTime)
 
-			session, ok := builder.Build()
-			assert(t, ok)
+			session, errs := builder.Build()
+			assert(t, len(errs) == 0)
 
-			for _, el := range session.Events {
+			for i, el := range session.Events {
 				assert(t, el.GetSecs() == (maxTime/eventCount))
+				assert(t, el.GetOffset() == maxTime*i/eventCount)
+				assert(t, !el.IsRepeating())
 			}
 		}
 	}
@@ -66,8 +70,8 @@ func TestSimpleErrorCases(t *testing.T) {
 		return func(t *testing.T) {
 			var events []cynic.Event
 			builder := cynic.EventBuilderNew(events)
-			_, ok := builder.Build()
-			assert(t, !ok)
+			_, errs := builder.Build()
+			assert(t, len(errs) > 0)
 		}
 	}
 
@@ -87,3 +91,113 @@ func TestSimpleErrorCases(t *testing.T) {
 		t.Run(c.name, setup(c.serCount, c.maxTime))
 	}
 }
+
+func TestBuilderRepeatable(t *testing.T) {
+	events := []cynic.Event{cynic.EventNew(1), cynic.EventNew(1)}
+
+	builder := cynic.EventBuilderNew(events)
+	builder.DistributeEvents(10)
+	builder.Repeatable()
+
+	session, errs := builder.Build()
+	assert(t, len(errs) == 0)
+
+	for _, el := range session.Events {
+		assert(t, el.IsRepeating())
+	}
+}
+
+func TestBuilderGroups(t *testing.T) {
+	var events []cynic.Event
+	for _, tag := range []string{"db", "web", "db", "web", "web", ""} {
+		event := cynic.EventNew(1)
+		if tag != "" {
+			event.SetTags(tag)
+		}
+		events = append(events, event)
+	}
+
+	builder := cynic.EventBuilderNew(events)
+	builder.GroupBy(cynic.GroupByTag)
+	builder.GroupWindow("db", 60)
+	builder.GroupWindow("web", 30)
+	builder.DistributeEvents(5)
+
+	session, errs := builder.Build()
+	assert(t, len(errs) == 0)
+
+	offsets := make(map[string][]int)
+	for _, el := range session.Events {
+		tag := ""
+		if tags := el.Tags(); len(tags) > 0 {
+			tag = tags[0]
+		}
+		offsets[tag] = append(offsets[tag], el.GetOffset())
+	}
+
+	assert(t, session.Events[0].GetSecs() == 30)
+	assert(t, session.Events[1].GetSecs() == 10)
+	assert(t, session.Events[5].GetSecs() == 5)
+
+	assert(t, offsets["db"][0] == 0 && offsets["db"][1] == 30)
+	assert(t, offsets["web"][0] == 0 && offsets["web"][1] == 10 && offsets["web"][2] == 20)
+	assert(t, offsets[""][0] == 0)
+
+	// a group without a window of its own, and without a default
+	builder = cynic.EventBuilderNew(events)
+	builder.GroupBy(cynic.GroupByTag)
+	builder.GroupWindow("db", 60)
+
+	_, errs = builder.Build()
+	assert(t, len(errs) == 2)
+	assert(t, errors.Is(errs[0], cynic.ErrEventBuilder))
+}
+
+func TestBuilderJitterAndStaggerOffsets(t *testing.T) {
+	var events []cynic.Event
+	for i := 0; i < 20; i++ {
+		events = append(events, cynic.EventNew(1))
+	}
+
+	builder := cynic.EventBuilderNew(events)
+	builder.DistributeEvents(20)
+	builder.Jitter(5)
+	builder.StaggerOffsets(1)
+
+	session, errs := builder.Build()
+	assert(t, len(errs) == 0)
+
+	seen := make(map[int]bool)
+	for i, el := range session.Events {
+		assert(t, el.GetOffset() >= i)
+		assert(t, !seen[el.GetOffset()])
+		seen[el.GetOffset()] = true
+	}
+
+	builder = cynic.EventBuilderNew(events)
+	builder.DistributeEvents(20)
+	builder.Jitter(-1)
+	builder.StaggerOffsets(-1)
+
+	_, errs = builder.Build()
+	assert(t, len(errs) == 2)
+}
+
+func TestBuilderAlignTo(t *testing.T) {
+	events := []cynic.Event{cynic.EventNew(1), cynic.EventNew(1)}
+
+	before := time.Now().Unix()
+	builder := cynic.EventBuilderNew(events)
+	builder.DistributeEvents(10)
+	builder.AlignTo(time.Minute)
+
+	session, errs := builder.Build()
+	after := time.Now().Unix()
+	assert(t, len(errs) == 0)
+
+	// the first event lands on the next minute
+	offset := int64(session.Events[0].GetOffset())
+	assert(t, offset <= 60)
+	assert(t, (before+offset)%60 == 0 || (after+offset)%60 == 0)
+	assert(t, session.Events[1].GetOffset()-session.Events[0].GetOffset() == 5)
+}
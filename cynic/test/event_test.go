@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"sync"
 	"testing"
 
@@ -155,3 +156,25 @@ func TestExtraField(t *testing.T) {
 	})
 	event.Execute()
 }
+
+// The event api checks whether events are deleted while the planner
+// deletes them, without holding its lock.
+func TestEventDeleteConcurrently(t *testing.T) {
+	event := cynic.EventNew(1)
+	planner := cynic.PlannerNew()
+	planner.Add(&event)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !event.IsDeleted() {
+			runtime.Gosched()
+		}
+	}()
+
+	assert(t, planner.DeleteID(event.ID()))
+	wg.Wait()
+
+	assert(t, event.IsDeleted())
+}
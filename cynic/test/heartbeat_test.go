@@ -0,0 +1,220 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/cynictest"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func TestHeartbeatRegistration(t *testing.T) {
+	heartbeats := cynic.HeartbeatsNew("")
+
+	_, err := cynic.HeartbeatEventNew(heartbeats, "backup", time.Hour, time.Minute)
+	assert(t, err == nil)
+
+	cases := []struct {
+		name  string
+		every time.Duration
+		grace time.Duration
+	}{
+		{"backup", time.Hour, time.Minute},
+		{"", time.Hour, 0},
+		{"with/slash", time.Hour, 0},
+		{"no-interval", 0, 0},
+		{"negative-grace", time.Hour, -time.Second},
+	}
+
+	for _, c := range cases {
+		_, err := cynic.HeartbeatEventNew(heartbeats, c.name, c.every, c.grace)
+		if !errors.Is(err, cynic.ErrBadHeartbeat) {
+			log.Println("expected an error for:", c.name, err)
+		}
+		assert(t, errors.Is(err, cynic.ErrBadHeartbeat))
+	}
+
+	_, err = cynic.HeartbeatCronEventNew(heartbeats, "nightly", nil, 0)
+	assert(t, errors.Is(err, cynic.ErrBadHeartbeat))
+
+	assert(t, errors.Is(heartbeats.Ping("nope", ""), cynic.ErrUnknownHeartbeat))
+	assert(t, len(heartbeats.List()) == 1)
+}
+
+func TestHeartbeatOverdue(t *testing.T) {
+	clock := cynictest.ClockNew(epoch)
+	heartbeats := cynic.HeartbeatsNew("")
+	heartbeats.SetClock(clock)
+
+	event, err := cynic.HeartbeatEventNew(heartbeats, "job", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, event.Label == "job")
+	assert(t, event.IsRepeating())
+
+	status, _ := heartbeats.Status("job")
+	assert(t, !status.Overdue)
+	assert(t, status.LastPing.IsZero())
+
+	event.Execute()
+	assert(t, !event.IsFailing())
+
+	// nothing within the interval and the grace period
+	clock.Advance(time.Hour + time.Minute)
+	status, _ = heartbeats.Status("job")
+	assert(t, !status.Overdue)
+
+	clock.Advance(time.Second)
+	status, _ = heartbeats.Status("job")
+	assert(t, status.Overdue)
+	assert(t, status.Deadline.Equal(epoch.Add(time.Hour+time.Minute)))
+
+	event.Execute()
+	assert(t, event.IsFailing())
+
+	assert(t, heartbeats.Ping("job", "") == nil)
+	event.Execute()
+	assert(t, !event.IsFailing())
+
+	status, _ = heartbeats.Status("job")
+	assert(t, status.LastPing.Equal(clock.Now()))
+
+	assert(t, heartbeats.Fail("job", "disk full") == nil)
+	status, _ = heartbeats.Status("job")
+	assert(t, status.Failed)
+	assert(t, status.Message == "disk full")
+	assert(t, status.Pings == 2)
+
+	event.Execute()
+	assert(t, event.IsFailing())
+}
+
+func TestHeartbeatCron(t *testing.T) {
+	heartbeats := cynic.HeartbeatsNew("")
+
+	nightly, err := cynic.CronParse("0 3 * * *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cynic.HeartbeatCronEventNew(heartbeats, "nightly", nightly, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// waiting for the next run, and an hour after it
+	status, _ := heartbeats.Status("nightly")
+	assert(t, !status.Overdue)
+	assert(t, status.Deadline.UTC().Hour() == 4)
+	assert(t, status.Deadline.Sub(time.Now()) <= 25*time.Hour)
+}
+
+func TestHeartbeatDelete(t *testing.T) {
+	heartbeats := cynic.HeartbeatsNew("")
+
+	event, err := cynic.HeartbeatEventNew(heartbeats, "backup", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planner := cynic.PlannerNew()
+	planner.Add(&event)
+	assert(t, planner.DeleteID(event.ID()))
+
+	assert(t, len(heartbeats.List()) == 0)
+	assert(t, errors.Is(heartbeats.Ping("backup", ""), cynic.ErrUnknownHeartbeat))
+
+	// the name is free again, and deleting the old event twice does
+	// not take it from the new one
+	again, err := cynic.HeartbeatEventNew(heartbeats, "backup", time.Hour, time.Minute)
+	assert(t, err == nil)
+	event.Delete()
+	assert(t, heartbeats.Ping("backup", "") == nil)
+
+	again.Delete()
+	assert(t, len(heartbeats.List()) == 0)
+}
+
+func TestHeartbeatEndpoint(t *testing.T) {
+	heartbeats := cynic.HeartbeatsNew("sekrit")
+	if _, err := cynic.HeartbeatEventNew(heartbeats, "backup", time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(heartbeats)
+	defer server.Close()
+
+	send := func(method, path, body string, auth bool) (int, cynic.HeartbeatStatus) {
+		req, err := http.NewRequest(method, server.URL+cynic.DefaultHeartbeatEndpoint+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth {
+			req.Header.Set("Authorization", "Bearer sekrit")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var status cynic.HeartbeatStatus
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		return resp.StatusCode, status
+	}
+
+	code, _ := send(http.MethodPost, "backup", "", false)
+	assert(t, code == http.StatusUnauthorized)
+
+	code, status := send(http.MethodPost, "backup", "42 GiB\n", true)
+	assert(t, code == http.StatusOK)
+	assert(t, status.Pings == 1)
+	assert(t, status.Message == "42 GiB")
+	assert(t, !status.LastPing.IsZero())
+
+	code, status = send(http.MethodGet, "backup/fail", "", true)
+	assert(t, code == http.StatusOK)
+	assert(t, status.Failed)
+
+	code, _ = send(http.MethodPost, "nope", "", true)
+	assert(t, code == http.StatusNotFound)
+
+	code, _ = send(http.MethodDelete, "backup", "", true)
+	assert(t, code == http.StatusMethodNotAllowed)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+cynic.DefaultHeartbeatEndpoint, nil)
+	req.Header.Set("Authorization", "Bearer sekrit")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var list []cynic.HeartbeatStatus
+	assert(t, json.NewDecoder(resp.Body).Decode(&list) == nil)
+	assert(t, len(list) == 1)
+	assert(t, list[0].Name == "backup")
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/checks"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func TestHistoryRing(t *testing.T) {
+	status := cynic.StatusServerNew("", "0", "/TestHistoryRing/")
+	status.WithHistory(cynic.HistoryConfig{Capacity: 3})
+
+	for i := 1; i <= 5; i++ {
+		status.Update("counter", i)
+	}
+
+	points, err := status.History("counter", cynic.HistoryQuery{})
+	assert(t, err == nil)
+	assert(t, len(points) == 3)
+	assert(t, points[0].Value == 3)
+	assert(t, points[2].Value == 5)
+	assert(t, !points[2].Time.Before(points[0].Time))
+
+	// the range is inclusive, and open when zero
+	points, _ = status.History("counter", cynic.HistoryQuery{To: points[0].Time.Add(-time.Nanosecond)})
+	assert(t, len(points) == 0)
+
+	_, err = status.History("missing", cynic.HistoryQuery{})
+	assert(t, errors.Is(err, cynic.ErrStatusValueNotFound))
+
+	_, err = status.History("counter", cynic.HistoryQuery{From: time.Now(), To: time.Now().Add(-time.Hour)})
+	assert(t, errors.Is(err, cynic.ErrBadHistoryQuery))
+
+	status.Delete("counter")
+	_, err = status.History("counter", cynic.HistoryQuery{})
+	assert(t, errors.Is(err, cynic.ErrStatusValueNotFound))
+}
+
+func TestHistoryMaxAge(t *testing.T) {
+	status := cynic.StatusServerNew("", "0", "/TestHistoryMaxAge/")
+	status.WithHistory(cynic.HistoryConfig{Capacity: 10, MaxAge: 50 * time.Millisecond})
+
+	status.Update("old", 1)
+	time.Sleep(100 * time.Millisecond)
+	status.Update("old", 2)
+
+	points, err := status.History("old", cynic.HistoryQuery{})
+	assert(t, err == nil)
+	assert(t, len(points) == 1)
+	assert(t, points[0].Value == 2)
+}
+
+func TestHistoryBuckets(t *testing.T) {
+	status := cynic.StatusServerNew("", "0", "/TestHistoryBuckets/")
+	status.WithHistory(cynic.HistoryConfig{})
+
+	for _, value := range []float64{4, 1, 7} {
+		status.Update("latency", value)
+	}
+	status.Update("latency", "timed out") // skipped
+
+	// one huge step, so everything falls in the same bucket
+	buckets, err := status.HistoryBuckets("latency", cynic.HistoryQuery{Step: 1000 * time.Hour})
+	assert(t, err == nil)
+	assert(t, len(buckets) == 1)
+	assert(t, buckets[0].Min == 1)
+	assert(t, buckets[0].Max == 7)
+	assert(t, buckets[0].Avg == 4)
+	assert(t, buckets[0].Count == 3)
+
+	// tiny steps, so (most likely) one bucket per value
+	buckets, _ = status.HistoryBuckets("latency", cynic.HistoryQuery{Step: time.Nanosecond})
+	assert(t, len(buckets) >= 1 && len(buckets) <= 3)
+
+	_, err = status.HistoryBuckets("latency", cynic.HistoryQuery{})
+	assert(t, errors.Is(err, cynic.ErrBadHistoryQuery))
+}
+
+func TestHistoryPath(t *testing.T) {
+	status := cynic.StatusServerNew("", "0", "/TestHistoryPath/")
+	status.WithHistory(cynic.HistoryConfig{})
+
+	status.Update("homepage", checks.Result{OK: true, LatencyMS: 120})
+	status.Update("homepage", checks.Result{OK: false, Message: "refused"})
+	status.Update("homepage", checks.Result{OK: true, LatencyMS: 80})
+
+	points, err := status.History("homepage", cynic.HistoryQuery{Path: "$.latency_ms"})
+	assert(t, err == nil)
+	assert(t, len(points) == 2) // the failure has no latency
+	assert(t, points[0].Value == 120.0)
+
+	buckets, err := status.HistoryBuckets("homepage", cynic.HistoryQuery{Path: "$.latency_ms", Step: 1000 * time.Hour})
+	assert(t, err == nil)
+	assert(t, buckets[0].Avg == 100)
+}
+
+func TestHistoryEndpoint(t *testing.T) {
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true, Root: "/TestHistoryEndpoint/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Stop()
+
+	status.WithHistory(cynic.HistoryConfig{Capacity: 10})
+	status.Update("latency", 10)
+	status.Update("latency", 30)
+
+	server := httptest.NewServer(status.Handler())
+	defer server.Close()
+
+	history := server.URL + "/TestHistoryEndpoint/history/"
+
+	code, body := getStatus(t, http.DefaultClient, history+"latency?from=-1h", nil)
+	assert(t, code == http.StatusOK)
+	assert(t, len(body["points"].([]interface{})) == 2)
+
+	code, body = getStatus(t, http.DefaultClient, history+"latency?step=1000h", nil)
+	assert(t, code == http.StatusOK)
+	bucket := body["points"].([]interface{})[0].(map[string]interface{})
+	assert(t, bucket["avg"] == 20.0)
+
+	code, _ = getStatus(t, http.DefaultClient, history+"nope", nil)
+	assert(t, code == http.StatusNotFound)
+
+	code, _ = getStatus(t, http.DefaultClient, history+"latency?step=sideways", nil)
+	assert(t, code == http.StatusBadRequest)
+}
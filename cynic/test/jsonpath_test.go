@@ -0,0 +1,78 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func TestJSONPath(t *testing.T) {
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{
+		"a": {"b": [10, 20, {"c": "deep"}]},
+		"with.dots": {"x": 1},
+		"list": [[1, 2], [3, 4]]
+	}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		path     string
+		expected interface{}
+	}
+
+	cases := [...]testCase{
+		{"$.a.b[0]", 10.0},
+		{"a.b.1", 20.0},
+		{"$.a.b[2].c", "deep"},
+		{"$.a.b[-1].c", "deep"},
+		{`$["with.dots"].x`, 1.0},
+		{"$['with.dots']['x']", 1.0},
+		{"$.list[1][0]", 3.0},
+	}
+
+	for _, c := range cases {
+		value, err := cynic.JSONPath(doc, c.path)
+		if err != nil || value != c.expected {
+			log.Println("path:", c.path, "got:", value, err)
+		}
+		assert(t, err == nil)
+		assert(t, value == c.expected)
+	}
+
+	root, err := cynic.JSONPath(doc, "$")
+	assert(t, err == nil)
+	assert(t, root.(map[string]interface{})["a"] != nil)
+
+	bad := [...]string{
+		"$.nope",
+		"$.a.b[3]",
+		"$.a.b.x",
+		"$.a.b[0].c",
+		"$.a[",
+	}
+
+	for _, path := range bad {
+		_, err := cynic.JSONPath(doc, path)
+		assert(t, errors.Is(err, cynic.ErrJSONPath))
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func TestPlannerRunCancel(t *testing.T) {
+	var count int32
+
+	event := cynic.EventNew(1)
+	event.Repeat(true)
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		atomic.AddInt32(&count, 1)
+		return false, 0
+	})
+
+	planner := cynic.PlannerNew()
+	planner.Add(&event)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+
+	err := planner.Run(ctx)
+	assert(t, err == nil)
+
+	// the planner really ticks now
+	assert(t, atomic.LoadInt32(&count) >= 1)
+
+	// and really stopped ticking
+	after := atomic.LoadInt32(&count)
+	time.Sleep(1500 * time.Millisecond)
+	assert(t, atomic.LoadInt32(&count) == after)
+}
+
+func TestAlerterStopFlushes(t *testing.T) {
+	var received []cynic.AlertMessage
+
+	alerter := cynic.AlerterNew(3600, func(messages []cynic.AlertMessage) {
+		received = append(received, messages...)
+	})
+	alerter.Start()
+
+	alerter.Ch <- cynic.AlertMessage{Response: "hello"}
+	alerter.Ch <- cynic.AlertMessage{Response: "kitty"}
+
+	alerter.Stop()
+
+	assert(t, len(received) == 2)
+	assert(t, received[0].Response == "hello")
+	assert(t, received[1].Response == "kitty")
+}
+
+func TestAlerterStopNotStarted(t *testing.T) {
+	alerter := cynic.AlerterNew(1, func(_ []cynic.AlertMessage) {})
+
+	done := make(chan struct{})
+	go func() {
+		alerter.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stopping an idle alerter should not block")
+	}
+}
+
+func TestStartCancel(t *testing.T) {
+	var alerts int32
+
+	event := cynic.EventNew(1)
+	event.Repeat(true)
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		return true, "always alerting"
+	})
+
+	alerter := cynic.AlerterNew(3600, func(messages []cynic.AlertMessage) {
+		atomic.AddInt32(&alerts, int32(len(messages)))
+	})
+
+	session := cynic.Session{
+		Events:  []cynic.Event{event},
+		Alerter: &alerter,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- cynic.Start(ctx, session) }()
+
+	select {
+	case err := <-done:
+		assert(t, err == nil)
+	case <-time.After(10 * time.Second):
+		t.Fatal("start did not return after cancellation")
+	}
+
+	// alerter was stopped, and flushed what it had
+	assert(t, atomic.LoadInt32(&alerts) >= 1)
+}
+
+func TestStartClosesStatusOnError(t *testing.T) {
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Host: "127.0.0.1", Port: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(status.GetPort()))
+
+	garbage := path.Join(t.TempDir(), "garbage.json")
+	if err := os.WriteFile(garbage, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = cynic.Start(context.Background(), cynic.Session{StatusCache: status, StatePath: garbage})
+	assert(t, err != nil)
+
+	// the port is free again
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// alertRecorder is a started alerter that keeps what it delivers.
+type alertRecorder struct {
+	alerter  cynic.Alerter
+	mux      sync.Mutex
+	messages []cynic.AlertMessage
+}
+
+func alertRecorderNew() *alertRecorder {
+	recorder := &alertRecorder{}
+	recorder.alerter = cynic.AlerterNew(3600, func(messages []cynic.AlertMessage) {
+		recorder.mux.Lock()
+		defer recorder.mux.Unlock()
+		recorder.messages = append(recorder.messages, messages...)
+	})
+	recorder.alerter.Start()
+	return recorder
+}
+
+// delivered stops the alerter, so that everything is flushed, and
+// returns the label and state of what was delivered.
+func (s *alertRecorder) delivered() []string {
+	s.alerter.Stop()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var ret []string
+	for _, msg := range s.messages {
+		ret = append(ret, msg.Label+":"+string(msg.State))
+	}
+	return ret
+}
+
+// switchEvent is an event that fails while down is set.
+func switchEvent(label string, down *int32) *cynic.Event {
+	event := cynic.EventNew(3600)
+	event.Label = label
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		return atomic.LoadInt32(down) == 1, label + " checked"
+	})
+	return &event
+}
+
+func run(t *testing.T, planner *cynic.Planner, events ...*cynic.Event) {
+	t.Helper()
+
+	for _, event := range events {
+		if err := planner.Trigger(event.ID()); err != nil {
+			t.Fatal(err)
+		}
+		planner.Wait()
+	}
+}
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	now := time.Date(2021, time.March, 7, 2, 30, 0, 0, time.UTC)
+
+	sundays, err := cynic.CronParse("0 2 * * sun", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		window cynic.MaintenanceWindow
+		at     time.Time
+		active bool
+	}{
+		{"in range", cynic.MaintenanceWindow{Start: now.Add(-time.Hour), End: now.Add(time.Hour)}, now, true},
+		{"before range", cynic.MaintenanceWindow{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour)}, now, false},
+		{"end excluded", cynic.MaintenanceWindow{Start: now.Add(-time.Hour), End: now}, now, false},
+		{"cron inside", cynic.MaintenanceWindow{Schedule: sundays, Duration: time.Hour}, now, true},
+		{"cron on start", cynic.MaintenanceWindow{Schedule: sundays, Duration: time.Hour}, now.Add(-30 * time.Minute), true},
+		{"cron too short", cynic.MaintenanceWindow{Schedule: sundays, Duration: 30 * time.Minute}, now, false},
+		{"cron other day", cynic.MaintenanceWindow{Schedule: sundays, Duration: time.Hour}, now.Add(24 * time.Hour), false},
+	}
+
+	for _, c := range cases {
+		if c.window.Active(c.at) != c.active {
+			log.Println("unexpected activity for:", c.name)
+		}
+		assert(t, c.window.Active(c.at) == c.active)
+	}
+}
+
+func TestMaintenanceWindowMatches(t *testing.T) {
+	event := cynic.EventNew(1)
+	event.Label = "db-primary"
+	event.SetTags("db", "critical")
+
+	assert(t, event.HasTag("db"))
+	assert(t, !event.HasTag("web"))
+
+	assert(t, (&cynic.MaintenanceWindow{}).Matches(&event))
+	assert(t, (&cynic.MaintenanceWindow{Labels: []string{"db-primary"}}).Matches(&event))
+	assert(t, (&cynic.MaintenanceWindow{Tags: []string{"web", "critical"}}).Matches(&event))
+	assert(t, !(&cynic.MaintenanceWindow{Labels: []string{"db-replica"}, Tags: []string{"web"}}).Matches(&event))
+}
+
+func TestPlannerMaintenance(t *testing.T) {
+	planner := cynic.PlannerNew()
+	now := time.Now()
+
+	_, err := planner.AddMaintenance(cynic.MaintenanceWindow{End: now.Add(-time.Hour)})
+	assert(t, errors.Is(err, cynic.ErrBadMaintenance))
+
+	sundays, _ := cynic.CronParse("0 2 * * sun", time.UTC)
+	_, err = planner.AddMaintenance(cynic.MaintenanceWindow{Schedule: sundays})
+	assert(t, errors.Is(err, cynic.ErrBadMaintenance))
+
+	over, err := planner.AddMaintenance(cynic.MaintenanceWindow{Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)})
+	assert(t, err == nil)
+
+	current, err := planner.AddMaintenance(cynic.MaintenanceWindow{End: now.Add(time.Hour), Reason: "upgrade"})
+	assert(t, err == nil)
+
+	recurring, err := planner.AddMaintenance(cynic.MaintenanceWindow{Schedule: sundays, Duration: time.Hour})
+	assert(t, err == nil)
+
+	windows := planner.Maintenance()
+	assert(t, len(windows) == 2)
+	assert(t, windows[0].ID == current)
+	assert(t, !windows[0].Start.IsZero())
+	assert(t, windows[1].ID == recurring)
+
+	// the window that was over is forgotten
+	assert(t, !planner.RemoveMaintenance(over))
+	assert(t, planner.RemoveMaintenance(current))
+	assert(t, !planner.RemoveMaintenance(current))
+	assert(t, len(planner.Maintenance()) == 1)
+}
+
+func TestMutedByMaintenance(t *testing.T) {
+	recorder := alertRecorderNew()
+
+	planner := cynic.PlannerNew()
+	planner.SetAlerter(&recorder.alerter)
+
+	down := int32(1)
+	db := switchEvent("db", &down)
+	db.SetTags("storage")
+	web := switchEvent("web", &down)
+	planner.Add(db)
+	planner.Add(web)
+
+	id, err := planner.AddMaintenance(cynic.MaintenanceWindow{
+		End:    time.Now().Add(time.Hour),
+		Tags:   []string{"storage"},
+		Reason: "disk swap",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, planner, db, web)
+
+	reason, muted := planner.Muted(db)
+	assert(t, muted)
+	assert(t, reason == "maintenance: disk swap")
+
+	info, _ := planner.Info(db.ID())
+	assert(t, info.Failing)
+	assert(t, info.Muted == reason)
+	assert(t, info.Tags[0] == "storage")
+
+	_, muted = planner.Muted(web)
+	assert(t, !muted)
+
+	// still failing once the window is gone: now it alerts
+	planner.RemoveMaintenance(id)
+	run(t, planner, db)
+
+	delivered := recorder.delivered()
+	log.Println("delivered:", delivered)
+	assert(t, strings.Join(delivered, " ") == "web:firing db:firing")
+}
+
+func TestMutedByDependency(t *testing.T) {
+	recorder := alertRecorderNew()
+
+	planner := cynic.PlannerNew()
+	planner.SetAlerter(&recorder.alerter)
+
+	gatewayDown := int32(1)
+	appDown := int32(1)
+
+	gateway := switchEvent("gateway", &gatewayDown)
+	app := switchEvent("app", &appDown)
+	app.DependsOn("gateway")
+	planner.Add(gateway)
+	planner.Add(app)
+
+	run(t, planner, gateway, app)
+
+	reason, muted := planner.Muted(app)
+	log.Println("app:", reason)
+	assert(t, muted)
+	assert(t, strings.Contains(reason, gateway.UniqStr()))
+
+	// the gateway is back, the app is still down
+	atomic.StoreInt32(&gatewayDown, 0)
+	run(t, planner, gateway)
+
+	_, muted = planner.Muted(app)
+	assert(t, !muted)
+
+	run(t, planner, app)
+
+	delivered := recorder.delivered()
+	log.Println("delivered:", delivered)
+	assert(t, strings.Join(delivered, " ") == "gateway:firing gateway:resolved app:firing")
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func assertMetric(t *testing.T, rendered, line string) {
+	if !strings.Contains(rendered, line+"\n") {
+		log.Println("missing metric line:", line)
+		log.Println(rendered)
+		t.Fail()
+	}
+}
+
+func TestMetricsEvents(t *testing.T) {
+	metrics := cynic.MetricsNew()
+
+	calls := 0
+	event := cynic.EventNew(1)
+	event.Label = `say "hi"`
+	event.Repeat(true)
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		calls++
+		return calls%2 == 0, nil
+	})
+
+	planner := cynic.PlannerNew()
+	planner.SetMetrics(metrics)
+	planner.Add(&event)
+
+	for i := 0; i < 5; i++ {
+		planner.Tick()
+	}
+
+	// first tick places the cursor, so four executions
+	assert(t, calls == 4)
+
+	name := fmt.Sprintf(`say \"hi\"-%d`, event.ID())
+	rendered := metrics.Render(true)
+
+	assertMetric(t, rendered, "# TYPE cynic_event_executions counter")
+	assertMetric(t, rendered, fmt.Sprintf(`cynic_event_executions_total{event="%s"} 4`, name))
+	assertMetric(t, rendered, fmt.Sprintf(`cynic_event_failures_total{event="%s"} 2`, name))
+	assertMetric(t, rendered, fmt.Sprintf(`cynic_hook_duration_seconds_bucket{event="%s",le="+Inf"} 4`, name))
+	assertMetric(t, rendered, fmt.Sprintf(`cynic_hook_duration_seconds_bucket{event="%s",le="0.005"} 4`, name))
+	assertMetric(t, rendered, fmt.Sprintf(`cynic_hook_duration_seconds_count{event="%s"} 4`, name))
+	assert(t, strings.Contains(rendered, fmt.Sprintf(`cynic_event_last_run_timestamp_seconds{event="%s"} 1.`, name)))
+	assert(t, strings.HasSuffix(rendered, "# EOF\n"))
+}
+
+func TestMetricsAlerts(t *testing.T) {
+	metrics := cynic.MetricsNew()
+
+	alerter := cynic.AlerterNew(3600, nil)
+	alerter.SetMetrics(metrics)
+	alerter.Start()
+
+	alerter.Ch <- cynic.AlertMessage{EventID: 1, State: cynic.AlertFiring}
+	alerter.Ch <- cynic.AlertMessage{EventID: 2, State: cynic.AlertFiring}
+	alerter.Ch <- cynic.AlertMessage{EventID: 1, State: cynic.AlertOK}
+	alerter.Stop()
+
+	rendered := metrics.Render(true)
+	assertMetric(t, rendered, `cynic_alerts_total{state="firing"} 2`)
+	assertMetric(t, rendered, `cynic_alerts_total{state="resolved"} 1`)
+}
+
+func TestMetricsStatusValues(t *testing.T) {
+	status := cynic.StatusServerNew("localhost", "0", "/status/")
+
+	metrics := cynic.MetricsNew()
+	metrics.SetStatusCache(&status)
+
+	status.Update("temperature", 21.5)
+	status.Update("replicas", 3)
+	status.Update("healthy", true)
+	status.Update("name", "not a number")
+
+	rendered := metrics.Render(true)
+	assertMetric(t, rendered, `cynic_status_value{key="temperature"} 21.5`)
+	assertMetric(t, rendered, `cynic_status_value{key="replicas"} 3`)
+	assertMetric(t, rendered, `cynic_status_value{key="healthy"} 1`)
+	assert(t, !strings.Contains(rendered, `key="name"`))
+}
+
+func TestMetricsCustom(t *testing.T) {
+	metrics := cynic.MetricsNew()
+
+	gauge, err := metrics.RegisterGauge("queue_depth", "Jobs waiting.")
+	assert(t, err == nil)
+	counter, err := metrics.RegisterCounter("jobs_processed", "Jobs done.")
+	assert(t, err == nil)
+
+	gauge.Set(10)
+	gauge.Add(-3)
+	counter.Inc()
+	counter.Add(2)
+	counter.Add(-100)
+
+	rendered := metrics.Render(true)
+	assertMetric(t, rendered, "# TYPE queue_depth gauge")
+	assertMetric(t, rendered, "# HELP queue_depth Jobs waiting.")
+	assertMetric(t, rendered, "queue_depth 7")
+	assertMetric(t, rendered, "# TYPE jobs_processed counter")
+	assertMetric(t, rendered, "jobs_processed_total 3")
+
+	prometheus := metrics.Render(false)
+	assertMetric(t, prometheus, "# TYPE jobs_processed_total counter")
+	assert(t, !strings.Contains(prometheus, "# EOF"))
+
+	for _, name := range []string{"queue_depth", "bad-name", "9lives", "cynic_mine", ""} {
+		_, err := metrics.RegisterGauge(name, "")
+		assert(t, errors.Is(err, cynic.ErrInvalidMetric))
+	}
+}
+
+func TestMetricsContentType(t *testing.T) {
+	metrics := cynic.MetricsNew()
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;q=0.5")
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, req)
+
+	assert(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "application/openmetrics-text"))
+	assert(t, strings.HasSuffix(rec.Body.String(), "# EOF\n"))
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec = httptest.NewRecorder()
+	metrics.ServeHTTP(rec, req)
+
+	assert(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func dailyEvent(label string, secs int) *cynic.Event {
+	event := cynic.EventNew(secs)
+	event.Label = label
+	event.Repeat(true)
+	return &event
+}
+
+func TestPlannerStateRoundTrip(t *testing.T) {
+	statePath := path.Join(t.TempDir(), "state.json")
+
+	planner := cynic.PlannerNew()
+	planner.Add(dailyEvent("backups", day))
+	planner.Add(dailyEvent("weekly", week))
+	planner.Add(dailyEvent("", 10)) // can not be matched, not saved
+
+	for i := 0; i < 5; i++ {
+		planner.Tick()
+	}
+
+	if err := planner.SaveState(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	state := planner.State()
+	assert(t, len(state.Events) == 2)
+
+	// a "restart": new planner, new events, new ids
+	restarted := cynic.PlannerNew()
+	backups := dailyEvent("backups", day)
+	weekly := dailyEvent("weekly", week)
+	restarted.Add(backups)
+	restarted.Add(weekly)
+
+	assert(t, backups.GetAbsExpiry() == day)
+
+	restored, err := restarted.LoadState(statePath)
+	assert(t, err == nil)
+	assert(t, restored == 2)
+
+	log.Println("restored expiries:", backups.GetAbsExpiry(), weekly.GetAbsExpiry())
+	assert(t, backups.GetAbsExpiry() >= day-6 && backups.GetAbsExpiry() <= day-4)
+	assert(t, weekly.GetAbsExpiry() >= week-6 && weekly.GetAbsExpiry() <= week-4)
+}
+
+func TestPlannerStateMissedAndChanged(t *testing.T) {
+	missed := dailyEvent("missed", day)
+	changed := dailyEvent("changed", 60)
+	unknown := dailyEvent("unknown", day)
+
+	planner := cynic.PlannerNew()
+	planner.Add(missed)
+	planner.Add(changed)
+	planner.Add(unknown)
+
+	restored, err := planner.Restore(cynic.PlannerState{
+		Version: 1,
+		Events: []cynic.EventState{
+			// should have run while cynic was down
+			{Label: "missed", Secs: day, Repeat: true, NextRun: time.Now().Add(-time.Hour)},
+			// the interval was changed in the meantime
+			{Label: "changed", Secs: 30, Repeat: true, NextRun: time.Now().Add(time.Second)},
+		},
+	})
+
+	assert(t, err == nil)
+	assert(t, restored == 1)
+	assert(t, missed.GetAbsExpiry() == 1)
+	assert(t, changed.GetAbsExpiry() == 60)
+	assert(t, unknown.GetAbsExpiry() == day)
+
+	// the heap was fixed up: the missed event is the first to run
+	var ran bool
+	missed.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		ran = true
+		return false, nil
+	})
+	planner.Tick()
+	planner.Tick()
+	assert(t, ran)
+}
+
+func TestPlannerStateLastID(t *testing.T) {
+	before := cynic.EventNew(1)
+
+	planner := cynic.PlannerNew()
+	_, err := planner.Restore(cynic.PlannerState{Version: 1, LastID: before.ID() + 1000})
+	assert(t, err == nil)
+
+	after := cynic.EventNew(1)
+	assert(t, after.ID() > before.ID()+1000)
+
+	// never goes backwards
+	_, err = planner.Restore(cynic.PlannerState{Version: 1, LastID: 1})
+	assert(t, err == nil)
+
+	last := cynic.EventNew(1)
+	assert(t, last.ID() > after.ID())
+}
+
+func TestPlannerStateErrors(t *testing.T) {
+	planner := cynic.PlannerNew()
+
+	restored, err := planner.LoadState(path.Join(t.TempDir(), "nope.json"))
+	assert(t, err == nil)
+	assert(t, restored == 0)
+
+	_, err = planner.Restore(cynic.PlannerState{Version: 99})
+	assert(t, err != nil)
+
+	garbage := path.Join(t.TempDir(), "garbage.json")
+	if err := os.WriteFile(garbage, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = planner.LoadState(garbage)
+	assert(t, err != nil)
+}
+
+func TestStartSavesState(t *testing.T) {
+	statePath := path.Join(t.TempDir(), "state.json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	err := cynic.Start(ctx, cynic.Session{
+		Events:    []cynic.Event{*dailyEvent("saved", day)},
+		StatePath: statePath,
+	})
+	assert(t, err == nil)
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var state cynic.PlannerState
+	assert(t, json.Unmarshal(data, &state) == nil)
+	assert(t, len(state.Events) == 1)
+	assert(t, state.Events[0].Label == "saved")
+	assert(t, time.Until(state.Events[0].NextRun) > 23*time.Hour)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	policy := cynic.RetryPolicy{
+		MaxAttempts: 10,
+		Base:        100 * time.Millisecond,
+		Cap:         time.Second,
+	}
+
+	assert(t, policy.Backoff(0) == 0)
+	assert(t, policy.Backoff(1) == 100*time.Millisecond)
+	assert(t, policy.Backoff(2) == 200*time.Millisecond)
+	assert(t, policy.Backoff(3) == 400*time.Millisecond)
+	assert(t, policy.Backoff(4) == 800*time.Millisecond)
+	assert(t, policy.Backoff(5) == time.Second)
+	assert(t, policy.Backoff(50) == time.Second)
+}
+
+func TestRetryBackoffNoCap(t *testing.T) {
+	policy := cynic.RetryPolicy{Base: time.Second}
+	assert(t, policy.Backoff(4) == 8*time.Second)
+	assert(t, policy.Backoff(1000) > 0)
+}
+
+func TestRetryJitter(t *testing.T) {
+	policy := cynic.RetryPolicy{
+		Base:   time.Second,
+		Cap:    time.Second,
+		Jitter: 0.5,
+	}
+
+	for i := 0; i < 100; i++ {
+		wait := policy.Backoff(1)
+		assert(t, wait > 500*time.Millisecond-1 && wait <= time.Second)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	assert(t, cynic.RetryPolicy{}.Attempts() == 1)
+	assert(t, cynic.RetryPolicy{MaxAttempts: -3}.Attempts() == 1)
+	assert(t, cynic.RetryPolicy{MaxAttempts: 3}.Attempts() == 3)
+}
+
+func TestRetryTransientFailure(t *testing.T) {
+	var calls int
+	alerter := cynic.AlerterNew(3600, func(_ []cynic.AlertMessage) {})
+
+	event := cynic.EventNew(1)
+	event.SetRetryPolicy(cynic.RetryPolicy{
+		MaxAttempts: 3,
+		Base:        time.Millisecond,
+	})
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		calls++
+		// fail once, then recover
+		return calls == 1, "dropped packet"
+	})
+
+	planner := cynic.PlannerNew()
+	planner.SetAlerter(&alerter)
+	planner.Add(&event)
+
+	planner.Tick()
+	planner.Tick()
+
+	assert(t, calls == 2)
+
+	select {
+	case <-alerter.Ch:
+		t.Fatal("transient failure should not alert")
+	default:
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	var calls int
+	alerter := cynic.AlerterNew(3600, func(_ []cynic.AlertMessage) {})
+
+	event := cynic.EventNew(1)
+	event.SetRetryPolicy(cynic.RetryPolicy{
+		MaxAttempts: 4,
+		Base:        time.Millisecond,
+		Cap:         2 * time.Millisecond,
+	})
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		calls++
+		return true, "down"
+	})
+
+	planner := cynic.PlannerNew()
+	planner.SetAlerter(&alerter)
+	planner.SetWorkers(1)
+	planner.Add(&event)
+
+	planner.Tick()
+	planner.Tick()
+
+	select {
+	case msg := <-alerter.Ch:
+		assert(t, msg.Attempts == 4)
+		assert(t, msg.Response == "down")
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected an alert after retries")
+	}
+
+	planner.Wait()
+	assert(t, calls == 4)
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+	"git.sr.ht/~psyomn/ecophagy/cynic/script"
+)
+
+func writeScript(t *testing.T, file, src string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadScript(t *testing.T, src string) *script.Script {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "check.cynic")
+	writeScript(t, file, src)
+
+	s, err := script.Load(script.Options{Path: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScriptLanguage(t *testing.T) {
+	cases := []struct {
+		name  string
+		src   string
+		alert bool
+		value interface{}
+	}{
+		{"empty", "", false, nil},
+		{"comments", "# nothing here\n\n", false, nil},
+		{"ok", `ok "fine"`, false, "fine"},
+		{"alert", `alert "broken"`, true, "broken"},
+		{"arithmetic", "ok 1 + 2 * 3 - 8 / 4 % 3", false, 5.0},
+		{"grouping", "ok (1 + 2) * 3", false, 9.0},
+		{"negation", "ok -2 * -3", false, 6.0},
+		{"text", `ok "a" + "b" + str(1.5)`, false, "ab1.5"},
+		{"comparison", `ok [1 < 2, 2 <= 2, "a" > "b", 1 == 1, "1" == 1, null != false]`, false,
+			[]interface{}{true, true, false, true, false, true}},
+		{"logic", `ok [true && "x", false || "y", !0, null && fail()]`, false,
+			[]interface{}{"x", "y", true, nil}},
+		{"let and assign", "let x = 1\nx = x + 1\nok x", false, 2.0},
+		{"if else", "let x = 5\nif x > 10 {\n alert \"big\"\n} else if x > 3 {\n ok \"medium\"\n} else {\n ok \"small\"\n}", false, "medium"},
+		{"for list", "let sum = 0\nfor n in [1, 2, 3] {\n sum = sum + n\n}\nok sum", false, 6.0},
+		{"for map", "let out = \"\"\nfor k in {\"b\": 1, \"a\": 2} {\n out = out + k\n}\nok out", false, "ab"},
+		{"early alert", "for n in [1, 2, 3] {\n if n == 2 {\n  alert n\n }\n}\nok \"never\"", true, 2.0},
+		{"maps", "let m = {name: \"db\", \"up\": true}\nm.port = 5432\nm[\"tags\"] = [\"a\"]\nok [m.name, m.up, m.port, m.tags[0], m.missing]", false,
+			[]interface{}{"db", true, 5432.0, "a", nil}},
+		{"multiline", "ok {\n  \"a\": 1,\n  \"b\": [\n    2,\n    3,\n  ],\n}", false,
+			map[string]interface{}{"a": 1.0, "b": []interface{}{2.0, 3.0}}},
+		{"negative index", `ok [10, 20, 30][-1]`, false, 30.0},
+		{"json", `let doc = json("{\"a\": {\"b\": [1, 2]}}")` + "\nok [doc.a.b[1], jsonpath(doc, \"$.a.b.0\"), jsonpath(doc, \"a.nope\")]", false,
+			[]interface{}{2.0, 1.0, nil}},
+		{"builtins", `ok [len("héllo"), len([1, 2]), num("42"), num(true), contains("cynic", "yn"), contains([1, 2], 2), contains({"a": 1}, "b"), matches("v1.2.3", "^v\\d+"), keys({"z": 1, "y": 2})]`, false,
+			[]interface{}{5.0, 2.0, 42.0, 1.0, true, true, false, true, []interface{}{"y", "z"}}},
+		{"str", `ok [str(null), str(true), str([1, "a"]), str({"k": 1})]`, false,
+			[]interface{}{"null", "true", `[1,"a"]`, `{"k":1}`}},
+		{"keywords as keys", `let m = {ok: 1}` + "\nok m.ok", false, 1.0},
+	}
+
+	for _, c := range cases {
+		alert, value, err := loadScript(t, c.src).Eval(context.Background(), nil)
+		if err != nil || alert != c.alert || !reflect.DeepEqual(value, c.value) {
+			log.Printf("%s: got %v %#v %v", c.name, alert, value, err)
+		}
+		assert(t, err == nil)
+		assert(t, alert == c.alert)
+		assert(t, reflect.DeepEqual(value, c.value))
+	}
+}
+
+func TestScriptSyntaxErrors(t *testing.T) {
+	cases := map[string]string{
+		"unterminated string": `ok "oops`,
+		"missing brace":       "if true {\n ok 1\n",
+		"no name":             "let = 1",
+		"bad assignment":      "1 = 2",
+		"two statements":      "ok 1 ok 2",
+		"dangling operator":   "ok 1 +",
+		"stray character":     "ok 1 @ 2",
+		"unclosed list":       "ok [1, 2",
+	}
+
+	for name, src := range cases {
+		file := filepath.Join(t.TempDir(), "bad.cynic")
+		writeScript(t, file, src)
+
+		_, err := script.Load(script.Options{Path: file})
+		if !errors.Is(err, script.ErrSyntax) {
+			log.Println("expected a syntax error for:", name, "got:", err)
+		}
+		assert(t, errors.Is(err, script.ErrSyntax))
+	}
+
+	// errors say where
+	file := filepath.Join(t.TempDir(), "lines.cynic")
+	writeScript(t, file, "let a = 1\n\nlet b = (\n")
+	_, err := script.Load(script.Options{Path: file})
+	assert(t, err != nil && strings.Contains(err.Error(), "lines.cynic:4"))
+}
+
+func TestScriptRuntimeErrors(t *testing.T) {
+	cases := map[string]string{
+		"undefined":        "ok nope",
+		"assign undefined": "nope = 1",
+		"shadow builtin":   "let len = 1",
+		"type mismatch":    `ok "a" + 1`,
+		"division by zero": "ok 1 / 0",
+		"field of null":    "let x = null\nok x.field",
+		"out of range":     "ok [1][3]",
+		"not callable":     "let x = 1\nok x()",
+		"wrong arity":      "ok len()",
+		"bad json":         `ok json("{")`,
+		"bad regex":        `ok matches("a", "(")`,
+		"no files":         `ok fetch("file:///etc/passwd")`,
+	}
+
+	for name, src := range cases {
+		alert, _, err := loadScript(t, src).Eval(context.Background(), nil)
+		if !errors.Is(err, script.ErrRuntime) {
+			log.Println("expected a runtime error for:", name, "got:", err)
+		}
+		assert(t, errors.Is(err, script.ErrRuntime))
+		assert(t, alert)
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	// nested loops over a modest list are a lot of work
+	src := "let l = [0, 1, 2, 3, 4, 5, 6, 7, 8, 9]\nlet n = 0\n" +
+		"for a in l {\n for b in l {\n  for c in l {\n   for d in l {\n    n = n + 1\n   }\n  }\n }\n}\nok n"
+
+	file := filepath.Join(t.TempDir(), "busy.cynic")
+	writeScript(t, file, src)
+
+	busy, err := script.Load(script.Options{Path: file, MaxSteps: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = busy.Eval(context.Background(), nil)
+	assert(t, errors.Is(err, script.ErrRuntime))
+	assert(t, strings.Contains(err.Error(), "too many steps"))
+
+	// values can not grow without bounds either
+	_, _, err = loadScript(t, "let s = \"xxxxxxxx\"\nfor i in [1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21,22,23,24,25,26,27,28,29,30] {\n s = s + s\n}").
+		Eval(context.Background(), nil)
+	assert(t, errors.Is(err, script.ErrRuntime))
+	assert(t, strings.Contains(err.Error(), "too long"))
+}
+
+func TestScriptFetchAndStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/stats":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"queue": {"depth": 1200}}`)
+		case "/echo":
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, req.Method+" "+req.Header.Get("X-Token"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Stop()
+
+	src := fmt.Sprintf(`
+let resp = fetch("%[1]s/stats")
+if resp.status != 200 {
+    alert "stats are down: " + str(resp.status)
+}
+let depth = jsonpath(json(resp.body), "queue.depth")
+status("depth", depth)
+status("type", resp.headers["content-type"])
+
+let echo = fetch("%[1]s/echo", {"method": "post", "headers": {"X-Token": "t"}})
+status("echo", [echo.status, echo.body])
+
+if fetch("%[1]s/nope").status == 404 && fetch("http://127.0.0.1:1/").error {
+    status("errors", "seen")
+}
+
+if depth > 1000 {
+    alert {"message": "queue is backing up", "depth": depth}
+}
+ok depth
+`, server.URL)
+
+	event := cynic.EventNew(60)
+	event.Label = "queue"
+
+	alert, value := loadScript(t, src).Run(&cynic.HookParameters{Status: status, Event: &event})
+	log.Println("script said:", alert, value)
+	assert(t, alert)
+	assert(t, reflect.DeepEqual(value, map[string]interface{}{"message": "queue is backing up", "depth": 1200.0}))
+
+	ns := status.Namespace("queue")
+	depth, _ := ns.Get("depth")
+	assert(t, depth == 1200.0)
+	contentType, _ := ns.Get("type")
+	assert(t, contentType == "application/json")
+	echo, _ := ns.Get("echo")
+	assert(t, reflect.DeepEqual(echo, []interface{}{202.0, "POST t"}))
+	seen, _ := ns.Get("errors")
+	assert(t, seen == "seen")
+
+	// the result is reported like any other check's
+	entry, err := status.Entry(event.UniqStr())
+	assert(t, err == nil)
+	assert(t, entry.Severity == cynic.SeverityCritical)
+}
+
+func TestScriptHotReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "reload.cynic")
+	writeScript(t, file, `ok "first"`)
+
+	hook, err := script.Hook(script.Options{Path: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alert, value := hook(nil)
+	assert(t, !alert && value == "first")
+
+	// same size, so the modification time has to give it away
+	writeScript(t, file, `ok "again"`)
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	alert, value = hook(nil)
+	assert(t, !alert && value == "again")
+
+	// a broken edit alerts, until it is fixed
+	writeScript(t, file, `ok "oops`)
+	alert, value = hook(nil)
+	log.Println("broken script:", value)
+	assert(t, alert)
+	assert(t, strings.Contains(value.(string), script.ErrSyntax.Error()))
+
+	writeScript(t, file, `alert "fixed, and failing"`)
+	alert, value = hook(nil)
+	assert(t, alert && value == "fixed, and failing")
+
+	// and so does a script that went away
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	alert, _ = hook(nil)
+	assert(t, alert)
+}
+
+func TestScriptLogger(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "logs.cynic")
+	writeScript(t, file, "log(\"depth\", 12, [1])\nok")
+
+	// without a logger, lines go nowhere
+	quiet, err := script.Load(script.Options{Path: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert, _ := quiet.Run(nil)
+	assert(t, !alert)
+
+	var out bytes.Buffer
+	s, err := script.Load(script.Options{Path: file, Logger: log.New(&out, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Run(nil)
+	assert(t, out.String() == file+": depth 12 [1]\n")
+
+	// reloads are noticed on the same logger
+	out.Reset()
+	writeScript(t, file, "for n in [1, 2, 3] {\n log(n)\n}\nok")
+	s.Run(nil)
+	log.Print("reloaded script logged: ", out.String())
+	assert(t, strings.HasPrefix(out.String(), "script: reloaded "+file+"\n"))
+	assert(t, strings.HasSuffix(out.String(), file+": 3\n"))
+
+	// and a run can not log without bounds
+	out.Reset()
+	writeScript(t, file, `let long = "€"
+let ten = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10]
+for n in ten + [11] {
+    long = long + long
+}
+for a in ten {
+    for b in ten {
+        log(long)
+        log(long)
+    }
+}
+`)
+	s.Run(nil)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	log.Println("logged", len(lines), "lines")
+	assert(t, len(lines) == 102) // the reload notice, 100 lines, and a warning
+	assert(t, strings.Contains(lines[len(lines)-1], "too many lines"))
+	assert(t, len(lines[1]) < 1100 && strings.HasSuffix(lines[1], "..."))
+	assert(t, utf8.ValidString(lines[1]))
+}
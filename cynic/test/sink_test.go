@@ -0,0 +1,307 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~psyomn/ecophagy/cynic/cynictest"
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+var sinkMessages = []cynic.AlertMessage{
+	{
+		Response: "connection refused",
+		EventID:  42,
+		Label:    "gateway",
+		State:    cynic.AlertFiring,
+		Attempts: 3,
+	},
+}
+
+func webhookServer(t *testing.T, body *[]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		*body = data
+	}))
+}
+
+func TestWebhookSinkJSON(t *testing.T) {
+	var body []byte
+	ts := webhookServer(t, &body)
+	defer ts.Close()
+
+	sink := cynic.WebhookSinkNew(ts.URL, cynic.WebhookJSON)
+	assert(t, sink.Send(context.Background(), sinkMessages) == nil)
+
+	var received []cynic.AlertMessage
+	assert(t, json.Unmarshal(body, &received) == nil)
+	assert(t, len(received) == 1)
+	assert(t, received[0].Label == "gateway")
+	assert(t, received[0].EventID == 42)
+}
+
+func TestWebhookSinkSlack(t *testing.T) {
+	var body []byte
+	ts := webhookServer(t, &body)
+	defer ts.Close()
+
+	sink := cynic.WebhookSinkNew(ts.URL, cynic.WebhookSlack)
+	assert(t, sink.Send(context.Background(), sinkMessages) == nil)
+
+	var received map[string]string
+	assert(t, json.Unmarshal(body, &received) == nil)
+	assert(t, strings.Contains(received["text"], "[FIRING] gateway"))
+	assert(t, strings.Contains(received["text"], "after 3 attempts"))
+}
+
+func TestWebhookSinkMatrix(t *testing.T) {
+	var body []byte
+	ts := webhookServer(t, &body)
+	defer ts.Close()
+
+	sink := cynic.WebhookSinkNew(ts.URL, cynic.WebhookMatrix)
+	assert(t, sink.Send(context.Background(), sinkMessages) == nil)
+
+	var received map[string]string
+	assert(t, json.Unmarshal(body, &received) == nil)
+	assert(t, received["msgtype"] == "m.text")
+	assert(t, strings.Contains(received["body"], "connection refused"))
+}
+
+func TestWebhookSinkError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	sink := cynic.WebhookSinkNew(ts.URL, cynic.WebhookJSON)
+	assert(t, sink.Send(context.Background(), sinkMessages) != nil)
+}
+
+// fakeSMTPServer speaks just enough smtp to receive one mail.
+func fakeSMTPServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mails := make(chan string, 1)
+
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		write := func(line string) {
+			_, _ = conn.Write([]byte(line + "\r\n"))
+		}
+
+		write("220 localhost fake smtp")
+
+		var data strings.Builder
+		inData := false
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					mails <- data.String()
+					write("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO":
+				write("250 localhost")
+			case "DATA":
+				inData = true
+				write("354 go ahead")
+			case "QUIT":
+				write("221 bye")
+				return
+			default:
+				write("250 OK")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), mails
+}
+
+func TestSMTPSink(t *testing.T) {
+	addr, mails := fakeSMTPServer(t)
+
+	sink := cynic.SMTPSinkNew(addr, "cynic@localhost", []string{"ops@localhost"}, nil)
+	err := sink.Send(context.Background(), sinkMessages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case mail := <-mails:
+		assert(t, strings.Contains(mail, "Subject: cynic alerts (1)"))
+		assert(t, strings.Contains(mail, "[FIRING] gateway"))
+	case <-time.After(2 * time.Second):
+		t.Fatal("no mail received")
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	out := path.Join(t.TempDir(), "alerts.json")
+
+	sink := cynic.ExecSinkNew("sh", "-c", "cat > "+out)
+	assert(t, sink.Send(context.Background(), sinkMessages) == nil)
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []cynic.AlertMessage
+	assert(t, json.Unmarshal(data, &received) == nil)
+	assert(t, len(received) == 1 && received[0].Label == "gateway")
+}
+
+func TestExecSinkFailure(t *testing.T) {
+	sink := cynic.ExecSinkNew("sh", "-c", "exit 3")
+	assert(t, sink.Send(context.Background(), sinkMessages) != nil)
+}
+
+type recordingSink struct {
+	mux      sync.Mutex
+	name     string
+	messages []cynic.AlertMessage
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) Send(_ context.Context, messages []cynic.AlertMessage) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.messages = append(s.messages, messages...)
+	return nil
+}
+
+func (s *recordingSink) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.messages)
+}
+
+func TestRateLimitedSink(t *testing.T) {
+	rec := &recordingSink{name: "recorder"}
+	sink := cynic.RateLimit(rec, 2, time.Hour)
+
+	assert(t, sink.Name() == "recorder")
+	assert(t, sink.Send(context.Background(), sinkMessages) == nil)
+	assert(t, sink.Send(context.Background(), sinkMessages) == nil)
+
+	err := sink.Send(context.Background(), sinkMessages)
+	assert(t, errors.Is(err, cynic.ErrSinkRateLimited))
+	assert(t, rec.count() == 2)
+}
+
+func TestRateLimitedSinkRefills(t *testing.T) {
+	clock := cynictest.ClockNew(epoch)
+	rec := &recordingSink{name: "recorder"}
+
+	// a token every 30s
+	sink := cynic.RateLimit(rec, 2, time.Minute)
+	sink.SetClock(clock)
+
+	steps := []struct {
+		after     time.Duration
+		delivered bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{20 * time.Second, false},
+		// partial refills add up
+		{10 * time.Second, true},
+		{0, false},
+		{29 * time.Second, false},
+		{time.Second, true},
+		// but not past the burst
+		{time.Hour, true},
+		{0, true},
+		{0, false},
+	}
+
+	delivered := 0
+	for i, step := range steps {
+		clock.Advance(step.after)
+
+		err := sink.Send(context.Background(), sinkMessages)
+		if (err == nil) != step.delivered {
+			log.Println("step", i, "got", err)
+			t.Fail()
+		}
+		if err == nil {
+			delivered++
+		}
+	}
+
+	assert(t, rec.count() == delivered)
+}
+
+func TestAlerterFanOut(t *testing.T) {
+	first := &recordingSink{name: "first"}
+	second := &recordingSink{name: "second"}
+
+	alerter := cynic.AlerterNew(3600, nil)
+	alerter.AddSink(first)
+	alerter.AddSink(second)
+	alerter.Start()
+
+	alerter.Ch <- cynic.AlertMessage{Response: "hello"}
+	alerter.Ch <- cynic.AlertMessage{Response: "kitty"}
+	alerter.Stop()
+
+	assert(t, first.count() == 2)
+	assert(t, second.count() == 2)
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func readSnapshots(t *testing.T, r io.Reader) ([]cynic.Snapshot, error) {
+	t.Helper()
+
+	reader, err := cynic.SnapshotReaderNew(r)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var snaps []cynic.Snapshot
+	for {
+		snap, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return snaps, nil
+		}
+		if err != nil {
+			return snaps, err
+		}
+		snaps = append(snaps, *snap)
+	}
+}
+
+func writeSnapshots(t *testing.T, compression cynic.SnapshotCompression, snaps ...cynic.Snapshot) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer, err := cynic.SnapshotWriterNew(&buf, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range snaps {
+		if err := writer.Write(&snaps[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+var testSnapshots = []cynic.Snapshot{
+	{Timestamp: 1600000000, Data: `{"a":1}`},
+	{Timestamp: 1600000060, Data: `{"a":2,"b":"two"}`},
+	{Timestamp: 1600000120, Data: `{}`},
+}
+
+var snapshotCompressions = []cynic.SnapshotCompression{
+	cynic.SnapshotUncompressed,
+	cynic.SnapshotGzip,
+	cynic.SnapshotZstd,
+}
+
+func TestSnapshotFormatRoundTrip(t *testing.T) {
+	for _, compression := range snapshotCompressions {
+		data := writeSnapshots(t, compression, testSnapshots...)
+
+		snaps, err := readSnapshots(t, bytes.NewReader(data))
+		if err != nil {
+			log.Println("compression", compression, ":", err)
+			t.Fatal(err)
+		}
+
+		assert(t, len(snaps) == len(testSnapshots))
+		for i := range snaps {
+			assert(t, snaps[i] == testSnapshots[i])
+		}
+	}
+}
+
+func TestSnapshotFormatAppend(t *testing.T) {
+	for _, compression := range snapshotCompressions {
+		filePath := path.Join(t.TempDir(), "snapshots.bin")
+
+		for i := range testSnapshots {
+			file, err := cynic.SnapshotFileAppend(filePath, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Write(&testSnapshots[i]); err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var snaps []cynic.Snapshot
+		err := cynic.ReadSnapshotFile(filePath, func(snap *cynic.Snapshot) error {
+			snaps = append(snaps, *snap)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		log.Println("compression", compression, "read", len(snaps), "snapshots")
+		assert(t, len(snaps) == len(testSnapshots))
+		for i := range snaps {
+			assert(t, snaps[i] == testSnapshots[i])
+		}
+	}
+}
+
+func TestSnapshotFormatCorruption(t *testing.T) {
+	data := writeSnapshots(t, cynic.SnapshotUncompressed, testSnapshots...)
+
+	// flip a byte of the last record's payload
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)-2] ^= 0xff
+
+	snaps, err := readSnapshots(t, bytes.NewReader(flipped))
+	log.Println("flipped:", err)
+	assert(t, errors.Is(err, cynic.ErrSnapshotCorrupt))
+	assert(t, len(snaps) == len(testSnapshots)-1)
+
+	truncated := data[:len(data)-3]
+	snaps, err = readSnapshots(t, bytes.NewReader(truncated))
+	log.Println("truncated:", err)
+	assert(t, errors.Is(err, cynic.ErrSnapshotCorrupt))
+	assert(t, len(snaps) == len(testSnapshots)-1)
+}
+
+func TestSnapshotFormatUnsupported(t *testing.T) {
+	_, err := cynic.SnapshotReaderNew(bytes.NewReader([]byte("definitely not a snapshot file")))
+	assert(t, errors.Is(err, cynic.ErrSnapshotFormat))
+
+	unknown := cynic.SnapshotCompression(0xff)
+
+	_, err = cynic.SnapshotWriterNew(io.Discard, unknown)
+	assert(t, errors.Is(err, cynic.ErrSnapshotFormat))
+
+	// a header claiming a compression nobody knows
+	data := writeSnapshots(t, cynic.SnapshotUncompressed)
+	data[9] = byte(unknown)
+	_, err = cynic.SnapshotReaderNew(bytes.NewReader(data))
+	assert(t, errors.Is(err, cynic.ErrSnapshotFormat))
+}
+
+func TestSnapshotFormatReadsVersion1(t *testing.T) {
+	store := cynic.SnapshotStore{
+		Magic:   0x43594E4943535452,
+		Version: 1,
+	}
+	for i := range testSnapshots {
+		snap := testSnapshots[i]
+		store.Snapshots = append(store.Snapshots, &snap)
+	}
+
+	filePath := path.Join(t.TempDir(), "v1.bin")
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader, err := cynic.SnapshotReaderNew(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	assert(t, reader.Version() == 1)
+
+	snaps, err := readSnapshots(t, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, len(snaps) == len(testSnapshots))
+	for i := range snaps {
+		assert(t, snaps[i] == testSnapshots[i])
+	}
+}
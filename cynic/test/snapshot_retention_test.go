@@ -0,0 +1,207 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+var retentionDay = time.Date(2021, time.March, 10, 0, 0, 0, 0, time.Local)
+
+func dumpName(at time.Time) string {
+	return at.Format(time.RFC3339) + ".2.cynic"
+}
+
+// writeDump writes one snapshot per minute, for count minutes from
+// at, in a dump file named after at.
+func writeDump(t *testing.T, dir string, at time.Time, count int) {
+	t.Helper()
+
+	file, err := cynic.SnapshotFileAppend(path.Join(dir, dumpName(at)), cynic.SnapshotGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < count; i++ {
+		snap := cynic.Snapshot{
+			Timestamp: at.Add(time.Duration(i) * time.Minute).Unix(),
+			Data:      fmt.Sprintf(`{"i":%d}`, i),
+		}
+		if err := file.Write(&snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func countSnapshots(t *testing.T, filePath string) int {
+	t.Helper()
+
+	count := 0
+	err := cynic.ReadSnapshotFile(filePath, func(*cynic.Snapshot) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestRetentionCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	writeDump(t, dir, retentionDay.Add(10*time.Hour), 60)
+	writeDump(t, dir, retentionDay.Add(11*time.Hour), 60)
+	writeDump(t, dir, retentionDay.Add(49*time.Hour), 60)
+
+	conf := cynic.SnapshotConfig{
+		Path:        dir,
+		Compression: cynic.SnapshotGzip,
+		Retention:   &cynic.RetentionPolicy{CompactAfter: 24 * time.Hour},
+	}
+
+	now := retentionDay.Add(60 * time.Hour)
+	if err := conf.ApplyRetention(now); err != nil {
+		t.Fatal(err)
+	}
+
+	names := listDir(t, dir)
+	log.Println("after compaction:", names)
+	assert(t, len(names) == 2)
+	assert(t, names[0] == "2021-03-10.daily.2.cynic")
+	assert(t, names[1] == dumpName(retentionDay.Add(49*time.Hour)))
+	assert(t, countSnapshots(t, path.Join(dir, names[0])) == 120)
+
+	// a late dump of the same day is merged into the daily file, and
+	// snapshots already there are not duplicated
+	writeDump(t, dir, retentionDay.Add(11*time.Hour), 90)
+	if err := conf.ApplyRetention(now); err != nil {
+		t.Fatal(err)
+	}
+
+	names = listDir(t, dir)
+	assert(t, len(names) == 2)
+	assert(t, countSnapshots(t, path.Join(dir, names[0])) == 150)
+}
+
+func TestRetentionDownsample(t *testing.T) {
+	dir := t.TempDir()
+
+	writeDump(t, dir, retentionDay.Add(10*time.Hour), 60)
+
+	conf := cynic.SnapshotConfig{
+		Path: dir,
+		Retention: &cynic.RetentionPolicy{
+			CompactAfter: time.Hour,
+			Downsample: []cynic.DownsampleRule{
+				{After: 24 * time.Hour, Every: 5 * time.Minute},
+				{After: 72 * time.Hour, Every: 30 * time.Minute},
+			},
+		},
+	}
+
+	cases := []struct {
+		now   time.Time
+		name  string
+		count int
+	}{
+		{retentionDay.Add(20 * time.Hour), "2021-03-10.daily.2.cynic", 60},
+		{retentionDay.Add(50 * time.Hour), "2021-03-10.daily-300s.2.cynic", 12},
+		{retentionDay.Add(50 * time.Hour), "2021-03-10.daily-300s.2.cynic", 12},
+		{retentionDay.Add(100 * time.Hour), "2021-03-10.daily-1800s.2.cynic", 2},
+	}
+
+	for _, c := range cases {
+		if err := conf.ApplyRetention(c.now); err != nil {
+			t.Fatal(err)
+		}
+
+		names := listDir(t, dir)
+		log.Println("at", c.now, names)
+		assert(t, len(names) == 1)
+		assert(t, names[0] == c.name)
+		assert(t, countSnapshots(t, path.Join(dir, names[0])) == c.count)
+	}
+}
+
+func TestRetentionPrune(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy cynic.RetentionPolicy
+		kept   int
+	}{
+		{"max files", cynic.RetentionPolicy{MaxFiles: 2}, 2},
+		{"max age", cynic.RetentionPolicy{MaxAge: 36 * time.Hour}, 1},
+		{"max bytes", cynic.RetentionPolicy{MaxBytes: 1}, 0},
+		{"nothing", cynic.RetentionPolicy{}, 4},
+	}
+
+	for _, c := range cases {
+		dir := t.TempDir()
+
+		for i := 0; i < 4; i++ {
+			writeDump(t, dir, retentionDay.Add(time.Duration(i)*24*time.Hour), 1)
+		}
+
+		// not ours, never touched
+		if err := os.WriteFile(path.Join(dir, "notes.txt"), []byte("hi"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		conf := cynic.SnapshotConfig{Path: dir, Retention: &c.policy}
+		if err := conf.ApplyRetention(retentionDay.Add(4 * 24 * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		names := listDir(t, dir)
+		log.Println(c.name, names)
+		assert(t, len(names) == c.kept+1)
+
+		if c.kept > 0 {
+			assert(t, names[c.kept-1] == dumpName(retentionDay.Add(3*24*time.Hour)))
+		}
+	}
+}
@@ -0,0 +1,402 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+// selfSigned writes a certificate for localhost that can be used by
+// both the server and the clients, and be its own authority.
+func selfSigned(t *testing.T) (certFile, keyFile string, cert tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cynic test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, cert
+}
+
+func getStatus(t *testing.T, client *http.Client, url string, setup func(*http.Request)) (int, map[string]interface{}) {
+	t.Helper()
+
+	req, err := makeBackgroundRequest(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(req)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestStatusCacheIsolated(t *testing.T) {
+	var caches []*cynic.StatusCache
+	for _, value := range []string{"one", "two"} {
+		status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Host: "127.0.0.1", Port: "0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status.Update("name", value)
+		status.Handle("/extra", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+		go func() { _ = status.Start() }()
+		defer status.Stop()
+
+		caches = append(caches, status)
+	}
+
+	for i, value := range []string{"one", "two"} {
+		url := "http://127.0.0.1:" + strconv.Itoa(caches[i].GetPort())
+
+		code, body := getStatus(t, http.DefaultClient, url+cynic.DefaultStatusEndpoint, nil)
+		assert(t, code == http.StatusOK)
+		assert(t, body["name"] == value)
+
+		code, _ = getStatus(t, http.DefaultClient, url+"/extra", nil)
+		assert(t, code == http.StatusTeapot)
+	}
+}
+
+func TestStatusCacheNewErrors(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	_, port, _ := net.SplitHostPort(taken.Addr().String())
+
+	cases := []struct {
+		name      string
+		config    cynic.StatusCacheConfig
+		configErr bool
+	}{
+		{"port taken", cynic.StatusCacheConfig{Host: "127.0.0.1", Port: port}, false},
+		{"username only", cynic.StatusCacheConfig{Port: "0", Username: "admin"}, true},
+		{"tls without key", cynic.StatusCacheConfig{Port: "0", TLS: &cynic.StatusTLSConfig{CertFile: "x"}}, true},
+		{"tls missing files", cynic.StatusCacheConfig{Port: "0", TLS: &cynic.StatusTLSConfig{CertFile: "/nope", KeyFile: "/nope"}}, false},
+	}
+
+	for _, c := range cases {
+		status, err := cynic.StatusCacheNew(c.config)
+		if err == nil {
+			status.Stop()
+			log.Println("expected an error for:", c.name)
+		}
+		assert(t, err != nil)
+		assert(t, errors.Is(err, cynic.ErrStatusConfig) == c.configErr)
+	}
+}
+
+func TestStatusCacheAuth(t *testing.T) {
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{
+		Embedded: true,
+		Token:    "reader",
+		Username: "admin",
+		Password: "hunter2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Stop()
+
+	status.Update("hello", "kitty")
+	status.AcceptUpdates("writer")
+	status.HandleAuthenticated("/own/", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	assert(t, status.GetPort() == 0)
+
+	server := httptest.NewServer(status.Handler())
+	defer server.Close()
+
+	root := server.URL + cynic.DefaultStatusEndpoint
+
+	code, _ := getStatus(t, http.DefaultClient, root, nil)
+	assert(t, code == http.StatusUnauthorized)
+
+	code, _ = getStatus(t, http.DefaultClient, root, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer nope")
+	})
+	assert(t, code == http.StatusUnauthorized)
+
+	code, body := getStatus(t, http.DefaultClient, root, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer reader")
+	})
+	assert(t, code == http.StatusOK)
+	assert(t, body["hello"] == "kitty")
+
+	code, _ = getStatus(t, http.DefaultClient, root, func(req *http.Request) {
+		req.SetBasicAuth("admin", "hunter2")
+	})
+	assert(t, code == http.StatusOK)
+
+	code, _ = getStatus(t, http.DefaultClient, server.URL+"/links", func(req *http.Request) {
+		req.SetBasicAuth("admin", "wrong")
+	})
+	assert(t, code == http.StatusUnauthorized)
+
+	// handlers with credentials of their own are left alone
+	code, _ = getStatus(t, http.DefaultClient, server.URL+"/own/", nil)
+	assert(t, code == http.StatusNoContent)
+
+	// and so are updates, which need the update token
+	code, _ = getStatus(t, http.DefaultClient, root, func(req *http.Request) {
+		req.Method = http.MethodPost
+		req.Header.Set("Authorization", "Bearer writer")
+		req.Body = http.NoBody
+	})
+	assert(t, code == http.StatusBadRequest)
+}
+
+func TestStatusCacheUpdates(t *testing.T) {
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true, Root: "/TestStatusCacheUpdates"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Stop()
+
+	status.AcceptUpdates("sekrit")
+	status.Update("hello", "kitty")
+	status.Update("whosagood", "doggo")
+	status.Update("ARGH", "BLARGH")
+
+	server := httptest.NewServer(status.Handler())
+	defer server.Close()
+
+	update := func(method, path, token, body string) int {
+		req, err := http.NewRequest(method, server.URL+"/TestStatusCacheUpdates"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the root is given without its trailing slash, which it gets:
+	// both the root and the keys under it are served
+	assert(t, update(http.MethodPost, "", "", `{"hello": "cat"}`) == http.StatusUnauthorized)
+	assert(t, update(http.MethodPost, "", "wrong", `{"hello": "cat"}`) == http.StatusUnauthorized)
+	assert(t, update(http.MethodPost, "", "sekrit", `not json`) == http.StatusBadRequest)
+	assert(t, update(http.MethodPost, "", "sekrit", `["not", "an", "object"]`) == http.StatusBadRequest)
+	assert(t, update(http.MethodPut, "", "sekrit", `"cat"`) == http.StatusMethodNotAllowed)
+	assert(t, update(http.MethodDelete, "", "sekrit", ``) == http.StatusMethodNotAllowed)
+
+	assert(t, update(http.MethodPost, "", "sekrit", `{"hello": "cat", "fresh": 1}`) == http.StatusNoContent)
+	hello, _ := status.Get("hello")
+	assert(t, hello == "cat")
+	assert(t, status.NumEntries() == 4)
+
+	assert(t, update(http.MethodPost, "?replace=true", "sekrit", `{"fresh": 2, "hello": "kitty"}`) == http.StatusNoContent)
+	assert(t, status.NumEntries() == 2)
+	fresh, _ := status.Get("fresh")
+	assert(t, fresh == 2.0)
+
+	assert(t, update(http.MethodPut, "/fresh", "sekrit", `3`) == http.StatusNoContent)
+	fresh, _ = status.Get("fresh")
+	assert(t, fresh == 3.0)
+}
+
+func TestStatusCacheTLS(t *testing.T) {
+	certFile, keyFile, cert := selfSigned(t)
+
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{
+		Host: "127.0.0.1",
+		Port: "0",
+		TLS: &cynic.StatusTLSConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: certFile,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status.Update("secure", true)
+
+	go func() { _ = status.Start() }()
+	defer status.Stop()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	url := "https://127.0.0.1:" + strconv.Itoa(status.GetPort()) + cynic.DefaultStatusEndpoint
+
+	// without a client certificate, the handshake fails
+	anonymous := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+	}}
+	req, _ := makeBackgroundRequest(url)
+	resp, err := anonymous.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	assert(t, err != nil)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}}
+
+	code, body := getStatus(t, client, url, nil)
+	assert(t, code == http.StatusOK)
+	assert(t, body["secure"] == true)
+}
+
+func TestStatusCacheAuthCluster(t *testing.T) {
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{
+		Host:  "127.0.0.1",
+		Port:  "0",
+		Token: "reader",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster, err := cynic.ClusterNew(cynic.ClusterConfig{Node: "alone", Token: clusterToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- cynic.Start(ctx, cynic.Session{StatusCache: status, Cluster: cluster})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	endpoint := "http://127.0.0.1:" + strconv.Itoa(status.GetPort()) + cynic.DefaultClusterEndpoint
+
+	// the state of the cluster needs the credentials of the cache
+	code, _ := getStatus(t, http.DefaultClient, endpoint, nil)
+	assert(t, code == http.StatusUnauthorized)
+
+	code, _ = getStatus(t, http.DefaultClient, endpoint, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+clusterToken)
+	})
+	assert(t, code == http.StatusUnauthorized)
+
+	code, body := getStatus(t, http.DefaultClient, endpoint, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer reader")
+	})
+	assert(t, code == http.StatusOK)
+	assert(t, body["node"] == "alone")
+
+	// while the gossip only needs the cluster token
+	code, _ = getStatus(t, http.DefaultClient, endpoint+"gossip", func(req *http.Request) {
+		req.Method = http.MethodPost
+		req.Header.Set("Authorization", "Bearer "+clusterToken)
+		req.Body = io.NopCloser(strings.NewReader(`{"node": "other"}`))
+	})
+	assert(t, code == http.StatusOK)
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func TestStatusEntryStale(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name  string
+		entry cynic.StatusEntry
+		stale bool
+	}{
+		{"no ttl", cynic.StatusEntry{UpdatedAt: now.Add(-time.Hour)}, false},
+		{"fresh", cynic.StatusEntry{UpdatedAt: now.Add(-time.Second), TTL: time.Minute}, false},
+		{"stale", cynic.StatusEntry{UpdatedAt: now.Add(-2 * time.Minute), TTL: time.Minute}, true},
+	}
+
+	for _, c := range cases {
+		if c.entry.Stale(now) != c.stale {
+			t.Log("unexpected staleness for:", c.name)
+		}
+		assert(t, c.entry.Stale(now) == c.stale)
+	}
+}
+
+func TestStatusCacheTTL(t *testing.T) {
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true, DefaultTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Stop()
+
+	status.Update("fresh", 1)
+	status.UpdateEntry("old", cynic.StatusEntry{
+		Value:     "ok",
+		UpdatedAt: time.Now().Add(-2 * time.Minute),
+		TTL:       time.Minute,
+		Source:    42,
+		Severity:  cynic.SeverityWarning,
+	})
+
+	entry, err := status.Entry("fresh")
+	assert(t, err == nil)
+	assert(t, entry.TTL == time.Hour)
+	assert(t, !entry.UpdatedAt.IsZero())
+
+	assert(t, strings.Join(status.Stale(), ",") == "old")
+
+	server := httptest.NewServer(status.Handler())
+	defer server.Close()
+
+	get := func(path string) map[string]interface{} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var body map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// stale entries are still there, and listed
+	body := get(cynic.DefaultStatusEndpoint)
+	assert(t, body["old"] == "ok")
+	assert(t, body["fresh"] == 1.0)
+	assert(t, body[cynic.StaleKey].([]interface{})[0] == "old")
+
+	body = get(cynic.DefaultStatusEndpoint + "?meta=true")
+	old := body["old"].(map[string]interface{})
+	assert(t, old["stale"] == true)
+	assert(t, old["ttl"] == "1m0s")
+	assert(t, old["source"] == 42.0)
+	assert(t, old["severity"] == "warning")
+	assert(t, body["fresh"].(map[string]interface{})["stale"] == nil)
+	assert(t, body[cynic.StaleKey] == nil)
+
+	body = get(cynic.DefaultStatusEndpoint + "old?meta=true")
+	assert(t, body["value"] == "ok")
+	assert(t, body["stale"] == true)
+}
+
+func TestStatusNamespaces(t *testing.T) {
+	status, err := cynic.StatusCacheNew(cynic.StatusCacheConfig{Embedded: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer status.Stop()
+
+	web := status.Namespace("web")
+	web.Update("homepage", "up")
+	web.Update("api", "down")
+	status.Namespace("db").Update("primary", "up")
+	status.Update("loose", true)
+
+	value, err := web.Get("homepage")
+	assert(t, err == nil)
+	assert(t, value == "up")
+
+	value, err = status.Get("web/api")
+	assert(t, err == nil)
+	assert(t, value == "down")
+
+	assert(t, strings.Join(web.Keys(), ",") == "api,homepage")
+
+	web.Delete("api")
+	assert(t, strings.Join(web.Keys(), ",") == "homepage")
+
+	server := httptest.NewServer(status.Handler())
+	defer server.Close()
+
+	get := func(path string) string {
+		resp, err := http.Get(server.URL + cynic.DefaultStatusEndpoint + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	assert(t, get("web/") == `{"homepage":"up"}`)
+	assert(t, get("web/homepage") == `"up"`)
+	assert(t, get("db/") == `{"primary":"up"}`)
+	assert(t, get("nope/") == `{}`)
+	assert(t, strings.Contains(get(""), `"web/homepage":"up"`))
+}
+
+func TestEventStatusEntry(t *testing.T) {
+	event := cynic.EventNew(10)
+	entry := event.StatusEntry("fine", cynic.SeverityInfo)
+
+	assert(t, entry.Source == event.ID())
+	assert(t, entry.TTL == cynic.DefaultStaleFactor*10*time.Second)
+	assert(t, entry.Severity == cynic.SeverityInfo)
+
+	hourly, err := cynic.EventCronNew("0 * * * *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry = hourly.StatusEntry("fine", cynic.SeverityInfo)
+	assert(t, entry.TTL == cynic.DefaultStaleFactor*time.Hour)
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2018-2021 Simon Symeonidis (psyomn)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cynic "git.sr.ht/~psyomn/ecophagy/cynic/lib"
+)
+
+func TestWorkersDoNotBlockTick(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+
+	planner := cynic.PlannerNew()
+	planner.SetWorkers(4)
+
+	events := make([]cynic.Event, 4)
+	for i := range events {
+		events[i] = cynic.EventNew(1)
+		events[i].AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+			<-release
+			atomic.AddInt32(&count, 1)
+			return false, 0
+		})
+		planner.Add(&events[i])
+	}
+
+	done := make(chan struct{})
+	go func() {
+		planner.Tick()
+		planner.Tick()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tick blocked on slow hooks")
+	}
+
+	assert(t, atomic.LoadInt32(&count) == 0)
+
+	close(release)
+	planner.Wait()
+
+	assert(t, atomic.LoadInt32(&count) == 4)
+}
+
+func TestWorkersBounded(t *testing.T) {
+	var running, maxRunning int32
+	const workers = 2
+
+	planner := cynic.PlannerNew()
+	planner.SetWorkers(workers)
+
+	events := make([]cynic.Event, 6)
+	for i := range events {
+		events[i] = cynic.EventNew(1)
+		events[i].AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+			now := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&maxRunning)
+				if now <= old || atomic.CompareAndSwapInt32(&maxRunning, old, now) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return false, 0
+		})
+		planner.Add(&events[i])
+	}
+
+	planner.Tick()
+	planner.Tick()
+	planner.Wait()
+
+	assert(t, atomic.LoadInt32(&maxRunning) <= workers)
+	assert(t, atomic.LoadInt32(&maxRunning) >= 1)
+}
+
+func TestWorkersSkipOverlappingRuns(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+
+	event := cynic.EventNew(1)
+	event.Repeat(true)
+	event.AddHook(func(_ *cynic.HookParameters) (bool, interface{}) {
+		atomic.AddInt32(&count, 1)
+		<-release
+		return false, 0
+	})
+
+	planner := cynic.PlannerNew()
+	planner.SetWorkers(2)
+	planner.Add(&event)
+
+	for i := 0; i < 5; i++ {
+		planner.Tick()
+	}
+
+	close(release)
+	planner.Wait()
+
+	assert(t, atomic.LoadInt32(&count) == 1)
+}
+
+func TestHookTimeout(t *testing.T) {
+	alerter := cynic.AlerterNew(3600, func(_ []cynic.AlertMessage) {})
+
+	event := cynic.EventNew(1)
+	event.SetTimeout(50 * time.Millisecond)
+	event.AddHook(func(params *cynic.HookParameters) (bool, interface{}) {
+		<-params.Context.Done()
+		return false, 0
+	})
+
+	planner := cynic.PlannerNew()
+	planner.SetAlerter(&alerter)
+	planner.SetWorkers(1)
+	planner.Add(&event)
+
+	planner.Tick()
+	planner.Tick()
+
+	select {
+	case msg := <-alerter.Ch:
+		assert(t, msg.TimedOut)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a timeout alert")
+	}
+
+	planner.Wait()
+}
+
+func TestHookWithinTimeout(t *testing.T) {
+	var ran bool
+
+	event := cynic.EventNew(1)
+	event.SetTimeout(time.Second)
+	event.AddHook(func(params *cynic.HookParameters) (bool, interface{}) {
+		_, hasDeadline := params.Context.Deadline()
+		ran = hasDeadline
+		return false, 0
+	})
+
+	event.Execute()
+
+	assert(t, ran)
+}
+
+func TestHookContextCancelledOnShutdown(t *testing.T) {
+	var cancelled int32
+
+	event := cynic.EventNew(1)
+	event.AddHook(func(params *cynic.HookParameters) (bool, interface{}) {
+		<-params.Context.Done()
+		atomic.StoreInt32(&cancelled, 1)
+		return false, 0
+	})
+
+	planner := cynic.PlannerNew()
+	planner.SetWorkers(1)
+	planner.Add(&event)
+
+	// first tick places the cursor, second one runs the event
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+
+	assert(t, planner.Run(ctx) == nil)
+	assert(t, atomic.LoadInt32(&cancelled) == 1)
+}
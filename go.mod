@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/Masterminds/semver v1.5.0
+	github.com/klauspost/compress v1.17.9
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/pressly/goose/v3 v3.21.1
 	golang.org/x/crypto v0.21.0